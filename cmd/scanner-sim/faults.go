@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Faults configures misbehaviour injected into simulator sessions, to
+// exercise the server's timeout, reconnect and parsing paths
+type Faults struct {
+	DropRate      float64       // chance of closing the connection instead of answering
+	DropAfter     int           // close each connection after this many commands (0 = never)
+	Latency       time.Duration // delay before every response
+	Bandwidth     int           // response throughput in bytes per second (0 = unlimited)
+	MalformedRate float64       // chance of sending a malformed response frame
+	ErrorRate     float64       // chance of answering with a busy or hardware fault status
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (f *Faults) register(fs *flag.FlagSet) {
+	fs.Float64Var(&f.DropRate, "fault-drop-rate", 0, "probability of dropping the connection instead of answering a command")
+	fs.IntVar(&f.DropAfter, "fault-drop-after", 0, "drop each connection after this many commands (0 = never)")
+	fs.DurationVar(&f.Latency, "fault-latency", 0, "delay before every response")
+	fs.IntVar(&f.Bandwidth, "fault-bandwidth", 0, "throttle responses to this many bytes per second (0 = unlimited)")
+	fs.Float64Var(&f.MalformedRate, "fault-malformed-rate", 0, "probability of sending a malformed response frame")
+	fs.Float64Var(&f.ErrorRate, "fault-error-rate", 0, "probability of answering with a busy or hardware fault status")
+}
+
+func (f *Faults) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.rng == nil {
+		f.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return f.rng.Float64() < p
+}
+
+func (f *Faults) intn(n int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.rng == nil {
+		f.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return f.rng.Intn(n)
+}
+
+// malformedFrame returns a broken response: a truncated payload, an absurd
+// length, a payload too short for the command, or an unknown status byte
+func (f *Faults) malformedFrame() (frame []byte, kind string) {
+	switch f.intn(4) {
+	case 0:
+		frame = make([]byte, 5+8)
+		binary.BigEndian.PutUint32(frame[1:], 64)
+		return frame, "truncated payload"
+	case 1:
+		frame = make([]byte, 5)
+		binary.BigEndian.PutUint32(frame[1:], 0xfffffff0)
+		return frame, "oversized length"
+	case 2:
+		frame = make([]byte, 5+2)
+		binary.BigEndian.PutUint32(frame[1:], 2)
+		return frame, "short payload"
+	default:
+		frame = []byte{0x7f, 0, 0, 0, 0}
+		return frame, "unknown status"
+	}
+}
+
+// throttledWriter paces writes to a fixed byte rate, emulating a slow link
+type throttledWriter struct {
+	w         io.Writer
+	bandwidth int
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	if t.bandwidth <= 0 {
+		return t.w.Write(p)
+	}
+
+	chunk := t.bandwidth / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	written := 0
+	for written < len(p) {
+		end := written + chunk
+		if end > len(p) {
+			end = len(p)
+		}
+		n, err := t.w.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(t.bandwidth))
+	}
+	return written, nil
+}
@@ -0,0 +1,97 @@
+// Command scanner-sim emulates a cytology scanner speaking the binary CMD_*
+// protocol over TCP, so the server can run end-to-end without hardware.
+// It renders a synthetic multi-layer smear with depth-dependent blur and
+// can inject disconnects, slow links, error statuses and malformed frames.
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cyto-viewer/pkg/logger"
+)
+
+func main() {
+	addr := flag.String("addr", ":9090", "listen address")
+	layers := flag.Int("layers", 40, "number of focus layers")
+	width := flag.Int("width", 100000, "slide width in pixels")
+	height := flag.Int("height", 100000, "slide height in pixels")
+	tileSize := flag.Int("tile-size", 512, "tile size reported to clients")
+	maxDimension := flag.Int("max-dimension", 4096, "clip scanned and captured regions to this many pixels per side")
+	layerSpacing := flag.Float64("layer-spacing", 0.5, "focus step between layers in micrometres")
+	scanDelay := flag.Duration("scan-delay", 200*time.Millisecond, "simulated acquisition time per layer")
+	jpegQuality := flag.Int("jpeg-quality", 90, "JPEG quality of layer data")
+	seed := flag.Int64("seed", 1, "specimen seed; the same seed always renders the same slide")
+	needsCalibration := flag.Bool("require-calibration", false, "reject scans with 'not calibrated' until CMD_CALIBRATE")
+	objectiveList := flag.String("objectives", "10,20,40", "comma-separated objective magnifications accepted by GET_IMAGE")
+	firmware := flag.String("firmware", "sim-1.0.0", "firmware version reported on connect")
+	serialNumber := flag.String("serial-number", "SIM-0001", "serial number reported on connect")
+	profile := flag.String("calibration-profile", "factory", "calibration profile reported by CALIBRATE")
+
+	faults := &Faults{}
+	faults.register(flag.CommandLine)
+	flag.Parse()
+
+	log := logger.New()
+
+	if *layers < 1 || *tileSize < 1 || *maxDimension < 1 || *width < 1 || *height < 1 {
+		log.Fatal("Layers, sizes and dimensions must be positive")
+	}
+
+	var objectives []int
+	for _, field := range strings.Split(*objectiveList, ",") {
+		magnification, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || magnification < 1 {
+			log.Fatal("Invalid objective magnification", "value", field)
+		}
+		objectives = append(objectives, magnification)
+	}
+
+	sim := &simulator{
+		log:              log,
+		specimen:         newSpecimen(*seed, *layers),
+		faults:           faults,
+		layers:           *layers,
+		width:            *width,
+		height:           *height,
+		tileSize:         *tileSize,
+		maxDimension:     *maxDimension,
+		layerSpacing:     *layerSpacing,
+		scanDelay:        *scanDelay,
+		jpegQuality:      *jpegQuality,
+		needsCalibration: *needsCalibration,
+		objectives:       objectives,
+		firmware:         *firmware,
+		serialNumber:     *serialNumber,
+		profile:          *profile,
+		started:          time.Now(),
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal("Failed to listen", "addr", *addr, "error", err)
+	}
+	log.Info("Scanner simulator listening", "addr", listener.Addr().String(), "layers", *layers)
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+		<-quit
+		log.Info("Shutting down simulator")
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go sim.serve(conn)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"cyto-viewer/internal/scanner"
+	"cyto-viewer/pkg/logger"
+)
+
+// Largest command payload the simulator accepts
+const maxCommandSize = 1 << 20
+
+// Size of the header leading each layer and image frame
+const layerHeaderSize = 32
+
+type simulator struct {
+	log      *logger.Logger
+	specimen *specimen
+	faults   *Faults
+
+	layers           int
+	width            int // slide size in pixels
+	height           int
+	tileSize         int
+	maxDimension     int // scans and captures are clipped to this many pixels per side
+	layerSpacing     float64
+	scanDelay        time.Duration
+	jpegQuality      int
+	needsCalibration bool
+	objectives       []int // magnifications GET_IMAGE accepts
+	firmware         string
+	serialNumber     string
+	profile          string // calibration profile reported by CALIBRATE
+
+	mu           sync.Mutex
+	scanning     bool
+	calibrated   bool
+	currentLayer int
+	errorCode    uint32
+	started      time.Time
+}
+
+// commandError is answered with a non-OK status; the session continues
+type commandError struct {
+	status  scanner.Status
+	message string
+}
+
+func (e *commandError) Error() string { return e.message }
+
+func invalidArgument(format string, args ...interface{}) error {
+	return &commandError{status: scanner.StatusInvalidArgument, message: fmt.Sprintf(format, args...)}
+}
+
+func writeFrame(w io.Writer, status scanner.Status, payload []byte) error {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = byte(status)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[5:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// serve runs one client session until it disconnects or a fault drops it
+func (sim *simulator) serve(conn net.Conn) {
+	defer conn.Close()
+
+	remote := conn.RemoteAddr().String()
+	sim.log.Info("Client connected", "remote", remote)
+	defer sim.log.Info("Client disconnected", "remote", remote)
+
+	out := &throttledWriter{w: conn, bandwidth: sim.faults.Bandwidth}
+	header := make([]byte, 5)
+	commands := 0
+
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		cmd := header[0]
+		length := binary.BigEndian.Uint32(header[1:])
+		if length > maxCommandSize {
+			sim.log.Warn("Command too large, closing", "remote", remote, "length", length)
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		commands++
+
+		if cmd == scanner.CMD_DISCONNECT {
+			return
+		}
+
+		if (sim.faults.DropAfter > 0 && commands > sim.faults.DropAfter) || sim.faults.chance(sim.faults.DropRate) {
+			sim.log.Warn("Fault: dropping connection", "remote", remote, "command", cmd)
+			return
+		}
+		if sim.faults.Latency > 0 {
+			time.Sleep(sim.faults.Latency)
+		}
+		if sim.faults.chance(sim.faults.MalformedRate) {
+			frame, kind := sim.faults.malformedFrame()
+			sim.log.Warn("Fault: malformed frame", "remote", remote, "command", cmd, "kind", kind)
+			if _, err := out.Write(frame); err != nil {
+				return
+			}
+			continue
+		}
+		if sim.faults.chance(sim.faults.ErrorRate) {
+			status := scanner.StatusBusy
+			if sim.faults.intn(2) == 0 {
+				status = scanner.StatusHardwareFault
+				sim.mu.Lock()
+				sim.errorCode = uint32(cmd)<<8 | uint32(status) // cleared by calibration
+				sim.mu.Unlock()
+			}
+			sim.log.Warn("Fault: error status", "remote", remote, "command", cmd, "status", status)
+			if err := writeFrame(out, status, []byte("injected fault")); err != nil {
+				return
+			}
+			continue
+		}
+
+		err := sim.handle(out, cmd, payload)
+		if ce, ok := err.(*commandError); ok {
+			sim.log.Info("Command rejected", "remote", remote, "command", cmd, "status", ce.status, "reason", ce.message)
+			err = writeFrame(out, ce.status, []byte(ce.message))
+		}
+		if err != nil {
+			sim.log.Warn("Session failed", "remote", remote, "error", err)
+			return
+		}
+	}
+}
+
+// handle answers one command. *commandError results are reported to the
+// client by the caller; other errors end the session.
+func (sim *simulator) handle(w io.Writer, cmd byte, payload []byte) error {
+	switch cmd {
+	case scanner.CMD_CONNECT:
+		return writeFrame(w, scanner.StatusOK, sim.deviceInfo())
+	case scanner.CMD_GET_LAYERS:
+		return writeFrame(w, scanner.StatusOK, sim.layerTable())
+	case scanner.CMD_STATUS:
+		return writeFrame(w, scanner.StatusOK, sim.status())
+	case scanner.CMD_SET_FOCUS:
+		return sim.setFocus(w, payload)
+	case scanner.CMD_CALIBRATE:
+		return sim.calibrate(w)
+	case scanner.CMD_SCAN:
+		return sim.scan(w, payload)
+	case scanner.CMD_GET_IMAGE:
+		return sim.getImage(w, payload)
+	default:
+		return &commandError{status: scanner.StatusUnknownCommand, message: fmt.Sprintf("unknown command 0x%02x", cmd)}
+	}
+}
+
+// deviceInfo encodes the protocol version, then the firmware version and
+// serial number, each as a length-prefixed string
+func (sim *simulator) deviceInfo() []byte {
+	buf := binary.BigEndian.AppendUint32(nil, scanner.ProtocolVersion)
+	for _, field := range []string{sim.firmware, sim.serialNumber} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+// layerTable encodes [num_layers] followed by 20 bytes per layer: index,
+// width, height, focus depth in nanometres and tile size
+func (sim *simulator) layerTable() []byte {
+	buf := make([]byte, 4+20*sim.layers)
+	binary.BigEndian.PutUint32(buf, uint32(sim.layers))
+
+	for i := 0; i < sim.layers; i++ {
+		entry := buf[4+20*i:]
+		binary.BigEndian.PutUint32(entry[0:], uint32(i))
+		binary.BigEndian.PutUint32(entry[4:], uint32(sim.width))
+		binary.BigEndian.PutUint32(entry[8:], uint32(sim.height))
+		binary.BigEndian.PutUint32(entry[12:], uint32(math.Round(float64(i)*sim.layerSpacing*1000)))
+		binary.BigEndian.PutUint32(entry[16:], uint32(sim.tileSize))
+	}
+	return buf
+}
+
+// status encodes temperature (centidegrees), ready flag, error code and
+// current focus layer
+func (sim *simulator) status() []byte {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	// Stage temperature drifts slowly around 36.5C
+	temp := 36.5 + 0.4*math.Sin(time.Since(sim.started).Minutes())
+
+	buf := make([]byte, 13)
+	binary.BigEndian.PutUint32(buf[0:], uint32(temp*100))
+	if !sim.scanning {
+		buf[4] = 1
+	}
+	binary.BigEndian.PutUint32(buf[5:], sim.errorCode)
+	binary.BigEndian.PutUint32(buf[9:], uint32(sim.currentLayer))
+	return buf
+}
+
+func (sim *simulator) setFocus(w io.Writer, payload []byte) error {
+	if len(payload) != 4 {
+		return invalidArgument("SET_FOCUS takes a 4-byte layer index, got %d bytes", len(payload))
+	}
+	layer := int(binary.BigEndian.Uint32(payload))
+	if layer >= sim.layers {
+		return invalidArgument("focus layer %d out of range (0-%d)", layer, sim.layers-1)
+	}
+
+	sim.mu.Lock()
+	sim.currentLayer = layer
+	sim.mu.Unlock()
+
+	return writeFrame(w, scanner.StatusOK, nil)
+}
+
+func (sim *simulator) calibrate(w io.Writer) error {
+	if err := sim.acquire(); err != nil {
+		return err
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	sim.mu.Lock()
+	sim.calibrated = true
+	sim.scanning = false
+	sim.errorCode = 0
+	sim.mu.Unlock()
+
+	return writeFrame(w, scanner.StatusOK, []byte(sim.profile))
+}
+
+// acquire claims the stage for a scan or calibration
+func (sim *simulator) acquire() error {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	if sim.scanning {
+		return &commandError{status: scanner.StatusBusy, message: "scan in progress"}
+	}
+	sim.scanning = true
+	return nil
+}
+
+func (sim *simulator) release() {
+	sim.mu.Lock()
+	sim.scanning = false
+	sim.mu.Unlock()
+}
+
+// region validates a requested region against the slide and clips it to
+// the simulator's maximum dimension
+func (sim *simulator) region(x, y, width, height int) (int, int, error) {
+	if width <= 0 || height <= 0 {
+		return 0, 0, invalidArgument("empty region %dx%d", width, height)
+	}
+	if x < 0 || y < 0 || x+width > sim.width || y+height > sim.height {
+		return 0, 0, invalidArgument("region %d,%d %dx%d outside slide %dx%d", x, y, width, height, sim.width, sim.height)
+	}
+	if width > sim.maxDimension {
+		width = sim.maxDimension
+	}
+	if height > sim.maxDimension {
+		height = sim.maxDimension
+	}
+	return width, height, nil
+}
+
+// scan parses [x][y][width][height][num_layers][layer...] and answers with
+// one frame per layer
+func (sim *simulator) scan(w io.Writer, payload []byte) error {
+	if len(payload) < 20 {
+		return invalidArgument("SCAN payload of %d bytes is too short", len(payload))
+	}
+	x := int(binary.BigEndian.Uint32(payload[0:]))
+	y := int(binary.BigEndian.Uint32(payload[4:]))
+	width := int(binary.BigEndian.Uint32(payload[8:]))
+	height := int(binary.BigEndian.Uint32(payload[12:]))
+	count := int(binary.BigEndian.Uint32(payload[16:]))
+	if count == 0 || len(payload) != 20+4*count {
+		return invalidArgument("SCAN payload of %d bytes doesn't hold %d layers", len(payload), count)
+	}
+
+	layers := make([]int, count)
+	for i := range layers {
+		layers[i] = int(binary.BigEndian.Uint32(payload[20+4*i:]))
+		if layers[i] >= sim.layers {
+			return invalidArgument("layer %d out of range (0-%d)", layers[i], sim.layers-1)
+		}
+	}
+
+	width, height, err := sim.region(x, y, width, height)
+	if err != nil {
+		return err
+	}
+
+	sim.mu.Lock()
+	calibrated := sim.calibrated
+	sim.mu.Unlock()
+	if sim.needsCalibration && !calibrated {
+		return &commandError{status: scanner.StatusNotCalibrated, message: "calibrate before scanning"}
+	}
+
+	if err := sim.acquire(); err != nil {
+		return err
+	}
+	defer sim.release()
+
+	sim.log.Info("Scanning", "x", x, "y", y, "width", width, "height", height, "layers", count)
+	for _, layer := range layers {
+		time.Sleep(sim.scanDelay)
+
+		frame, err := sim.layerFrame(x, y, width, height, layer)
+		if err != nil {
+			return err
+		}
+		if err := writeFrame(w, scanner.StatusOK, frame); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getImage parses [x][y][width][height][layer] and an optional
+// [objective], and answers with a single frame in the layer frame format.
+// Every objective is rendered at scan resolution.
+func (sim *simulator) getImage(w io.Writer, payload []byte) error {
+	if len(payload) != 20 && len(payload) != 24 {
+		return invalidArgument("GET_IMAGE takes 20 or 24 bytes, got %d", len(payload))
+	}
+	x := int(binary.BigEndian.Uint32(payload[0:]))
+	y := int(binary.BigEndian.Uint32(payload[4:]))
+	width := int(binary.BigEndian.Uint32(payload[8:]))
+	height := int(binary.BigEndian.Uint32(payload[12:]))
+	layer := int(binary.BigEndian.Uint32(payload[16:]))
+	if layer >= sim.layers {
+		return invalidArgument("layer %d out of range (0-%d)", layer, sim.layers-1)
+	}
+	if len(payload) == 24 {
+		objective := int(binary.BigEndian.Uint32(payload[20:]))
+		if objective != 0 && !sim.hasObjective(objective) {
+			return invalidArgument("no %dx objective (have %v)", objective, sim.objectives)
+		}
+	}
+
+	width, height, err := sim.region(x, y, width, height)
+	if err != nil {
+		return err
+	}
+
+	frame, err := sim.layerFrame(x, y, width, height, layer)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, scanner.StatusOK, frame)
+}
+
+func (sim *simulator) hasObjective(magnification int) bool {
+	for _, o := range sim.objectives {
+		if o == magnification {
+			return true
+		}
+	}
+	return false
+}
+
+// layerFrame renders a region and encodes it as a 32-byte header (layer,
+// width, height, tiles x/y, tile size, compressed flag, data size) followed
+// by JPEG data
+func (sim *simulator) layerFrame(x, y, width, height, layer int) ([]byte, error) {
+	img := sim.specimen.render(x, y, width, height, layer)
+
+	var buf bytes.Buffer
+	buf.Write(make([]byte, layerHeaderSize))
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: sim.jpegQuality}); err != nil {
+		return nil, err
+	}
+
+	frame := buf.Bytes()
+	binary.BigEndian.PutUint32(frame[0:], uint32(layer))
+	binary.BigEndian.PutUint32(frame[4:], uint32(width))
+	binary.BigEndian.PutUint32(frame[8:], uint32(height))
+	binary.BigEndian.PutUint32(frame[12:], uint32((width+sim.tileSize-1)/sim.tileSize))
+	binary.BigEndian.PutUint32(frame[16:], uint32((height+sim.tileSize-1)/sim.tileSize))
+	binary.BigEndian.PutUint32(frame[20:], uint32(sim.tileSize))
+	frame[24] = 1
+	binary.BigEndian.PutUint32(frame[28:], uint32(len(frame)-layerHeaderSize))
+
+	return frame, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// Spacing of the grid cells are scattered on, in pixels at full resolution
+const cellGrid = 96
+
+// Defocus blur radius added per focus layer of distance from a cell's plane
+const blurPerLayer = 0.6
+
+// cell is one synthetic cell: a cytoplasm disc with an offset nucleus,
+// sharpest at its own focal depth
+type cell struct {
+	x, y     float64 // centre
+	radius   float64 // cytoplasm
+	nx, ny   float64 // nucleus centre
+	nRadius  float64
+	depth    float64 // focal plane, in layers
+	cytoRGB  [3]float64
+	nucleRGB [3]float64
+}
+
+// specimen generates a deterministic, infinitely large smear of cells from a
+// seed, so any region at any focus layer can be rendered on demand
+type specimen struct {
+	seed   uint64
+	layers int
+}
+
+func newSpecimen(seed int64, layers int) *specimen {
+	return &specimen{seed: uint64(seed), layers: layers}
+}
+
+// splitmix64 hashes its input into well-distributed bits
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// rand01 returns a deterministic value in [0,1) for the given coordinates
+func (s *specimen) rand01(a, b, k int) float64 {
+	h := splitmix64(s.seed ^ splitmix64(uint64(a)<<32^uint64(uint32(b))) ^ uint64(k)*0x632be59bd9b4e019)
+	return float64(h>>11) / (1 << 53)
+}
+
+// cellsIn returns the cells scattered in grid square (gx, gy). Roughly a
+// third of squares are empty background.
+func (s *specimen) cellsIn(gx, gy int) []cell {
+	n := int(s.rand01(gx, gy, 0) * 3)
+	cells := make([]cell, 0, n)
+
+	for i := 0; i < n; i++ {
+		k := 1 + i*16
+		c := cell{
+			x:       (float64(gx) + s.rand01(gx, gy, k)) * cellGrid,
+			y:       (float64(gy) + s.rand01(gx, gy, k+1)) * cellGrid,
+			radius:  14 + s.rand01(gx, gy, k+2)*16,
+			depth:   s.rand01(gx, gy, k+3) * float64(s.layers-1),
+			nRadius: 5 + s.rand01(gx, gy, k+4)*7,
+		}
+		angle := s.rand01(gx, gy, k+5) * 2 * math.Pi
+		offset := s.rand01(gx, gy, k+6) * (c.radius - c.nRadius) * 0.6
+		c.nx = c.x + math.Cos(angle)*offset
+		c.ny = c.y + math.Sin(angle)*offset
+
+		// Papanicolaou-like palette: cyan to pink cytoplasm, dark blue-purple nuclei
+		if s.rand01(gx, gy, k+7) < 0.5 {
+			c.cytoRGB = [3]float64{150, 200, 205}
+		} else {
+			c.cytoRGB = [3]float64{235, 160, 185}
+		}
+		shade := s.rand01(gx, gy, k+8) * 30
+		c.nucleRGB = [3]float64{70 + shade, 50 + shade, 120 + shade}
+
+		cells = append(cells, c)
+	}
+	return cells
+}
+
+// coverage is the soft-edged fraction of a disc covering a point at distance
+// d from its centre; the edge ramp widens with blur
+func coverage(d, radius, blur float64) float64 {
+	a := 0.5 - (d-radius)/(2*blur)
+	if a < 0 {
+		return 0
+	}
+	if a > 1 {
+		return 1
+	}
+	return a
+}
+
+// render draws the region (x0, y0, w, h) as seen at the given focus layer.
+// Cells away from the layer are blurred and lose contrast in proportion to
+// their distance from it.
+func (s *specimen) render(x0, y0, w, h, layer int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	// Cells that can reach into the region, bucketed by grid square
+	gx0, gy0 := floorDiv(x0, cellGrid)-1, floorDiv(y0, cellGrid)-1
+	gx1, gy1 := floorDiv(x0+w, cellGrid)+1, floorDiv(y0+h, cellGrid)+1
+	grid := make(map[[2]int][]cell)
+	for gy := gy0; gy <= gy1; gy++ {
+		for gx := gx0; gx <= gx1; gx++ {
+			grid[[2]int{gx, gy}] = s.cellsIn(gx, gy)
+		}
+	}
+
+	background := [3]float64{240, 232, 236}
+
+	for py := 0; py < h; py++ {
+		y := float64(y0 + py)
+		cy := floorDiv(y0+py, cellGrid)
+		for px := 0; px < w; px++ {
+			x := float64(x0 + px)
+			cx := floorDiv(x0+px, cellGrid)
+			rgb := background
+
+			for gy := cy - 1; gy <= cy+1; gy++ {
+				for gx := cx - 1; gx <= cx+1; gx++ {
+					for _, c := range grid[[2]int{gx, gy}] {
+						dz := math.Abs(float64(layer) - c.depth)
+						blur := 0.75 + dz*blurPerLayer
+						contrast := 1 / (1 + 0.04*dz)
+
+						if a := coverage(math.Hypot(x-c.x, y-c.y), c.radius, blur) * 0.8 * contrast; a > 0 {
+							for i := range rgb {
+								rgb[i] += (c.cytoRGB[i] - rgb[i]) * a
+							}
+						}
+						if a := coverage(math.Hypot(x-c.nx, y-c.ny), c.nRadius, blur) * contrast; a > 0 {
+							for i := range rgb {
+								rgb[i] += (c.nucleRGB[i] - rgb[i]) * a
+							}
+						}
+					}
+				}
+			}
+
+			// Sensor noise
+			noise := (s.rand01(x0+px, y0+py, layer+1000) - 0.5) * 6
+
+			i := img.PixOffset(px, py)
+			img.Pix[i+0] = clampByte(rgb[0] + noise)
+			img.Pix[i+1] = clampByte(rgb[1] + noise)
+			img.Pix[i+2] = clampByte(rgb[2] + noise)
+			img.Pix[i+3] = 255
+		}
+	}
+
+	return img
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+func clampByte(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
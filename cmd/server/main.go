@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,7 +11,10 @@ import (
 
 	"cyto-viewer/internal/api"
 	"cyto-viewer/internal/config"
+	"cyto-viewer/internal/events"
+	"cyto-viewer/internal/jobs"
 	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/storage"
 	"cyto-viewer/internal/tiler"
 	"cyto-viewer/pkg/auth"
 	"cyto-viewer/pkg/logger"
@@ -20,6 +22,9 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// How often device status is polled for the event stream
+const scannerStatusInterval = 10 * time.Second
+
 func main() {
 	// Initialize logger
 	log := logger.New()
@@ -31,27 +36,88 @@ func main() {
 	}
 
 	// Initialize GPU tile processor
-	tileProcessor, err := tiler.NewGPUTileProcessor(cfg.GPU)
+	tileProcessor, err := tiler.NewGPUTileProcessor(&cfg.GPU)
 	if err != nil {
 		log.Fatal("Failed to initialize GPU processor", "error", err)
 	}
 	defer tileProcessor.Close()
+	tileStore := storage.NewTileStore(cfg.Storage.BasePath)
+	tileProcessor.SetTileStore(tileStore)
+
+	// Initialize scanner interfaces. Scanners may be offline; they are
+	// connected in the background and slides can be viewed meanwhile.
+	scanners, err := scanner.NewRegistry(cfg.Scanners)
+	if err != nil {
+		log.Fatal("Failed to initialize scanner interfaces", "error", err)
+	}
+	defer scanners.Close()
+	scanners.OnStateChange(func(sc *scanner.Interface, c scanner.StateChange) {
+		if c.Error != "" {
+			log.Warn("Scanner state changed", "scanner", sc.ID(), "state", c.State, "error", c.Error)
+		} else {
+			log.Info("Scanner state changed", "scanner", sc.ID(), "state", c.State)
+		}
+	})
+
+	// Load slide and profile revisions used to version tile URLs
+	revisions, err := storage.OpenRevisions(cfg.Storage.BasePath)
+	if err != nil {
+		log.Fatal("Failed to load revisions", "error", err)
+	}
+
+	slides, err := storage.OpenSlideCatalog(cfg.Storage.BasePath)
+	if err != nil {
+		log.Fatal("Failed to load slide catalog", "error", err)
+	}
+	cases, err := storage.OpenCaseCatalog(cfg.Storage.BasePath)
+	if err != nil {
+		log.Fatal("Failed to load case catalog", "error", err)
+	}
+
+	annotations, err := storage.OpenAnnotationStore(cfg.Storage.BasePath)
+	if err != nil {
+		log.Fatal("Failed to open annotation store", "error", err)
+	}
+	measurements, err := storage.OpenMeasurementStore(cfg.Storage.BasePath)
+	if err != nil {
+		log.Fatal("Failed to open measurement store", "error", err)
+	}
 
-	// Initialize scanner interface
-	scannerInterface, err := scanner.NewInterface(cfg.Scanner)
+	// Scans run as queued jobs that store each layer as it arrives
+	scanJobs, err := jobs.OpenQueue(cfg.Storage.BasePath, scanners, tileStore, slides, log)
 	if err != nil {
-		log.Fatal("Failed to initialize scanner interface", "error", err)
+		log.Fatal("Failed to load scan job queue", "error", err)
 	}
-	defer scannerInterface.Close()
+	// Tiles of a layer become viewable as soon as it is stored; drop tiles
+	// cached from an earlier scan and bump the revision so viewers refetch
+	scanJobs.OnEvent(func(e jobs.Event) {
+		if e.Type != jobs.EventLayerStored {
+			return
+		}
+		layer := e.Layer
+		tileProcessor.Invalidate(tiler.InvalidationFilter{SlideID: e.Job.SlideID, Layer: &layer})
+		if _, err := revisions.BumpSlide(e.Job.SlideID); err != nil {
+			log.Error("Failed to bump slide revision", "slide", e.Job.SlideID, "error", err)
+		}
+	})
+
+	// Live event stream of scanner state, device status and scan progress
+	eventHub := events.NewHub()
+	stopScannerEvents := events.WatchScanners(eventHub, scanners, scannerStatusInterval)
+	defer stopScannerEvents()
+	events.WatchJobs(eventHub, scanJobs)
+
+	scanJobs.Start()
+	defer scanJobs.Close()
 
 	// Initialize authentication
-	authManager := auth.NewManager(cfg.Auth)
+	authManager := auth.NewManager(&cfg.Auth)
 
 	// Setup router
 	router := mux.NewRouter()
 
 	// API handlers
-	apiHandler := api.NewHandler(log, tileProcessor, scannerInterface, authManager, cfg)
+	apiHandler := api.NewHandler(log, tileProcessor, scanners, authManager, revisions, slides, cases, tileStore, annotations, measurements, scanJobs, eventHub, cfg)
 	apiHandler.RegisterRoutes(router)
 
 	// Static files for the viewer
@@ -71,6 +137,8 @@ func main() {
 		WriteTimeout: 30 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
+	// Event streams never finish on their own
+	srv.RegisterOnShutdown(eventHub.Close)
 
 	// Start server in goroutine
 	go func() {
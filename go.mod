@@ -8,8 +8,6 @@ require (
 	golang.org/x/crypto v0.18.0
 	github.com/chai2010/webp v1.1.1
 	github.com/kolesa-team/go-webp v1.0.4
-)
-
-require (
-	golang.org/x/sys v0.16.0 // indirect
+	github.com/Kagami/go-avif v0.1.0
+	golang.org/x/sys v0.16.0
 )
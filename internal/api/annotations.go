@@ -0,0 +1,459 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cyto-viewer/internal/geojson"
+	"cyto-viewer/internal/geometry"
+	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// Longest annotation label accepted, in characters
+const maxLabelLength = 200
+
+var validColor = regexp.MustCompile(`^#[0-9A-Fa-f]{6}([0-9A-Fa-f]{2})?$`)
+
+// annotationRequest is the body of annotation create and update requests.
+// Updates must name the version they were based on, in If-Match or here.
+type annotationRequest struct {
+	Geometry geometry.Geometry `json:"geometry"`
+	Label    string            `json:"label"`
+	Color    string            `json:"color"`
+	Layer    *int              `json:"layer"`
+	Version  int64             `json:"version"`
+}
+
+func (req *annotationRequest) validate() []scanner.Violation {
+	var violations []scanner.Violation
+	if err := req.Geometry.Validate(); err != nil {
+		violations = append(violations, scanner.Violation{Field: "geometry", Message: err.Error()})
+	}
+	if utf8.RuneCountInString(req.Label) > maxLabelLength {
+		violations = append(violations, scanner.Violation{Field: "label",
+			Message: fmt.Sprintf("must be at most %d characters", maxLabelLength)})
+	}
+	if req.Color != "" && !validColor.MatchString(req.Color) {
+		violations = append(violations, scanner.Violation{Field: "color", Message: "must be #rrggbb or #rrggbbaa"})
+	}
+	if req.Layer != nil && *req.Layer < 0 {
+		violations = append(violations, scanner.Violation{Field: "layer", Message: "must not be negative"})
+	}
+	return violations
+}
+
+// annotationView is an annotation as returned by the API, measured in the
+// slide's physical units
+type annotationView struct {
+	storage.Annotation
+	Measurement geometry.Measurement `json:"measurement"`
+}
+
+func newAnnotationView(a storage.Annotation, slide storage.Slide) annotationView {
+	return annotationView{Annotation: a, Measurement: a.Geometry.Measure(slide.MicronsPerPixel)}
+}
+
+func annotationETag(a storage.Annotation) string {
+	return fmt.Sprintf(`"%d"`, a.Version)
+}
+
+// annotationSlide returns the slide a request addresses, writing a 404 if
+// it doesn't exist
+func (h *Handler) annotationSlide(w http.ResponseWriter, r *http.Request) (storage.Slide, bool) {
+	slide, ok := h.slides.Get(mux.Vars(r)["slideId"])
+	if !ok {
+		http.Error(w, "Slide not found", http.StatusNotFound)
+	}
+	return slide, ok
+}
+
+// handleListAnnotations lists a slide's annotations. bbox=minX,minY,maxX,maxY
+// (level 0 pixels) limits them to those whose bounds overlap the region,
+// layer to one focus layer (annotations on all layers always match) and
+// label to one label.
+func (h *Handler) handleListAnnotations(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.annotationSlide(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := storage.AnnotationFilter{Label: query.Get("label")}
+	var violations []scanner.Violation
+	if bbox := query.Get("bbox"); bbox != "" {
+		bounds, err := parseBBox(bbox)
+		if err != nil {
+			violations = append(violations, scanner.Violation{Field: "bbox", Message: err.Error()})
+		}
+		filter.Bounds = &bounds
+	}
+	if value := query.Get("layer"); value != "" {
+		layer, err := strconv.Atoi(value)
+		if err != nil || layer < 0 {
+			violations = append(violations, scanner.Violation{Field: "layer", Message: "must be a focus layer index"})
+		}
+		filter.Layer = &layer
+	}
+	if len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	annotations, err := h.annotations.List(slide.ID, filter)
+	if err != nil {
+		h.log.Error("Failed to list annotations", "slideId", slide.ID, "error", err)
+		http.Error(w, "Failed to list annotations", http.StatusInternalServerError)
+		return
+	}
+
+	views := make([]annotationView, 0, len(annotations))
+	for _, a := range annotations {
+		views = append(views, newAnnotationView(a, slide))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+func (h *Handler) handleGetAnnotation(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.annotationSlide(w, r)
+	if !ok {
+		return
+	}
+
+	a, err := h.annotations.Get(slide.ID, mux.Vars(r)["annotationId"])
+	if errors.Is(err, storage.ErrAnnotationNotFound) {
+		http.Error(w, "Annotation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.log.Error("Failed to read annotation", "slideId", slide.ID, "error", err)
+		http.Error(w, "Failed to read annotation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", annotationETag(a))
+	json.NewEncoder(w).Encode(newAnnotationView(a, slide))
+}
+
+func (h *Handler) handleCreateAnnotation(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.annotationSlide(w, r)
+	if !ok {
+		return
+	}
+
+	var req annotationRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if violations := req.validate(); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	created, err := h.annotations.Create(slide.ID, storage.Annotation{
+		Geometry: req.Geometry,
+		Label:    req.Label,
+		Color:    req.Color,
+		Layer:    req.Layer,
+		Author:   h.currentUser(r),
+	})
+	if err != nil {
+		h.log.Error("Failed to create annotation", "slideId", slide.ID, "error", err)
+		http.Error(w, "Failed to create annotation", http.StatusInternalServerError)
+		return
+	}
+	a := created[0]
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/api/slides/%s/annotations/%s", slide.ID, a.ID))
+	w.Header().Set("ETag", annotationETag(a))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newAnnotationView(a, slide))
+}
+
+// handleUpdateAnnotation replaces an annotation's geometry, label, color and
+// layer. It fails with 412 and the current annotation if someone else
+// changed it first.
+func (h *Handler) handleUpdateAnnotation(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.annotationSlide(w, r)
+	if !ok {
+		return
+	}
+
+	var req annotationRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if violations := req.validate(); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+	version, ok := expectedVersion(w, r, req.Version)
+	if !ok {
+		return
+	}
+
+	a, err := h.annotations.Update(slide.ID, mux.Vars(r)["annotationId"], version, h.currentUser(r),
+		func(a *storage.Annotation) {
+			a.Geometry = req.Geometry
+			a.Label = req.Label
+			a.Color = req.Color
+			a.Layer = req.Layer
+		})
+	if h.writeAnnotationError(w, slide, a, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", annotationETag(a))
+	json.NewEncoder(w).Encode(newAnnotationView(a, slide))
+}
+
+func (h *Handler) handleDeleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.annotationSlide(w, r)
+	if !ok {
+		return
+	}
+	version, ok := expectedVersion(w, r, 0)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["annotationId"]
+	err := h.annotations.Delete(slide.ID, id, version)
+	if errors.Is(err, storage.ErrVersionConflict) {
+		current, _ := h.annotations.Get(slide.ID, id)
+		h.writeAnnotationError(w, slide, current, err)
+		return
+	}
+	if h.writeAnnotationError(w, slide, storage.Annotation{}, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeAnnotationError answers a failed annotation change, and reports
+// whether err was set. A version conflict returns the current annotation.
+func (h *Handler) writeAnnotationError(w http.ResponseWriter, slide storage.Slide, current storage.Annotation, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, storage.ErrAnnotationNotFound):
+		http.Error(w, "Annotation not found", http.StatusNotFound)
+	case errors.Is(err, storage.ErrVersionConflict):
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", annotationETag(current))
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "Annotation was modified by someone else",
+			"current": newAnnotationView(current, slide),
+		})
+	default:
+		h.log.Error("Failed to change annotation", "slideId", slide.ID, "error", err)
+		http.Error(w, "Failed to change annotation", http.StatusInternalServerError)
+	}
+	return true
+}
+
+// expectedVersion returns the annotation version a change is based on,
+// from If-Match or else the request body, writing a 428 if neither has one
+func expectedVersion(w http.ResponseWriter, r *http.Request, bodyVersion int64) (int64, bool) {
+	if match := r.Header.Get("If-Match"); match != "" {
+		tag := strings.Trim(strings.TrimPrefix(strings.TrimSpace(match), "W/"), `"`)
+		version, err := strconv.ParseInt(tag, 10, 64)
+		if err != nil || version < 1 {
+			http.Error(w, "If-Match must be an annotation ETag", http.StatusBadRequest)
+			return 0, false
+		}
+		return version, true
+	}
+	if bodyVersion > 0 {
+		return bodyVersion, true
+	}
+
+	http.Error(w, "Send If-Match or version with the annotation version being changed", http.StatusPreconditionRequired)
+	return 0, false
+}
+
+// parseBBox parses minX,minY,maxX,maxY
+func parseBBox(value string) (geometry.Rect, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != 4 {
+		return geometry.Rect{}, fmt.Errorf("must be minX,minY,maxX,maxY")
+	}
+
+	var v [4]float64
+	for i, field := range fields {
+		f, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return geometry.Rect{}, fmt.Errorf("%q is not a number", field)
+		}
+		v[i] = f
+	}
+	if v[0] > v[2] || v[1] > v[3] {
+		return geometry.Rect{}, fmt.Errorf("min must not exceed max")
+	}
+	return geometry.Rect{MinX: v[0], MinY: v[1], MaxX: v[2], MaxY: v[3]}, nil
+}
+
+const (
+	// Limits on one GeoJSON import
+	maxImportBytes       = 512 << 20
+	maxImportAnnotations = 100000
+
+	// Rejected features listed in an import's 400 response
+	maxImportViolations = 100
+)
+
+// geojsonScale returns the factor from level 0 pixels to the coordinates
+// a request's units parameter selects: pixels (the default, as in QuPath)
+// or microns. It writes a 400 if the units are unknown or the slide's
+// pixel size isn't.
+func geojsonScale(w http.ResponseWriter, r *http.Request, slide storage.Slide) (float64, bool) {
+	switch units := r.URL.Query().Get("units"); units {
+	case "", "pixels":
+		return 1, true
+	case "microns":
+		if slide.MicronsPerPixel <= 0 {
+			writeViolations(w, []scanner.Violation{{Field: "units", Message: "the slide's pixel size is unknown"}})
+			return 0, false
+		}
+		return slide.MicronsPerPixel, true
+	default:
+		writeViolations(w, []scanner.Violation{{Field: "units", Message: `must be "pixels" or "microns"`}})
+		return 0, false
+	}
+}
+
+// handleExportAnnotations streams a slide's annotations as a GeoJSON
+// FeatureCollection
+func (h *Handler) handleExportAnnotations(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.annotationSlide(w, r)
+	if !ok {
+		return
+	}
+	scale, ok := geojsonScale(w, r, slide)
+	if !ok {
+		return
+	}
+
+	annotations, err := h.annotations.List(slide.ID, storage.AnnotationFilter{})
+	if err != nil {
+		h.log.Error("Failed to list annotations", "slideId", slide.ID, "error", err)
+		http.Error(w, "Failed to export annotations", http.StatusInternalServerError)
+		return
+	}
+
+	// Large exports can outlast the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.geojson"`, slide.ID))
+	enc := geojson.NewEncoder(w, scale)
+	for i := range annotations {
+		if err := enc.Encode(&annotations[i]); err != nil {
+			// Headers are sent; the client sees a truncated document
+			h.log.Error("Failed to export annotations", "slideId", slide.ID, "error", err)
+			return
+		}
+	}
+	enc.Close()
+}
+
+// handleImportAnnotations adds the features of a GeoJSON document as
+// annotations. Features are decoded as they stream in and all are checked
+// before any is stored: an import with any invalid feature stores nothing.
+func (h *Handler) handleImportAnnotations(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.annotationSlide(w, r)
+	if !ok {
+		return
+	}
+	scale, ok := geojsonScale(w, r, slide)
+	if !ok {
+		return
+	}
+
+	// Large uploads can outlast the server's read timeout
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	author := h.currentUser(r)
+	dec := geojson.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportBytes), scale)
+	var imported []storage.Annotation
+	var violations []scanner.Violation
+	rejected := 0
+
+	for {
+		annotations, err := dec.Next()
+		if err == io.EOF {
+			break
+		}
+		var featureErr *geojson.FeatureError
+		if errors.As(err, &featureErr) {
+			rejected++
+			if len(violations) < maxImportViolations {
+				violations = append(violations, scanner.Violation{
+					Field:   fmt.Sprintf("features[%d].%s", featureErr.Index, featureErr.Field),
+					Message: featureErr.Message,
+				})
+			}
+			continue
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Import exceeds %d MB", maxImportBytes>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			writeViolations(w, []scanner.Violation{{Field: "body", Message: err.Error()}})
+			return
+		}
+
+		for _, a := range annotations {
+			a.Author = author
+			imported = append(imported, a)
+		}
+		if len(imported) > maxImportAnnotations {
+			writeViolations(w, []scanner.Violation{{Field: "features",
+				Message: fmt.Sprintf("more than %d annotations in one import", maxImportAnnotations)}})
+			return
+		}
+	}
+
+	if rejected > 0 {
+		if rejected > len(violations) {
+			violations = append(violations, scanner.Violation{Field: "features",
+				Message: fmt.Sprintf("%d more features rejected", rejected-len(violations))})
+		}
+		writeViolations(w, violations)
+		return
+	}
+
+	created, err := h.annotations.Create(slide.ID, imported...)
+	if err != nil {
+		h.log.Error("Failed to import annotations", "slideId", slide.ID, "error", err)
+		http.Error(w, "Failed to import annotations", http.StatusInternalServerError)
+		return
+	}
+	h.log.Info("Annotations imported", "slideId", slide.ID, "count", len(created), "user", author)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"imported": len(created),
+	})
+}
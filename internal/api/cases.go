@@ -0,0 +1,275 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// Longest specimen type accepted, in characters
+const maxSpecimenTypeLength = 100
+
+var validAccession = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 ._/-]{0,63}$`)
+
+// caseRequest is the body of case create and update requests. An update
+// replaces every field.
+type caseRequest struct {
+	AccessionNumber string   `json:"accessionNumber"`
+	SpecimenType    string   `json:"specimenType"`
+	CollectionDate  string   `json:"collectionDate"`
+	Slides          []string `json:"slides"`
+	Readers         []string `json:"readers"`
+	Editors         []string `json:"editors"`
+}
+
+func (h *Handler) validateCase(req *caseRequest) []scanner.Violation {
+	var violations []scanner.Violation
+	if !validAccession.MatchString(req.AccessionNumber) {
+		violations = append(violations, scanner.Violation{Field: "accessionNumber",
+			Message: "must be 1-64 letters, digits, spaces or . _ / -, starting with a letter or digit"})
+	}
+	if strings.TrimSpace(req.SpecimenType) == "" {
+		violations = append(violations, scanner.Violation{Field: "specimenType", Message: "is required"})
+	} else if utf8.RuneCountInString(req.SpecimenType) > maxSpecimenTypeLength {
+		violations = append(violations, scanner.Violation{Field: "specimenType",
+			Message: fmt.Sprintf("must be at most %d characters", maxSpecimenTypeLength)})
+	}
+	if req.CollectionDate != "" {
+		date, err := time.Parse("2006-01-02", req.CollectionDate)
+		if err != nil {
+			violations = append(violations, scanner.Violation{Field: "collectionDate", Message: "must be a date as YYYY-MM-DD"})
+		} else if date.After(time.Now()) {
+			violations = append(violations, scanner.Violation{Field: "collectionDate", Message: "must not be in the future"})
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, slideID := range req.Slides {
+		field := fmt.Sprintf("slides[%d]", i)
+		if seen[slideID] {
+			violations = append(violations, scanner.Violation{Field: field, Message: fmt.Sprintf("slide %s is listed twice", slideID)})
+			continue
+		}
+		seen[slideID] = true
+		if _, ok := h.slides.Get(slideID); !ok {
+			violations = append(violations, scanner.Violation{Field: field, Message: fmt.Sprintf("slide %q not found", slideID)})
+		}
+	}
+	for _, list := range []struct {
+		field string
+		users []string
+	}{{"readers", req.Readers}, {"editors", req.Editors}} {
+		for i, user := range list.users {
+			if strings.TrimSpace(user) == "" {
+				violations = append(violations, scanner.Violation{Field: fmt.Sprintf("%s[%d]", list.field, i), Message: "must be a username"})
+			}
+		}
+	}
+	return violations
+}
+
+// apply copies the request into a case
+func (req *caseRequest) apply(c *storage.Case) {
+	c.AccessionNumber = req.AccessionNumber
+	c.SpecimenType = req.SpecimenType
+	c.CollectionDate = req.CollectionDate
+	c.Slides = append([]string{}, req.Slides...)
+	c.Readers = append([]string{}, req.Readers...)
+	c.Editors = append([]string{}, req.Editors...)
+}
+
+// canReadCase reports whether the request's user may view a case and its
+// slides. Admins may view every case.
+func (h *Handler) canReadCase(r *http.Request, c *storage.Case) bool {
+	user := h.currentUser(r)
+	return h.auth.IsAdmin(user) || c.CanRead(user)
+}
+
+func (h *Handler) canEditCase(r *http.Request, c *storage.Case) bool {
+	user := h.currentUser(r)
+	return h.auth.IsAdmin(user) || c.CanEdit(user)
+}
+
+// canReadSlide reports whether the request's user may see a slide: any
+// user if it belongs to no case, otherwise the case's users
+func (h *Handler) canReadSlide(r *http.Request, slideID string) bool {
+	c, ok := h.cases.ForSlide(slideID)
+	return !ok || h.canReadCase(r, &c)
+}
+
+// canEditSlide reports whether the request's user may change a slide and
+// what belongs to it: any user if it belongs to no case, otherwise the
+// case's owner and editors
+func (h *Handler) canEditSlide(r *http.Request, slideID string) bool {
+	c, ok := h.cases.ForSlide(slideID)
+	return !ok || h.canEditCase(r, &c)
+}
+
+// requireSlideEdit wraps a route that changes a slide, its overlays,
+// annotations or measurements so that only users who may edit the slide's
+// case reach it. caseAccessMiddleware has already checked read access.
+func (h *Handler) requireSlideEdit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.canEditSlide(r, mux.Vars(r)["slideId"]) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// caseAccessMiddleware applies case permissions to every route addressing
+// a slide, so its tiles, overlays and annotations are covered too
+func (h *Handler) caseAccessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slideID, ok := mux.Vars(r)["slideId"]; ok && !h.canReadSlide(r, slideID) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleListCases lists the cases the user may view, newest first.
+// accession limits them to accession numbers starting with it, ignoring
+// case.
+func (h *Handler) handleListCases(w http.ResponseWriter, r *http.Request) {
+	cases := make([]storage.Case, 0)
+	for _, c := range h.cases.List(r.URL.Query().Get("accession")) {
+		if h.canReadCase(r, &c) {
+			cases = append(cases, c)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cases)
+}
+
+// requestCase returns the case a request addresses, writing a 404 if it
+// doesn't exist or the user may not view it
+func (h *Handler) requestCase(w http.ResponseWriter, r *http.Request) (storage.Case, bool) {
+	c, ok := h.cases.Get(mux.Vars(r)["caseId"])
+	if !ok || !h.canReadCase(r, &c) {
+		http.Error(w, "Case not found", http.StatusNotFound)
+		return storage.Case{}, false
+	}
+	return c, true
+}
+
+func (h *Handler) handleGetCase(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.requestCase(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// handleCreateCase creates a case owned by the user. Its slides must not
+// belong to another case.
+func (h *Handler) handleCreateCase(w http.ResponseWriter, r *http.Request) {
+	var req caseRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if violations := h.validateCase(&req); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	c := storage.Case{Owner: h.currentUser(r)}
+	req.apply(&c)
+	c, err := h.cases.Create(c)
+	if h.writeCaseError(w, err) {
+		return
+	}
+	h.log.Info("Case created", "case", c.ID, "accession", c.AccessionNumber, "slides", len(c.Slides))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/cases/"+c.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// handleUpdateCase replaces a case's details, slides and users. Only its
+// owner, editors and admins may change it.
+func (h *Handler) handleUpdateCase(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.requestCase(w, r)
+	if !ok {
+		return
+	}
+	if !h.canEditCase(r, &c) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req caseRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if violations := h.validateCase(&req); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	c, err := h.cases.Update(c.ID, req.apply)
+	if h.writeCaseError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// handleDeleteCase deletes a case but not its slides, which become visible
+// to every user. Only the owner and admins may delete a case.
+func (h *Handler) handleDeleteCase(w http.ResponseWriter, r *http.Request) {
+	c, ok := h.requestCase(w, r)
+	if !ok {
+		return
+	}
+	if user := h.currentUser(r); user != c.Owner && !h.auth.IsAdmin(user) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if h.writeCaseError(w, h.cases.Delete(c.ID)) {
+		return
+	}
+	h.log.Info("Case deleted", "case", c.ID, "accession", c.AccessionNumber)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeCaseError answers a failed case change, and reports whether err was
+// set
+func (h *Handler) writeCaseError(w http.ResponseWriter, err error) bool {
+	var inCase *storage.SlideInCaseError
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, storage.ErrCaseNotFound):
+		http.Error(w, "Case not found", http.StatusNotFound)
+	case errors.Is(err, storage.ErrAccessionExists):
+		http.Error(w, "Another case has this accession number", http.StatusConflict)
+	case errors.As(err, &inCase):
+		http.Error(w, fmt.Sprintf("Slide %s already belongs to another case", inCase.SlideID), http.StatusConflict)
+	default:
+		h.log.Error("Failed to change case", "error", err)
+		http.Error(w, "Failed to change case", http.StatusInternalServerError)
+	}
+	return true
+}
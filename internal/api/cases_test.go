@@ -0,0 +1,233 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cyto-viewer/internal/storage"
+
+	"github.com/gorilla/mux"
+)
+
+func TestBatchRequestsUseURLSlide(t *testing.T) {
+	s := newTestServer(t)
+	s.createCase("alice", `{"accessionNumber": "C26-1", "specimenType": "FNA", "slides": ["slide-2"]}`)
+
+	// bob may read slide-1 but not slide-2, and names slide-2 in the body
+	body := `[{"SlideID": "slide-2", "Layer": 0, "X": 0, "Y": 0, "Z": 0, "Format": "png"},
+		{"SlideID": "slide-1", "X": 1}]`
+	req := httptest.NewRequest("POST", "/api/tiles/slide-1/batch", strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"slideId": "slide-1"})
+	w := httptest.NewRecorder()
+
+	requests, ok := s.h.batchRequests(w, req)
+	if !ok {
+		t.Fatalf("batch rejected: %d %s", w.Code, w.Body.String())
+	}
+	for i, r := range requests {
+		if r.SlideID != "slide-1" {
+			t.Errorf("request %d reads slide %q, want the URL's slide-1", i, r.SlideID)
+		}
+	}
+}
+
+func TestBatchRequestsUnknownOverlay(t *testing.T) {
+	s := newTestServer(t)
+
+	req := httptest.NewRequest("POST", "/api/tiles/slide-1/batch", strings.NewReader(`[{"Overlay": "ovl_other"}]`))
+	req = mux.SetURLVars(req, map[string]string{"slideId": "slide-1"})
+	w := httptest.NewRecorder()
+
+	if _, ok := s.h.batchRequests(w, req); ok || w.Code != http.StatusNotFound {
+		t.Fatalf("got ok=%v %d, want 404 for an overlay of another slide", ok, w.Code)
+	}
+}
+
+// TestSlideRoutePermissions checks case permissions on every slide route
+// that can be served without a GPU, scanner or job queue, and that
+// changing routes refuse readers before doing anything
+func TestSlideRoutePermissions(t *testing.T) {
+	s := newTestServer(t)
+	s.createCase("alice", `{"accessionNumber": "C26-1", "specimenType": "FNA",
+		"slides": ["slide-1"], "readers": ["rita"], "editors": ["ed"]}`)
+
+	// An annotation to read, change and delete
+	w := s.do("alice", "POST", "/api/slides/slide-1/annotations",
+		`{"geometry": {"type": "point", "points": [[1, 1]]}, "label": "HSIL"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create annotation: %d %s", w.Code, w.Body.String())
+	}
+	annotation := "/api/slides/slide-1/annotations/" + strings.TrimPrefix(
+		w.Header().Get("Location"), "/api/slides/slide-1/annotations/")
+
+	reads := []struct{ method, url, body string }{
+		{"GET", "/api/slides/slide-1", ""},
+		{"GET", "/api/slides/slide-1/overlays", ""},
+		{"GET", "/api/slides/slide-1/annotations", ""},
+		{"GET", "/api/slides/slide-1/annotations/geojson", ""},
+		{"GET", annotation, ""},
+		{"GET", "/api/slides/slide-1/measurements", ""},
+		{"GET", "/api/slides/slide-1/summary", ""},
+		{"POST", "/api/slides/slide-1/measure", `{"type": "point", "points": [[1, 1]]}`},
+	}
+	changes := []struct{ method, url, body string }{
+		{"DELETE", "/api/slides/slide-1", ""},
+		{"POST", "/api/slides/slide-1/overlays", `{"x": 0, "y": 0, "width": 10, "height": 10, "layer": 0}`},
+		{"DELETE", "/api/slides/slide-1/overlays/ovl_1", ""},
+		{"POST", "/api/slides/slide-1/annotations", `{"geometry": {"type": "point", "points": [[2, 2]]}}`},
+		{"POST", "/api/slides/slide-1/annotations/geojson", `[]`},
+		{"PUT", annotation, `{"geometry": {"type": "point", "points": [[3, 3]]}, "version": 1}`},
+		{"DELETE", annotation, ""},
+		{"POST", "/api/slides/slide-1/measurements", `{"geometry": {"type": "point", "points": [[1, 1]]}}`},
+	}
+
+	for _, user := range []string{"rita", "mallory"} {
+		for _, c := range changes {
+			if w := s.do(user, c.method, c.url, c.body); w.Code != http.StatusForbidden {
+				t.Errorf("%s %s %s: %d, want 403", user, c.method, c.url, w.Code)
+			}
+		}
+	}
+	for _, url := range []string{"/api/tiles/slide-1?x=0&y=0", "/api/tiles/slide-1/batch"} {
+		method := "GET"
+		if strings.HasSuffix(url, "/batch") {
+			method = "POST"
+		}
+		if w := s.do("mallory", method, url, `[]`); w.Code != http.StatusForbidden {
+			t.Errorf("mallory %s %s: %d, want 403", method, url, w.Code)
+		}
+	}
+	for _, r := range reads {
+		if w := s.do("mallory", r.method, r.url, r.body); w.Code != http.StatusForbidden {
+			t.Errorf("mallory %s %s: %d, want 403", r.method, r.url, w.Code)
+		}
+		for _, user := range []string{"alice", "rita", "ed", "root"} {
+			if w := s.do(user, r.method, r.url, r.body); w.Code != http.StatusOK {
+				t.Errorf("%s %s %s: %d, want 200", user, r.method, r.url, w.Code)
+			}
+		}
+	}
+
+	// Editors and admins get past the permission check
+	for _, user := range []string{"ed", "root"} {
+		w := s.do(user, "POST", "/api/slides/slide-1/annotations",
+			`{"geometry": {"type": "point", "points": [[2, 2]]}}`)
+		if w.Code != http.StatusCreated {
+			t.Errorf("%s create annotation: %d, want 201", user, w.Code)
+		}
+	}
+	if w := s.do("ed", "PUT", annotation, `{"geometry": {"type": "point", "points": [[3, 3]]}, "version": 1}`); w.Code != http.StatusOK {
+		t.Errorf("ed update annotation: %d, want 200", w.Code)
+	}
+	if w := s.do("ed", "DELETE", annotation, ""); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("ed delete annotation without version: %d, want 428", w.Code)
+	}
+
+	// Slides in no case stay open to everyone
+	if w := s.do("mallory", "POST", "/api/slides/slide-2/annotations",
+		`{"geometry": {"type": "point", "points": [[2, 2]]}}`); w.Code != http.StatusCreated {
+		t.Errorf("mallory annotate unassigned slide: %d, want 201", w.Code)
+	}
+}
+
+func TestTileSize(t *testing.T) {
+	slide := storage.Slide{ID: "slide-1", TileSize: 256,
+		Overlays: []storage.Overlay{{ID: "ovl_1", TileSize: 1024}, {ID: "ovl_2"}}}
+
+	tests := []struct {
+		name       string
+		slide      storage.Slide
+		slideFound bool
+		overlay    string
+		want       int
+		wantOK     bool
+	}{
+		{"slide", slide, true, "", 256, true},
+		{"overlay", slide, true, "ovl_1", 1024, true},
+		{"overlay without size", slide, true, "ovl_2", defaultTileSize, true},
+		{"unknown overlay", slide, true, "ovl_3", 0, false},
+		{"slide without size", storage.Slide{}, true, "", defaultTileSize, true},
+		{"unknown slide", storage.Slide{}, false, "", defaultTileSize, true},
+		{"overlay of unknown slide", storage.Slide{}, false, "ovl_1", 0, false},
+	}
+	for _, tt := range tests {
+		size, ok := tileSize(tt.slide, tt.slideFound, tt.overlay)
+		if size != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: got %d, %v, want %d, %v", tt.name, size, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestCaseEndpoints(t *testing.T) {
+	s := newTestServer(t)
+	id := s.createCase("alice", `{"accessionNumber": "C26-100", "specimenType": "FNA",
+		"slides": ["slide-1"], "readers": ["rita"], "editors": ["ed"]}`)
+	s.createCase("bob", `{"accessionNumber": "NG26-1", "specimenType": "Urine"}`)
+	url := "/api/cases/" + id
+
+	// Listing shows each user only the cases they may read
+	list := func(user, query string) []string {
+		var cases []storage.Case
+		json.NewDecoder(s.do(user, "GET", "/api/cases"+query, "").Body).Decode(&cases)
+		var accessions []string
+		for _, c := range cases {
+			accessions = append(accessions, c.AccessionNumber)
+		}
+		return accessions
+	}
+	listTests := []struct {
+		user, query, want string
+	}{
+		{"rita", "", "C26-100"},
+		{"mallory", "", ""},
+		{"root", "", "NG26-1 C26-100"},
+		{"root", "?accession=c26", "C26-100"},
+		{"bob", "?accession=C26", ""},
+	}
+	for _, tt := range listTests {
+		if got := strings.Join(list(tt.user, tt.query), " "); got != tt.want {
+			t.Errorf("%s lists %q: got %q, want %q", tt.user, tt.query, got, tt.want)
+		}
+	}
+
+	update := `{"accessionNumber": "C26-100", "specimenType": "FNA", "slides": ["slide-1", "slide-2"],
+		"readers": ["rita"], "editors": ["ed"]}`
+	requests := []struct {
+		user, method, url, body string
+		want                    int
+	}{
+		{"mallory", "GET", url, "", http.StatusNotFound},
+		{"rita", "GET", url, "", http.StatusOK},
+		{"mallory", "PUT", url, update, http.StatusNotFound},
+		{"rita", "PUT", url, update, http.StatusForbidden},
+		{"ed", "PUT", url, update, http.StatusOK},
+		{"ed", "DELETE", url, "", http.StatusForbidden},
+
+		{"bob", "POST", "/api/cases", `{"accessionNumber": "c26-100", "specimenType": "FNA"}`, http.StatusConflict},
+		{"bob", "POST", "/api/cases", `{"accessionNumber": "C26-101", "specimenType": "FNA", "slides": ["slide-2"]}`, http.StatusConflict},
+		{"bob", "POST", "/api/cases", `{"accessionNumber": "C26-101", "specimenType": "FNA", "slides": ["slide-3", "slide-3"]}`, http.StatusBadRequest},
+		{"bob", "POST", "/api/cases", `{"accessionNumber": "C26-101", "specimenType": "FNA", "slides": ["slide-9"]}`, http.StatusBadRequest},
+		{"bob", "POST", "/api/cases", `{"accessionNumber": "C26-101", "specimenType": "FNA", "collectionDate": "2999-01-01"}`, http.StatusBadRequest},
+		{"bob", "POST", "/api/cases", `{"accessionNumber": "-C26", "specimenType": "FNA"}`, http.StatusBadRequest},
+		{"bob", "POST", "/api/cases", `{"accessionNumber": "C26-101", "specimenType": " "}`, http.StatusBadRequest},
+	}
+	for _, r := range requests {
+		if w := s.do(r.user, r.method, r.url, r.body); w.Code != r.want {
+			t.Errorf("%s %s %s %s: %d, want %d", r.user, r.method, r.url, r.body, w.Code, r.want)
+		}
+	}
+
+	// slide-2 joined the case with ed's update, so only its users see it
+	if w := s.do("mallory", "GET", "/api/slides/slide-2", ""); w.Code != http.StatusForbidden {
+		t.Errorf("mallory reads slide-2 in the case: %d, want 403", w.Code)
+	}
+	if w := s.do("alice", "DELETE", url, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("owner deletes case: %d", w.Code)
+	}
+	if w := s.do("mallory", "GET", "/api/slides/slide-2", ""); w.Code != http.StatusOK {
+		t.Errorf("mallory reads slide-2 after its case was deleted: %d, want 200", w.Code)
+	}
+}
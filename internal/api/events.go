@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cyto-viewer/internal/events"
+)
+
+const (
+	// Comment lines sent on idle streams so proxies keep them open
+	eventKeepalive = 15 * time.Second
+
+	// Reconnect delay suggested to EventSource clients, in milliseconds
+	eventRetryMs = 3000
+)
+
+// handleEvents streams scanner and job events as Server-Sent Events.
+// Clients reconnecting with Last-Event-ID receive the events they missed,
+// as long as they are still in the hub's history. Events about slides the
+// user may not see are left out.
+func (h *Handler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	backlog, stream, cancel := h.events.Subscribe(lastID)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetryMs)
+	for _, e := range backlog {
+		if !h.canSeeEvent(r, e) {
+			continue
+		}
+		if err := writeEvent(w, e); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-stream:
+			if !ok {
+				// Fell behind; the client reconnects and catches up
+				return
+			}
+			if !h.canSeeEvent(r, e) {
+				continue
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (h *Handler) canSeeEvent(r *http.Request, e events.Event) bool {
+	return e.SlideID == "" || h.canReadSlide(r, e.SlideID)
+}
+
+func writeEvent(w http.ResponseWriter, e events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cyto-viewer/internal/config"
+	"cyto-viewer/internal/events"
+	"cyto-viewer/internal/jobs"
+	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/storage"
+	"cyto-viewer/pkg/logger"
+)
+
+// withJobs gives the server a queue holding a queued job for each of the
+// given slides, named after them. Its only scanner can't be reached, so the
+// jobs stay queued.
+func (s *testServer) withJobs(slideIDs ...string) {
+	s.t.Helper()
+
+	var queued []jobs.Job
+	for _, id := range slideIDs {
+		queued = append(queued, jobs.Job{ID: "job-" + id, Status: jobs.StatusQueued, SlideID: id, Submitted: time.Now()})
+	}
+	dir := s.t.TempDir()
+	data, err := json.Marshal(queued)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "jobs.json"), data, 0644); err != nil {
+		s.t.Fatal(err)
+	}
+
+	registry, err := scanner.NewRegistry([]config.ScannerConfig{
+		{ID: "unreachable", Protocol: "tcp", Address: "127.0.0.1:1", Timeout: time.Second},
+	})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { registry.Close() })
+	q, err := jobs.OpenQueue(dir, registry, storage.NewTileStore(dir), s.h.slides, logger.New())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { q.Close() })
+	s.h.jobs = q
+}
+
+func TestJobsFilteredByCase(t *testing.T) {
+	s := newTestServer(t)
+	s.createCase("alice", `{"accessionNumber": "C26-1", "specimenType": "FNA",
+		"slides": ["slide-1"], "readers": ["rita"]}`)
+	s.withJobs("slide-1", "slide-2")
+
+	listed := func(user string) []string {
+		w := s.do(user, "GET", "/api/scanner/jobs", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s list jobs: %d", user, w.Code)
+		}
+		var list []jobs.Job
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, job := range list {
+			ids = append(ids, job.ID)
+		}
+		return ids
+	}
+	if got := strings.Join(listed("mallory"), ","); got != "job-slide-2" {
+		t.Errorf("mallory lists %q, want only job-slide-2", got)
+	}
+	if got := strings.Join(listed("rita"), ","); got != "job-slide-1,job-slide-2" {
+		t.Errorf("rita lists %q, want both jobs", got)
+	}
+
+	tests := []struct {
+		user, method, url string
+		want              int
+	}{
+		{"mallory", "GET", "/api/scanner/jobs/job-slide-1", http.StatusNotFound},
+		{"mallory", "POST", "/api/scanner/jobs/job-slide-1/cancel", http.StatusNotFound},
+		{"rita", "GET", "/api/scanner/jobs/job-slide-1", http.StatusOK},
+		{"rita", "POST", "/api/scanner/jobs/job-slide-1/cancel", http.StatusForbidden},
+		{"mallory", "GET", "/api/scanner/jobs/job-slide-2", http.StatusOK},
+		{"alice", "POST", "/api/scanner/jobs/job-slide-1/cancel", http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		if w := s.do(tt.user, tt.method, tt.url, ""); w.Code != tt.want {
+			t.Errorf("%s %s %s: %d, want %d", tt.user, tt.method, tt.url, w.Code, tt.want)
+		}
+	}
+}
+
+func TestEventsFilteredByCase(t *testing.T) {
+	s := newTestServer(t)
+	s.createCase("alice", `{"accessionNumber": "C26-1", "specimenType": "FNA", "slides": ["slide-1"]}`)
+	hub := events.NewHub()
+	defer hub.Close()
+	s.h.events = hub
+
+	hub.Publish("start", nil)
+	hub.PublishSlide(events.TypeJobQueued, "slide-1", map[string]interface{}{"slide": "slide-1"})
+	hub.PublishSlide(events.TypeJobQueued, "slide-2", map[string]interface{}{"slide": "slide-2"})
+	hub.Publish("end", nil)
+
+	// The stream needs a real connection to lift the write deadline
+	srv := httptest.NewServer(s.router)
+	defer srv.Close()
+
+	received := func(user string) string {
+		s.do(user, "GET", "/api/cases", "") // logs in
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/api/events", nil)
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: s.tokens[user]})
+		req.Header.Set("Last-Event-ID", "1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var slides []string
+		lines := bufio.NewScanner(resp.Body)
+		for lines.Scan() {
+			line := lines.Text()
+			switch {
+			case strings.HasPrefix(line, "data: "):
+				if strings.Contains(line, "slide-1") {
+					slides = append(slides, "slide-1")
+				} else if strings.Contains(line, "slide-2") {
+					slides = append(slides, "slide-2")
+				}
+			case line == "event: end":
+				return strings.Join(slides, ",")
+			}
+		}
+		t.Fatalf("%s: stream ended before the last event: %v", user, lines.Err())
+		return ""
+	}
+
+	if got := received("mallory"); got != "slide-2" {
+		t.Errorf("mallory received %q, want only slide-2", got)
+	}
+	if got := received("alice"); got != "slide-1,slide-2" {
+		t.Errorf("alice received %q, want both slides", got)
+	}
+}
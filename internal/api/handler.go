@@ -2,13 +2,17 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
 	"cyto-viewer/internal/config"
+	"cyto-viewer/internal/events"
+	"cyto-viewer/internal/jobs"
 	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/storage"
 	"cyto-viewer/internal/tiler"
 	"cyto-viewer/pkg/auth"
 	"cyto-viewer/pkg/logger"
@@ -17,22 +21,41 @@ import (
 )
 
 type Handler struct {
-	log         *logger.Logger
-	tiler       *tiler.GPUTileProcessor
-	scanner     *scanner.Interface
-	auth        *auth.Manager
-	config      *config.Config
+	log          *logger.Logger
+	tiler        *tiler.GPUTileProcessor
+	scanners     *scanner.Registry
+	auth         *auth.Manager
+	revisions    *storage.Revisions
+	slides       *storage.SlideCatalog
+	cases        *storage.CaseCatalog
+	tiles        *storage.TileStore
+	annotations  *storage.AnnotationStore
+	measurements *storage.MeasurementStore
+	jobs         *jobs.Queue
+	events       *events.Hub
+	config       *config.Config
 }
 
 func NewHandler(log *logger.Logger, tiler *tiler.GPUTileProcessor, 
-                scanner *scanner.Interface, auth *auth.Manager, 
-                cfg *config.Config) *Handler {
+                scanners *scanner.Registry, auth *auth.Manager, 
+                revisions *storage.Revisions, slides *storage.SlideCatalog,
+                cases *storage.CaseCatalog, tiles *storage.TileStore,
+                annotations *storage.AnnotationStore, measurements *storage.MeasurementStore,
+                jobs *jobs.Queue, events *events.Hub, cfg *config.Config) *Handler {
 	return &Handler{
-		log:     log,
-		tiler:   tiler,
-		scanner: scanner,
-		auth:    auth,
-		config:  cfg,
+		log:          log,
+		tiler:        tiler,
+		scanners:     scanners,
+		auth:         auth,
+		revisions:    revisions,
+		slides:       slides,
+		cases:        cases,
+		tiles:        tiles,
+		annotations:  annotations,
+		measurements: measurements,
+		jobs:         jobs,
+		events:       events,
+		config:       cfg,
 	}
 }
 
@@ -46,23 +69,62 @@ func (h *Handler) RegisterRoutes(r *mux.Router) {
 	// Protected routes
 	protected := api.PathPrefix("").Subrouter()
 	protected.Use(h.authMiddleware)
+	protected.Use(h.caseAccessMiddleware)
 
 	// Tile serving - the most critical endpoint
 	protected.HandleFunc("/tiles/{slideId}", h.handleGetTile).Methods("GET")
 	protected.HandleFunc("/tiles/{slideId}/batch", h.handleBatchTiles).Methods("POST")
 
-	// Slide management
+	// Slide management. Routes that change a slide or what belongs to it
+	// need edit rights on its case; the rest only read rights.
+	protected.HandleFunc("/cases", h.handleListCases).Methods("GET")
+	protected.HandleFunc("/cases", h.handleCreateCase).Methods("POST")
+	protected.HandleFunc("/cases/{caseId}", h.handleGetCase).Methods("GET")
+	protected.HandleFunc("/cases/{caseId}", h.handleUpdateCase).Methods("PUT")
+	protected.HandleFunc("/cases/{caseId}", h.handleDeleteCase).Methods("DELETE")
 	protected.HandleFunc("/slides", h.handleListSlides).Methods("GET")
 	protected.HandleFunc("/slides/{slideId}", h.handleGetSlide).Methods("GET")
-	protected.HandleFunc("/slides/{slideId}", h.handleDeleteSlide).Methods("DELETE")
+	protected.HandleFunc("/slides/{slideId}", h.requireSlideEdit(h.handleDeleteSlide)).Methods("DELETE")
+	protected.HandleFunc("/slides/{slideId}/overlays", h.handleListOverlays).Methods("GET")
+	protected.HandleFunc("/slides/{slideId}/overlays", h.requireSlideEdit(h.handleCaptureOverlay)).Methods("POST")
+	protected.HandleFunc("/slides/{slideId}/overlays/{overlayId}", h.requireSlideEdit(h.handleDeleteOverlay)).Methods("DELETE")
+	protected.HandleFunc("/slides/{slideId}/measure", h.handleMeasure).Methods("POST")
+	protected.HandleFunc("/slides/{slideId}/measurements", h.handleListMeasurements).Methods("GET")
+	protected.HandleFunc("/slides/{slideId}/measurements", h.requireSlideEdit(h.handleRecordMeasurement)).Methods("POST")
+	protected.HandleFunc("/slides/{slideId}/measurements/{measurementId}", h.handleGetMeasurement).Methods("GET")
+	protected.HandleFunc("/slides/{slideId}/summary", h.handleSlideSummary).Methods("GET")
+	protected.HandleFunc("/slides/{slideId}/annotations", h.handleListAnnotations).Methods("GET")
+	protected.HandleFunc("/slides/{slideId}/annotations", h.requireSlideEdit(h.handleCreateAnnotation)).Methods("POST")
+	protected.HandleFunc("/slides/{slideId}/annotations/geojson", h.handleExportAnnotations).Methods("GET")
+	protected.HandleFunc("/slides/{slideId}/annotations/geojson", h.requireSlideEdit(h.handleImportAnnotations)).Methods("POST")
+	protected.HandleFunc("/slides/{slideId}/annotations/{annotationId}", h.handleGetAnnotation).Methods("GET")
+	protected.HandleFunc("/slides/{slideId}/annotations/{annotationId}", h.requireSlideEdit(h.handleUpdateAnnotation)).Methods("PUT")
+	protected.HandleFunc("/slides/{slideId}/annotations/{annotationId}", h.requireSlideEdit(h.handleDeleteAnnotation)).Methods("DELETE")
+
+	// Scanner control. Routes under /scanners/{scannerId} address one
+	// scanner; /scanner routes address the default scanner, except that
+	// scans submitted there go to whichever scanner is idle first.
+	protected.HandleFunc("/scanners", h.handleListScanners).Methods("GET")
+	for _, prefix := range []string{"/scanners/{scannerId}", "/scanner"} {
+		protected.HandleFunc(prefix+"/status", h.handleScannerStatus).Methods("GET")
+		protected.HandleFunc(prefix+"/scan", h.handleStartScan).Methods("POST")
+		protected.HandleFunc(prefix+"/layers", h.handleGetLayers).Methods("GET")
+		protected.HandleFunc(prefix+"/calibrate", h.handleCalibrate).Methods("POST")
+		protected.HandleFunc(prefix+"/jobs", h.handleListJobs).Methods("GET")
+	}
+	protected.HandleFunc("/scanner/jobs/{jobId}", h.handleGetJob).Methods("GET")
+	protected.HandleFunc("/scanner/jobs/{jobId}/cancel", h.handleCancelJob).Methods("POST")
 
-	// Scanner control
-	protected.HandleFunc("/scanner/status", h.handleScannerStatus).Methods("GET")
-	protected.HandleFunc("/scanner/scan", h.handleStartScan).Methods("POST")
-	protected.HandleFunc("/scanner/layers", h.handleGetLayers).Methods("GET")
+	// Live scanner and job events
+	protected.HandleFunc("/events", h.handleEvents).Methods("GET")
 
 	// System info
 	protected.HandleFunc("/system/stats", h.handleSystemStats).Methods("GET")
+
+	// Administration
+	admin := protected.PathPrefix("/admin").Subrouter()
+	admin.Use(h.adminMiddleware)
+	admin.HandleFunc("/cache/invalidate", h.handleInvalidateCache).Methods("POST")
 }
 
 func (h *Handler) handleGetTile(w http.ResponseWriter, r *http.Request) {
@@ -74,13 +136,23 @@ func (h *Handler) handleGetTile(w http.ResponseWriter, r *http.Request) {
 	x, _ := strconv.Atoi(r.URL.Query().Get("x"))
 	y, _ := strconv.Atoi(r.URL.Query().Get("y"))
 	z, _ := strconv.Atoi(r.URL.Query().Get("z"))
-	format := r.URL.Query().Get("format")
-	if format == "" {
-		format = "webp" // Default to WebP for better compression
+
+	// The response depends on Accept, so shared caches must key on it
+	w.Header().Set("Vary", "Accept")
+	format, err := negotiateFormat(r, h.losslessOnly(r))
+	if err != nil {
+		writeFormatError(w, err)
+		return
 	}
-	quality, _ := strconv.Atoi(r.URL.Query().Get("quality"))
-	if quality == 0 {
-		quality = 85
+	quality := parseQuality(r.URL.Query().Get("quality"))
+	profile := r.URL.Query().Get("profile")
+	overlay := r.URL.Query().Get("overlay")
+	slide, slideFound := h.slides.Get(slideId)
+	size, ok := tileSize(slide, slideFound, overlay)
+	if !ok {
+		// Tiles of deleted overlays may linger in the cache
+		http.Error(w, "Overlay not found", http.StatusNotFound)
+		return
 	}
 
 	// Process tile request
@@ -90,29 +162,56 @@ func (h *Handler) handleGetTile(w http.ResponseWriter, r *http.Request) {
 		X:        x,
 		Y:        y,
 		Z:        z,
-		Width:    512,
-		Height:   512,
+		Width:    size,
+		Height:   size,
 		Format:   format,
 		Quality:  quality,
+		Profile:  profile,
+		Overlay:  overlay,
 	}
 
 	start := time.Now()
 	resp, err := h.tiler.ProcessTile(r.Context(), req)
+	if errors.Is(err, tiler.ErrUnsupportedFormat) {
+		http.Error(w, fmt.Sprintf("Tile format %q is not available on this server", format), http.StatusNotAcceptable)
+		return
+	}
+	if errors.Is(err, storage.ErrTileNotFound) {
+		// Not scanned yet, or outside the slide
+		http.Error(w, "Tile not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		h.log.Error("Failed to process tile", "error", err)
 		http.Error(w, "Failed to process tile", http.StatusInternalServerError)
 		return
 	}
 
-	// Set aggressive caching headers
+	// Warm the cache with the tiles this session is likely to request next.
+	// Overlays are small and have a single layer, so aren't prefetched.
+	if cookie, err := r.Cookie("auth_token"); err == nil && overlay == "" && slideFound {
+		h.tiler.Prefetch(cookie.Value, req, &slide)
+	}
+
+	// The revision tag changes whenever the slide or profile is invalidated.
+	// Only URLs carrying the current tag may be cached forever, and only by
+	// the browser: a slide can be restricted to a case at any time, and
+	// shared caches would go on serving its tiles to everyone.
+	revision := h.revisions.Tag(slideId, profile)
+	etag := fmt.Sprintf(`"%s@%s"`, resp.CacheKey, revision)
+
 	w.Header().Set("Content-Type", resp.ContentType)
-	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
-	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, resp.CacheKey))
+	if r.URL.Query().Get("rev") == revision {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("ETag", etag)
 	w.Header().Set("X-Processing-Time", fmt.Sprintf("%dms", time.Since(start).Milliseconds()))
 
 	// Check ETag
 	if match := r.Header.Get("If-None-Match"); match != "" {
-		if match == fmt.Sprintf(`"%s"`, resp.CacheKey) {
+		if match == etag {
 			w.WriteHeader(http.StatusNotModified)
 			return
 		}
@@ -122,19 +221,17 @@ func (h *Handler) handleGetTile(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) handleBatchTiles(w http.ResponseWriter, r *http.Request) {
-	var requests []*tiler.TileRequest
-	if err := json.NewDecoder(r.Body).Decode(&requests); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	w.Header().Set("Vary", "Accept")
+	requests, ok := h.batchRequests(w, r)
+	if !ok {
 		return
 	}
 
-	// Limit batch size to prevent abuse
-	if len(requests) > 100 {
-		http.Error(w, "Batch size too large (max 100)", http.StatusBadRequest)
+	responses, err := h.tiler.ProcessBatch(r.Context(), requests)
+	if errors.Is(err, tiler.ErrUnsupportedFormat) {
+		http.Error(w, "Requested tile format is not available on this server", http.StatusNotAcceptable)
 		return
 	}
-
-	responses, err := h.tiler.ProcessBatch(r.Context(), requests)
 	if err != nil {
 		h.log.Error("Batch processing failed", "error", err)
 		http.Error(w, "Batch processing failed", http.StatusInternalServerError)
@@ -146,17 +243,123 @@ func (h *Handler) handleBatchTiles(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(responses)
 }
 
+// batchRequests reads a batch of tile requests, filling in sizes, formats
+// and qualities, and writes an error if the batch is invalid. Every tile is
+// taken from the slide in the URL, which is the one case permissions were
+// checked against, whatever slide the body names.
+func (h *Handler) batchRequests(w http.ResponseWriter, r *http.Request) ([]*tiler.TileRequest, bool) {
+	var requests []*tiler.TileRequest
+	if err := json.NewDecoder(r.Body).Decode(&requests); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// Limit batch size to prevent abuse
+	if len(requests) > 100 {
+		http.Error(w, "Batch size too large (max 100)", http.StatusBadRequest)
+		return nil, false
+	}
+
+	slideId := mux.Vars(r)["slideId"]
+	slide, slideFound := h.slides.Get(slideId)
+
+	// Tiles without an explicit format use the one negotiated for the batch
+	losslessOnly := h.losslessOnly(r)
+	negotiated, negotiateErr := negotiateFormat(r, losslessOnly)
+	for _, req := range requests {
+		if req == nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return nil, false
+		}
+		req.SlideID = slideId
+		size, ok := tileSize(slide, slideFound, req.Overlay)
+		if !ok {
+			http.Error(w, "Overlay not found", http.StatusNotFound)
+			return nil, false
+		}
+		req.Width, req.Height = size, size
+		if req.Format == "" {
+			if negotiateErr != nil {
+				writeFormatError(w, negotiateErr)
+				return nil, false
+			}
+			req.Format = negotiated
+		} else {
+			format, err := checkFormat(req.Format, losslessOnly)
+			if err != nil {
+				writeFormatError(w, err)
+				return nil, false
+			}
+			req.Format = format
+		}
+		req.Quality = clampQuality(req.Quality)
+	}
+	return requests, true
+}
+
+// Tile size of slides that don't record one
+const defaultTileSize = 512
+
+// tileSize returns the size of a slide's tiles as stored at ingest, or of
+// an overlay's tiles if overlay is set. It reports false if the slide has
+// no such overlay.
+func tileSize(slide storage.Slide, slideFound bool, overlay string) (int, bool) {
+	size := slide.TileSize
+	if overlay != "" {
+		o, found := slide.Overlay(overlay)
+		if !slideFound || !found {
+			return 0, false
+		}
+		size = o.TileSize
+	}
+	if size <= 0 {
+		size = defaultTileSize
+	}
+	return size, true
+}
+
+const defaultTileQuality = 85
+
+// parseQuality reads the quality query parameter, clamped to 1-100
+func parseQuality(value string) int {
+	quality, _ := strconv.Atoi(value)
+	return clampQuality(quality)
+}
+
+func clampQuality(quality int) int {
+	switch {
+	case quality == 0:
+		return defaultTileQuality
+	case quality < 1:
+		return 1
+	case quality > 100:
+		return 100
+	}
+	return quality
+}
+
 func (h *Handler) handleListSlides(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement slide listing from storage
-	slides := []map[string]interface{}{
-		{
-			"id":        "slide-001",
-			"name":      "Sample Cytology Slide",
-			"created":   time.Now().Add(-24 * time.Hour),
-			"width":     102400,
-			"height":    102400,
-			"layers":    40,
-		},
+	slides := []map[string]interface{}{}
+	for _, slide := range h.slides.List() {
+		c, inCase := h.cases.ForSlide(slide.ID)
+		if inCase && !h.canReadCase(r, &c) {
+			continue
+		}
+		entry := map[string]interface{}{
+			"id":      slide.ID,
+			"name":    slide.Name,
+			"created": slide.Created,
+			"width":   slide.Width,
+			"height":  slide.Height,
+			"layers":  len(slide.Layers),
+			"status":  slide.Status,
+
+			"micronsPerPixel": micronsPerPixel(slide.MicronsPerPixel),
+		}
+		if inCase {
+			entry["caseId"] = c.ID
+		}
+		slides = append(slides, entry)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -167,16 +370,35 @@ func (h *Handler) handleGetSlide(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	slideId := vars["slideId"]
 
-	// TODO: Fetch slide metadata from storage
+	stored, ok := h.slides.Get(slideId)
+	if !ok {
+		http.Error(w, "Slide not found", http.StatusNotFound)
+		return
+	}
+
 	slide := map[string]interface{}{
-		"id":        slideId,
-		"name":      "Sample Cytology Slide",
-		"created":   time.Now().Add(-24 * time.Hour),
-		"width":     102400,
-		"height":    102400,
-		"layers":    40,
-		"tileSize":  512,
-		"format":    "webp",
+		"id":          stored.ID,
+		"name":        stored.Name,
+		"created":     stored.Created,
+		"width":       stored.Width,
+		"height":      stored.Height,
+		"layers":      len(stored.Layers),
+		"focusLayers": stored.Layers,
+		"tileSize":    stored.TileSize,
+		"levels":      stored.Levels(),
+		"format":      "webp",
+		"status":      stored.Status,
+		"jobId":       stored.JobID,
+		"scanner":     stored.Scanner,
+		"acquisition": stored.Acquisition,
+		"overlays":    overlaysOrEmpty(stored.Overlays),
+		"revision":    h.revisions.Tag(slideId, ""),
+
+		"micronsPerPixel": micronsPerPixel(stored.MicronsPerPixel),
+	}
+	if c, ok := h.cases.ForSlide(slideId); ok {
+		slide["caseId"] = c.ID
+		slide["accessionNumber"] = c.AccessionNumber
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -187,17 +409,188 @@ func (h *Handler) handleDeleteSlide(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	slideId := vars["slideId"]
 
-	// TODO: Implement slide deletion
+	if _, ok := h.slides.Get(slideId); !ok {
+		http.Error(w, "Slide not found", http.StatusNotFound)
+		return
+	}
+	if err := h.tiles.DeleteSlide(slideId); err != nil {
+		h.log.Error("Failed to delete slide tiles", "slideId", slideId, "error", err)
+		http.Error(w, "Failed to delete slide", http.StatusInternalServerError)
+		return
+	}
+	if err := h.slides.Delete(slideId); err != nil {
+		h.log.Error("Failed to remove slide from catalog", "slideId", slideId, "error", err)
+	}
+	if err := h.annotations.DeleteSlide(slideId); err != nil {
+		h.log.Error("Failed to delete slide annotations", "slideId", slideId, "error", err)
+	}
+	if err := h.measurements.DeleteSlide(slideId); err != nil {
+		h.log.Error("Failed to delete slide measurements", "slideId", slideId, "error", err)
+	}
+	if err := h.cases.RemoveSlide(slideId); err != nil {
+		h.log.Error("Failed to remove slide from its case", "slideId", slideId, "error", err)
+	}
+
+	h.tiler.Invalidate(tiler.InvalidationFilter{SlideID: slideId})
+	if _, err := h.revisions.BumpSlide(slideId); err != nil {
+		h.log.Error("Failed to bump slide revision", "slideId", slideId, "error", err)
+	}
 	h.log.Info("Slide deleted", "slideId", slideId)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (h *Handler) handleScannerStatus(w http.ResponseWriter, r *http.Request) {
-	status, err := h.scanner.GetStatus()
+func (h *Handler) handleListOverlays(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.slides.Get(mux.Vars(r)["slideId"])
+	if !ok {
+		http.Error(w, "Slide not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(overlaysOrEmpty(slide.Overlays))
+}
+
+// handleCaptureOverlay re-captures a region of a slide at another focus
+// layer (or depth) and objective, and stores it as an overlay whose tiles
+// are served with the tile API's overlay parameter
+func (h *Handler) handleCaptureOverlay(w http.ResponseWriter, r *http.Request) {
+	slideId := mux.Vars(r)["slideId"]
+
+	var body struct {
+		X         int      `json:"x"`
+		Y         int      `json:"y"`
+		Width     int      `json:"width"`
+		Height    int      `json:"height"`
+		Layer     *int     `json:"layer"`
+		Depth     *float64 `json:"depth"` // micrometres
+		Objective int      `json:"objective"`
+	}
+	if !decodeRequest(w, r, &body) {
+		return
+	}
+	if (body.Layer == nil) == (body.Depth == nil) {
+		writeViolations(w, []scanner.Violation{{Field: "layer", Message: "exactly one of layer or depth is required"}})
+		return
+	}
+
+	req := &scanner.CaptureRequest{
+		X:         body.X,
+		Y:         body.Y,
+		Width:     body.Width,
+		Height:    body.Height,
+		Depth:     body.Depth,
+		Objective: body.Objective,
+	}
+	if body.Layer != nil {
+		req.Layer = *body.Layer
+	}
+
+	overlay, err := h.jobs.Capture(r.Context(), slideId, req, h.currentUser(r))
+	if errors.Is(err, jobs.ErrSlideNotFound) {
+		http.Error(w, "Slide not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, jobs.ErrUnknownScanner) {
+		http.Error(w, "The slide's scanner is not configured", http.StatusConflict)
+		return
+	}
+	if writeValidationError(w, err) {
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to get scanner status", http.StatusInternalServerError)
+		h.log.Error("Region capture failed", "slideId", slideId, "error", err)
+		http.Error(w, fmt.Sprintf("Capture failed: %v", err), scannerErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/api/slides/%s/overlays/%s", slideId, overlay.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(overlay)
+}
+
+func (h *Handler) handleDeleteOverlay(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := h.jobs.DeleteOverlay(vars["slideId"], vars["overlayId"])
+	switch {
+	case errors.Is(err, jobs.ErrSlideNotFound):
+		http.Error(w, "Slide not found", http.StatusNotFound)
+		return
+	case errors.Is(err, jobs.ErrOverlayNotFound):
+		http.Error(w, "Overlay not found", http.StatusNotFound)
 		return
+	case err != nil:
+		h.log.Error("Failed to delete overlay tiles", "overlayId", vars["overlayId"], "error", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func overlaysOrEmpty(overlays []storage.Overlay) []storage.Overlay {
+	if overlays == nil {
+		return []storage.Overlay{}
+	}
+	return overlays
+}
+
+// scannerFor returns the scanner a request addresses: {scannerId} if the
+// route has one, otherwise the default scanner. It writes a 404 for an
+// unknown ID.
+func (h *Handler) scannerFor(w http.ResponseWriter, r *http.Request) (*scanner.Interface, bool) {
+	id, scoped := mux.Vars(r)["scannerId"]
+	if !scoped {
+		return h.scanners.Default(), true
+	}
+
+	sc, ok := h.scanners.Get(id)
+	if !ok {
+		http.Error(w, "Scanner not found", http.StatusNotFound)
+	}
+	return sc, ok
+}
+
+func (h *Handler) handleListScanners(w http.ResponseWriter, r *http.Request) {
+	scanners := make([]map[string]interface{}, 0)
+	for _, sc := range h.scanners.List() {
+		state := sc.State()
+		scanners = append(scanners, map[string]interface{}{
+			"id":         sc.ID(),
+			"name":       sc.Name(),
+			"state":      state.State,
+			"since":      state.Since,
+			"calibrated": state.Calibrated,
+			"identity":   sc.Device(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scanners)
+}
+
+func (h *Handler) handleScannerStatus(w http.ResponseWriter, r *http.Request) {
+	sc, ok := h.scannerFor(w, r)
+	if !ok {
+		return
+	}
+
+	connection := sc.State()
+	status := map[string]interface{}{
+		"id":         sc.ID(),
+		"name":       sc.Name(),
+		"connection": connection,
+		"identity":   sc.Device(), // as of the last connection
+	}
+
+	// Device readings are only available while the scanner is idle
+	if connection.State == scanner.StateReady {
+		device, err := sc.GetStatus()
+		if err != nil {
+			status["device_error"] = err.Error()
+		} else {
+			status["device"] = device
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -206,39 +599,219 @@ func (h *Handler) handleScannerStatus(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) handleStartScan(w http.ResponseWriter, r *http.Request) {
 	var req scanner.ScanRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	result, err := h.scanner.StartScan(r.Context(), &req)
+	// Scans outlast any HTTP timeout, so they run as queued jobs. Unless
+	// the route names a scanner, the first idle scanner takes the job.
+	scannerID := mux.Vars(r)["scannerId"]
+	if scannerID != "" {
+		if _, ok := h.scannerFor(w, r); !ok {
+			return
+		}
+	}
+
+	job, err := h.jobs.Submit(req, scannerID, h.currentUser(r))
+	if writeValidationError(w, err) {
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Scan failed: %v", err), http.StatusInternalServerError)
+		h.log.Error("Failed to submit scan job", "error", err)
+		http.Error(w, "Failed to queue scan", http.StatusInternalServerError)
 		return
 	}
+	h.log.Info("Scan job queued", "job", job.ID, "slide", job.SlideID)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	w.Header().Set("Location", "/api/scanner/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// handleCalibrate calibrates a scanner. The request waits for the scanner
+// to finish, which is bounded by its scan timeout.
+func (h *Handler) handleCalibrate(w http.ResponseWriter, r *http.Request) {
+	sc, ok := h.scannerFor(w, r)
+	if !ok {
+		return
+	}
+
+	// Calibration can outlast the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	if err := sc.Calibrate(r.Context()); err != nil {
+		h.log.Error("Calibration failed", "scanner", sc.ID(), "error", err)
+		http.Error(w, fmt.Sprintf("Calibration failed: %v", err), scannerErrorStatus(err))
+		return
+	}
+	h.log.Info("Scanner calibrated", "scanner", sc.ID())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sc.State())
+}
+
+func (h *Handler) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	jobList := h.jobs.List()
+
+	// Scoped to one scanner: the jobs pinned to it or that it ran
+	if id, scoped := mux.Vars(r)["scannerId"]; scoped {
+		if _, ok := h.scannerFor(w, r); !ok {
+			return
+		}
+		filtered := make([]jobs.Job, 0)
+		for _, job := range jobList {
+			if job.Scanner == id || job.Assigned == id {
+				filtered = append(filtered, job)
+			}
+		}
+		jobList = filtered
+	}
+
+	// Jobs scanning slides of cases the user can't see are left out
+	visible := make([]jobs.Job, 0, len(jobList))
+	for _, job := range jobList {
+		if h.canReadSlide(r, job.SlideID) {
+			visible = append(visible, job)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visible)
+}
+
+// requestJob returns the job a request addresses, writing a 404 if it
+// doesn't exist or scans a slide the user may not see
+func (h *Handler) requestJob(w http.ResponseWriter, r *http.Request) (jobs.Job, bool) {
+	job, ok := h.jobs.Get(mux.Vars(r)["jobId"])
+	if !ok || !h.canReadSlide(r, job.SlideID) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return jobs.Job{}, false
+	}
+	return job, true
+}
+
+func (h *Handler) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.requestJob(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+func (h *Handler) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.requestJob(w, r)
+	if !ok {
+		return
+	}
+	if !h.canEditSlide(r, job.SlideID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	job, err := h.jobs.Cancel(job.ID)
+	switch {
+	case errors.Is(err, jobs.ErrJobNotFound):
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	case errors.Is(err, jobs.ErrJobFinished):
+		http.Error(w, fmt.Sprintf("Job already %s", job.Status), http.StatusConflict)
+		return
+	case err != nil:
+		h.log.Error("Failed to cancel job", "job", job.ID, "error", err)
+		http.Error(w, "Failed to cancel job", http.StatusInternalServerError)
+		return
+	}
+	h.log.Info("Scan job cancelled", "job", job.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// decodeRequest decodes a JSON request body, answering a structured 400 if
+// it can't
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+
+	violation := scanner.Violation{Field: "body", Message: err.Error()}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		violation = scanner.Violation{Field: typeErr.Field, Message: "must be " + typeErr.Type.String()}
+	}
+	writeViolations(w, []scanner.Violation{violation})
+	return false
+}
+
+// writeValidationError answers a structured 400 if err is a
+// *scanner.ValidationError, and reports whether it did
+func writeValidationError(w http.ResponseWriter, err error) bool {
+	var invalid *scanner.ValidationError
+	if !errors.As(err, &invalid) {
+		return false
+	}
+	writeViolations(w, invalid.Violations)
+	return true
+}
+
+// writeViolations answers 400 listing every problem found in a request
+func writeViolations(w http.ResponseWriter, violations []scanner.Violation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      "Invalid request",
+		"violations": violations,
+	})
+}
+
+// scannerErrorStatus maps scanner errors to HTTP status codes
+func scannerErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, scanner.ErrNotConnected), errors.Is(err, scanner.ErrConnectionBroken),
+		errors.Is(err, scanner.ErrDisconnected):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, scanner.ErrScannerBusy):
+		return http.StatusConflict
+	case errors.Is(err, scanner.ErrInvalidArgument):
+		return http.StatusBadRequest
+	case errors.Is(err, scanner.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, scanner.ErrMalformedResponse):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
 }
 
 func (h *Handler) handleGetLayers(w http.ResponseWriter, r *http.Request) {
-	layers := h.scanner.GetLayerInfo()
+	sc, ok := h.scannerFor(w, r)
+	if !ok {
+		return
+	}
+	layers := sc.GetLayerInfo()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(layers)
 }
 
 func (h *Handler) handleSystemStats(w http.ResponseWriter, r *http.Request) {
-	hits, misses, cacheSize, tileCount := h.tiler.(*tiler.GPUTileProcessor).TileCache.Stats()
+	memory, disk := h.tiler.CacheStats()
+
+	cache := map[string]interface{}{
+		"memory": tierStats(memory),
+	}
+	if disk != nil {
+		cache["disk"] = tierStats(*disk)
+	}
 
 	stats := map[string]interface{}{
-		"cache": map[string]interface{}{
-			"hits":    hits,
-			"misses":  misses,
-			"hitRate": float64(hits) / float64(hits+misses),
-			"size":    cacheSize,
-			"tiles":   tileCount,
-		},
+		"cache":  cache,
+		"encode": h.tiler.EncodeMetrics(),
 		"uptime": time.Since(h.config.StartTime).String(),
 	}
 
@@ -246,6 +819,77 @@ func (h *Handler) handleSystemStats(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(stats)
 }
 
+func tierStats(s tiler.TierStats) map[string]interface{} {
+	return map[string]interface{}{
+		"hits":    s.Hits,
+		"misses":  s.Misses,
+		"hitRate": s.HitRate(),
+		"size":    s.Size,
+		"maxSize": s.MaxSize,
+		"tiles":   s.Tiles,
+	}
+}
+
+func (h *Handler) handleInvalidateCache(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		SlideID string  `json:"slideId"`
+		Layer   *int    `json:"layer"`
+		Profile *string `json:"profile"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	// Refuse to silently turn a typo into a full cache wipe
+	if req.SlideID == "" && req.Layer == nil && req.Profile == nil {
+		http.Error(w, "At least one of slideId, layer or profile is required", http.StatusBadRequest)
+		return
+	}
+	if req.Layer != nil && req.SlideID == "" {
+		http.Error(w, "layer requires slideId", http.StatusBadRequest)
+		return
+	}
+
+	removed := h.tiler.Invalidate(tiler.InvalidationFilter{
+		SlideID: req.SlideID,
+		Layer:   req.Layer,
+		Profile: req.Profile,
+	})
+
+	// Bump revisions so browsers stop using their immutable copies
+	var err error
+	switch {
+	case req.SlideID != "" && req.Profile != nil:
+		_, err = h.revisions.BumpSlideProfile(req.SlideID, *req.Profile)
+	case req.SlideID != "":
+		_, err = h.revisions.BumpSlide(req.SlideID)
+	default:
+		_, err = h.revisions.BumpProfile(*req.Profile)
+	}
+	if err != nil {
+		h.log.Error("Failed to bump revision", "error", err)
+		http.Error(w, "Failed to update revision", http.StatusInternalServerError)
+		return
+	}
+
+	h.log.Info("Tile cache invalidated", "slideId", req.SlideID, "removed", removed)
+
+	result := map[string]interface{}{
+		"removed": removed,
+	}
+	if req.SlideID != "" {
+		profile := ""
+		if req.Profile != nil {
+			profile = *req.Profile
+		}
+		result["revision"] = h.revisions.Tag(req.SlideID, profile)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
 func (h *Handler) handleLogin(w http.ResponseWriter, r *http.Request) {
 	var credentials struct {
 		Username string `json:"username"`
@@ -308,3 +952,36 @@ func (h *Handler) authMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// currentUser returns the username of the authenticated session, if any
+func (h *Handler) currentUser(r *http.Request) string {
+	cookie, err := r.Cookie("auth_token")
+	if err != nil {
+		return ""
+	}
+	username, _ := h.auth.Username(cookie.Value)
+	return username
+}
+
+// losslessOnly reports whether the client may only receive lossless tiles
+func (h *Handler) losslessOnly(r *http.Request) bool {
+	return h.auth.LosslessOnly(h.currentUser(r))
+}
+
+func (h *Handler) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("auth_token")
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		username, ok := h.auth.Username(cookie.Value)
+		if !ok || !h.auth.IsAdmin(username) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
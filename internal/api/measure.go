@@ -0,0 +1,296 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+
+	"cyto-viewer/internal/geometry"
+	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// micronsPerPixel returns a slide's pixel size for JSON, null when unknown
+func micronsPerPixel(mpp float64) *float64 {
+	if mpp <= 0 {
+		return nil
+	}
+	return &mpp
+}
+
+// handleMeasure measures a shape drawn on a slide, in level 0 pixels. The
+// physical length and area are null if the slide's pixel size is unknown.
+func (h *Handler) handleMeasure(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.slides.Get(mux.Vars(r)["slideId"])
+	if !ok {
+		http.Error(w, "Slide not found", http.StatusNotFound)
+		return
+	}
+
+	var shape geometry.Geometry
+	if !decodeRequest(w, r, &shape) {
+		return
+	}
+	if err := shape.Validate(); err != nil {
+		writeViolations(w, []scanner.Violation{{Field: "points", Message: err.Error()}})
+		return
+	}
+
+	measurement := shape.Measure(slide.MicronsPerPixel)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":        shape.Type,
+		"bounds":      shape.Bounds(),
+		"measurement": measurement,
+	})
+}
+
+// measurementRequest records a measurement of either a shape or an existing
+// annotation. Label and layer default to the annotation's.
+type measurementRequest struct {
+	Geometry     *geometry.Geometry `json:"geometry"`
+	AnnotationID string             `json:"annotationId"`
+	Label        *string            `json:"label"`
+	Layer        *int               `json:"layer"`
+}
+
+func (req *measurementRequest) validate() []scanner.Violation {
+	var violations []scanner.Violation
+	switch {
+	case req.Geometry == nil && req.AnnotationID == "":
+		violations = append(violations, scanner.Violation{Field: "geometry", Message: "geometry or annotationId is required"})
+	case req.Geometry != nil && req.AnnotationID != "":
+		violations = append(violations, scanner.Violation{Field: "geometry", Message: "must be omitted when annotationId is set"})
+	case req.Geometry != nil:
+		if err := req.Geometry.Validate(); err != nil {
+			violations = append(violations, scanner.Violation{Field: "geometry", Message: err.Error()})
+		}
+	}
+	if req.Label != nil && utf8.RuneCountInString(*req.Label) > maxLabelLength {
+		violations = append(violations, scanner.Violation{Field: "label",
+			Message: fmt.Sprintf("must be at most %d characters", maxLabelLength)})
+	}
+	if req.Layer != nil && *req.Layer < 0 {
+		violations = append(violations, scanner.Violation{Field: "layer", Message: "must not be negative"})
+	}
+	return violations
+}
+
+// handleListMeasurements lists a slide's recorded measurements, oldest
+// first, optionally only those with a label, on a focus layer or of an
+// annotation
+func (h *Handler) handleListMeasurements(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.annotationSlide(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := storage.MeasurementFilter{Label: query.Get("label"), AnnotationID: query.Get("annotationId")}
+	if value := query.Get("layer"); value != "" {
+		layer, err := strconv.Atoi(value)
+		if err != nil || layer < 0 {
+			writeViolations(w, []scanner.Violation{{Field: "layer", Message: "must be a focus layer index"}})
+			return
+		}
+		filter.Layer = &layer
+	}
+
+	measurements, err := h.measurements.List(slide.ID, filter)
+	if err != nil {
+		h.log.Error("Failed to list measurements", "slideId", slide.ID, "error", err)
+		http.Error(w, "Failed to list measurements", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(measurements)
+}
+
+func (h *Handler) handleGetMeasurement(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.annotationSlide(w, r)
+	if !ok {
+		return
+	}
+
+	m, err := h.measurements.Get(slide.ID, mux.Vars(r)["measurementId"])
+	if errors.Is(err, storage.ErrMeasurementNotFound) {
+		http.Error(w, "Measurement not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.log.Error("Failed to read measurement", "slideId", slide.ID, "error", err)
+		http.Error(w, "Failed to read measurement", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// handleRecordMeasurement measures a shape or annotation with the slide's
+// current calibration and records the result, with the focus layer and
+// user, so it can be audited and reported on later
+func (h *Handler) handleRecordMeasurement(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.annotationSlide(w, r)
+	if !ok {
+		return
+	}
+
+	var req measurementRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if violations := req.validate(); len(violations) > 0 {
+		writeViolations(w, violations)
+		return
+	}
+
+	var m storage.Measurement
+	if req.AnnotationID != "" {
+		a, err := h.annotations.Get(slide.ID, req.AnnotationID)
+		if errors.Is(err, storage.ErrAnnotationNotFound) {
+			writeViolations(w, []scanner.Violation{{Field: "annotationId", Message: "annotation not found on this slide"}})
+			return
+		}
+		if err != nil {
+			h.log.Error("Failed to read annotation", "slideId", slide.ID, "error", err)
+			http.Error(w, "Failed to read annotation", http.StatusInternalServerError)
+			return
+		}
+		m = storage.Measurement{AnnotationID: a.ID, Geometry: a.Geometry, Label: a.Label, Layer: a.Layer}
+	} else {
+		m.Geometry = *req.Geometry
+	}
+	if req.Label != nil {
+		m.Label = *req.Label
+	}
+	if req.Layer != nil {
+		m.Layer = req.Layer
+	}
+	m.Result = m.Geometry.Measure(slide.MicronsPerPixel)
+	m.User = h.currentUser(r)
+
+	m, err := h.measurements.Add(slide.ID, m)
+	if err != nil {
+		h.log.Error("Failed to record measurement", "slideId", slide.ID, "error", err)
+		http.Error(w, "Failed to record measurement", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/api/slides/%s/measurements/%s", slide.ID, m.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
+
+// labelSummary totals a slide's annotations and measurements with one
+// label. Cells are point annotations. The um totals are null unless every
+// measurement counted was calibrated.
+type labelSummary struct {
+	Label        *string  `json:"label,omitempty"`
+	Annotations  int      `json:"annotations"`
+	Cells        int      `json:"cells"`
+	Measurements int      `json:"measurements"`
+	LengthPx     float64  `json:"lengthPx"`
+	AreaPx       float64  `json:"areaPx"`
+	LengthUm     *float64 `json:"lengthUm"`
+	AreaUm2      *float64 `json:"areaUm2"`
+
+	uncalibrated bool
+}
+
+func (s *labelSummary) addAnnotation(a *storage.Annotation) {
+	s.Annotations++
+	if a.Geometry.Type == geometry.TypePoint {
+		s.Cells++
+	}
+}
+
+func (s *labelSummary) addMeasurement(m *storage.Measurement) {
+	s.Measurements++
+	s.LengthPx += m.Result.Length
+	s.AreaPx += m.Result.Area
+	if m.Result.LengthMicrons == nil || m.Result.AreaMicrons == nil {
+		s.uncalibrated = true
+		return
+	}
+	if s.LengthUm == nil {
+		s.LengthUm, s.AreaUm2 = new(float64), new(float64)
+	}
+	*s.LengthUm += *m.Result.LengthMicrons
+	*s.AreaUm2 += *m.Result.AreaMicrons
+}
+
+func (s *labelSummary) finish() {
+	switch {
+	case s.uncalibrated:
+		s.LengthUm, s.AreaUm2 = nil, nil
+	case s.Measurements == 0:
+		s.LengthUm, s.AreaUm2 = new(float64), new(float64)
+	}
+}
+
+// handleSlideSummary reports a slide's annotation counts and measured
+// lengths and areas per label, unlabelled ones under "", for reporting
+func (h *Handler) handleSlideSummary(w http.ResponseWriter, r *http.Request) {
+	slide, ok := h.annotationSlide(w, r)
+	if !ok {
+		return
+	}
+
+	annotations, err := h.annotations.List(slide.ID, storage.AnnotationFilter{})
+	if err != nil {
+		h.log.Error("Failed to list annotations", "slideId", slide.ID, "error", err)
+		http.Error(w, "Failed to summarize slide", http.StatusInternalServerError)
+		return
+	}
+	measurements, err := h.measurements.List(slide.ID, storage.MeasurementFilter{})
+	if err != nil {
+		h.log.Error("Failed to list measurements", "slideId", slide.ID, "error", err)
+		http.Error(w, "Failed to summarize slide", http.StatusInternalServerError)
+		return
+	}
+
+	var total labelSummary
+	byLabel := make(map[string]*labelSummary)
+	summary := func(label string) *labelSummary {
+		s, ok := byLabel[label]
+		if !ok {
+			label := label
+			s = &labelSummary{Label: &label}
+			byLabel[label] = s
+		}
+		return s
+	}
+	for i := range annotations {
+		summary(annotations[i].Label).addAnnotation(&annotations[i])
+		total.addAnnotation(&annotations[i])
+	}
+	for i := range measurements {
+		summary(measurements[i].Label).addMeasurement(&measurements[i])
+		total.addMeasurement(&measurements[i])
+	}
+
+	labels := make([]*labelSummary, 0, len(byLabel))
+	for _, s := range byLabel {
+		s.finish()
+		labels = append(labels, s)
+	}
+	sort.Slice(labels, func(i, j int) bool { return *labels[i].Label < *labels[j].Label })
+	total.finish()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"slideId":         slide.ID,
+		"micronsPerPixel": micronsPerPixel(slide.MicronsPerPixel),
+		"labels":          labels,
+		"total":           total,
+	})
+}
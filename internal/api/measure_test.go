@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"cyto-viewer/internal/storage"
+)
+
+func TestRecordMeasurement(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.h.slides.Update("slide-1", func(sl *storage.Slide) { sl.MicronsPerPixel = 0.5 }); err != nil {
+		t.Fatal(err)
+	}
+
+	w := s.do("alice", "POST", "/api/slides/slide-1/annotations",
+		`{"geometry": {"type": "rectangle", "points": [[0, 0], [10, 20]]}, "label": "nucleus", "layer": 2}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create annotation: %d %s", w.Code, w.Body.String())
+	}
+	var annotation storage.Annotation
+	json.NewDecoder(w.Body).Decode(&annotation)
+
+	relayered := 4
+	tests := []struct {
+		name      string
+		body      string
+		wantLabel string
+		wantLayer *int
+	}{
+		{"annotation", `{"annotationId": "` + annotation.ID + `"}`, "nucleus", annotation.Layer},
+		{"annotation relabelled", `{"annotationId": "` + annotation.ID + `", "label": "cell", "layer": 4}`, "cell", &relayered},
+		{"shape", `{"geometry": {"type": "rectangle", "points": [[0, 0], [10, 20]]}}`, "", nil},
+	}
+	for _, tt := range tests {
+		w := s.do("bob", "POST", "/api/slides/slide-1/measurements", tt.body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: %d %s", tt.name, w.Code, w.Body.String())
+		}
+		var m storage.Measurement
+		json.NewDecoder(w.Body).Decode(&m)
+
+		if m.User != "bob" || m.Label != tt.wantLabel || (m.Layer == nil) != (tt.wantLayer == nil) ||
+			(m.Layer != nil && *m.Layer != *tt.wantLayer) {
+			t.Errorf("%s: recorded %+v", tt.name, m)
+		}
+		if m.Result.Area != 200 || m.Result.AreaMicrons == nil || *m.Result.AreaMicrons != 50 {
+			t.Errorf("%s: result %+v, want 200 px² and 50 µm² at the slide's calibration", tt.name, m.Result)
+		}
+		if w := s.do("bob", "GET", w.Header().Get("Location"), ""); w.Code != http.StatusOK {
+			t.Errorf("%s: get recorded measurement: %d", tt.name, w.Code)
+		}
+	}
+
+	bad := []string{
+		`{}`,
+		`{"annotationId": "ann_missing"}`,
+		`{"annotationId": "` + annotation.ID + `", "geometry": {"type": "point", "points": [[1, 1]]}}`,
+		`{"geometry": {"type": "point", "points": [[1, 1]]}, "layer": -1}`,
+	}
+	for _, body := range bad {
+		if w := s.do("bob", "POST", "/api/slides/slide-1/measurements", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestSlideSummary(t *testing.T) {
+	s := newTestServer(t)
+	for _, body := range []string{
+		`{"geometry": {"type": "point", "points": [[1, 1]]}, "label": "HSIL"}`,
+		`{"geometry": {"type": "point", "points": [[2, 2]]}, "label": "HSIL"}`,
+		`{"geometry": {"type": "polyline", "points": [[0, 0], [3, 4]]}}`,
+	} {
+		if w := s.do("alice", "POST", "/api/slides/slide-1/annotations", body); w.Code != http.StatusCreated {
+			t.Fatalf("create annotation: %d %s", w.Code, w.Body.String())
+		}
+	}
+	if w := s.do("alice", "POST", "/api/slides/slide-1/measurements",
+		`{"geometry": {"type": "polyline", "points": [[0, 0], [3, 4]]}, "label": "HSIL"}`); w.Code != http.StatusCreated {
+		t.Fatalf("record measurement: %d %s", w.Code, w.Body.String())
+	}
+
+	w := s.do("alice", "GET", "/api/slides/slide-1/summary", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("summary: %d %s", w.Code, w.Body.String())
+	}
+	var summary struct {
+		MicronsPerPixel *float64       `json:"micronsPerPixel"`
+		Labels          []labelSummary `json:"labels"`
+		Total           labelSummary   `json:"total"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.MicronsPerPixel != nil || len(summary.Labels) != 2 {
+		t.Fatalf("summary %+v, want an uncalibrated slide with two labels", summary)
+	}
+	unlabelled, hsil := summary.Labels[0], summary.Labels[1]
+	if *unlabelled.Label != "" || unlabelled.Annotations != 1 || unlabelled.Cells != 0 || unlabelled.Measurements != 0 {
+		t.Errorf("unlabelled %+v", unlabelled)
+	}
+	if unlabelled.LengthUm == nil || *unlabelled.LengthUm != 0 {
+		t.Errorf("unlabelled length %v, want 0 with nothing measured", unlabelled.LengthUm)
+	}
+	if *hsil.Label != "HSIL" || hsil.Annotations != 2 || hsil.Cells != 2 || hsil.Measurements != 1 || hsil.LengthPx != 5 {
+		t.Errorf("HSIL %+v", hsil)
+	}
+	if hsil.LengthUm != nil || summary.Total.LengthUm != nil {
+		t.Error("uncalibrated measurements were totalled in microns")
+	}
+	if summary.Total.Annotations != 3 || summary.Total.Cells != 2 || summary.Total.Measurements != 1 {
+		t.Errorf("total %+v", summary.Total)
+	}
+}
@@ -0,0 +1,210 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cyto-viewer/internal/tiler"
+)
+
+// Default formats served to clients that accept any image type
+const (
+	defaultTileFormat     = "webp"
+	defaultLosslessFormat = "png"
+)
+
+type tileFormat struct {
+	name      string
+	mediaType string
+}
+
+// tileFormats lists the lossy formats we can negotiate, in server preference order
+var tileFormats = []tileFormat{
+	{"avif", "image/avif"},
+	{"webp", "image/webp"},
+	{"jpeg", "image/jpeg"},
+}
+
+// losslessFormats lists the lossless formats, in server preference order.
+// They are only negotiated for lossless-only clients; others must ask for
+// them explicitly with the format parameter.
+var losslessFormats = []tileFormat{
+	{"jxl", "image/jxl"},
+	{"webp-lossless", "image/webp"},
+	{"png", "image/png"},
+}
+
+// formatError is returned when no acceptable tile format exists
+type formatError struct {
+	status int
+	msg    string
+}
+
+func (e *formatError) Error() string { return e.msg }
+
+// negotiateFormat picks the tile format for a request. An explicit format
+// query parameter wins; otherwise the Accept header is matched against the
+// formats this build can encode, preferring AVIF > WebP > JPEG at equal
+// q-values. Wildcard-only Accept headers (fetch() sends */*) get the default.
+// Lossless-only clients negotiate among JPEG-XL > lossless WebP > PNG instead.
+func negotiateFormat(r *http.Request, losslessOnly bool) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return checkFormat(format, losslessOnly)
+	}
+
+	formats, fallback := tileFormats, defaultTileFormat
+	if losslessOnly {
+		formats, fallback = losslessFormats, defaultLosslessFormat
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return fallback, nil
+	}
+
+	best, bestQ := "", 0.0
+	wildcardQ := 0.0
+	refused := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, q := parseAcceptPart(part)
+		if q <= 0 {
+			refused[mediaType] = true // q=0 means "not acceptable"
+			continue
+		}
+		switch mediaType {
+		case "*/*", "image/*":
+			if q > wildcardQ {
+				wildcardQ = q
+			}
+			continue
+		}
+
+		for _, f := range formats {
+			if f.mediaType != mediaType || !tiler.FormatSupported(f.name) {
+				continue
+			}
+			if q > bestQ || (q == bestQ && preferred(formats, f.name, best)) {
+				best, bestQ = f.name, q
+			}
+		}
+	}
+
+	if best != "" && bestQ >= wildcardQ {
+		return best, nil
+	}
+	if wildcardQ > 0 {
+		if format := wildcardFormat(formats, fallback, refused); format != "" {
+			return format, nil
+		}
+	}
+	if best != "" {
+		return best, nil
+	}
+
+	return "", &formatError{
+		status: http.StatusNotAcceptable,
+		msg:    "No acceptable tile format (supported: " + strings.Join(supportedMediaTypes(formats), ", ") + ")",
+	}
+}
+
+// wildcardFormat picks the format for a wildcard match: the default unless the
+// client refused it, then the remaining formats in preference order
+func wildcardFormat(formats []tileFormat, fallback string, refused map[string]bool) string {
+	for _, f := range formats {
+		if f.name == fallback && !refused[f.mediaType] {
+			return f.name
+		}
+	}
+	for _, f := range formats {
+		if tiler.FormatSupported(f.name) && !refused[f.mediaType] {
+			return f.name
+		}
+	}
+	return ""
+}
+
+// checkFormat validates an explicitly requested format
+func checkFormat(format string, losslessOnly bool) (string, error) {
+	format = strings.ToLower(format)
+	if format == "jpg" {
+		format = "jpeg"
+	}
+
+	for _, f := range append(tileFormats, losslessFormats...) {
+		if f.name != format {
+			continue
+		}
+		if losslessOnly && !tiler.FormatLossless(format) {
+			return "", &formatError{
+				status: http.StatusNotAcceptable,
+				msg:    fmt.Sprintf("Tile format %q is lossy; this client may only request png, webp-lossless or jxl", format),
+			}
+		}
+		if !tiler.FormatSupported(format) {
+			return "", &formatError{
+				status: http.StatusNotAcceptable,
+				msg:    fmt.Sprintf("Tile format %q is not available on this server", format),
+			}
+		}
+		return format, nil
+	}
+
+	return "", &formatError{
+		status: http.StatusBadRequest,
+		msg:    fmt.Sprintf("Unknown tile format %q", format),
+	}
+}
+
+// parseAcceptPart splits "image/webp;q=0.9" into its media type and q-value
+func parseAcceptPart(part string) (string, float64) {
+	params := strings.Split(part, ";")
+	mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+	q := 1.0
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "q=") {
+			if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+				q = v
+			}
+		}
+	}
+	return mediaType, q
+}
+
+// preferred reports whether format a ranks above b in server preference
+func preferred(formats []tileFormat, a, b string) bool {
+	if b == "" {
+		return true
+	}
+	for _, f := range formats {
+		switch f.name {
+		case a:
+			return true
+		case b:
+			return false
+		}
+	}
+	return false
+}
+
+func supportedMediaTypes(formats []tileFormat) []string {
+	var types []string
+	for _, f := range formats {
+		if tiler.FormatSupported(f.name) {
+			types = append(types, f.mediaType)
+		}
+	}
+	return types
+}
+
+// writeFormatError reports a negotiation failure with the right status code
+func writeFormatError(w http.ResponseWriter, err error) {
+	if fe, ok := err.(*formatError); ok {
+		http.Error(w, fe.msg, fe.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
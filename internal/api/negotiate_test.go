@@ -0,0 +1,212 @@
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cyto-viewer/internal/config"
+	"cyto-viewer/internal/storage"
+	"cyto-viewer/internal/tiler"
+
+	"github.com/gorilla/mux"
+)
+
+// ifSupported returns format if this build can encode it, else fallback
+func ifSupported(format, fallback string) string {
+	if tiler.FormatSupported(format) {
+		return format
+	}
+	return fallback
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	// Encoders behind build tags; empty if this build lacks them
+	avif, jxl := ifSupported("avif", ""), ifSupported("jxl", "")
+
+	tests := []struct {
+		name         string
+		query        string
+		accept       string
+		losslessOnly bool
+		want         string
+		wantStatus   int
+	}{
+		{name: "no Accept", want: "webp"},
+		{name: "single type", accept: "image/jpeg", want: "jpeg"},
+		{name: "server preference at equal q", accept: "image/jpeg, image/webp", want: "webp"},
+		{name: "avif preferred when built", accept: "image/avif, image/webp", want: ifSupported("avif", "webp")},
+		{name: "higher q wins", accept: "image/webp;q=0.5, image/jpeg;q=0.9", want: "jpeg"},
+		{name: "q without spaces", accept: "image/webp;q=0.5,image/jpeg", want: "jpeg"},
+		{name: "media types are case-insensitive", accept: "Image/JPEG", want: "jpeg"},
+		{name: "any type", accept: "*/*", want: "webp"},
+		{name: "any image", accept: "image/*", want: "webp"},
+		{name: "browser image Accept", accept: "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", want: ifSupported("avif", "webp")},
+		{name: "wildcard above explicit type", accept: "image/jpeg;q=0.5, */*", want: "webp"},
+		{name: "explicit type above wildcard", accept: "image/jpeg, */*;q=0.1", want: "jpeg"},
+		{name: "wildcard skips refused default", accept: "image/*, image/webp;q=0", want: ifSupported("avif", "jpeg")},
+		{name: "refused type", accept: "image/webp;q=0", wantStatus: http.StatusNotAcceptable},
+		{name: "everything refused", accept: "image/webp;q=0, */*;q=0", wantStatus: http.StatusNotAcceptable},
+		{name: "no image type", accept: "text/html", wantStatus: http.StatusNotAcceptable},
+		{name: "lossless not negotiated", accept: "image/png", wantStatus: http.StatusNotAcceptable},
+
+		{name: "format overrides Accept", query: "format=png", accept: "image/jpeg", want: "png"},
+		{name: "format alias", query: "format=JPG", want: "jpeg"},
+		{name: "format ignores refusal", query: "format=webp", accept: "image/webp;q=0", want: "webp"},
+		{name: "unknown format", query: "format=gif", wantStatus: http.StatusBadRequest},
+		{name: "format not built", query: "format=avif", want: avif, wantStatus: statusIf(avif == "", http.StatusNotAcceptable)},
+
+		{name: "lossless default", losslessOnly: true, want: "png"},
+		{name: "lossless any type", accept: "*/*", losslessOnly: true, want: "png"},
+		{name: "lossless webp", accept: "image/webp", losslessOnly: true, want: "webp-lossless"},
+		{name: "lossless preference", accept: "image/jxl, image/webp, image/png", losslessOnly: true, want: ifSupported("jxl", "webp-lossless")},
+		{name: "lossless refuses jpeg", accept: "image/jpeg", losslessOnly: true, wantStatus: http.StatusNotAcceptable},
+		{name: "lossless wildcard skips refused png", accept: "image/*, image/png;q=0", losslessOnly: true, want: ifSupported("jxl", "webp-lossless")},
+		{name: "lossless format", query: "format=webp-lossless", losslessOnly: true, want: "webp-lossless"},
+		{name: "lossless jxl format", query: "format=jxl", losslessOnly: true, want: jxl, wantStatus: statusIf(jxl == "", http.StatusNotAcceptable)},
+		{name: "lossy format refused", query: "format=jpeg", losslessOnly: true, wantStatus: http.StatusNotAcceptable},
+		{name: "lossy webp refused", query: "format=webp", losslessOnly: true, wantStatus: http.StatusNotAcceptable},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/tiles/slide-1?"+tt.query, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+
+		got, err := negotiateFormat(r, tt.losslessOnly)
+		if tt.wantStatus != 0 {
+			fe, ok := err.(*formatError)
+			if !ok || fe.status != tt.wantStatus {
+				t.Errorf("%s: got %q, %v, want status %d", tt.name, got, err, tt.wantStatus)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func statusIf(cond bool, status int) int {
+	if cond {
+		return status
+	}
+	return 0
+}
+
+func TestLosslessOnlyClients(t *testing.T) {
+	s := newTestServer(t)
+
+	// Refused before any tile is rendered, so no GPU is needed
+	for _, query := range []string{"", "&format=jpeg", "&format=jpg", "&format=webp", "&format=avif"} {
+		req := httptest.NewRequest("GET", "/api/tiles/slide-1?layer=0&x=0&y=0&z=0"+query, nil)
+		req.Header.Set("Accept", "image/jpeg, image/webp;q=0")
+		if w := s.send("pipeline", req); w.Code != http.StatusNotAcceptable {
+			t.Errorf("tile%s: %d, want 406", query, w.Code)
+		}
+	}
+
+	batch := func(user, accept, format string) (string, int) {
+		body := `[{"X": 0, "Y": 0, "Format": "` + format + `"}]`
+		req := httptest.NewRequest("POST", "/api/tiles/slide-1/batch", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"slideId": "slide-1"})
+		req.Header.Set("Accept", accept)
+		req.AddCookie(&http.Cookie{Name: "auth_token", Value: s.login(user)})
+		w := httptest.NewRecorder()
+
+		requests, ok := s.h.batchRequests(w, req)
+		if !ok {
+			return "", w.Code
+		}
+		return requests[0].Format, http.StatusOK
+	}
+	tests := []struct {
+		user, accept, format string
+		want                 string
+		wantStatus           int
+	}{
+		{"pipeline", "*/*", "", "png", http.StatusOK},
+		{"pipeline", "image/webp", "", "webp-lossless", http.StatusOK},
+		{"pipeline", "image/jpeg", "", "", http.StatusNotAcceptable},
+		{"pipeline", "*/*", "png", "png", http.StatusOK},
+		{"pipeline", "*/*", "jpeg", "", http.StatusNotAcceptable},
+		{"pipeline", "*/*", "webp", "", http.StatusNotAcceptable},
+		{"alice", "image/jpeg", "", "jpeg", http.StatusOK},
+		{"alice", "*/*", "webp", "webp", http.StatusOK},
+	}
+	for _, tt := range tests {
+		got, status := batch(tt.user, tt.accept, tt.format)
+		if got != tt.want || status != tt.wantStatus {
+			t.Errorf("batch for %s, Accept %s, format %q: got %q, %d, want %q, %d",
+				tt.user, tt.accept, tt.format, got, status, tt.want, tt.wantStatus)
+		}
+	}
+}
+
+func TestTileNegotiationHeaders(t *testing.T) {
+	s := newTestServer(t)
+	p, err := tiler.NewGPUTileProcessor(&config.GPUConfig{CacheSize: 64 << 20, CachePolicy: "lru", EncodeWorkers: 1})
+	if err != nil {
+		t.Skipf("no GPU: %v", err)
+	}
+	defer p.Close()
+	p.SetTileStore(s.h.tiles)
+	s.h.tiler = p
+
+	img := image.NewRGBA(image.Rect(0, 0, 512, 512))
+	for i := range img.Pix {
+		img.Pix[i] = 0xc0
+	}
+	img.Set(10, 10, color.RGBA{R: 0x80, A: 0xff})
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	err = s.h.tiles.Put("slide-1", 0, 0, 0, 0, &storage.StoredTile{Data: buf.Bytes(), Format: "jpeg", Width: 512, Height: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(query, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/tiles/slide-1?layer=0&x=0&y=0&z=0"+query, nil)
+		req.Header.Set("Accept", accept)
+		return s.send("alice", req)
+	}
+
+	etags := make(map[string]string)
+	for _, tt := range []struct{ query, accept, format, contentType string }{
+		{"", "image/webp", "webp", "image/webp"},
+		{"", "image/jpeg", "jpeg", "image/jpeg"},
+		{"&format=png", "image/webp", "png", "image/png"},
+	} {
+		w := get(tt.query, tt.accept)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s%s: %d %s", tt.accept, tt.query, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s%s: Content-Type %s, want %s", tt.accept, tt.query, got, tt.contentType)
+		}
+		if got := w.Header().Get("Vary"); got != "Accept" {
+			t.Errorf("%s%s: Vary %q, want Accept", tt.accept, tt.query, got)
+		}
+		etag := w.Header().Get("ETag")
+		if !strings.Contains(etag, ":"+tt.format+":") {
+			t.Errorf("%s%s: ETag %s doesn't name the format", tt.accept, tt.query, etag)
+		}
+		etags[etag] = tt.format
+	}
+	if len(etags) != 3 {
+		t.Errorf("formats share ETags: %v", etags)
+	}
+
+	// Refusals depend on Accept too
+	w := get("", "image/gif")
+	if w.Code != http.StatusNotAcceptable || w.Header().Get("Vary") != "Accept" {
+		t.Errorf("unacceptable Accept: %d, Vary %q", w.Code, w.Header().Get("Vary"))
+	}
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cyto-viewer/internal/config"
+	"cyto-viewer/internal/jobs"
+	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/scanner/scannertest"
+	"cyto-viewer/internal/storage"
+	"cyto-viewer/internal/tiler"
+	"cyto-viewer/pkg/logger"
+)
+
+// withSimulator connects the server to a simulated scanner "sim", which
+// scanned slide-1, and starts the job queue
+func (s *testServer) withSimulator(args ...string) *jobs.Queue {
+	s.t.Helper()
+
+	addr := scannertest.StartSimulator(s.t, append([]string{"-width", "2048", "-height", "2048", "-tile-size", "256"}, args...)...)
+	registry, err := scanner.NewRegistry([]config.ScannerConfig{{ID: "sim", Protocol: "tcp", Address: addr,
+		Timeout: 5 * time.Second, ScanTimeout: 5 * time.Second, MaxFrameSize: 64 << 20, MaxScanArea: 1 << 22}})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { registry.Close() })
+
+	q, err := jobs.OpenQueue(s.t.TempDir(), registry, s.h.tiles, s.h.slides, logger.New())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.t.Cleanup(func() { q.Close() })
+
+	sc := registry.Default()
+	deadline := time.Now().Add(10 * time.Second)
+	for sc.State().State != scanner.StateReady {
+		if time.Now().After(deadline) {
+			s.t.Fatalf("scanner not ready: %+v", sc.State())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.Start()
+
+	s.h.scanners, s.h.jobs = registry, q
+	s.h.slides.Update("slide-1", func(slide *storage.Slide) { slide.Scanner = "sim" })
+	return q
+}
+
+func TestOverlayEndpoints(t *testing.T) {
+	s := newTestServer(t)
+	s.withSimulator("-layers", "4", "-layer-spacing", "0.5")
+
+	rejected := []struct {
+		name, body string
+		want       int
+	}{
+		{"layer and depth", `{"x": 0, "y": 0, "width": 256, "height": 256, "layer": 1, "depth": 0.5}`, http.StatusBadRequest},
+		{"neither layer nor depth", `{"x": 0, "y": 0, "width": 256, "height": 256}`, http.StatusBadRequest},
+		{"outside the slide", `{"x": 900, "y": 0, "width": 256, "height": 256, "layer": 1}`, http.StatusBadRequest},
+		{"unknown layer", `{"x": 0, "y": 0, "width": 256, "height": 256, "layer": 9}`, http.StatusBadRequest},
+		{"objective not fitted", `{"x": 0, "y": 0, "width": 256, "height": 256, "layer": 1, "objective": 63}`, http.StatusBadRequest},
+	}
+	for _, tt := range rejected {
+		if w := s.do("alice", "POST", "/api/slides/slide-1/overlays", tt.body); w.Code != tt.want {
+			t.Errorf("%s: %d %s, want %d", tt.name, w.Code, w.Body.String(), tt.want)
+		}
+	}
+
+	w := s.do("alice", "POST", "/api/slides/slide-1/overlays", `{"x": 256, "y": 256, "width": 512, "height": 256, "depth": 1.1, "objective": 40}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("capture: %d %s", w.Code, w.Body.String())
+	}
+	var overlay storage.Overlay
+	json.NewDecoder(w.Body).Decode(&overlay)
+	if w.Header().Get("Location") != "/api/slides/slide-1/overlays/"+overlay.ID {
+		t.Errorf("Location %q for overlay %s", w.Header().Get("Location"), overlay.ID)
+	}
+	// 1.1um is nearest layer 2, at 1um
+	if overlay.Layer != 2 || overlay.FocusDepth != 1 || overlay.ImageWidth != 512 || overlay.TileSize != 256 || overlay.Owner != "alice" {
+		t.Errorf("overlay %+v", overlay)
+	}
+
+	var listed []storage.Overlay
+	json.NewDecoder(s.do("bob", "GET", "/api/slides/slide-1/overlays", "").Body).Decode(&listed)
+	if len(listed) != 1 || listed[0].ID != overlay.ID {
+		t.Errorf("listed %+v", listed)
+	}
+
+	tile := "/api/tiles/slide-1?x=1&y=0&overlay=" + overlay.ID
+	t.Run("tile API", func(t *testing.T) {
+		p, err := tiler.NewGPUTileProcessor(&config.GPUConfig{CacheSize: 64 << 20, CachePolicy: "lru", EncodeWorkers: 1})
+		if err != nil {
+			t.Skipf("no GPU: %v", err)
+		}
+		defer p.Close()
+		p.SetTileStore(s.h.tiles)
+		s.h.tiler = p
+		defer func() { s.h.tiler = nil }()
+
+		req := httptest.NewRequest("GET", tile, nil)
+		req.Header.Set("Accept", "image/jpeg")
+		if w := s.send("bob", req); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+			t.Errorf("overlay tile: %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		// The overlay is two tiles across
+		if w := s.do("bob", "GET", strings.Replace(tile, "x=1", "x=2", 1), ""); w.Code != http.StatusNotFound {
+			t.Errorf("tile beyond the overlay: %d, want 404", w.Code)
+		}
+	})
+
+	if w := s.do("alice", "DELETE", "/api/slides/slide-1/overlays/"+overlay.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+	}
+	if w := s.do("alice", "DELETE", "/api/slides/slide-1/overlays/"+overlay.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("second delete: %d, want 404", w.Code)
+	}
+	if w := s.do("bob", "GET", tile, ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleted overlay's tile: %d, want 404", w.Code)
+	}
+	if w := s.do("alice", "POST", "/api/slides/slide-9/overlays", `{"width": 256, "height": 256, "layer": 1}`); w.Code != http.StatusNotFound {
+		t.Errorf("capture on an unknown slide: %d, want 404", w.Code)
+	}
+	// slide-2 has no scanner configured to capture it on
+	if w := s.do("alice", "POST", "/api/slides/slide-2/overlays", `{"width": 256, "height": 256, "layer": 1}`); w.Code != http.StatusConflict {
+		t.Errorf("capture on a slide from an unknown scanner: %d, want 409", w.Code)
+	}
+}
+
+func TestOverlayCaptureBusyDuringScan(t *testing.T) {
+	s := newTestServer(t)
+	q := s.withSimulator("-layers", "4", "-scan-delay", "1s")
+
+	job, err := q.Submit(scanner.ScanRequest{Width: 256, Height: 256, Layers: []int{0, 1, 2, 3}}, "sim", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Cancel(job.ID)
+
+	sc, _ := s.h.scanners.Get("sim")
+	deadline := time.Now().Add(5 * time.Second)
+	for sc.State().State != scanner.StateScanning {
+		if time.Now().After(deadline) {
+			t.Fatal("scan didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := s.do("alice", "POST", "/api/slides/slide-1/overlays", `{"x": 0, "y": 0, "width": 256, "height": 256, "layer": 1}`)
+	if w.Code != http.StatusConflict {
+		t.Errorf("capture during a scan: %d %s, want 409", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cyto-viewer/internal/config"
+	"cyto-viewer/internal/scanner/scannertest"
+	"cyto-viewer/internal/storage"
+	"cyto-viewer/pkg/auth"
+	"cyto-viewer/pkg/logger"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	scannertest.Cleanup()
+	os.Exit(code)
+}
+
+// testServer is a handler with real storage in a temporary directory and
+// no GPU, scanners or job queue, so routes needing those can't be called
+type testServer struct {
+	t      *testing.T
+	h      *Handler
+	router *mux.Router
+	tokens map[string]string
+}
+
+// newTestServer starts a server where "root" is the only admin and
+// "pipeline" may only receive lossless tiles, with unassigned slides
+// slide-1 to slide-3
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+
+	// A password hash turns off development mode, where everyone is admin
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{Auth: config.AuthConfig{
+		JWTSecret:     "test-secret",
+		TokenExpiry:   time.Hour,
+		AdminUsers:    []string{"root"},
+		LosslessUsers: []string{"pipeline"},
+		PasswordHash:  string(hash),
+	}}
+
+	revisions, err := storage.OpenRevisions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slides, err := storage.OpenSlideCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases, err := storage.OpenCaseCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := storage.OpenAnnotationStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	measurements, err := storage.OpenMeasurementStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"slide-1", "slide-2", "slide-3"} {
+		err := slides.Put(storage.Slide{ID: id, Width: 1024, Height: 1024, TileSize: 512, Created: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := NewHandler(logger.New(), nil, nil, auth.NewManager(&cfg.Auth), revisions, slides,
+		cases, storage.NewTileStore(dir), annotations, measurements, nil, nil, cfg)
+	router := mux.NewRouter()
+	h.RegisterRoutes(router)
+	return &testServer{t: t, h: h, router: router, tokens: make(map[string]string)}
+}
+
+// do sends a request as user, logging in first if needed
+func (s *testServer) do(user, method, url, body string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.send(user, httptest.NewRequest(method, url, strings.NewReader(body)))
+}
+
+// send sends req as user, for requests that need their own headers
+func (s *testServer) send(user string, req *http.Request) *httptest.ResponseRecorder {
+	s.t.Helper()
+
+	req.AddCookie(&http.Cookie{Name: "auth_token", Value: s.login(user)})
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+// login returns a session token for user
+func (s *testServer) login(user string) string {
+	s.t.Helper()
+
+	token, ok := s.tokens[user]
+	if !ok {
+		var err error
+		token, err = s.h.auth.Authenticate(user, "secret")
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		s.tokens[user] = token
+	}
+	return token
+}
+
+// createCase creates a case as user and returns its ID
+func (s *testServer) createCase(user, body string) string {
+	s.t.Helper()
+
+	w := s.do(user, "POST", "/api/cases", body)
+	if w.Code != http.StatusCreated {
+		s.t.Fatalf("create case: %d %s", w.Code, w.Body.String())
+	}
+	id := strings.TrimPrefix(w.Header().Get("Location"), "/api/cases/")
+	if id == "" {
+		s.t.Fatal("create case: no Location")
+	}
+	return id
+}
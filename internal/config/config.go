@@ -2,15 +2,18 @@ package config
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type Config struct {
 	Server    ServerConfig
 	GPU       GPUConfig
-	Scanner   ScannerConfig
+	Scanners  []ScannerConfig
 	Auth      AuthConfig
 	Storage   StorageConfig
 	StartTime time.Time
@@ -25,21 +28,48 @@ type ServerConfig struct {
 
 type GPUConfig struct {
 	DeviceID        int
-	CacheSize       int64 // in bytes
+	CacheSize       int64  // in bytes
+	CachePolicy     string // "lru", "slru" or "tinylfu"
 	ColorCorrection bool
 	BatchSize       int
+	AVIFSpeed       int    // 0 (slowest, smallest) to 8 (fastest)
+	EncodeWorkers   int    // max concurrent tile encodes; 0 uses all CPUs
+	PrefetchWorkers int    // max concurrent background prefetch fetches
+	DiskCachePath   string // L2 tile cache directory; empty disables it
+	DiskCacheSize   int64  // in bytes
 }
 
 type ScannerConfig struct {
-	Protocol string // "tcp" or "serial"
-	Address  string // IP:Port or serial device path
-	Timeout  time.Duration
+	ID           string        // Registry key, as in /api/scanners/{id}
+	Name         string        // Display name
+	Protocol     string        // "tcp" or "serial"
+	Address      string        // IP:Port or serial device path
+	Timeout      time.Duration // Per-operation I/O deadline
+	ScanTimeout  time.Duration // Wait for each layer of a scan to start arriving
+	MaxFrameSize int           // Largest accepted layer data frame, in bytes
+	MaxScanArea  int64         // Largest region a scan or capture may request, in pixels
+	Serial       SerialConfig  // Line settings when Protocol is "serial"
+
+	// Optics, recorded with every slide the scanner produces
+	Objective       string  // e.g. "Plan Apo 40x/0.95"
+	Magnification   int     // nominal magnification of scans
+	MicronsPerPixel float64 // sample size of scan pixels
+}
+
+type SerialConfig struct {
+	BaudRate    int
+	DataBits    int    // 5-8
+	Parity      string // "none", "even" or "odd"
+	StopBits    int    // 1 or 2
+	FlowControl string // "none", "rtscts" or "xonxoff"
 }
 
 type AuthConfig struct {
 	JWTSecret     string
 	TokenExpiry   time.Duration
 	AllowedUsers  []string
+	AdminUsers    []string
+	LosslessUsers []string // clients restricted to lossless tile formats
 	PasswordHash  string
 }
 
@@ -62,17 +92,21 @@ func Load() (*Config, error) {
 		GPU: GPUConfig{
 			DeviceID:        getEnvInt("GPU_DEVICE_ID", 0),
 			CacheSize:       int64(getEnvInt("GPU_CACHE_SIZE", 8192)) * 1024 * 1024, // MB to bytes
+			CachePolicy:     getEnv("GPU_CACHE_POLICY", "lru"),
 			ColorCorrection: getEnvBool("GPU_COLOR_CORRECTION", true),
 			BatchSize:       getEnvInt("GPU_BATCH_SIZE", 16),
+			AVIFSpeed:       getEnvInt("AVIF_SPEED", 8),
+			EncodeWorkers:   getEnvInt("GPU_ENCODE_WORKERS", 0),
+			PrefetchWorkers: getEnvInt("GPU_PREFETCH_WORKERS", 2),
+			DiskCachePath:   getEnv("DISK_CACHE_PATH", ""), // off unless configured
+			DiskCacheSize:   int64(getEnvInt("DISK_CACHE_SIZE", 10)) * 1024 * 1024 * 1024, // GB to bytes
 		},
-		Scanner: ScannerConfig{
-			Protocol: getEnv("SCANNER_PROTOCOL", "tcp"),
-			Address:  getEnv("SCANNER_ADDRESS", "localhost:9090"),
-			Timeout:  time.Duration(getEnvInt("SCANNER_TIMEOUT", 30)) * time.Second,
-		},
+		Scanners: loadScanners(),
 		Auth: AuthConfig{
-			JWTSecret:   getEnv("JWT_SECRET", generateRandomSecret()),
-			TokenExpiry: time.Duration(getEnvInt("TOKEN_EXPIRY", 24)) * time.Hour,
+			JWTSecret:     getEnv("JWT_SECRET", generateRandomSecret()),
+			TokenExpiry:   time.Duration(getEnvInt("TOKEN_EXPIRY", 24)) * time.Hour,
+			AdminUsers:    getEnvList("ADMIN_USERS"),
+			LosslessUsers: getEnvList("LOSSLESS_ONLY_USERS"),
 		},
 		Storage: StorageConfig{
 			BasePath:      getEnv("STORAGE_PATH", "./data/slides"),
@@ -103,8 +137,41 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("GPU cache size too small: %d bytes", c.GPU.CacheSize)
 	}
 
-	if c.Scanner.Protocol != "tcp" && c.Scanner.Protocol != "serial" {
-		return fmt.Errorf("invalid scanner protocol: %s", c.Scanner.Protocol)
+	switch c.GPU.CachePolicy {
+	case "lru", "slru", "tinylfu":
+	default:
+		return fmt.Errorf("invalid cache policy: %s", c.GPU.CachePolicy)
+	}
+
+	if c.GPU.AVIFSpeed < 0 || c.GPU.AVIFSpeed > 8 {
+		return fmt.Errorf("invalid AVIF speed: %d", c.GPU.AVIFSpeed)
+	}
+
+	if c.GPU.EncodeWorkers < 0 {
+		return fmt.Errorf("invalid encode worker count: %d", c.GPU.EncodeWorkers)
+	}
+
+	if c.GPU.PrefetchWorkers < 0 {
+		return fmt.Errorf("invalid prefetch worker count: %d", c.GPU.PrefetchWorkers)
+	}
+
+	if c.GPU.DiskCachePath != "" && c.GPU.DiskCacheSize < 1024*1024 {
+		return fmt.Errorf("disk cache size too small: %d bytes", c.GPU.DiskCacheSize)
+	}
+
+	if len(c.Scanners) == 0 {
+		return fmt.Errorf("no scanners configured")
+	}
+	seen := make(map[string]bool)
+	for i := range c.Scanners {
+		sc := &c.Scanners[i]
+		if seen[sc.ID] {
+			return fmt.Errorf("duplicate scanner ID: %s", sc.ID)
+		}
+		seen[sc.ID] = true
+		if err := sc.Validate(); err != nil {
+			return fmt.Errorf("scanner %s: %w", sc.ID, err)
+		}
 	}
 
 	if c.Auth.JWTSecret == "" {
@@ -114,6 +181,126 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+func (s *SerialConfig) Validate() error {
+	if s.BaudRate <= 0 {
+		return fmt.Errorf("invalid serial baud rate: %d", s.BaudRate)
+	}
+
+	if s.DataBits < 5 || s.DataBits > 8 {
+		return fmt.Errorf("invalid serial data bits: %d (must be 5-8)", s.DataBits)
+	}
+
+	switch s.Parity {
+	case "none", "even", "odd":
+	default:
+		return fmt.Errorf("invalid serial parity: %s", s.Parity)
+	}
+
+	if s.StopBits != 1 && s.StopBits != 2 {
+		return fmt.Errorf("invalid serial stop bits: %d (must be 1 or 2)", s.StopBits)
+	}
+
+	switch s.FlowControl {
+	case "none", "rtscts", "xonxoff":
+	default:
+		return fmt.Errorf("invalid serial flow control: %s", s.FlowControl)
+	}
+
+	return nil
+}
+
+func (c *ScannerConfig) Validate() error {
+	if !validScannerID.MatchString(c.ID) {
+		return fmt.Errorf("invalid scanner ID: %q", c.ID)
+	}
+
+	if c.Protocol != "tcp" && c.Protocol != "serial" {
+		return fmt.Errorf("invalid scanner protocol: %s", c.Protocol)
+	}
+
+	if c.Timeout <= 0 || c.ScanTimeout <= 0 {
+		return fmt.Errorf("scanner timeouts must be positive")
+	}
+
+	// Compared as uint64: on 32-bit platforms MaxUint32 overflows int
+	if c.MaxFrameSize < 1024*1024 || uint64(c.MaxFrameSize) > math.MaxUint32 {
+		return fmt.Errorf("scanner max frame size must be between 1MB and 4GB")
+	}
+
+	if c.MaxScanArea <= 0 {
+		return fmt.Errorf("scanner max scan area must be positive")
+	}
+
+	if c.Magnification <= 0 {
+		return fmt.Errorf("invalid scanner magnification: %d", c.Magnification)
+	}
+
+	if !(c.MicronsPerPixel > 0 && c.MicronsPerPixel < 1000) {
+		return fmt.Errorf("invalid scanner microns per pixel: %g", c.MicronsPerPixel)
+	}
+
+	if c.Protocol == "serial" {
+		if err := c.Serial.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var validScannerID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// loadScanners reads the scanner fleet. SCANNERS lists scanner IDs, and
+// each scanner's settings come from SCANNER_<ID>_* variables (the ID upper
+// cased, dashes as underscores), falling back to the shared SCANNER_* ones.
+// Without SCANNERS, a single scanner "default" is read from SCANNER_*.
+func loadScanners() []ScannerConfig {
+	ids := getEnvList("SCANNERS")
+	if len(ids) == 0 {
+		return []ScannerConfig{loadScanner("default", "SCANNER_")}
+	}
+
+	scanners := make([]ScannerConfig, 0, len(ids))
+	for _, id := range ids {
+		prefix := "SCANNER_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_")) + "_"
+		scanners = append(scanners, loadScanner(id, prefix))
+	}
+	return scanners
+}
+
+func loadScanner(id, prefix string) ScannerConfig {
+	env := func(name, defaultValue string) string {
+		return getEnv(prefix+name, getEnv("SCANNER_"+name, defaultValue))
+	}
+	envInt := func(name string, defaultValue int) int {
+		return getEnvInt(prefix+name, getEnvInt("SCANNER_"+name, defaultValue))
+	}
+	envFloat := func(name string, defaultValue float64) float64 {
+		return getEnvFloat(prefix+name, getEnvFloat("SCANNER_"+name, defaultValue))
+	}
+
+	return ScannerConfig{
+		ID:           id,
+		Name:         env("NAME", id),
+		Protocol:     env("PROTOCOL", "tcp"),
+		Address:      env("ADDRESS", "localhost:9090"),
+		Timeout:      time.Duration(envInt("TIMEOUT", 30)) * time.Second,
+		ScanTimeout:  time.Duration(envInt("SCAN_TIMEOUT", 600)) * time.Second,
+		MaxFrameSize: envInt("MAX_FRAME_MB", 1024) * 1024 * 1024,
+		MaxScanArea:  int64(envInt("MAX_SCAN_MEGAPIXELS", 2500)) * 1000 * 1000,
+		Serial: SerialConfig{
+			BaudRate:    envInt("BAUD_RATE", 115200),
+			DataBits:    envInt("DATA_BITS", 8),
+			Parity:      env("PARITY", "none"),
+			StopBits:    envInt("STOP_BITS", 1),
+			FlowControl: env("FLOW_CONTROL", "none"),
+		},
+		Objective:       env("OBJECTIVE", ""),
+		Magnification:   envInt("MAGNIFICATION", 40),
+		MicronsPerPixel: envFloat("MICRONS_PER_PIXEL", 0.25),
+	}
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -130,6 +317,25 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatVal, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
+func getEnvList(key string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
 func getEnvBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolVal, err := strconv.ParseBool(value); err == nil {
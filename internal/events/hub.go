@@ -0,0 +1,122 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Recent events kept so reconnecting clients can catch up
+	historySize = 256
+
+	// Events buffered per subscriber before it is considered too slow
+	subscriberBuffer = 64
+)
+
+// Event is one message on the event stream
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+
+	// Slide the event is about, if any, so streams can leave out events
+	// of slides their user may not see
+	SlideID string `json:"-"`
+}
+
+// Hub fans published events out to subscribers. IDs increase
+// monotonically, so a client can resume from the last event it saw.
+type Hub struct {
+	mu      sync.Mutex
+	lastID  uint64
+	history []Event
+	subs    map[chan Event]struct{}
+	closed  bool
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+// Publish sends an event to every subscriber. A subscriber whose buffer
+// is full is dropped; its channel is closed so the client reconnects and
+// catches up from history.
+func (h *Hub) Publish(typ string, data interface{}) {
+	h.PublishSlide(typ, "", data)
+}
+
+// PublishSlide publishes an event about a slide
+func (h *Hub) PublishSlide(typ, slideID string, data interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastID++
+	e := Event{ID: h.lastID, Type: typ, Time: time.Now(), Data: data, SlideID: slideID}
+
+	h.history = append(h.history, e)
+	if len(h.history) > historySize {
+		h.history = h.history[len(h.history)-historySize:]
+	}
+
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the events after lastID still held in history,
+// followed by a channel of new events. A lastID of zero skips the
+// history. cancel must be called when the subscriber goes away.
+func (h *Hub) Subscribe(lastID uint64) (backlog []Event, events <-chan Event, cancel func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if lastID > 0 {
+		if lastID > h.lastID {
+			// IDs restarted with the server: everything is new
+			lastID = 0
+		}
+		for _, e := range h.history {
+			if e.ID > lastID {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	ch := make(chan Event, subscriberBuffer)
+	if h.closed {
+		close(ch)
+		return backlog, ch, func() {}
+	}
+	h.subs[ch] = struct{}{}
+
+	cancel = func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, cancel
+}
+
+// Close ends every subscription, so open streams finish and the server
+// can shut down
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,133 @@
+package events
+
+import "testing"
+
+func ids(events []Event) []uint64 {
+	var result []uint64
+	for _, e := range events {
+		result = append(result, e.ID)
+	}
+	return result
+}
+
+func TestHubDelivers(t *testing.T) {
+	h := NewHub()
+	_, first, cancelFirst := h.Subscribe(0)
+	defer cancelFirst()
+	_, second, cancelSecond := h.Subscribe(0)
+	defer cancelSecond()
+
+	h.Publish("scanner", "ready")
+	h.PublishSlide("job", "slide-1", 42)
+
+	for _, ch := range []<-chan Event{first, second} {
+		a, b := <-ch, <-ch
+		if a.ID != 1 || a.Type != "scanner" || a.Data != "ready" || a.SlideID != "" {
+			t.Errorf("first event %+v", a)
+		}
+		if b.ID != 2 || b.Type != "job" || b.SlideID != "slide-1" || b.Time.Before(a.Time) {
+			t.Errorf("second event %+v", b)
+		}
+	}
+
+	cancelFirst()
+	if _, ok := <-first; ok {
+		t.Error("cancelled subscription still open")
+	}
+	cancelFirst() // cancelling twice is harmless
+	h.Publish("scanner", "busy")
+	if e := <-second; e.ID != 3 {
+		t.Errorf("got event %d after another subscriber left, want 3", e.ID)
+	}
+}
+
+func TestHubDropsSlowSubscriber(t *testing.T) {
+	h := NewHub()
+	_, slow, cancelSlow := h.Subscribe(0)
+	defer cancelSlow()
+	_, fast, cancelFast := h.Subscribe(0)
+	defer cancelFast()
+
+	received := 0
+	for i := 0; i < subscriberBuffer+1; i++ {
+		h.Publish("progress", i)
+		<-fast
+		received++
+	}
+
+	// The slow subscriber gets what fitted in its buffer, then its channel
+	// is closed so it reconnects
+	buffered := 0
+	for range slow {
+		buffered++
+	}
+	if buffered != subscriberBuffer {
+		t.Errorf("slow subscriber got %d events before being dropped, want %d", buffered, subscriberBuffer)
+	}
+	if received != subscriberBuffer+1 {
+		t.Errorf("fast subscriber got %d events", received)
+	}
+
+	// Reconnecting from the last event seen catches up
+	backlog, _, cancel := h.Subscribe(uint64(buffered))
+	defer cancel()
+	if got := ids(backlog); len(got) != 1 || got[0] != subscriberBuffer+1 {
+		t.Errorf("backlog after reconnecting %v, want the missed event", got)
+	}
+}
+
+func TestHubReplay(t *testing.T) {
+	h := NewHub()
+	for i := 0; i < historySize+10; i++ {
+		h.Publish("progress", i)
+	}
+	last := uint64(historySize + 10)
+
+	tests := []struct {
+		name      string
+		lastID    uint64
+		wantFirst uint64
+		wantCount int
+	}{
+		{"no last event skips history", 0, 0, 0},
+		{"recent", last - 3, last - 2, 3},
+		{"up to date", last, 0, 0},
+		{"older than history", 5, last - historySize + 1, historySize},
+		{"from before a restart", last + 100, last - historySize + 1, historySize},
+	}
+	for _, tt := range tests {
+		backlog, _, cancel := h.Subscribe(tt.lastID)
+		cancel()
+		if len(backlog) != tt.wantCount {
+			t.Errorf("%s: got %d events, want %d", tt.name, len(backlog), tt.wantCount)
+			continue
+		}
+		if tt.wantCount > 0 && (backlog[0].ID != tt.wantFirst || backlog[len(backlog)-1].ID != last) {
+			t.Errorf("%s: got events %d to %d, want %d to %d", tt.name,
+				backlog[0].ID, backlog[len(backlog)-1].ID, tt.wantFirst, last)
+		}
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	h := NewHub()
+	h.Publish("scanner", "ready")
+	_, events, cancel := h.Subscribe(0)
+
+	h.Close()
+	if _, ok := <-events; ok {
+		t.Error("subscription open after Close")
+	}
+	cancel()
+
+	// Late subscribers still get the history, and a closed channel
+	backlog, late, cancelLate := h.Subscribe(1 << 30)
+	defer cancelLate()
+	if len(backlog) != 1 {
+		t.Errorf("got %d events after Close, want the history", len(backlog))
+	}
+	if _, ok := <-late; ok {
+		t.Error("subscription after Close is open")
+	}
+	h.Publish("scanner", "gone") // publishing after Close is harmless
+}
@@ -0,0 +1,92 @@
+package events
+
+import (
+	"time"
+
+	"cyto-viewer/internal/jobs"
+	"cyto-viewer/internal/scanner"
+)
+
+// Event types published on the stream
+const (
+	TypeScannerState  = "scanner.state"  // connection state changed
+	TypeScannerStatus = "scanner.status" // periodic device status, including temperature
+	TypeScannerError  = "scanner.error"  // a status poll failed
+	TypeJobQueued     = "job.queued"
+	TypeJobStarted    = "job.started"
+	TypeJobLayer      = "job.layer" // a layer was stored; its tiles can be viewed
+	TypeJobFinished   = "job.finished"
+)
+
+// WatchScanners publishes state changes of every scanner, and polls device
+// status every interval while a scanner is idle. The link is busy
+// streaming layers during a scan, so status is not polled then; job.layer
+// events report progress instead. Event data carries the scanner ID. The
+// returned func stops polling.
+func WatchScanners(hub *Hub, scanners *scanner.Registry, interval time.Duration) func() {
+	scanners.OnStateChange(func(sc *scanner.Interface, c scanner.StateChange) {
+		hub.Publish(TypeScannerState, map[string]interface{}{
+			"scanner": sc.ID(),
+			"state":   c.State,
+			"time":    c.Time,
+			"error":   c.Error,
+		})
+	})
+
+	stop := make(chan struct{})
+	for _, sc := range scanners.List() {
+		go pollStatus(hub, sc, interval, stop)
+	}
+
+	return func() { close(stop) }
+}
+
+func pollStatus(hub *Hub, sc *scanner.Interface, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if sc.State().State != scanner.StateReady {
+			continue
+		}
+		status, err := sc.GetStatus()
+		if err != nil {
+			hub.Publish(TypeScannerError, map[string]interface{}{
+				"scanner": sc.ID(),
+				"error":   err.Error(),
+			})
+			continue
+		}
+		status["scanner"] = sc.ID()
+		hub.Publish(TypeScannerStatus, status)
+	}
+}
+
+// WatchJobs publishes scan job lifecycle and per-layer progress events,
+// each about the job's slide
+func WatchJobs(hub *Hub, q *jobs.Queue) {
+	q.OnEvent(func(e jobs.Event) {
+		data := map[string]interface{}{
+			"job": e.Job,
+		}
+
+		slideID := e.Job.SlideID
+		switch e.Type {
+		case jobs.EventQueued:
+			hub.PublishSlide(TypeJobQueued, slideID, data)
+		case jobs.EventStarted:
+			hub.PublishSlide(TypeJobStarted, slideID, data)
+		case jobs.EventLayerStored:
+			data["layer"] = e.Layer
+			hub.PublishSlide(TypeJobLayer, slideID, data)
+		case jobs.EventFinished:
+			hub.PublishSlide(TypeJobFinished, slideID, data)
+		}
+	})
+}
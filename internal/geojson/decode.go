@@ -0,0 +1,347 @@
+package geojson
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"cyto-viewer/internal/geometry"
+	"cyto-viewer/internal/storage"
+)
+
+// FeatureError reports an invalid feature. Decoding can continue past it.
+type FeatureError struct {
+	Index   int // position in the input
+	Field   string
+	Message string
+}
+
+func (e *FeatureError) Error() string {
+	return fmt.Sprintf("features[%d].%s: %s", e.Index, e.Field, e.Message)
+}
+
+type decodeState int
+
+const (
+	stateStart    decodeState = iota
+	stateArray                // in a top-level array of features
+	stateObject               // in a top-level object
+	stateFeatures             // in the object's features array
+	stateDone
+)
+
+// Decoder reads annotations from a FeatureCollection, a bare array of
+// features as QuPath also writes, or a single Feature. Features are decoded
+// one at a time, so the input is never held in memory as a whole.
+type Decoder struct {
+	dec   *json.Decoder
+	scale float64
+	state decodeState
+	index int
+
+	// Members of a top-level object other than features, kept in case the
+	// object is a single Feature
+	members     map[string]json.RawMessage
+	sawFeatures bool
+}
+
+// NewDecoder reads features from r, dividing coordinates by scale
+func NewDecoder(r io.Reader, scale float64) *Decoder {
+	return &Decoder{
+		dec:     json.NewDecoder(r),
+		scale:   scale,
+		members: make(map[string]json.RawMessage),
+	}
+}
+
+// Next returns the annotations of the next feature: one, or one per part
+// of a Multi* geometry. It returns io.EOF after the last feature. A
+// *FeatureError rejects one feature and decoding may continue; any other
+// error means the input is not valid JSON or GeoJSON.
+func (d *Decoder) Next() ([]storage.Annotation, error) {
+	for {
+		switch d.state {
+		case stateStart:
+			tok, err := d.dec.Token()
+			if err != nil {
+				return nil, d.syntaxError(err)
+			}
+			switch tok {
+			case json.Delim('['):
+				d.state = stateArray
+			case json.Delim('{'):
+				d.state = stateObject
+			default:
+				return nil, errors.New("expected a FeatureCollection, an array of features or a Feature")
+			}
+
+		case stateArray, stateFeatures:
+			if d.dec.More() {
+				return d.nextFeature()
+			}
+			if _, err := d.dec.Token(); err != nil {
+				return nil, d.syntaxError(err)
+			}
+			if d.state == stateArray {
+				d.state = stateDone
+			} else {
+				d.state = stateObject
+			}
+
+		case stateObject:
+			if !d.dec.More() {
+				if _, err := d.dec.Token(); err != nil {
+					return nil, d.syntaxError(err)
+				}
+				d.state = stateDone
+				if !d.sawFeatures {
+					return d.singleFeature()
+				}
+				continue
+			}
+
+			tok, err := d.dec.Token()
+			if err != nil {
+				return nil, d.syntaxError(err)
+			}
+			key, _ := tok.(string)
+			if key == "features" && !d.sawFeatures {
+				tok, err := d.dec.Token()
+				if err != nil {
+					return nil, d.syntaxError(err)
+				}
+				if tok != json.Delim('[') {
+					return nil, errors.New("features must be an array")
+				}
+				d.sawFeatures = true
+				d.state = stateFeatures
+				continue
+			}
+			var value json.RawMessage
+			if err := d.dec.Decode(&value); err != nil {
+				return nil, d.syntaxError(err)
+			}
+			d.members[key] = value
+
+		case stateDone:
+			if _, err := d.dec.Token(); err != io.EOF {
+				return nil, errors.New("unexpected data after the GeoJSON document")
+			}
+			return nil, io.EOF
+		}
+	}
+}
+
+func (d *Decoder) syntaxError(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("invalid JSON: %w", err)
+}
+
+func (d *Decoder) nextFeature() ([]storage.Annotation, error) {
+	index := d.index
+	d.index++
+
+	var f Feature
+	if err := d.dec.Decode(&f); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			// The value was consumed; only this feature is bad
+			return nil, &FeatureError{Index: index, Field: typeErr.Field, Message: "must be " + typeErr.Type.String()}
+		}
+		return nil, d.syntaxError(err)
+	}
+	return d.convert(index, &f)
+}
+
+// singleFeature converts a top-level object that turned out to be a Feature
+func (d *Decoder) singleFeature() ([]storage.Annotation, error) {
+	data, err := json.Marshal(d.members)
+	if err != nil {
+		return nil, err
+	}
+	var f Feature
+	if err := json.Unmarshal(data, &f); err != nil || f.Type != "Feature" {
+		return nil, errors.New("expected a FeatureCollection, an array of features or a Feature")
+	}
+	return d.convert(0, &f)
+}
+
+// convert turns a feature into annotations, checking every part
+func (d *Decoder) convert(index int, f *Feature) ([]storage.Annotation, error) {
+	fail := func(field, format string, args ...interface{}) ([]storage.Annotation, error) {
+		return nil, &FeatureError{Index: index, Field: field, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if f.Type != "Feature" {
+		return fail("type", "must be \"Feature\", got %q", f.Type)
+	}
+	if f.Geometry == nil {
+		return fail("geometry", "is missing")
+	}
+
+	var props Properties
+	if len(f.Properties) > 0 && string(f.Properties) != "null" {
+		if err := json.Unmarshal(f.Properties, &props); err != nil {
+			return fail("properties", "%v", err)
+		}
+	}
+
+	template := storage.Annotation{Layer: props.FocusLayer, Label: props.Name}
+	if c := props.Classification; c != nil {
+		template.Label = c.Name
+		if c.Color != nil {
+			color, err := colorString(c.Color)
+			if err != nil {
+				return fail("properties.classification.color", "%v", err)
+			}
+			template.Color = color
+		}
+	}
+	if template.Layer != nil && *template.Layer < 0 {
+		return fail("properties.focusLayer", "must not be negative")
+	}
+
+	shapes, field, err := d.shapes(f.Geometry, props.ShapeType)
+	if err != nil {
+		return fail(field, "%v", err)
+	}
+
+	annotations := make([]storage.Annotation, 0, len(shapes))
+	for _, shape := range shapes {
+		if err := shape.Validate(); err != nil {
+			return fail("geometry", "%v", err)
+		}
+		a := template
+		a.Geometry = shape
+		annotations = append(annotations, a)
+	}
+	return annotations, nil
+}
+
+// shapes converts a GeoJSON geometry to shapes in level 0 pixels. On error
+// it also returns the offending field.
+func (d *Decoder) shapes(g *Geometry, shapeType string) ([]geometry.Geometry, string, error) {
+	field := "geometry.coordinates"
+	var shapes []geometry.Geometry
+	var err error
+
+	switch g.Type {
+	case "Point":
+		var pos []float64
+		if err = json.Unmarshal(g.Coordinates, &pos); err == nil {
+			var p geometry.Point
+			if p, err = d.point(pos); err == nil {
+				shapes = append(shapes, geometry.Geometry{Type: geometry.TypePoint, Points: []geometry.Point{p}})
+			}
+		}
+	case "MultiPoint":
+		var positions [][]float64
+		if err = json.Unmarshal(g.Coordinates, &positions); err == nil {
+			var points []geometry.Point
+			if points, err = d.points(positions); err == nil {
+				for _, p := range points {
+					shapes = append(shapes, geometry.Geometry{Type: geometry.TypePoint, Points: []geometry.Point{p}})
+				}
+			}
+		}
+	case "LineString", "MultiLineString":
+		var lines [][][]float64
+		if g.Type == "LineString" {
+			var line [][]float64
+			err = json.Unmarshal(g.Coordinates, &line)
+			lines = [][][]float64{line}
+		} else {
+			err = json.Unmarshal(g.Coordinates, &lines)
+		}
+		for _, line := range lines {
+			if err != nil {
+				break
+			}
+			var points []geometry.Point
+			if points, err = d.points(line); err == nil {
+				shapes = append(shapes, geometry.Geometry{Type: geometry.TypePolyline, Points: points})
+			}
+		}
+	case "Polygon", "MultiPolygon":
+		var polygons [][][][]float64
+		if g.Type == "Polygon" {
+			var polygon [][][]float64
+			err = json.Unmarshal(g.Coordinates, &polygon)
+			polygons = [][][][]float64{polygon}
+		} else {
+			err = json.Unmarshal(g.Coordinates, &polygons)
+			shapeType = ""
+		}
+		for _, rings := range polygons {
+			if err != nil {
+				break
+			}
+			var shape geometry.Geometry
+			if shape, err = d.polygon(rings, shapeType); err == nil {
+				shapes = append(shapes, shape)
+			}
+		}
+	default:
+		return nil, "geometry.type", fmt.Errorf("unsupported geometry type %q", g.Type)
+	}
+
+	if err != nil {
+		return nil, field, err
+	}
+	if len(shapes) == 0 {
+		return nil, field, errors.New("geometry is empty")
+	}
+	return shapes, "", nil
+}
+
+// polygon converts a polygon's rings. Holes aren't supported. A shapeType
+// of rectangle or ellipse restores the shape from the polygon's bounds.
+func (d *Decoder) polygon(rings [][][]float64, shapeType string) (geometry.Geometry, error) {
+	if len(rings) != 1 {
+		return geometry.Geometry{}, fmt.Errorf("polygons must have exactly one ring, got %d (holes are not supported)", len(rings))
+	}
+	points, err := d.points(rings[0])
+	if err != nil {
+		return geometry.Geometry{}, err
+	}
+	if n := len(points); n > 1 && points[0] == points[n-1] {
+		points = points[:n-1]
+	}
+
+	shape := geometry.Geometry{Type: geometry.TypePolygon, Points: points}
+	switch shapeType {
+	case string(geometry.TypeRectangle), string(geometry.TypeEllipse):
+		b := shape.Bounds()
+		shape = geometry.Geometry{
+			Type:   geometry.Type(shapeType),
+			Points: []geometry.Point{{b.MinX, b.MinY}, {b.MaxX, b.MaxY}},
+		}
+	}
+	return shape, nil
+}
+
+func (d *Decoder) points(positions [][]float64) ([]geometry.Point, error) {
+	if len(positions) > geometry.MaxPoints {
+		return nil, fmt.Errorf("%d positions exceeds the limit of %d", len(positions), geometry.MaxPoints)
+	}
+	points := make([]geometry.Point, len(positions))
+	for i, pos := range positions {
+		p, err := d.point(pos)
+		if err != nil {
+			return nil, err
+		}
+		points[i] = p
+	}
+	return points, nil
+}
+
+// point converts a position, ignoring any altitude
+func (d *Decoder) point(pos []float64) (geometry.Point, error) {
+	if len(pos) < 2 {
+		return geometry.Point{}, fmt.Errorf("position needs x and y, got %d values", len(pos))
+	}
+	return geometry.Point{pos[0] / d.scale, pos[1] / d.scale}, nil
+}
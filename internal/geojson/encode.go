@@ -0,0 +1,50 @@
+package geojson
+
+import (
+	"encoding/json"
+	"io"
+
+	"cyto-viewer/internal/storage"
+)
+
+// Encoder streams annotations as a FeatureCollection
+type Encoder struct {
+	w     io.Writer
+	enc   *json.Encoder
+	scale float64
+	count int
+}
+
+// NewEncoder writes features to w with coordinates multiplied by scale
+func NewEncoder(w io.Writer, scale float64) *Encoder {
+	return &Encoder{w: w, enc: json.NewEncoder(w), scale: scale}
+}
+
+// Encode writes one annotation as a feature
+func (e *Encoder) Encode(a *storage.Annotation) error {
+	f, err := toFeature(a, e.scale)
+	if err != nil {
+		return err
+	}
+
+	prefix := ",\n"
+	if e.count == 0 {
+		prefix = `{"type":"FeatureCollection","features":[` + "\n"
+	}
+	if _, err := io.WriteString(e.w, prefix); err != nil {
+		return err
+	}
+	e.count++
+	return e.enc.Encode(f)
+}
+
+// Close ends the collection. It must be called even if nothing was
+// encoded.
+func (e *Encoder) Close() error {
+	if e.count == 0 {
+		_, err := io.WriteString(e.w, `{"type":"FeatureCollection","features":[]}`+"\n")
+		return err
+	}
+	_, err := io.WriteString(e.w, "]}\n")
+	return err
+}
@@ -0,0 +1,168 @@
+// Package geojson converts annotations to and from GeoJSON as QuPath reads
+// and writes it: a FeatureCollection of features with objectType
+// "annotation" and the class in properties.classification. Coordinates are
+// level 0 pixels scaled by a factor, 1 for pixels or the slide's microns
+// per pixel for micrometres.
+//
+// Rectangles and ellipses have no GeoJSON type; they are written as
+// polygons, with properties.shapeType recording the original shape so they
+// read back unchanged.
+package geojson
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"cyto-viewer/internal/geometry"
+	"cyto-viewer/internal/storage"
+)
+
+// Vertices used to approximate an ellipse as a polygon
+const ellipseVertices = 64
+
+// Feature is a GeoJSON feature
+type Feature struct {
+	Type       string          `json:"type"`
+	ID         string          `json:"id,omitempty"`
+	Geometry   *Geometry       `json:"geometry"`
+	Properties json.RawMessage `json:"properties,omitempty"`
+}
+
+// Geometry is a GeoJSON geometry. Coordinates are decoded according to
+// Type.
+type Geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// Properties are the feature properties QuPath uses, plus the annotation
+// fields QuPath has no place for
+type Properties struct {
+	ObjectType     string          `json:"objectType"`
+	Name           string          `json:"name,omitempty"`
+	Classification *Classification `json:"classification,omitempty"`
+	IsLocked       bool            `json:"isLocked"`
+
+	ShapeType  string `json:"shapeType,omitempty"` // "rectangle" or "ellipse"
+	FocusLayer *int   `json:"focusLayer,omitempty"`
+	Author     string `json:"author,omitempty"`
+}
+
+// Classification is a QuPath class: a name and an RGB color
+type Classification struct {
+	Name  string `json:"name"`
+	Color []int  `json:"color,omitempty"`
+}
+
+// colorArray converts #rrggbb[aa] to QuPath's [r, g, b]
+func colorArray(color string) []int {
+	if len(color) < 7 || color[0] != '#' {
+		return nil
+	}
+	rgb := make([]int, 3)
+	for i := range rgb {
+		v, err := strconv.ParseUint(color[1+2*i:3+2*i], 16, 8)
+		if err != nil {
+			return nil
+		}
+		rgb[i] = int(v)
+	}
+	return rgb
+}
+
+// colorString converts QuPath's [r, g, b] to #rrggbb
+func colorString(rgb []int) (string, error) {
+	if len(rgb) != 3 {
+		return "", fmt.Errorf("color must be [r, g, b]")
+	}
+	var b strings.Builder
+	b.WriteByte('#')
+	for _, v := range rgb {
+		if v < 0 || v > 255 {
+			return "", fmt.Errorf("color component %d is outside 0-255", v)
+		}
+		fmt.Fprintf(&b, "%02x", v)
+	}
+	return b.String(), nil
+}
+
+// toFeature converts an annotation to a feature, scaling its coordinates
+func toFeature(a *storage.Annotation, scale float64) (*Feature, error) {
+	props := Properties{
+		ObjectType: "annotation",
+		FocusLayer: a.Layer,
+		Author:     a.Author,
+	}
+	if a.Label != "" {
+		props.Classification = &Classification{Name: a.Label, Color: colorArray(a.Color)}
+	}
+
+	g := a.Geometry
+	var geomType string
+	var coords interface{}
+	switch g.Type {
+	case geometry.TypePoint:
+		geomType, coords = "Point", scalePoint(g.Points[0], scale)
+	case geometry.TypePolyline:
+		geomType, coords = "LineString", scalePoints(g.Points, scale)
+	case geometry.TypePolygon:
+		geomType, coords = "Polygon", [][][2]float64{closeRing(scalePoints(g.Points, scale))}
+	case geometry.TypeRectangle, geometry.TypeEllipse:
+		props.ShapeType = string(g.Type)
+		geomType, coords = "Polygon", [][][2]float64{closeRing(scalePoints(outline(g), scale))}
+	default:
+		return nil, fmt.Errorf("annotation %s has unknown geometry type %q", a.ID, g.Type)
+	}
+
+	rawCoords, err := json.Marshal(coords)
+	if err != nil {
+		return nil, err
+	}
+	rawProps, err := json.Marshal(props)
+	if err != nil {
+		return nil, err
+	}
+	return &Feature{
+		Type:       "Feature",
+		ID:         a.ID,
+		Geometry:   &Geometry{Type: geomType, Coordinates: rawCoords},
+		Properties: rawProps,
+	}, nil
+}
+
+// outline returns the vertices of a rectangle or ellipse
+func outline(g geometry.Geometry) []geometry.Point {
+	b := g.Bounds()
+	if g.Type == geometry.TypeRectangle {
+		return []geometry.Point{{b.MinX, b.MinY}, {b.MaxX, b.MinY}, {b.MaxX, b.MaxY}, {b.MinX, b.MaxY}}
+	}
+
+	cx, cy := (b.MinX+b.MaxX)/2, (b.MinY+b.MaxY)/2
+	rx, ry := (b.MaxX-b.MinX)/2, (b.MaxY-b.MinY)/2
+	points := make([]geometry.Point, ellipseVertices)
+	for i := range points {
+		t := 2 * math.Pi * float64(i) / ellipseVertices
+		points[i] = geometry.Point{cx + rx*math.Cos(t), cy + ry*math.Sin(t)}
+	}
+	return points
+}
+
+func scalePoint(p geometry.Point, scale float64) [2]float64 {
+	return [2]float64{p[0] * scale, p[1] * scale}
+}
+
+func scalePoints(points []geometry.Point, scale float64) [][2]float64 {
+	scaled := make([][2]float64, len(points))
+	for i, p := range points {
+		scaled[i] = scalePoint(p, scale)
+	}
+	return scaled
+}
+
+// closeRing repeats the first position at the end, as GeoJSON requires
+func closeRing(ring [][2]float64) [][2]float64 {
+	return append(ring, ring[0])
+}
@@ -0,0 +1,292 @@
+package geojson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"cyto-viewer/internal/geometry"
+	"cyto-viewer/internal/storage"
+)
+
+// decodeAll decodes every feature of input, collecting feature errors, and
+// returns the first error that ends decoding
+func decodeAll(input string, scale float64) ([]storage.Annotation, []*FeatureError, error) {
+	d := NewDecoder(strings.NewReader(input), scale)
+	var annotations []storage.Annotation
+	var featureErrs []*FeatureError
+	for {
+		batch, err := d.Next()
+		var featureErr *FeatureError
+		switch {
+		case err == io.EOF:
+			return annotations, featureErrs, nil
+		case errors.As(err, &featureErr):
+			featureErrs = append(featureErrs, featureErr)
+		case err != nil:
+			return annotations, featureErrs, err
+		default:
+			annotations = append(annotations, batch...)
+		}
+	}
+}
+
+func encodeAll(t *testing.T, scale float64, annotations ...storage.Annotation) string {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, scale)
+	for i := range annotations {
+		if err := enc.Encode(&annotations[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func samePoints(a, b []geometry.Point) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i][0]-b[i][0]) > 1e-9 || math.Abs(a[i][1]-b[i][1]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRoundTrip(t *testing.T) {
+	layer := 3
+	annotations := []storage.Annotation{
+		{ID: "ann_1", Geometry: geometry.Geometry{Type: geometry.TypePoint, Points: []geometry.Point{{10, 20}}},
+			Label: "Mitosis", Color: "#ff8000", Layer: &layer, Author: "alice"},
+		{ID: "ann_2", Geometry: geometry.Geometry{Type: geometry.TypePolyline, Points: []geometry.Point{{0, 0}, {30, 40}, {60, 0}}}},
+		{ID: "ann_3", Geometry: geometry.Geometry{Type: geometry.TypePolygon, Points: []geometry.Point{{0, 0}, {100, 0}, {50, 80}}},
+			Label: "Tumor"},
+		{ID: "ann_4", Geometry: geometry.Geometry{Type: geometry.TypeRectangle, Points: []geometry.Point{{10, 10}, {110, 60}}}},
+		{ID: "ann_5", Geometry: geometry.Geometry{Type: geometry.TypeEllipse, Points: []geometry.Point{{200, 100}, {400, 150}}}},
+	}
+
+	// 1 for pixels, and a microns per pixel
+	for _, scale := range []float64{1, 0.25} {
+		got, featureErrs, err := decodeAll(encodeAll(t, scale, annotations...), scale)
+		if err != nil || len(featureErrs) > 0 {
+			t.Fatalf("scale %g: %v %v", scale, err, featureErrs)
+		}
+		if len(got) != len(annotations) {
+			t.Fatalf("scale %g: decoded %d annotations, want %d", scale, len(got), len(annotations))
+		}
+		for i, want := range annotations {
+			a := got[i]
+			if a.Geometry.Type != want.Geometry.Type || !samePoints(a.Geometry.Points, want.Geometry.Points) {
+				t.Errorf("scale %g: %s read back as %v, want %v", scale, want.ID, a.Geometry, want.Geometry)
+			}
+			if a.Label != want.Label || a.Color != want.Color {
+				t.Errorf("scale %g: %s label %q color %q, want %q %q", scale, want.ID, a.Label, a.Color, want.Label, want.Color)
+			}
+			if (a.Layer == nil) != (want.Layer == nil) || (a.Layer != nil && *a.Layer != *want.Layer) {
+				t.Errorf("scale %g: %s layer %v, want %v", scale, want.ID, a.Layer, want.Layer)
+			}
+		}
+	}
+}
+
+func TestEncodeScalesCoordinates(t *testing.T) {
+	out := encodeAll(t, 0.5, storage.Annotation{ID: "ann_1", Geometry: geometry.Geometry{
+		Type: geometry.TypePolygon, Points: []geometry.Point{{0, 0}, {100, 0}, {100, 200}}}})
+
+	var fc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry struct {
+				Type        string         `json:"type"`
+				Coordinates [][][2]float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties Properties `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal([]byte(out), &fc); err != nil {
+		t.Fatalf("output isn't JSON: %v\n%s", err, out)
+	}
+	if fc.Type != "FeatureCollection" || len(fc.Features) != 1 {
+		t.Fatalf("got %s with %d features", fc.Type, len(fc.Features))
+	}
+	f := fc.Features[0]
+	want := [][2]float64{{0, 0}, {50, 0}, {50, 100}, {0, 0}} // closed ring
+	if f.Geometry.Type != "Polygon" || len(f.Geometry.Coordinates) != 1 {
+		t.Fatalf("geometry %+v", f.Geometry)
+	}
+	for i, pos := range f.Geometry.Coordinates[0] {
+		if i >= len(want) || pos != want[i] {
+			t.Fatalf("ring %v, want %v", f.Geometry.Coordinates[0], want)
+		}
+	}
+	if f.Properties.ObjectType != "annotation" {
+		t.Errorf("objectType %q, want annotation", f.Properties.ObjectType)
+	}
+}
+
+func TestEncodeEmpty(t *testing.T) {
+	out := encodeAll(t, 1)
+	if strings.TrimSpace(out) != `{"type":"FeatureCollection","features":[]}` {
+		t.Errorf("got %q", out)
+	}
+	got, featureErrs, err := decodeAll(out, 1)
+	if err != nil || len(got) != 0 || len(featureErrs) != 0 {
+		t.Errorf("decoding an empty collection: %d annotations, %v, %v", len(got), featureErrs, err)
+	}
+}
+
+const pointFeature = `{"type": "Feature", "geometry": {"type": "Point", "coordinates": [4, 8]},
+	"properties": {"objectType": "annotation", "classification": {"name": "Stroma", "color": [0, 255, 0]}}}`
+
+func TestDecodeForms(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  int
+	}{
+		{"feature collection", `{"type": "FeatureCollection", "features": [` + pointFeature + `, ` + pointFeature + `]}`, 2},
+		{"members after features", `{"features": [` + pointFeature + `], "type": "FeatureCollection", "crs": null}`, 1},
+		{"array", `[` + pointFeature + `, ` + pointFeature + `, ` + pointFeature + `]`, 3},
+		{"empty array", `[]`, 0},
+		{"single feature", pointFeature, 1},
+		{"single feature, geometry last", `{"properties": null, "type": "Feature", "geometry": {"type": "Point", "coordinates": [1, 2]}}`, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, featureErrs, err := decodeAll(tt.input, 1)
+			if err != nil || len(featureErrs) > 0 {
+				t.Fatalf("%v %v", err, featureErrs)
+			}
+			if len(got) != tt.want {
+				t.Fatalf("decoded %d annotations, want %d", len(got), tt.want)
+			}
+			for _, a := range got {
+				if a.Geometry.Type != geometry.TypePoint {
+					t.Errorf("decoded %v, want a point", a.Geometry)
+				}
+			}
+		})
+	}
+
+	got, _, _ := decodeAll(pointFeature, 2)
+	if a := got[0]; a.Label != "Stroma" || a.Color != "#00ff00" || a.Geometry.Points[0] != (geometry.Point{2, 4}) {
+		t.Errorf("decoded %+v, want Stroma in #00ff00 at 2,4 after scaling", a)
+	}
+}
+
+func TestDecodeMultiGeometries(t *testing.T) {
+	input := `[
+		{"type": "Feature", "geometry": {"type": "MultiPoint", "coordinates": [[1, 1], [2, 2], [3, 3]]}, "properties": {"name": "cells"}},
+		{"type": "Feature", "geometry": {"type": "MultiLineString", "coordinates": [[[0, 0], [1, 1]], [[2, 2], [3, 3], [4, 2]]]}},
+		{"type": "Feature", "geometry": {"type": "MultiPolygon", "coordinates": [
+			[[[0, 0], [10, 0], [10, 10], [0, 10], [0, 0]]],
+			[[[20, 20], [30, 20], [25, 30], [20, 20]]]]},
+			"properties": {"shapeType": "rectangle"}}
+	]`
+	got, featureErrs, err := decodeAll(input, 1)
+	if err != nil || len(featureErrs) > 0 {
+		t.Fatalf("%v %v", err, featureErrs)
+	}
+
+	want := []struct {
+		typ    geometry.Type
+		points int
+	}{
+		{geometry.TypePoint, 1}, {geometry.TypePoint, 1}, {geometry.TypePoint, 1},
+		{geometry.TypePolyline, 2}, {geometry.TypePolyline, 3},
+		// shapeType describes a single shape, so it doesn't apply to the parts
+		{geometry.TypePolygon, 4}, {geometry.TypePolygon, 3},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("decoded %d annotations, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		if got[i].Geometry.Type != w.typ || len(got[i].Geometry.Points) != w.points {
+			t.Errorf("annotation %d is %v, want a %s of %d points", i, got[i].Geometry, w.typ, w.points)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if got[i].Label != "cells" {
+			t.Errorf("point %d has label %q, want the feature's", i, got[i].Label)
+		}
+	}
+}
+
+func TestDecodeFeatureErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		feature string
+		field   string
+	}{
+		{"wrong JSON type", `{"type": "Feature", "geometry": {"type": 5}}`, "geometry.type"},
+		{"not a feature", `{"type": "Polygon", "geometry": {"type": "Point", "coordinates": [1, 1]}}`, "type"},
+		{"no geometry", `{"type": "Feature"}`, "geometry"},
+		{"unsupported geometry", `{"type": "Feature", "geometry": {"type": "GeometryCollection", "coordinates": []}}`, "geometry.type"},
+		{"short position", `{"type": "Feature", "geometry": {"type": "Point", "coordinates": [1]}}`, "geometry.coordinates"},
+		{"coordinates of another type", `{"type": "Feature", "geometry": {"type": "Point", "coordinates": [[1, 2]]}}`, "geometry.coordinates"},
+		{"polygon with a hole", `{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [
+			[[0, 0], [10, 0], [10, 10], [0, 0]], [[2, 2], [3, 2], [3, 3], [2, 2]]]}}`, "geometry.coordinates"},
+		{"empty multipoint", `{"type": "Feature", "geometry": {"type": "MultiPoint", "coordinates": []}}`, "geometry.coordinates"},
+		{"degenerate polygon", `{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [[[0, 0], [1, 1], [0, 0]]]}}`, "geometry"},
+		{"color out of range", `{"type": "Feature", "geometry": {"type": "Point", "coordinates": [1, 1]},
+			"properties": {"classification": {"name": "x", "color": [300, 0, 0]}}}`, "properties.classification.color"},
+		{"negative focus layer", `{"type": "Feature", "geometry": {"type": "Point", "coordinates": [1, 1]},
+			"properties": {"focusLayer": -1}}`, "properties.focusLayer"},
+		{"bad properties", `{"type": "Feature", "geometry": {"type": "Point", "coordinates": [1, 1]},
+			"properties": {"isLocked": "yes"}}`, "properties"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The bad feature comes second; decoding carries on past it
+			input := `[` + pointFeature + `, ` + tt.feature + `, ` + pointFeature + `]`
+			got, featureErrs, err := decodeAll(input, 1)
+			if err != nil {
+				t.Fatalf("decoding stopped: %v", err)
+			}
+			if len(featureErrs) != 1 {
+				t.Fatalf("got feature errors %v, want one", featureErrs)
+			}
+			if fe := featureErrs[0]; fe.Index != 1 || fe.Field != tt.field {
+				t.Errorf("error at features[%d].%s (%s), want features[1].%s", fe.Index, fe.Field, fe.Message, tt.field)
+			}
+			if len(got) != 2 {
+				t.Errorf("decoded %d annotations around the bad feature, want 2", len(got))
+			}
+		})
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ``},
+		{"number", `42`},
+		{"string", `"FeatureCollection"`},
+		{"truncated array", `[` + pointFeature},
+		{"truncated collection", `{"type": "FeatureCollection", "features": [`},
+		{"features not an array", `{"type": "FeatureCollection", "features": {}}`},
+		{"object that isn't a feature", `{"type": "Topology", "objects": {}}`},
+		{"trailing data", `[] []`},
+		{"broken JSON", `[{"type": "Feature",]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeAll(tt.input, 1)
+			var featureErr *FeatureError
+			if err == nil || errors.As(err, &featureErr) {
+				t.Errorf("got %v, want an error ending decoding", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// Package geometry measures shapes drawn on a slide. Coordinates are slide
+// pixels at full resolution; conversion to physical units is by the slide's
+// microns per pixel.
+package geometry
+
+import (
+	"fmt"
+	"math"
+)
+
+// Type is the kind of shape a Geometry describes
+type Type string
+
+const (
+	TypePoint     Type = "point"
+	TypePolyline  Type = "polyline"
+	TypePolygon   Type = "polygon"
+	TypeRectangle Type = "rectangle" // two opposite corners
+	TypeEllipse   Type = "ellipse"   // two opposite corners of its bounding box
+)
+
+// Largest number of vertices accepted in one shape
+const MaxPoints = 100000
+
+// Point is an x, y pair, encoded as [x, y]
+type Point [2]float64
+
+// Geometry is a shape in slide pixel coordinates. Polygons are implicitly
+// closed: the last point need not repeat the first.
+type Geometry struct {
+	Type   Type    `json:"type"`
+	Points []Point `json:"points"`
+}
+
+// Rect is an axis-aligned bounding box
+type Rect struct {
+	MinX float64 `json:"minX"`
+	MinY float64 `json:"minY"`
+	MaxX float64 `json:"maxX"`
+	MaxY float64 `json:"maxY"`
+}
+
+// Validate checks that the shape has the number of points its type needs
+// and that every coordinate is finite
+func (g *Geometry) Validate() error {
+	n := len(g.Points)
+	switch g.Type {
+	case TypePoint:
+		if n != 1 {
+			return fmt.Errorf("a point needs exactly 1 point, got %d", n)
+		}
+	case TypePolyline:
+		if n < 2 {
+			return fmt.Errorf("a polyline needs at least 2 points, got %d", n)
+		}
+	case TypePolygon:
+		if n < 3 {
+			return fmt.Errorf("a polygon needs at least 3 points, got %d", n)
+		}
+	case TypeRectangle, TypeEllipse:
+		if n != 2 {
+			return fmt.Errorf("a %s needs exactly 2 corner points, got %d", g.Type, n)
+		}
+	default:
+		return fmt.Errorf("unknown geometry type %q", g.Type)
+	}
+	if n > MaxPoints {
+		return fmt.Errorf("%d points exceeds the limit of %d", n, MaxPoints)
+	}
+
+	for i, p := range g.Points {
+		if math.IsNaN(p[0]) || math.IsInf(p[0], 0) || math.IsNaN(p[1]) || math.IsInf(p[1], 0) {
+			return fmt.Errorf("point %d is not finite", i)
+		}
+	}
+	return nil
+}
+
+// Bounds returns the shape's bounding box
+func (g *Geometry) Bounds() Rect {
+	if len(g.Points) == 0 {
+		return Rect{}
+	}
+
+	b := Rect{MinX: g.Points[0][0], MinY: g.Points[0][1], MaxX: g.Points[0][0], MaxY: g.Points[0][1]}
+	for _, p := range g.Points[1:] {
+		b.MinX = math.Min(b.MinX, p[0])
+		b.MinY = math.Min(b.MinY, p[1])
+		b.MaxX = math.Max(b.MaxX, p[0])
+		b.MaxY = math.Max(b.MaxY, p[1])
+	}
+	return b
+}
+
+// Length returns the length of a polyline, or the perimeter of a closed
+// shape, in pixels. Points have no length.
+func (g *Geometry) Length() float64 {
+	switch g.Type {
+	case TypePolyline:
+		return pathLength(g.Points)
+	case TypePolygon:
+		if len(g.Points) == 0 {
+			return 0
+		}
+		return pathLength(g.Points) + distance(g.Points[len(g.Points)-1], g.Points[0])
+	case TypeRectangle:
+		b := g.Bounds()
+		return 2 * ((b.MaxX - b.MinX) + (b.MaxY - b.MinY))
+	case TypeEllipse:
+		// Ramanujan's approximation, exact for circles
+		a, c := g.radii()
+		if a+c == 0 {
+			return 0
+		}
+		h := (a - c) * (a - c) / ((a + c) * (a + c))
+		return math.Pi * (a + c) * (1 + 3*h/(10+math.Sqrt(4-3*h)))
+	default:
+		return 0
+	}
+}
+
+// Area returns the area enclosed by a closed shape in square pixels.
+// Self-intersecting polygons are measured by the shoelace formula, so
+// overlapping lobes with opposite winding partly cancel.
+func (g *Geometry) Area() float64 {
+	switch g.Type {
+	case TypePolygon:
+		sum := 0.0
+		for i, p := range g.Points {
+			q := g.Points[(i+1)%len(g.Points)]
+			sum += p[0]*q[1] - q[0]*p[1]
+		}
+		return math.Abs(sum) / 2
+	case TypeRectangle:
+		b := g.Bounds()
+		return (b.MaxX - b.MinX) * (b.MaxY - b.MinY)
+	case TypeEllipse:
+		a, c := g.radii()
+		return math.Pi * a * c
+	default:
+		return 0
+	}
+}
+
+// Closed reports whether the shape encloses an area
+func (g *Geometry) Closed() bool {
+	switch g.Type {
+	case TypePolygon, TypeRectangle, TypeEllipse:
+		return true
+	default:
+		return false
+	}
+}
+
+// Intersects reports whether the shape's bounding box overlaps r
+func (g *Geometry) Intersects(r Rect) bool {
+	b := g.Bounds()
+	return b.MinX <= r.MaxX && b.MaxX >= r.MinX && b.MinY <= r.MaxY && b.MaxY >= r.MinY
+}
+
+// radii returns the semi-axes of an ellipse
+func (g *Geometry) radii() (float64, float64) {
+	b := g.Bounds()
+	return (b.MaxX - b.MinX) / 2, (b.MaxY - b.MinY) / 2
+}
+
+func pathLength(points []Point) float64 {
+	total := 0.0
+	for i := 1; i < len(points); i++ {
+		total += distance(points[i-1], points[i])
+	}
+	return total
+}
+
+func distance(p, q Point) float64 {
+	return math.Hypot(q[0]-p[0], q[1]-p[1])
+}
+
+// Measurement is a shape's size in pixels and, when the pixel size is
+// known, in micrometres
+type Measurement struct {
+	Length          float64  `json:"lengthPx"`
+	Area            float64  `json:"areaPx"`
+	MicronsPerPixel *float64 `json:"micronsPerPixel"`
+	LengthMicrons   *float64 `json:"lengthUm"`
+	AreaMicrons     *float64 `json:"areaUm2"`
+}
+
+// Measure measures the shape on a slide sampled at micronsPerPixel; zero
+// leaves the physical sizes unset
+func (g *Geometry) Measure(micronsPerPixel float64) Measurement {
+	m := Measurement{
+		Length: g.Length(),
+		Area:   g.Area(),
+	}
+	if micronsPerPixel > 0 {
+		length := m.Length * micronsPerPixel
+		area := m.Area * micronsPerPixel * micronsPerPixel
+		m.MicronsPerPixel = &micronsPerPixel
+		m.LengthMicrons = &length
+		m.AreaMicrons = &area
+	}
+	return m
+}
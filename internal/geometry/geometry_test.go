@@ -0,0 +1,122 @@
+package geometry
+
+import (
+	"math"
+	"testing"
+)
+
+func polygon(points ...Point) Geometry {
+	return Geometry{Type: TypePolygon, Points: points}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestMeasureShapes(t *testing.T) {
+	tests := []struct {
+		name         string
+		shape        Geometry
+		length, area float64
+		bounds       Rect
+	}{
+		{"unit square", polygon(Point{0, 0}, Point{1, 0}, Point{1, 1}, Point{0, 1}), 4, 1, Rect{0, 0, 1, 1}},
+		{"unit square wound clockwise", polygon(Point{0, 0}, Point{0, 1}, Point{1, 1}, Point{1, 0}), 4, 1, Rect{0, 0, 1, 1}},
+		// Repeating the first point closes the ring a second time at no cost
+		{"self-closing ring", polygon(Point{0, 0}, Point{3, 0}, Point{3, 4}, Point{0, 0}), 12, 6, Rect{0, 0, 3, 4}},
+		{"triangle", polygon(Point{0, 0}, Point{3, 0}, Point{3, 4}), 12, 6, Rect{0, 0, 3, 4}},
+		// Opposite lobes cancel under the shoelace formula
+		{"bow tie", polygon(Point{0, 0}, Point{2, 2}, Point{2, 0}, Point{0, 2}), 4 + 4*math.Sqrt2, 0, Rect{0, 0, 2, 2}},
+		{"empty polygon", polygon(), 0, 0, Rect{}},
+		{"one-point polygon", polygon(Point{5, 7}), 0, 0, Rect{5, 7, 5, 7}},
+		{"rectangle from any corners", Geometry{Type: TypeRectangle, Points: []Point{{10, 40}, {30, 20}}}, 80, 400, Rect{10, 20, 30, 40}},
+		{"circle", Geometry{Type: TypeEllipse, Points: []Point{{0, 0}, {2, 2}}}, 2 * math.Pi, math.Pi, Rect{0, 0, 2, 2}},
+		// Ramanujan's approximation, 4e-7 short of the true 13.3648932
+		{"ellipse", Geometry{Type: TypeEllipse, Points: []Point{{0, 0}, {6, 2}}}, 13.36489277982672, 3 * math.Pi, Rect{0, 0, 6, 2}},
+		{"ellipse of no size", Geometry{Type: TypeEllipse, Points: []Point{{4, 4}, {4, 4}}}, 0, 0, Rect{4, 4, 4, 4}},
+		{"polyline", Geometry{Type: TypePolyline, Points: []Point{{0, 0}, {3, 4}, {3, 10}}}, 11, 0, Rect{0, 0, 3, 10}},
+		{"point", Geometry{Type: TypePoint, Points: []Point{{8, 9}}}, 0, 0, Rect{8, 9, 8, 9}},
+	}
+	for _, tt := range tests {
+		if got := tt.shape.Length(); !near(got, tt.length) {
+			t.Errorf("%s: length %v, want %v", tt.name, got, tt.length)
+		}
+		if got := tt.shape.Area(); !near(got, tt.area) {
+			t.Errorf("%s: area %v, want %v", tt.name, got, tt.area)
+		}
+		if got := tt.shape.Bounds(); got != tt.bounds {
+			t.Errorf("%s: bounds %+v, want %+v", tt.name, got, tt.bounds)
+		}
+	}
+}
+
+func TestMeasureScalesByMicronsPerPixel(t *testing.T) {
+	rect := Geometry{Type: TypeRectangle, Points: []Point{{0, 0}, {10, 20}}}
+
+	m := rect.Measure(0.25)
+	if m.Length != 60 || m.Area != 200 {
+		t.Errorf("measured %v px, %v px², want 60, 200", m.Length, m.Area)
+	}
+	if m.MicronsPerPixel == nil || *m.MicronsPerPixel != 0.25 ||
+		m.LengthMicrons == nil || !near(*m.LengthMicrons, 15) ||
+		m.AreaMicrons == nil || !near(*m.AreaMicrons, 12.5) {
+		t.Errorf("measured %+v, want 15um and 12.5um²", m)
+	}
+
+	// Without a pixel size only pixel measures are known
+	m = rect.Measure(0)
+	if m.Length != 60 || m.Area != 200 || m.MicronsPerPixel != nil || m.LengthMicrons != nil || m.AreaMicrons != nil {
+		t.Errorf("measured %+v without a pixel size", m)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		shape Geometry
+		ok    bool
+	}{
+		{"point", Geometry{Type: TypePoint, Points: []Point{{1, 1}}}, true},
+		{"point with two points", Geometry{Type: TypePoint, Points: []Point{{1, 1}, {2, 2}}}, false},
+		{"polyline", Geometry{Type: TypePolyline, Points: []Point{{0, 0}, {1, 1}}}, true},
+		{"one-point polyline", Geometry{Type: TypePolyline, Points: []Point{{0, 0}}}, false},
+		{"triangle", polygon(Point{0, 0}, Point{1, 0}, Point{1, 1}), true},
+		{"empty polygon", polygon(), false},
+		{"one-point polygon", polygon(Point{0, 0}), false},
+		{"two-point polygon", polygon(Point{0, 0}, Point{1, 1}), false},
+		{"rectangle", Geometry{Type: TypeRectangle, Points: []Point{{0, 0}, {1, 1}}}, true},
+		{"rectangle with three corners", Geometry{Type: TypeRectangle, Points: []Point{{0, 0}, {1, 1}, {2, 2}}}, false},
+		{"ellipse with one corner", Geometry{Type: TypeEllipse, Points: []Point{{0, 0}}}, false},
+		{"unknown type", Geometry{Type: "circle", Points: []Point{{0, 0}}}, false},
+		{"NaN", polygon(Point{0, 0}, Point{math.NaN(), 0}, Point{1, 1}), false},
+		{"infinite", Geometry{Type: TypePoint, Points: []Point{{math.Inf(1), 0}}}, false},
+		{"too many points", Geometry{Type: TypePolyline, Points: make([]Point, MaxPoints+1)}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.shape.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestIntersects(t *testing.T) {
+	square := polygon(Point{10, 10}, Point{20, 10}, Point{20, 20}, Point{10, 20})
+
+	tests := []struct {
+		name string
+		r    Rect
+		want bool
+	}{
+		{"inside", Rect{12, 12, 18, 18}, true},
+		{"containing", Rect{0, 0, 100, 100}, true},
+		{"overlapping", Rect{15, 15, 30, 30}, true},
+		{"touching an edge", Rect{20, 0, 30, 30}, true},
+		{"beside", Rect{21, 10, 30, 20}, false},
+		{"below", Rect{10, 21, 20, 30}, false},
+	}
+	for _, tt := range tests {
+		if got := square.Intersects(tt.r); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
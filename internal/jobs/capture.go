@@ -0,0 +1,121 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/storage"
+)
+
+var (
+	ErrSlideNotFound   = errors.New("slide not found")
+	ErrOverlayNotFound = errors.New("overlay not found")
+)
+
+// Capture re-acquires a region of an existing slide and stores it as an
+// overlay on that slide. The region is given in slide pixels. Captures are
+// short, so unlike scans they run in the caller rather than the queue; one
+// fails with scanner.ErrScannerBusy while a scan is running, and with
+// ErrUnknownScanner if the slide's scanner is no longer configured.
+func (q *Queue) Capture(ctx context.Context, slideID string, req *scanner.CaptureRequest, owner string) (storage.Overlay, error) {
+	slide, ok := q.slides.Get(slideID)
+	if !ok {
+		return storage.Overlay{}, ErrSlideNotFound
+	}
+	if req.X < 0 || req.Y < 0 || req.Width <= 0 || req.Height <= 0 ||
+		req.X+req.Width > slide.Width || req.Y+req.Height > slide.Height {
+		return storage.Overlay{}, &scanner.ValidationError{Violations: []scanner.Violation{{
+			Field: "region",
+			Message: fmt.Sprintf("region %d,%d %dx%d is not inside the %dx%d slide",
+				req.X, req.Y, req.Width, req.Height, slide.Width, slide.Height),
+		}}}
+	}
+
+	// Only the scanner that scanned the slide shares its stage coordinates
+	sc, ok := q.scanners.Get(slide.Scanner)
+	if !ok {
+		return storage.Overlay{}, fmt.Errorf("slide %s was scanned on %q: %w", slideID, slide.Scanner, ErrUnknownScanner)
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return storage.Overlay{}, err
+	}
+	id = "overlay_" + id
+
+	// The scanner addresses the stage, not the slide
+	stage := *req
+	stage.X += slide.OriginX
+	stage.Y += slide.OriginY
+
+	image, err := sc.Capture(ctx, &stage)
+	if err != nil {
+		return storage.Overlay{}, err
+	}
+
+	err = cutTiles(image, func(x, y int, tile *storage.StoredTile) error {
+		return q.tiles.PutOverlay(slideID, id, x, y, 0, tile)
+	})
+	if err != nil {
+		q.tiles.DeleteOverlay(slideID, id)
+		return storage.Overlay{}, fmt.Errorf("failed to store capture: %w", err)
+	}
+
+	overlay := storage.Overlay{
+		ID:          id,
+		X:           req.X,
+		Y:           req.Y,
+		Width:       req.Width,
+		Height:      req.Height,
+		Layer:       image.Layer,
+		Objective:   req.Objective,
+		ImageWidth:  image.Width,
+		ImageHeight: image.Height,
+		TileSize:    layerTileSize(image),
+		Owner:       owner,
+		Created:     time.Now(),
+	}
+	if info, ok := sc.GetLayerInfo()[image.Layer]; ok {
+		overlay.FocusDepth = info.FocusDepth
+	}
+	if slide.MicronsPerPixel > 0 && image.Width > 0 {
+		// The image may sample the region more finely than the scan did
+		overlay.MicronsPerPixel = slide.MicronsPerPixel * float64(req.Width) / float64(image.Width)
+	}
+
+	err = q.slides.Update(slideID, func(s *storage.Slide) {
+		s.Overlays = append(s.Overlays, overlay)
+	})
+	if err != nil {
+		// The slide was deleted while capturing
+		q.tiles.DeleteOverlay(slideID, id)
+		return storage.Overlay{}, ErrSlideNotFound
+	}
+
+	q.log.Info("Region captured", "slide", slideID, "overlay", id, "layer", image.Layer)
+	return overlay, nil
+}
+
+// DeleteOverlay removes an overlay and its tiles
+func (q *Queue) DeleteOverlay(slideID, overlayID string) error {
+	found := false
+	err := q.slides.Update(slideID, func(s *storage.Slide) {
+		for i, o := range s.Overlays {
+			if o.ID == overlayID {
+				s.Overlays = append(s.Overlays[:i], s.Overlays[i+1:]...)
+				found = true
+				return
+			}
+		}
+	})
+	if err != nil {
+		return ErrSlideNotFound
+	}
+	if !found {
+		return ErrOverlayNotFound
+	}
+	return q.tiles.DeleteOverlay(slideID, overlayID)
+}
@@ -0,0 +1,156 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/storage"
+)
+
+// putSlide adds a scanned slide taken at origin on the simulator's stage
+func putSlide(t *testing.T, slides *storage.SlideCatalog, id string, originX, originY int) {
+	t.Helper()
+	err := slides.Put(storage.Slide{ID: id, Width: 1024, Height: 1024, TileSize: 256, OriginX: originX, OriginY: originY,
+		Scanner: "sim", Status: storage.SlideComplete, MicronsPerPixel: 0.25, Created: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCaptureValidatesRegion(t *testing.T) {
+	addr := startSimulator(t, "-layers", "4", "-width", "2048", "-height", "2048")
+	q, slides := startSimQueue(t, addr)
+	// The slide ends 1024 pixels short of the stage's far edge
+	putSlide(t, slides, "slide-1", 1024, 0)
+
+	tests := []struct {
+		name      string
+		req       scanner.CaptureRequest
+		wantField string
+	}{
+		{"negative x", scanner.CaptureRequest{X: -1, Width: 256, Height: 256}, "region"},
+		{"empty", scanner.CaptureRequest{Width: 0, Height: 256}, "region"},
+		{"past the slide's right edge", scanner.CaptureRequest{X: 900, Width: 256, Height: 256}, "region"},
+		{"past the slide's bottom edge", scanner.CaptureRequest{Y: 1000, Width: 256, Height: 25}, "region"},
+		{"unknown layer", scanner.CaptureRequest{Width: 256, Height: 256, Layer: 9}, "layer"},
+		{"negative objective", scanner.CaptureRequest{Width: 256, Height: 256, Objective: -40}, "objective"},
+	}
+	for _, tt := range tests {
+		_, err := q.Capture(context.Background(), "slide-1", &tt.req, "")
+		var invalid *scanner.ValidationError
+		if !errors.As(err, &invalid) || invalid.Violations[0].Field != tt.wantField {
+			t.Errorf("%s: got %v, want a violation of %s", tt.name, err, tt.wantField)
+		}
+	}
+
+	if _, err := q.Capture(context.Background(), "slide-9", &scanner.CaptureRequest{Width: 256, Height: 256}, ""); !errors.Is(err, ErrSlideNotFound) {
+		t.Errorf("unknown slide: %v, want ErrSlideNotFound", err)
+	}
+	if slide, _ := slides.Get("slide-1"); len(slide.Overlays) != 0 {
+		t.Errorf("rejected captures stored overlays: %+v", slide.Overlays)
+	}
+}
+
+func TestCaptureNeedsSlideScanner(t *testing.T) {
+	q := openTestQueue(t, t.TempDir())
+
+	// Another scanner's stage coordinates wouldn't match the slide's
+	for _, scannerID := range []string{"retired", ""} {
+		err := q.slides.Put(storage.Slide{ID: "slide-1", Width: 1024, Height: 1024, Scanner: scannerID, Created: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = q.Capture(context.Background(), "slide-1", &scanner.CaptureRequest{Width: 256, Height: 256}, "")
+		if !errors.Is(err, ErrUnknownScanner) {
+			t.Errorf("slide scanned on %q: %v, want ErrUnknownScanner", scannerID, err)
+		}
+	}
+}
+
+func TestCaptureStoresOverlay(t *testing.T) {
+	addr := startSimulator(t, "-layers", "4", "-width", "2048", "-height", "2048", "-tile-size", "256", "-layer-spacing", "0.5")
+	q, slides := startSimQueue(t, addr)
+	putSlide(t, slides, "offset", 512, 256)
+	putSlide(t, slides, "stage", 0, 0)
+
+	req := scanner.CaptureRequest{X: 128, Y: 64, Width: 256, Height: 256, Layer: 2, Objective: 40}
+	overlay, err := q.Capture(context.Background(), "offset", &req, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overlay.X != 128 || overlay.Y != 64 || overlay.Width != 256 || overlay.Layer != 2 || overlay.Objective != 40 ||
+		overlay.ImageWidth != 256 || overlay.TileSize != 256 || overlay.FocusDepth != 1 ||
+		overlay.MicronsPerPixel != 0.25 || overlay.Owner != "alice" {
+		t.Errorf("overlay %+v", overlay)
+	}
+	if req.X != 128 || req.Y != 64 {
+		t.Errorf("caller's request moved to %d,%d", req.X, req.Y)
+	}
+
+	slide, _ := slides.Get("offset")
+	if stored, ok := slide.Overlay(overlay.ID); !ok || stored.ID != overlay.ID {
+		t.Fatalf("overlay not on the slide: %+v", slide.Overlays)
+	}
+	tile, err := q.tiles.GetOverlay("offset", overlay.ID, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same stage region captured through a slide at the stage origin
+	// gives the same image
+	same := scanner.CaptureRequest{X: 128 + 512, Y: 64 + 256, Width: 256, Height: 256, Layer: 2, Objective: 40}
+	direct, err := q.Capture(context.Background(), "stage", &same, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	directTile, err := q.tiles.GetOverlay("stage", direct.ID, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tile.Data, directTile.Data) {
+		t.Error("capture wasn't offset from the slide's origin to the stage")
+	}
+
+	if err := q.DeleteOverlay("offset", overlay.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.tiles.GetOverlay("offset", overlay.ID, 0, 0, 0); !errors.Is(err, storage.ErrTileNotFound) {
+		t.Errorf("deleted overlay's tile: %v", err)
+	}
+	if err := q.DeleteOverlay("offset", overlay.ID); !errors.Is(err, ErrOverlayNotFound) {
+		t.Errorf("second delete: %v, want ErrOverlayNotFound", err)
+	}
+}
+
+func TestCaptureBusyDuringScan(t *testing.T) {
+	addr := startSimulator(t, "-layers", "4", "-width", "2048", "-height", "2048", "-scan-delay", "1s")
+	q, slides := startSimQueue(t, addr)
+	putSlide(t, slides, "slide-1", 0, 0)
+
+	job, err := q.Submit(scanner.ScanRequest{Width: 256, Height: 256, Layers: []int{0, 1, 2, 3}}, "sim", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Cancel(job.ID)
+
+	sc := q.scanners.Default()
+	deadline := time.Now().Add(5 * time.Second)
+	for sc.State().State != scanner.StateScanning {
+		if time.Now().After(deadline) {
+			t.Fatal("scan didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = q.Capture(context.Background(), "slide-1", &scanner.CaptureRequest{Width: 256, Height: 256}, "")
+	if !errors.Is(err, scanner.ErrScannerBusy) {
+		t.Errorf("capture during a scan: %v, want ErrScannerBusy", err)
+	}
+	if slide, _ := slides.Get("slide-1"); len(slide.Overlays) != 0 {
+		t.Errorf("refused capture stored overlays: %+v", slide.Overlays)
+	}
+}
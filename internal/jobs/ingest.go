@@ -0,0 +1,135 @@
+package jobs
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/storage"
+)
+
+const (
+	defaultTileSize = 512
+
+	// JPEG quality of tiles cut from JPEG layers; high enough that tiles
+	// served as is are visually lossless
+	ingestQuality = 90
+)
+
+func layerTileSize(layer *scanner.LayerData) int {
+	if layer.TileSize > 0 {
+		return layer.TileSize
+	}
+	return defaultTileSize
+}
+
+// ingestLayer cuts a received layer into tiles and stores them at the base
+// zoom level
+func ingestLayer(tiles *storage.TileStore, slideID string, layer *scanner.LayerData) error {
+	return cutTiles(layer, func(x, y int, tile *storage.StoredTile) error {
+		return tiles.Put(slideID, layer.Layer, x, y, 0, tile)
+	})
+}
+
+// cutTiles decodes a layer and hands each of its tiles to put. Edge tiles
+// are padded so every tile is full size. JPEG layers are cut into JPEG
+// tiles; raw and PNG layers into PNG tiles, so they stay lossless.
+func cutTiles(layer *scanner.LayerData, put func(x, y int, tile *storage.StoredTile) error) error {
+	img, format, err := decodeLayer(layer)
+	if err != nil {
+		return err
+	}
+	encode := encodePNG
+	if format == "jpeg" {
+		encode = encodeJPEG
+	} else {
+		format = "png"
+	}
+
+	size := layerTileSize(layer)
+	bounds := img.Bounds()
+	tile := image.NewRGBA(image.Rect(0, 0, size, size))
+	var buf bytes.Buffer
+
+	for ty := 0; ty*size < bounds.Dy(); ty++ {
+		for tx := 0; tx*size < bounds.Dx(); tx++ {
+			src := image.Rect(tx*size, ty*size, (tx+1)*size, (ty+1)*size).Add(bounds.Min)
+
+			draw.Draw(tile, tile.Bounds(), image.White, image.Point{}, draw.Src)
+			draw.Draw(tile, tile.Bounds(), img, src.Min, draw.Src)
+
+			buf.Reset()
+			if err := encode(&buf, tile); err != nil {
+				return err
+			}
+
+			err := put(tx, ty, &storage.StoredTile{
+				Data:   append([]byte(nil), buf.Bytes()...),
+				Format: format,
+				Width:  size,
+				Height: size,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func encodeJPEG(buf *bytes.Buffer, tile *image.RGBA) error {
+	return jpeg.Encode(buf, tile, &jpeg.Options{Quality: ingestQuality})
+}
+
+func encodePNG(buf *bytes.Buffer, tile *image.RGBA) error {
+	return (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(buf, tile)
+}
+
+// decodeLayer decodes compressed layer data, or wraps raw RGBA. It also
+// returns the layer's encoding: the image format name, or "raw".
+func decodeLayer(layer *scanner.LayerData) (image.Image, string, error) {
+	if layer.Compressed {
+		img, format, err := image.Decode(bytes.NewReader(layer.RawData))
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to decode layer %d: %w", layer.Layer, err)
+		}
+		return img, format, nil
+	}
+
+	if len(layer.RawData) != layer.Width*layer.Height*4 {
+		return nil, "", fmt.Errorf("layer %d: %d bytes of raw data for %dx%d RGBA",
+			layer.Layer, len(layer.RawData), layer.Width, layer.Height)
+	}
+	return &image.RGBA{
+		Pix:    layer.RawData,
+		Stride: layer.Width * 4,
+		Rect:   image.Rect(0, 0, layer.Width, layer.Height),
+	}, "raw", nil
+}
+
+// newAcquisition converts the scanner's acquisition record into the slide's
+// provenance, attributing it to the job's owner
+func newAcquisition(a *scanner.Acquisition, job *Job) storage.Acquisition {
+	return storage.Acquisition{
+		Scanner:            a.Scanner,
+		ScannerName:        a.ScannerName,
+		SerialNumber:       a.Device.SerialNumber,
+		Firmware:           a.Device.Firmware,
+		ProtocolVersion:    a.Device.ProtocolVersion,
+		CalibrationProfile: a.CalibrationProfile,
+		Calibrated:         a.Calibrated,
+		Objective:          a.Objective,
+		Magnification:      a.Magnification,
+		MicronsPerPixel:    a.MicronsPerPixel,
+		FocusDepths:        a.FocusDepths,
+		Temperature:        a.Temperature,
+		Operator:           job.Owner,
+		JobID:              job.ID,
+		Started:            a.Started,
+	}
+}
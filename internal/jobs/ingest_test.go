@@ -0,0 +1,94 @@
+package jobs
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/storage"
+)
+
+// testLayer is a 200x150 gradient, so tiles of 64 leave padded edge tiles
+func testLayer() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 200, 150))
+	for y := 0; y < 150; y++ {
+		for x := 0; x < 200; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x ^ y), A: 255})
+		}
+	}
+	return img
+}
+
+func TestCutTiles(t *testing.T) {
+	src := testLayer()
+	var jpegData, pngData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngData, src); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		layer      scanner.LayerData
+		wantFormat string
+		lossless   bool
+	}{
+		{"raw", scanner.LayerData{RawData: src.Pix, Width: 200, Height: 150, TileSize: 64}, "png", true},
+		{"png", scanner.LayerData{RawData: pngData.Bytes(), Width: 200, Height: 150, TileSize: 64, Compressed: true}, "png", true},
+		{"jpeg", scanner.LayerData{RawData: jpegData.Bytes(), Width: 200, Height: 150, TileSize: 64, Compressed: true}, "jpeg", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tiles := make(map[image.Point]*storage.StoredTile)
+			err := cutTiles(&tt.layer, func(x, y int, tile *storage.StoredTile) error {
+				tiles[image.Pt(x, y)] = tile
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tiles) != 4*3 {
+				t.Fatalf("got %d tiles, want 4x3", len(tiles))
+			}
+
+			for pos, tile := range tiles {
+				if tile.Format != tt.wantFormat || tile.Width != 64 || tile.Height != 64 {
+					t.Fatalf("tile %v is %s %dx%d, want %s 64x64", pos, tile.Format, tile.Width, tile.Height, tt.wantFormat)
+				}
+				img, format, err := image.Decode(bytes.NewReader(tile.Data))
+				if err != nil || format != tt.wantFormat {
+					t.Fatalf("tile %v doesn't decode as %s: %v", pos, tt.wantFormat, err)
+				}
+				if !tt.lossless {
+					continue
+				}
+				for y := 0; y < 64; y++ {
+					for x := 0; x < 64; x++ {
+						sx, sy := pos.X*64+x, pos.Y*64+y
+						want := color.RGBA{255, 255, 255, 255} // padding
+						if sx < 200 && sy < 150 {
+							want = src.RGBAAt(sx, sy)
+						}
+						if got := color.RGBAModel.Convert(img.At(x, y)); got != want {
+							t.Fatalf("tile %v pixel %d,%d is %v, want %v", pos, x, y, got, want)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCutTilesRawSizeMismatch(t *testing.T) {
+	layer := &scanner.LayerData{RawData: make([]byte, 100), Width: 200, Height: 150, TileSize: 64}
+	err := cutTiles(layer, func(x, y int, tile *storage.StoredTile) error { return nil })
+	if err == nil {
+		t.Fatal("expected an error for raw data that doesn't fill the layer")
+	}
+}
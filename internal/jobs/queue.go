@@ -0,0 +1,643 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/storage"
+	"cyto-viewer/pkg/logger"
+)
+
+// Status is the lifecycle state of a scan job
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusCompleted Status = "completed"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+var (
+	ErrJobNotFound    = errors.New("job not found")
+	ErrJobFinished    = errors.New("job already finished")
+	ErrUnknownScanner = errors.New("unknown scanner")
+)
+
+// Finished jobs kept in the queue file for history
+const maxFinishedJobs = 500
+
+// How often the worker rechecks for work when nothing wakes it
+const pollInterval = 5 * time.Second
+
+// Progress reports how far a running scan has got
+type Progress struct {
+	LayersTotal    int        `json:"layersTotal"`
+	LayersReceived int        `json:"layersReceived"`
+	BytesReceived  int64      `json:"bytesReceived"`
+	ETA            *time.Time `json:"eta,omitempty"`
+}
+
+// Job is a scan submitted to the queue. Its slide is created when the scan
+// starts and fills in layer by layer.
+type Job struct {
+	ID        string              `json:"id"`
+	Status    Status              `json:"status"`
+	Request   scanner.ScanRequest `json:"request"`
+	Scanner   string              `json:"scanner,omitempty"`  // requested scanner; empty for any
+	Assigned  string              `json:"assigned,omitempty"` // scanner running or that ran the job
+	SlideID   string              `json:"slideId"`
+	Owner     string              `json:"owner,omitempty"`
+	Submitted time.Time           `json:"submitted"`
+	Started   *time.Time          `json:"started,omitempty"`
+	Finished  *time.Time          `json:"finished,omitempty"`
+	Progress  Progress            `json:"progress"`
+	Error     string              `json:"error,omitempty"`
+}
+
+// EventType identifies a change in a job's lifecycle
+type EventType string
+
+const (
+	EventQueued      EventType = "queued"   // submitted, or requeued after an interrupted scan
+	EventStarted     EventType = "started"  // scan began
+	EventLayerStored EventType = "layer"    // a layer's tiles were stored and can be viewed
+	EventFinished    EventType = "finished" // completed, failed or cancelled
+)
+
+// Event is passed to OnEvent listeners. Layer is set for EventLayerStored.
+type Event struct {
+	Type  EventType
+	Job   Job
+	Layer int
+}
+
+func (j *Job) finished() bool {
+	switch j.Status {
+	case StatusCompleted, StatusFailed, StatusCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+func (j *Job) clone() Job {
+	c := *j
+	c.Request.Layers = append([]int(nil), j.Request.Layers...)
+	return c
+}
+
+// Queue schedules scan jobs onto a fleet of scanners. Each scanner has a
+// worker that, whenever its scanner is ready, takes the oldest queued job
+// that may run there. Jobs are persisted in jobs.json, so queued work
+// survives restarts; a job interrupted by shutdown or by its scanner
+// disconnecting is requeued and scanned again.
+type Queue struct {
+	path     string
+	scanners *scanner.Registry
+	tiles    *storage.TileStore
+	slides   *storage.SlideCatalog
+	log      *logger.Logger
+
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	order   []string                      // job IDs in submission order
+	cancels map[string]context.CancelFunc // running jobs
+
+	listenersMu sync.Mutex
+	listeners   []func(Event)
+
+	wake    map[string]chan struct{} // per scanner worker
+	ctx     context.Context
+	stop    context.CancelFunc
+	workers sync.WaitGroup
+	closed  sync.Once
+}
+
+func OpenQueue(basePath string, scanners *scanner.Registry, tiles *storage.TileStore,
+	slides *storage.SlideCatalog, log *logger.Logger) (*Queue, error) {
+	ctx, stop := context.WithCancel(context.Background())
+	q := &Queue{
+		path:     filepath.Join(basePath, "jobs.json"),
+		scanners: scanners,
+		tiles:    tiles,
+		slides:   slides,
+		log:      log,
+		jobs:     make(map[string]*Job),
+		cancels:  make(map[string]context.CancelFunc),
+		wake:     make(map[string]chan struct{}),
+		ctx:      ctx,
+		stop:     stop,
+	}
+	for _, sc := range scanners.List() {
+		q.wake[sc.ID()] = make(chan struct{}, 1)
+	}
+
+	if err := q.load(); err != nil {
+		stop()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *Queue) load() error {
+	data, err := os.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read job queue: %w", err)
+	}
+
+	var jobs []*Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return fmt.Errorf("failed to parse job queue: %w", err)
+	}
+
+	for _, job := range jobs {
+		if job.Status == StatusRunning {
+			// Interrupted by a restart: scan again from the start
+			job.Status = StatusQueued
+			job.Started = nil
+			job.Assigned = ""
+			job.Progress = Progress{LayersTotal: len(job.Request.Layers)}
+		}
+		q.jobs[job.ID] = job
+		q.order = append(q.order, job.ID)
+	}
+
+	return nil
+}
+
+// Start runs a worker per scanner that feeds it queued jobs whenever it is
+// ready
+func (q *Queue) Start() {
+	q.scanners.OnStateChange(func(sc *scanner.Interface, c scanner.StateChange) {
+		if c.State == scanner.StateReady {
+			q.notifyScanner(sc.ID())
+		}
+	})
+	for _, sc := range q.scanners.List() {
+		q.workers.Add(1)
+		go q.run(sc)
+	}
+}
+
+// Close stops the workers. Running scans are interrupted and stay queued.
+func (q *Queue) Close() error {
+	q.closed.Do(func() {
+		q.stop()
+		q.workers.Wait()
+	})
+	return nil
+}
+
+// OnEvent registers fn to be called on every job event. Listeners run on
+// the worker goroutine and should not block.
+func (q *Queue) OnEvent(fn func(Event)) {
+	q.listenersMu.Lock()
+	defer q.listenersMu.Unlock()
+	q.listeners = append(q.listeners, fn)
+}
+
+// emit notifies listeners. Callers must not hold q.mu.
+func (q *Queue) emit(e Event) {
+	q.listenersMu.Lock()
+	listeners := q.listeners
+	q.listenersMu.Unlock()
+
+	for _, fn := range listeners {
+		fn(e)
+	}
+}
+
+// notify wakes every worker
+func (q *Queue) notify() {
+	for id := range q.wake {
+		q.notifyScanner(id)
+	}
+}
+
+func (q *Queue) notifyScanner(id string) {
+	select {
+	case q.wake[id] <- struct{}{}:
+	default:
+	}
+}
+
+// Submit queues a scan and returns the new job. scannerID pins the job to
+// one scanner; empty lets any idle scanner take it. The request must be
+// valid for the pinned scanner, or for at least one scanner; otherwise a
+// *scanner.ValidationError is returned.
+func (q *Queue) Submit(req scanner.ScanRequest, scannerID, owner string) (Job, error) {
+	if err := q.validate(&req, scannerID); err != nil {
+		return Job{}, err
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	job := &Job{
+		ID:        id,
+		Status:    StatusQueued,
+		Request:   req,
+		Scanner:   scannerID,
+		SlideID:   "slide_" + id,
+		Owner:     owner,
+		Submitted: time.Now(),
+		Progress:  Progress{LayersTotal: len(req.Layers)},
+	}
+	job.Request.Layers = append([]int(nil), req.Layers...)
+
+	q.mu.Lock()
+	q.jobs[id] = job
+	q.order = append(q.order, id)
+	err = q.saveLocked()
+	snapshot := job.clone()
+	q.mu.Unlock()
+
+	if err != nil {
+		return Job{}, fmt.Errorf("failed to persist job: %w", err)
+	}
+
+	q.emit(Event{Type: EventQueued, Job: snapshot})
+	if scannerID != "" {
+		q.notifyScanner(scannerID)
+	} else {
+		q.notify()
+	}
+	return snapshot, nil
+}
+
+func (q *Queue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.clone(), true
+}
+
+// List returns all jobs, oldest first
+func (q *Queue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]Job, 0, len(q.order))
+	for _, id := range q.order {
+		jobs = append(jobs, q.jobs[id].clone())
+	}
+	return jobs
+}
+
+// Cancel cancels a queued job, or stops a running one. Layers already
+// stored remain viewable on the job's slide.
+func (q *Queue) Cancel(id string) (Job, error) {
+	q.mu.Lock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		q.mu.Unlock()
+		return Job{}, ErrJobNotFound
+	}
+	if job.finished() {
+		q.mu.Unlock()
+		return job.clone(), ErrJobFinished
+	}
+
+	if cancel, running := q.cancels[id]; running {
+		// The worker records the cancellation when the scan unwinds
+		cancel()
+		q.mu.Unlock()
+		return job.clone(), nil
+	}
+
+	q.finishLocked(job, StatusCancelled, nil)
+	err := q.saveLocked()
+	snapshot := job.clone()
+	q.mu.Unlock()
+
+	q.emit(Event{Type: EventFinished, Job: snapshot})
+	return snapshot, err
+}
+
+func (q *Queue) validate(req *scanner.ScanRequest, scannerID string) error {
+	if scannerID != "" {
+		sc, ok := q.scanners.Get(scannerID)
+		if !ok {
+			return ErrUnknownScanner
+		}
+		return sc.ValidateScan(req)
+	}
+
+	var first error
+	for _, sc := range q.scanners.List() {
+		err := sc.ValidateScan(req)
+		if err == nil {
+			return nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// run is the worker of one scanner
+func (q *Queue) run(sc *scanner.Interface) {
+	defer q.workers.Done()
+
+	for q.ctx.Err() == nil {
+		if sc.State().State == scanner.StateReady {
+			if job, ctx, cancel := q.claim(sc); job != nil {
+				q.execute(ctx, sc, job)
+				cancel()
+				continue
+			}
+		}
+
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-q.wake[sc.ID()]:
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// claim marks the oldest queued job that may run on the scanner as running
+// there, so no other worker takes it. Unpinned jobs the scanner can't
+// perform are left for others. It returns nil if there is none.
+func (q *Queue) claim(sc *scanner.Interface) (*Job, context.Context, context.CancelFunc) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	scannerID := sc.ID()
+	for _, id := range q.order {
+		job := q.jobs[id]
+		if job.Status != StatusQueued || (job.Scanner != "" && job.Scanner != scannerID) {
+			continue
+		}
+		if job.Scanner == "" && sc.ValidateScan(&job.Request) != nil {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(q.ctx)
+		now := time.Now()
+		job.Status = StatusRunning
+		job.Assigned = scannerID
+		job.Started = &now
+		job.Progress = Progress{LayersTotal: len(job.Request.Layers)}
+		q.cancels[job.ID] = cancel
+		q.persistLocked(job)
+		return job, ctx, cancel
+	}
+	return nil, nil, nil
+}
+
+func (q *Queue) execute(ctx context.Context, sc *scanner.Interface, job *Job) {
+	q.mu.Lock()
+	started := job.clone()
+	q.mu.Unlock()
+	req := started.Request
+	now := *started.Started
+
+	q.emit(Event{Type: EventStarted, Job: started})
+	if err := ctx.Err(); err != nil {
+		// Cancelled as it was claimed
+		q.complete(job, err)
+		return
+	}
+
+	q.log.Info("Scan job started", "job", job.ID, "scanner", sc.ID(), "slide", job.SlideID, "layers", len(req.Layers))
+
+	// Every layer is sampled alike
+	var micronsPerPixel float64
+	layerInfo := sc.GetLayerInfo()
+	for _, layer := range req.Layers {
+		if info, ok := layerInfo[layer]; ok {
+			micronsPerPixel = info.MicronsPerPixel
+			break
+		}
+	}
+
+	if _, exists := q.slides.Get(job.SlideID); !exists {
+		err := q.slides.Put(storage.Slide{
+			ID:      job.SlideID,
+			Name:    fmt.Sprintf("Scan %s", now.Format("2006-01-02 15:04")),
+			Created: now,
+			Width:   req.Width,
+			Height:  req.Height,
+			OriginX: req.StartX,
+			OriginY: req.StartY,
+			Scanner: sc.ID(),
+			Status:  storage.SlideScanning,
+			JobID:   job.ID,
+
+			MicronsPerPixel: micronsPerPixel,
+		})
+		if err != nil {
+			q.complete(job, fmt.Errorf("failed to create slide: %w", err))
+			return
+		}
+	} else {
+		q.slides.Update(job.SlideID, func(s *storage.Slide) {
+			s.Status = storage.SlideScanning
+			s.Scanner = sc.ID()
+			s.MicronsPerPixel = micronsPerPixel
+		})
+	}
+
+	acquisition, err := sc.Scan(ctx, &req, func(layer *scanner.LayerData) error {
+		if err := ingestLayer(q.tiles, job.SlideID, layer); err != nil {
+			return fmt.Errorf("failed to store layer %d: %w", layer.Layer, err)
+		}
+		q.slides.Update(job.SlideID, func(s *storage.Slide) {
+			s.Width, s.Height, s.TileSize = layer.Width, layer.Height, layerTileSize(layer)
+			s.Layers = appendLayer(s.Layers, layer.Layer)
+		})
+		q.layerReceived(job, layer.Layer, len(layer.RawData))
+		return nil
+	})
+	if acquisition != nil {
+		record := newAcquisition(acquisition, job)
+		q.slides.Update(job.SlideID, func(s *storage.Slide) {
+			s.Acquisition = &record
+		})
+	}
+
+	q.complete(job, err)
+}
+
+// layerReceived updates progress and the ETA after each stored layer
+func (q *Queue) layerReceived(job *Job, layer, size int) {
+	q.mu.Lock()
+
+	p := &job.Progress
+	p.LayersReceived++
+	p.BytesReceived += int64(size)
+
+	if remaining := p.LayersTotal - p.LayersReceived; remaining > 0 && job.Started != nil {
+		perLayer := time.Since(*job.Started) / time.Duration(p.LayersReceived)
+		eta := time.Now().Add(perLayer * time.Duration(remaining))
+		p.ETA = &eta
+	} else {
+		p.ETA = nil
+	}
+
+	q.persistLocked(job)
+	snapshot := job.clone()
+	q.mu.Unlock()
+
+	q.emit(Event{Type: EventLayerStored, Job: snapshot, Layer: layer})
+}
+
+// complete records the outcome of a scan
+func (q *Queue) complete(job *Job, err error) {
+	q.mu.Lock()
+
+	delete(q.cancels, job.ID)
+
+	switch {
+	case err == nil:
+		q.finishLocked(job, StatusCompleted, nil)
+	case q.ctx.Err() != nil, errors.Is(err, scanner.ErrNotConnected), errors.Is(err, scanner.ErrDisconnected):
+		// Shutting down, or the scanner dropped before or during the scan:
+		// leave it queued to run again once it reconnects
+		job.Status = StatusQueued
+		job.Started = nil
+		job.Assigned = ""
+		q.log.Warn("Scan job requeued", "job", job.ID, "error", err)
+	case errors.Is(err, context.Canceled):
+		q.finishLocked(job, StatusCancelled, nil)
+	default:
+		q.finishLocked(job, StatusFailed, err)
+	}
+
+	slideStatus := storage.SlideFailed
+	switch job.Status {
+	case StatusCompleted:
+		slideStatus = storage.SlideComplete
+	case StatusQueued:
+		slideStatus = storage.SlideScanning
+	}
+	q.slides.Update(job.SlideID, func(s *storage.Slide) {
+		s.Status = slideStatus
+	})
+
+	q.persistLocked(job)
+	snapshot := job.clone()
+	q.mu.Unlock()
+
+	if snapshot.Status == StatusQueued {
+		q.emit(Event{Type: EventQueued, Job: snapshot})
+	} else {
+		q.emit(Event{Type: EventFinished, Job: snapshot})
+	}
+}
+
+func (q *Queue) finishLocked(job *Job, status Status, err error) {
+	now := time.Now()
+	job.Status = status
+	job.Finished = &now
+	job.Progress.ETA = nil
+	if err != nil {
+		job.Error = err.Error()
+	}
+
+	switch status {
+	case StatusFailed:
+		q.log.Error("Scan job failed", "job", job.ID, "error", err)
+	default:
+		q.log.Info("Scan job finished", "job", job.ID, "status", status)
+	}
+}
+
+// persistLocked saves the queue after a worker changed job. The worker
+// carries on if that fails: the change stands in memory and the next save
+// writes it.
+func (q *Queue) persistLocked(job *Job) {
+	if err := q.saveLocked(); err != nil {
+		q.log.Error("Failed to persist job queue", "job", job.ID, "status", job.Status, "error", err)
+	}
+}
+
+func (q *Queue) saveLocked() error {
+	q.pruneLocked()
+
+	jobs := make([]*Job, 0, len(q.order))
+	for _, id := range q.order {
+		jobs = append(jobs, q.jobs[id])
+	}
+
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// pruneLocked drops the oldest finished jobs beyond maxFinishedJobs
+func (q *Queue) pruneLocked() {
+	finished := 0
+	for _, id := range q.order {
+		if q.jobs[id].finished() {
+			finished++
+		}
+	}
+	if finished <= maxFinishedJobs {
+		return
+	}
+
+	kept := q.order[:0]
+	for _, id := range q.order {
+		if finished > maxFinishedJobs && q.jobs[id].finished() {
+			delete(q.jobs, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	q.order = kept
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func appendLayer(layers []int, layer int) []int {
+	for _, l := range layers {
+		if l == layer {
+			return layers
+		}
+	}
+	return append(layers, layer)
+}
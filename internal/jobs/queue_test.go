@@ -0,0 +1,544 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"cyto-viewer/internal/config"
+	"cyto-viewer/internal/scanner"
+	"cyto-viewer/internal/storage"
+	"cyto-viewer/pkg/logger"
+)
+
+// openTestQueue opens a queue in dir for scanners "a" and "b", which can't
+// be reached, so nothing runs unless a test claims it. The workers aren't
+// started.
+func openTestQueue(t *testing.T, dir string) *Queue {
+	t.Helper()
+
+	var cfgs []config.ScannerConfig
+	for _, id := range []string{"a", "b"} {
+		cfgs = append(cfgs, config.ScannerConfig{ID: id, Protocol: "tcp", Address: "127.0.0.1:1",
+			Timeout: time.Second, MaxScanArea: 1 << 20})
+	}
+	registry, err := scanner.NewRegistry(cfgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { registry.Close() })
+
+	slides, err := storage.OpenSlideCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := OpenQueue(dir, registry, storage.NewTileStore(dir), slides, logger.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func testScan() scanner.ScanRequest {
+	return scanner.ScanRequest{Width: 512, Height: 512, Layers: []int{0, 1}}
+}
+
+// startSimQueue runs a queue with one scanner "sim" connected to the
+// simulator at addr, once the scanner is ready
+func startSimQueue(t *testing.T, addr string, configure ...func(*config.ScannerConfig)) (*Queue, *storage.SlideCatalog) {
+	t.Helper()
+	return startFleetQueue(t, map[string]string{"sim": addr}, configure...)
+}
+
+// startFleetQueue runs a queue with a scanner for each ID connected to the
+// simulator at its address, once every scanner is ready. The scanners are
+// configured in ID order, and configure adjusts each one.
+func startFleetQueue(t *testing.T, addrs map[string]string, configure ...func(*config.ScannerConfig)) (*Queue, *storage.SlideCatalog) {
+	t.Helper()
+	dir := t.TempDir()
+
+	var cfgs []config.ScannerConfig
+	for id, addr := range addrs {
+		cfgs = append(cfgs, config.ScannerConfig{ID: id, Protocol: "tcp", Address: addr,
+			Timeout: 5 * time.Second, ScanTimeout: 5 * time.Second, MaxFrameSize: 64 << 20, MaxScanArea: 1 << 22})
+	}
+	sort.Slice(cfgs, func(i, j int) bool { return cfgs[i].ID < cfgs[j].ID })
+	for i := range cfgs {
+		for _, fn := range configure {
+			fn(&cfgs[i])
+		}
+	}
+	registry, err := scanner.NewRegistry(cfgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { registry.Close() })
+
+	slides, err := storage.OpenSlideCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := OpenQueue(dir, registry, storage.NewTileStore(dir), slides, logger.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+
+	deadline := time.Now().Add(10 * time.Second)
+	for _, sc := range registry.List() {
+		for sc.State().State != scanner.StateReady {
+			if time.Now().After(deadline) {
+				t.Fatalf("scanner %s not ready: %+v", sc.ID(), sc.State())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	q.Start()
+	return q, slides
+}
+
+// waitForJob waits until a job has finished
+func waitForJob(t *testing.T, q *Queue, id string) Job {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		job, ok := q.Get(id)
+		if !ok {
+			t.Fatalf("job %s not found", id)
+		}
+		if job.finished() {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s still %s", id, job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// recordEvents collects the queue's events
+func recordEvents(q *Queue) func() []Event {
+	var mu sync.Mutex
+	var events []Event
+	q.OnEvent(func(e Event) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	})
+	return func() []Event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Event(nil), events...)
+	}
+}
+
+func TestQueueSubmit(t *testing.T) {
+	q := openTestQueue(t, t.TempDir())
+	events := recordEvents(q)
+
+	job, err := q.Submit(testScan(), "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != StatusQueued || job.SlideID != "slide_"+job.ID || job.Owner != "alice" || job.Progress.LayersTotal != 2 {
+		t.Errorf("submitted %+v", job)
+	}
+	if got := events(); len(got) != 1 || got[0].Type != EventQueued || got[0].Job.ID != job.ID {
+		t.Errorf("events %+v, want one queued event", got)
+	}
+
+	if _, err := q.Submit(testScan(), "c", "alice"); !errors.Is(err, ErrUnknownScanner) {
+		t.Errorf("submit to an unknown scanner: %v, want ErrUnknownScanner", err)
+	}
+	var invalid *scanner.ValidationError
+	if _, err := q.Submit(scanner.ScanRequest{Width: 512, Height: 512}, "a", "alice"); !errors.As(err, &invalid) {
+		t.Errorf("submit without layers: %v, want a validation error", err)
+	}
+	if len(q.List()) != 1 {
+		t.Errorf("rejected submissions were queued: %+v", q.List())
+	}
+}
+
+func TestQueueClaim(t *testing.T) {
+	dir := t.TempDir()
+	q := openTestQueue(t, dir)
+	a, _ := q.scanners.Get("a")
+	b, _ := q.scanners.Get("b")
+
+	pinned, err := q.Submit(testScan(), "b", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := q.Submit(testScan(), "", "")
+	second, _ := q.Submit(testScan(), "", "")
+
+	// Scanner a takes the unpinned jobs oldest first and leaves b's job
+	for _, want := range []string{first.ID, second.ID} {
+		job, _, cancel := q.claim(a)
+		if job == nil {
+			t.Fatalf("a claimed nothing, want %s", want)
+		}
+		defer cancel()
+		if job.ID != want || job.Status != StatusRunning || job.Assigned != "a" || job.Started == nil {
+			t.Errorf("a claimed %+v, want %s running there", job, want)
+		}
+	}
+	if job, _, _ := q.claim(a); job != nil {
+		t.Errorf("a claimed %s, pinned to b", job.ID)
+	}
+	job, _, cancel := q.claim(b)
+	if job == nil || job.ID != pinned.ID {
+		t.Fatalf("b claimed %+v, want %s", job, pinned.ID)
+	}
+	cancel()
+
+	// Claims are persisted
+	data, err := os.ReadFile(filepath.Join(dir, "jobs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []Job
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range saved {
+		if job.Status != StatusRunning {
+			t.Errorf("saved job %s is %s, want running", job.ID, job.Status)
+		}
+	}
+}
+
+func TestQueueWorkersPerScanner(t *testing.T) {
+	// Scanner a has a smaller stage than b
+	q, _ := startFleetQueue(t, map[string]string{
+		"a": startSimulator(t, "-layers", "2", "-width", "1024", "-height", "1024", "-scan-delay", "200ms"),
+		"b": startSimulator(t, "-layers", "2", "-width", "2048", "-height", "2048", "-scan-delay", "200ms"),
+	})
+	submit := func(req scanner.ScanRequest, scannerID string) Job {
+		t.Helper()
+		job, err := q.Submit(req, scannerID, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+	want := func(id string, assigned string) Job {
+		t.Helper()
+		job := waitForJob(t, q, id)
+		if job.Status != StatusCompleted || job.Assigned != assigned {
+			t.Errorf("job %s finished %s on %q, want completed on %s", id, job.Status, job.Assigned, assigned)
+		}
+		return job
+	}
+
+	// Jobs pinned to each scanner run there, at the same time
+	onA, onB := submit(testScan(), "a"), submit(testScan(), "b")
+	jobA, jobB := want(onA.ID, "a"), want(onB.ID, "b")
+	if !jobA.Started.Before(*jobB.Finished) || !jobB.Started.Before(*jobA.Finished) {
+		t.Errorf("scans ran one after the other: a %v-%v, b %v-%v", jobA.Started, jobA.Finished, jobB.Started, jobB.Finished)
+	}
+
+	// While a is busy, an unpinned job goes to idle b
+	busy := submit(testScan(), "a")
+	a, _ := q.scanners.Get("a")
+	deadline := time.Now().Add(5 * time.Second)
+	for a.State().State != scanner.StateScanning {
+		if time.Now().After(deadline) {
+			t.Fatal("scan on a didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	idle := submit(testScan(), "")
+	want(idle.ID, "b")
+	want(busy.ID, "a")
+
+	// An unpinned job beyond a's stage waits for b, even with a idle
+	wide := submit(scanner.ScanRequest{StartX: 1024, Width: 512, Height: 512, Layers: []int{0}}, "")
+	want(wide.ID, "b")
+}
+
+func TestQueueRequeuesInterruptedJobs(t *testing.T) {
+	dir := t.TempDir()
+	started := time.Now().Add(-time.Minute)
+	saved := []Job{
+		{ID: "done", Status: StatusCompleted, Request: testScan(), Finished: &started},
+		{ID: "interrupted", Status: StatusRunning, Request: testScan(), Assigned: "a", Started: &started,
+			Progress: Progress{LayersTotal: 2, LayersReceived: 1, BytesReceived: 100}},
+		{ID: "waiting", Status: StatusQueued, Request: testScan()},
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "jobs.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q := openTestQueue(t, dir)
+	list := q.List()
+	if len(list) != 3 || list[0].ID != "done" || list[1].ID != "interrupted" || list[2].ID != "waiting" {
+		t.Fatalf("loaded %+v, want the saved order", list)
+	}
+	if job := list[1]; job.Status != StatusQueued || job.Assigned != "" || job.Started != nil ||
+		job.Progress != (Progress{LayersTotal: 2}) {
+		t.Errorf("interrupted job loaded as %+v, want it queued from the start", job)
+	}
+	if list[0].Status != StatusCompleted {
+		t.Errorf("finished job loaded as %s", list[0].Status)
+	}
+
+	// The interrupted job runs before the one queued after it
+	a, _ := q.scanners.Get("a")
+	if job, _, cancel := q.claim(a); job == nil || job.ID != "interrupted" {
+		t.Errorf("claimed %+v, want the interrupted job", job)
+	} else {
+		cancel()
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	q := openTestQueue(t, t.TempDir())
+	events := recordEvents(q)
+
+	queued, _ := q.Submit(testScan(), "", "")
+	cancelled, err := q.Cancel(queued.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled.Status != StatusCancelled || cancelled.Finished == nil {
+		t.Errorf("cancelled %+v", cancelled)
+	}
+	if got := events(); len(got) != 2 || got[1].Type != EventFinished {
+		t.Errorf("events %+v, want queued then finished", got)
+	}
+	if _, err := q.Cancel(queued.ID); !errors.Is(err, ErrJobFinished) {
+		t.Errorf("cancel twice: %v, want ErrJobFinished", err)
+	}
+	if _, err := q.Cancel("missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("cancel missing: %v, want ErrJobNotFound", err)
+	}
+
+	// A running job is stopped, and cancelled once its scan unwinds
+	a, _ := q.scanners.Get("a")
+	q.Submit(testScan(), "", "")
+	job, ctx, cancel := q.claim(a)
+	defer cancel()
+	running, err := q.Cancel(job.ID)
+	if err != nil || running.Status != StatusRunning {
+		t.Fatalf("cancel running: %+v, %v", running, err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("running scan not stopped")
+	}
+	q.complete(job, ctx.Err())
+	if got, _ := q.Get(job.ID); got.Status != StatusCancelled {
+		t.Errorf("stopped job is %s, want cancelled", got.Status)
+	}
+}
+
+func TestQueueCompleteRequeuesDisconnected(t *testing.T) {
+	q := openTestQueue(t, t.TempDir())
+	a, _ := q.scanners.Get("a")
+	q.Submit(testScan(), "", "")
+	q.Submit(testScan(), "", "")
+
+	failed, _, cancelFailed := q.claim(a)
+	defer cancelFailed()
+	q.complete(failed, errors.New("hardware fault"))
+	if got, _ := q.Get(failed.ID); got.Status != StatusFailed || got.Error != "hardware fault" {
+		t.Errorf("failed job is %+v", got)
+	}
+
+	// The scanner dropping before or during the scan isn't the job's fault
+	for _, err := range []error{
+		scanner.ErrNotConnected,
+		fmt.Errorf("failed to receive layer data: %w", fmt.Errorf("%w: %w", scanner.ErrDisconnected, io.EOF)),
+	} {
+		dropped, _, cancelDropped := q.claim(a)
+		defer cancelDropped()
+		q.complete(dropped, err)
+		got, _ := q.Get(dropped.ID)
+		if got.Status != StatusQueued || got.Assigned != "" || got.Started != nil {
+			t.Errorf("job on a scanner that dropped with %q is %+v, want it queued again", err, got)
+		}
+	}
+}
+
+func TestQueueRequeuesScanOnDroppedLink(t *testing.T) {
+	// Answers the handshake and the scan's status poll, then drops the link
+	// on every CMD_SCAN
+	addr := startSimulator(t, "-layers", "2", "-width", "1024", "-height", "1024", "-fault-drop-after", "3")
+	q, slides := startSimQueue(t, addr)
+
+	var mu sync.Mutex
+	var seen []EventType
+	retried := make(chan struct{})
+	q.OnEvent(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, e.Type)
+		if len(seen) == 4 {
+			close(retried)
+		}
+	})
+
+	submitted, err := q.Submit(testScan(), "sim", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-retried:
+	case <-time.After(10 * time.Second):
+		t.Fatal("interrupted scan not retried")
+	}
+
+	mu.Lock()
+	want := []EventType{EventQueued, EventStarted, EventQueued, EventStarted}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Errorf("events %v, want %v", seen[:4], want)
+			break
+		}
+	}
+	mu.Unlock()
+	if job, _ := q.Get(submitted.ID); job.finished() || job.Error != "" {
+		t.Errorf("job %+v, want it still queued or running", job)
+	}
+	if slide, _ := slides.Get(submitted.SlideID); slide.Status != storage.SlideScanning {
+		t.Errorf("interrupted scan's slide is %s, want scanning", slide.Status)
+	}
+}
+
+func TestQueueScansSimulatedSlide(t *testing.T) {
+	addr := startSimulator(t, "-layers", "4", "-width", "2048", "-height", "2048",
+		"-tile-size", "256", "-scan-delay", "0")
+	q, slides := startSimQueue(t, addr)
+
+	layersStored := make(chan int, 4)
+	q.OnEvent(func(e Event) {
+		if e.Type == EventLayerStored {
+			layersStored <- e.Layer
+		}
+	})
+
+	submitted, err := q.Submit(scanner.ScanRequest{StartX: 256, StartY: 256, Width: 512, Height: 512, Layers: []int{1, 3}}, "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := waitForJob(t, q, submitted.ID)
+	if job.Status != StatusCompleted || job.Assigned != "sim" || job.Progress.LayersReceived != 2 || job.Progress.BytesReceived == 0 {
+		t.Fatalf("job finished as %+v", job)
+	}
+	if len(layersStored) != 2 {
+		t.Errorf("got %d layer events, want 2", len(layersStored))
+	}
+
+	slide, ok := slides.Get(job.SlideID)
+	if !ok {
+		t.Fatal("scan didn't create its slide")
+	}
+	if slide.Status != storage.SlideComplete || slide.Width != 512 || slide.Height != 512 || slide.TileSize != 256 ||
+		len(slide.Layers) != 2 || slide.JobID != job.ID || slide.Scanner != "sim" || slide.Acquisition == nil {
+		t.Errorf("slide %+v", slide)
+	}
+	for _, layer := range []int{1, 3} {
+		if _, err := q.tiles.Get(job.SlideID, layer, 1, 1, 0); err != nil {
+			t.Errorf("layer %d tile 1,1 not stored: %v", layer, err)
+		}
+	}
+}
+
+func TestQueueRecordsAcquisition(t *testing.T) {
+	addr := startSimulator(t, "-layers", "4", "-width", "2048", "-height", "2048", "-layer-spacing", "0.5",
+		"-firmware", "sim-2.3.1", "-serial-number", "SIM-0042", "-calibration-profile", "he-stain", "-require-calibration")
+	q, slides := startSimQueue(t, addr, func(cfg *config.ScannerConfig) {
+		cfg.Name = "Bench scanner"
+		cfg.Objective = "Plan Apo 40x/0.95"
+		cfg.Magnification = 40
+		cfg.MicronsPerPixel = 0.25
+	})
+
+	before := time.Now()
+	if err := q.scanners.Default().Calibrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	submitted, err := q.Submit(scanner.ScanRequest{Width: 512, Height: 512, Layers: []int{1, 3}}, "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := waitForJob(t, q, submitted.ID)
+	if job.Status != StatusCompleted {
+		t.Fatalf("job finished as %+v", job)
+	}
+
+	slide, _ := slides.Get(job.SlideID)
+	a := slide.Acquisition
+	if a == nil {
+		t.Fatal("slide has no acquisition record")
+	}
+	if a.Scanner != "sim" || a.ScannerName != "Bench scanner" || a.SerialNumber != "SIM-0042" ||
+		a.Firmware != "sim-2.3.1" || a.ProtocolVersion != scanner.ProtocolVersion {
+		t.Errorf("instrument %+v", a)
+	}
+	if a.CalibrationProfile != "he-stain" || a.Calibrated == nil || a.Calibrated.Before(before) || a.Calibrated.After(a.Started) {
+		t.Errorf("calibration %q at %v, scan started %v", a.CalibrationProfile, a.Calibrated, a.Started)
+	}
+	if a.Objective != "Plan Apo 40x/0.95" || a.Magnification != 40 || a.MicronsPerPixel != 0.25 || slide.MicronsPerPixel != 0.25 {
+		t.Errorf("optics %+v, slide at %gum per pixel", a, slide.MicronsPerPixel)
+	}
+	if len(a.FocusDepths) != 2 || a.FocusDepths[1] != 0.5 || a.FocusDepths[3] != 1.5 {
+		t.Errorf("focus depths %v, want 1: 0.5, 3: 1.5", a.FocusDepths)
+	}
+	// The simulator's stage drifts around 36.5C
+	if a.Temperature == nil || *a.Temperature < 36 || *a.Temperature > 37 {
+		t.Errorf("temperature %v", a.Temperature)
+	}
+	if a.Operator != "alice" || a.JobID != job.ID {
+		t.Errorf("operator %q for job %q", a.Operator, a.JobID)
+	}
+}
+
+func TestQueueCancelsSimulatedScan(t *testing.T) {
+	addr := startSimulator(t, "-layers", "4", "-width", "2048", "-height", "2048", "-scan-delay", "1s")
+	q, slides := startSimQueue(t, addr)
+
+	started := make(chan struct{}, 1)
+	q.OnEvent(func(e Event) {
+		if e.Type == EventStarted {
+			started <- struct{}{}
+		}
+	})
+
+	submitted, err := q.Submit(scanner.ScanRequest{Width: 256, Height: 256, Layers: []int{0, 1, 2, 3}}, "sim", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan didn't start")
+	}
+	if _, err := q.Cancel(submitted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	job := waitForJob(t, q, submitted.ID)
+	if job.Status != StatusCancelled || job.Progress.LayersReceived == 4 {
+		t.Errorf("job finished as %+v, want it cancelled mid-scan", job)
+	}
+	if slide, _ := slides.Get(job.SlideID); slide.Status != storage.SlideFailed {
+		t.Errorf("cancelled scan's slide is %s", slide.Status)
+	}
+}
@@ -0,0 +1,21 @@
+package jobs
+
+import (
+	"os"
+	"testing"
+
+	"cyto-viewer/internal/scanner/scannertest"
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	scannertest.Cleanup()
+	os.Exit(code)
+}
+
+// startSimulator starts the scanner simulator with the given flags and
+// returns its address
+func startSimulator(t *testing.T, args ...string) string {
+	t.Helper()
+	return scannertest.StartSimulator(t, args...)
+}
@@ -0,0 +1,64 @@
+package scanner
+
+import "time"
+
+// DeviceInfo identifies the scanner hardware, as reported in the CMD_CONNECT
+// handshake. Fields are empty for scanners older than protocol version 1.
+type DeviceInfo struct {
+	ProtocolVersion int    `json:"protocolVersion"`
+	Firmware        string `json:"firmware,omitempty"`
+	SerialNumber    string `json:"serialNumber,omitempty"`
+}
+
+// Acquisition describes how a scan was acquired: the instrument and its
+// state when the scan started
+type Acquisition struct {
+	Scanner            string
+	ScannerName        string
+	Device             DeviceInfo
+	CalibrationProfile string
+	Calibrated         *time.Time // last calibration before the scan
+	Objective          string
+	Magnification      int
+	MicronsPerPixel    float64
+	FocusDepths        map[int]float64 // micrometres, per requested layer
+	Temperature        *float64        // degrees Celsius, when the scanner reported it
+	Started            time.Time
+}
+
+// Device returns the identity reported when the scanner last connected
+func (s *Interface) Device() DeviceInfo {
+	s.layersMu.RLock()
+	defer s.layersMu.RUnlock()
+	return s.device
+}
+
+// acquisition records the instrument state for a scan of req. temperature
+// is nil if the status poll before the scan failed. Callers hold s.mu.
+func (s *Interface) acquisition(req *ScanRequest, temperature *float64) *Acquisition {
+	state := s.state.info()
+
+	s.layersMu.RLock()
+	defer s.layersMu.RUnlock()
+
+	depths := make(map[int]float64, len(req.Layers))
+	for _, layer := range req.Layers {
+		if info, ok := s.layerData[layer]; ok {
+			depths[layer] = info.FocusDepth
+		}
+	}
+
+	return &Acquisition{
+		Scanner:            s.config.ID,
+		ScannerName:        s.config.Name,
+		Device:             s.device,
+		CalibrationProfile: state.CalibrationProfile,
+		Calibrated:         state.Calibrated,
+		Objective:          s.config.Objective,
+		Magnification:      s.config.Magnification,
+		MicronsPerPixel:    s.config.MicronsPerPixel,
+		FocusDepths:        depths,
+		Temperature:        temperature,
+		Started:            time.Now(),
+	}
+}
@@ -3,7 +3,10 @@ package scanner
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"sync"
 	"time"
@@ -13,10 +16,18 @@ import (
 
 type Interface struct {
 	config    *config.ScannerConfig
-	conn      net.Conn
+	conn      *frameConn // nil unless ready; guarded by mu
 	mu        sync.Mutex
-	connected bool
+	state     *stateMachine
+
+	layersMu  sync.RWMutex // guards layerData and device apart from mu, so they can be read during scans
 	layerData map[int]*LayerInfo
+	device    DeviceInfo
+
+	ctx    context.Context // cancelled by Close
+	cancel context.CancelFunc
+	lost   chan struct{} // signalled when a ready connection drops
+	done   chan struct{} // closed when the reconnect loop exits
 }
 
 type LayerInfo struct {
@@ -26,21 +37,38 @@ type LayerInfo struct {
 	FocusDepth float64
 	TileSize   int
 	Format     string
+
+	// Physical pixel size, from the scanner's configured optics; the
+	// protocol doesn't report it
+	MicronsPerPixel float64
 }
 
 type ScanRequest struct {
-	StartX int
-	StartY int
-	Width  int
-	Height int
-	Layers []int // Which focus layers to capture
+	StartX int   `json:"startX"`
+	StartY int   `json:"startY"`
+	Width  int   `json:"width"`
+	Height int   `json:"height"`
+	Layers []int `json:"layers"` // Which focus layers to capture
+}
+
+// CaptureRequest selects a region to re-acquire with CMD_GET_IMAGE. The
+// focus is either a layer index or, when Depth is set, the layer nearest
+// that depth in micrometres.
+type CaptureRequest struct {
+	X         int
+	Y         int
+	Width     int
+	Height    int
+	Layer     int
+	Depth     *float64
+	Objective int // magnification, e.g. 40; zero keeps the current objective
 }
 
 type ScanResult struct {
-	SlideID   string
-	Timestamp time.Time
-	Layers    []*LayerData
-	Metadata  map[string]interface{}
+	SlideID     string
+	Timestamp   time.Time
+	Layers      []*LayerData
+	Acquisition *Acquisition
 }
 
 type LayerData struct {
@@ -66,101 +94,247 @@ const (
 	CMD_GET_IMAGE   = 0x08
 )
 
+// NewInterface starts maintaining a connection to the scanner in the
+// background. It doesn't wait for the scanner to be reachable: until it is,
+// commands fail with ErrNotConnected while reconnects back off.
 func NewInterface(cfg *config.ScannerConfig) (*Interface, error) {
+	switch cfg.Protocol {
+	case "tcp", "serial":
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", cfg.Protocol)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	iface := &Interface{
 		config:    cfg,
+		state:     newStateMachine(),
 		layerData: make(map[int]*LayerInfo),
+		ctx:       ctx,
+		cancel:    cancel,
+		lost:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	go iface.maintain()
+
+	return iface, nil
+}
+
+// ID returns the scanner's registry key
+func (s *Interface) ID() string {
+	return s.config.ID
+}
+
+// Name returns the scanner's display name
+func (s *Interface) Name() string {
+	return s.config.Name
+}
+
+// State returns the connection state and its recent transitions
+func (s *Interface) State() StateInfo {
+	return s.state.info()
+}
+
+// OnStateChange registers fn to be called on every state transition
+func (s *Interface) OnStateChange(fn func(StateChange)) {
+	s.state.onChange(fn)
+}
+
+// maintain connects, watches the connection until it drops and reconnects
+// with backoff, until Close
+func (s *Interface) maintain() {
+	defer close(s.done)
+
+	for {
+		if err := s.connect(); err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			s.state.set(StateError, err)
+
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(s.state.scheduleRetry()):
+			}
+			continue
+		}
+
+		if !s.watch() {
+			return
+		}
 	}
+}
+
+// watch probes a ready connection until it drops (true) or the interface is
+// closed (false)
+func (s *Interface) watch() bool {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
 
-	if err := iface.connect(); err != nil {
-		return nil, fmt.Errorf("failed to connect to scanner: %w", err)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return false
+		case <-s.lost:
+			return true
+		case <-ticker.C:
+			s.healthCheck()
+		}
 	}
+}
 
-	// Get layer information from scanner
-	if err := iface.queryLayerInfo(); err != nil {
-		return nil, fmt.Errorf("failed to query layer info: %w", err)
+func (s *Interface) healthCheck() {
+	// A command or scan in progress will notice a drop by itself
+	if !s.mu.TryLock() {
+		return
 	}
+	defer s.mu.Unlock()
 
-	return iface, nil
+	if s.conn == nil {
+		return
+	}
+	_, err := s.roundTrip(s.ctx, CMD_STATUS, nil)
+	s.check(err)
 }
 
 func (s *Interface) connect() error {
+	s.state.set(StateConnecting, nil)
+
+	rw, err := s.dial()
+	if err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Connect to scanner via TCP or serial
-	var err error
-	switch s.config.Protocol {
-	case "tcp":
-		s.conn, err = net.DialTimeout("tcp", s.config.Address, 10*time.Second)
-	case "serial":
-		// For serial connections, use a serial library
-		return fmt.Errorf("serial protocol not yet implemented")
+	// Drop any stale signal from the previous connection
+	select {
+	case <-s.lost:
 	default:
-		return fmt.Errorf("unsupported protocol: %s", s.config.Protocol)
 	}
+	s.conn = newFrameConn(rw, s.config.Timeout, s.config.MaxFrameSize)
 
+	// Send connection handshake
+	response, err := s.roundTrip(s.ctx, CMD_CONNECT, nil)
 	if err != nil {
-		return err
+		s.closeConn()
+		return fmt.Errorf("handshake failed: %w", err)
 	}
+	device, err := parseDeviceInfo(response)
+	if err != nil {
+		s.closeConn()
+		return fmt.Errorf("handshake failed: %w", err)
+	}
+	s.layersMu.Lock()
+	s.device = device
+	s.layersMu.Unlock()
 
-	// Send connection handshake
-	if err := s.sendCommand(CMD_CONNECT, nil); err != nil {
-		s.conn.Close()
-		return err
+	// Get layer information from scanner
+	if err := s.queryLayerInfo(); err != nil {
+		s.closeConn()
+		return fmt.Errorf("failed to query layer info: %w", err)
 	}
 
-	s.connected = true
+	s.state.set(StateReady, nil)
 	return nil
 }
 
-func (s *Interface) queryLayerInfo() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if !s.connected {
-		return fmt.Errorf("not connected to scanner")
+// dial opens the transport configured for the scanner
+func (s *Interface) dial() (io.ReadWriteCloser, error) {
+	// Connect to scanner via TCP or serial
+	switch s.config.Protocol {
+	case "tcp":
+		dialer := net.Dialer{Timeout: s.config.Timeout}
+		return dialer.DialContext(s.ctx, "tcp", s.config.Address)
+	case "serial":
+		return openSerial(s.config.Address, &s.config.Serial)
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", s.config.Protocol)
 	}
+}
 
+// queryLayerInfo refreshes the layer table. Callers hold s.mu.
+func (s *Interface) queryLayerInfo() error {
 	// Request layer information
-	if err := s.sendCommand(CMD_GET_LAYERS, nil); err != nil {
+	response, err := s.roundTrip(s.ctx, CMD_GET_LAYERS, nil)
+	if err != nil {
 		return err
 	}
 
-	// Read response
-	response, err := s.readResponse()
+	layers, err := parseLayerTable(response)
 	if err != nil {
 		return err
 	}
-
-	// Parse layer information
-	// Format: [num_layers][layer_1_info][layer_2_info]...
-	numLayers := int(binary.BigEndian.Uint32(response[:4]))
-	offset := 4
-
-	for i := 0; i < numLayers; i++ {
-		layerInfo := &LayerInfo{
-			LayerIndex: int(binary.BigEndian.Uint32(response[offset:])),
-			Width:      int(binary.BigEndian.Uint32(response[offset+4:])),
-			Height:     int(binary.BigEndian.Uint32(response[offset+8:])),
-			FocusDepth: float64(binary.BigEndian.Uint32(response[offset+12:])) / 1000.0,
-			TileSize:   int(binary.BigEndian.Uint32(response[offset+16:])),
-		}
-		s.layerData[layerInfo.LayerIndex] = layerInfo
-		offset += 20
+	for _, info := range layers {
+		info.MicronsPerPixel = s.config.MicronsPerPixel
 	}
 
+	s.layersMu.Lock()
+	s.layerData = layers
+	s.layersMu.Unlock()
 	return nil
 }
 
 func (s *Interface) StartScan(ctx context.Context, req *ScanRequest) (*ScanResult, error) {
+	result := &ScanResult{
+		SlideID:   fmt.Sprintf("slide_%d", time.Now().Unix()),
+		Timestamp: time.Now(),
+		Layers:    make([]*LayerData, 0, len(req.Layers)),
+	}
+
+	acquisition, err := s.Scan(ctx, req, func(layer *LayerData) error {
+		result.Layers = append(result.Layers, layer)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Acquisition = acquisition
+
+	return result, nil
+}
+
+// Scan runs a scan and hands each layer to onLayer as it arrives, so the
+// whole scan never has to be held in memory. If onLayer fails, the scan is
+// abandoned and the connection re-established. The acquisition record is
+// returned once the scan has been sent, even if it later fails.
+func (s *Interface) Scan(ctx context.Context, req *ScanRequest, onLayer func(*LayerData) error) (*Acquisition, error) {
+	if err := s.ValidateScan(req); err != nil {
+		return nil, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if !s.connected {
-		return nil, fmt.Errorf("not connected to scanner")
+	if s.conn == nil {
+		return nil, ErrNotConnected
 	}
 
+	// Record the stage temperature the scan starts at. A scanner that
+	// declines the poll doesn't stop the scan; a broken link does.
+	var temperature *float64
+	response, err := s.roundTrip(ctx, CMD_STATUS, nil)
+	var scanErr *ScannerError
+	switch {
+	case err == nil:
+		if status, err := parseStatus(response); err == nil {
+			t := status["temperature"].(float64)
+			temperature = &t
+		}
+	case !errors.As(err, &scanErr):
+		return nil, s.check(err)
+	}
+	acquisition := s.acquisition(req, temperature)
+
+	s.state.set(StateScanning, nil)
+	defer func() {
+		if s.conn != nil {
+			s.state.set(StateReady, nil)
+		}
+	}()
+
 	// Prepare scan command
 	cmdData := make([]byte, 20)
 	binary.BigEndian.PutUint32(cmdData[0:], uint32(req.StartX))
@@ -177,71 +351,137 @@ func (s *Interface) StartScan(ctx context.Context, req *ScanRequest) (*ScanResul
 	}
 
 	// Send scan command
-	if err := s.sendCommand(CMD_SCAN, cmdData); err != nil {
-		return nil, err
-	}
-
-	// Wait for scan to complete and receive data
-	result := &ScanResult{
-		SlideID:   fmt.Sprintf("slide_%d", time.Now().Unix()),
-		Timestamp: time.Now(),
-		Layers:    make([]*LayerData, 0, len(req.Layers)),
-		Metadata:  make(map[string]interface{}),
+	if err := s.conn.writeFrame(CMD_SCAN, cmdData); err != nil {
+		return nil, s.check(err)
 	}
 
 	// Receive layer data
+	pending := make(map[int]bool, len(req.Layers))
+	for _, layer := range req.Layers {
+		pending[layer] = true
+	}
 	for range req.Layers {
-		layerData, err := s.receiveLayerData(ctx)
+		layerData, err := s.receiveLayerData(ctx, CMD_SCAN)
+		if errors.Is(err, ErrNotCalibrated) {
+			s.state.setCalibrated(time.Time{}, "")
+		}
+		if err == nil && !pending[layerData.Layer] {
+			err = fmt.Errorf("%s: unrequested or repeated layer %d: %w", commandName(CMD_SCAN), layerData.Layer, ErrMalformedResponse)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to receive layer data: %w", err)
+			return acquisition, fmt.Errorf("failed to receive layer data: %w", s.abort(err))
+		}
+		delete(pending, layerData.Layer)
+		if err := onLayer(layerData); err != nil {
+			return acquisition, s.abort(err)
 		}
-		result.Layers = append(result.Layers, layerData)
 	}
 
-	return result, nil
+	return acquisition, nil
 }
 
-func (s *Interface) receiveLayerData(ctx context.Context) (*LayerData, error) {
-	// Read layer header
-	header := make([]byte, 32)
-	if _, err := s.conn.Read(header); err != nil {
+// Capture re-acquires a single region: it moves the focus with
+// CMD_SET_FOCUS, then reads the region back with CMD_GET_IMAGE. It fails
+// with ErrScannerBusy rather than wait while a scan holds the scanner.
+func (s *Interface) Capture(ctx context.Context, req *CaptureRequest) (*LayerData, error) {
+	if err := s.ValidateCapture(req); err != nil {
 		return nil, err
 	}
+	if s.state.get() == StateScanning {
+		return nil, ErrScannerBusy
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil, ErrNotConnected
+	}
 
-	layerData := &LayerData{
-		Layer:      int(binary.BigEndian.Uint32(header[0:])),
-		Width:      int(binary.BigEndian.Uint32(header[4:])),
-		Height:     int(binary.BigEndian.Uint32(header[8:])),
-		TilesX:     int(binary.BigEndian.Uint32(header[12:])),
-		TilesY:     int(binary.BigEndian.Uint32(header[16:])),
-		TileSize:   int(binary.BigEndian.Uint32(header[20:])),
-		Compressed: header[24] == 1,
+	layer := req.Layer
+	if req.Depth != nil {
+		var ok bool
+		if layer, ok = s.nearestLayer(*req.Depth); !ok {
+			return nil, fmt.Errorf("no focus layers known to resolve depth %.2fum", *req.Depth)
+		}
 	}
 
-	dataSize := int(binary.BigEndian.Uint32(header[28:]))
-	layerData.RawData = make([]byte, dataSize)
+	s.state.set(StateScanning, nil)
+	defer func() {
+		if s.conn != nil {
+			s.state.set(StateReady, nil)
+		}
+	}()
 
-	// Read the actual image data
-	totalRead := 0
-	for totalRead < dataSize {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		default:
-			n, err := s.conn.Read(layerData.RawData[totalRead:])
-			if err != nil {
-				return nil, err
-			}
-			totalRead += n
+	focus := make([]byte, 4)
+	binary.BigEndian.PutUint32(focus, uint32(layer))
+	if _, err := s.roundTrip(ctx, CMD_SET_FOCUS, focus); err != nil {
+		return nil, s.check(err)
+	}
+
+	// Payload: [x][y][width][height][layer][objective]
+	cmdData := make([]byte, 24)
+	binary.BigEndian.PutUint32(cmdData[0:], uint32(req.X))
+	binary.BigEndian.PutUint32(cmdData[4:], uint32(req.Y))
+	binary.BigEndian.PutUint32(cmdData[8:], uint32(req.Width))
+	binary.BigEndian.PutUint32(cmdData[12:], uint32(req.Height))
+	binary.BigEndian.PutUint32(cmdData[16:], uint32(layer))
+	binary.BigEndian.PutUint32(cmdData[20:], uint32(req.Objective))
+
+	if err := s.conn.writeFrame(CMD_GET_IMAGE, cmdData); err != nil {
+		return nil, s.check(err)
+	}
+
+	image, err := s.receiveLayerData(ctx, CMD_GET_IMAGE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive image: %w", s.abort(err))
+	}
+	return image, nil
+}
+
+// nearestLayer returns the focus layer closest to depth
+func (s *Interface) nearestLayer(depth float64) (int, bool) {
+	s.layersMu.RLock()
+	defer s.layersMu.RUnlock()
+
+	best, found := 0, false
+	bestDist := 0.0
+	for _, info := range s.layerData {
+		dist := math.Abs(info.FocusDepth - depth)
+		if !found || dist < bestDist || (dist == bestDist && info.LayerIndex < best) {
+			best, bestDist, found = info.LayerIndex, dist, true
 		}
 	}
+	return best, found
+}
 
-	return layerData, nil
+// abort ends a multi-frame exchange early. Unless the scanner itself ended
+// it with an error status, frames are still in flight and the stream can't
+// be resynchronised, so the connection is dropped. Callers hold s.mu.
+func (s *Interface) abort(err error) error {
+	var scanErr *ScannerError
+	if !errors.As(err, &scanErr) && s.conn != nil {
+		s.conn.fail(err)
+	}
+	return s.check(err)
+}
+
+// Size of the header leading each layer data frame
+const layerHeaderSize = 32
+
+func (s *Interface) receiveLayerData(ctx context.Context, cmd byte) (*LayerData, error) {
+	// Each layer arrives as one frame: [header][image data]. The scanner may
+	// take up to ScanTimeout to start sending it.
+	frame, err := s.conn.readLayerFrame(ctx, cmd, s.config.ScanTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return parseLayerFrame(cmd, frame)
 }
 
 func (s *Interface) GetLayerInfo() map[int]*LayerInfo {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.layersMu.RLock()
+	defer s.layersMu.RUnlock()
 
 	// Return a copy
 	result := make(map[int]*LayerInfo)
@@ -255,89 +495,118 @@ func (s *Interface) SetFocusLayer(layer int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.conn == nil {
+		return ErrNotConnected
+	}
+
 	cmdData := make([]byte, 4)
 	binary.BigEndian.PutUint32(cmdData, uint32(layer))
 
-	return s.sendCommand(CMD_SET_FOCUS, cmdData)
+	_, err := s.roundTrip(s.ctx, CMD_SET_FOCUS, cmdData)
+	return s.check(err)
 }
 
-func (s *Interface) GetStatus() (map[string]interface{}, error) {
+// Calibrate runs CMD_CALIBRATE. Calibration moves the stage, so it may take
+// as long as a scan to answer.
+func (s *Interface) Calibrate(ctx context.Context) error {
+	if s.state.get() == StateScanning {
+		return ErrScannerBusy
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if err := s.sendCommand(CMD_STATUS, nil); err != nil {
-		return nil, err
+	if s.conn == nil {
+		return ErrNotConnected
 	}
 
-	response, err := s.readResponse()
-	if err != nil {
-		return nil, err
-	}
+	s.state.set(StateScanning, nil)
+	defer func() {
+		if s.conn != nil {
+			s.state.set(StateReady, nil)
+		}
+	}()
 
-	// Parse status response
-	status := map[string]interface{}{
-		"connected":    s.connected,
-		"temperature":  float64(binary.BigEndian.Uint32(response[0:])) / 100.0,
-		"ready":        response[4] == 1,
-		"error_code":   int(binary.BigEndian.Uint32(response[5:])),
-		"current_layer": int(binary.BigEndian.Uint32(response[9:])),
+	if err := s.conn.writeFrame(CMD_CALIBRATE, nil); err != nil {
+		return s.check(err)
+	}
+	response, err := s.conn.readFrame(ctx, CMD_CALIBRATE, maxControlFrameSize, s.config.ScanTimeout)
+	if err != nil {
+		var scanErr *ScannerError
+		if errors.As(err, &scanErr) && scanErr.Status != StatusBusy {
+			// Calibration ran and failed
+			s.state.setCalibrated(time.Time{}, "")
+		}
+		return s.check(err)
 	}
 
-	return status, nil
+	// Calibration succeeded even if the profile name is unreadable
+	profile, _ := parseCalibration(response)
+	s.state.setCalibrated(time.Now(), profile)
+	return nil
 }
 
-func (s *Interface) sendCommand(cmd byte, data []byte) error {
-	// Command format: [CMD][LENGTH][DATA]
-	cmdPacket := []byte{cmd}
-	
-	length := make([]byte, 4)
-	binary.BigEndian.PutUint32(length, uint32(len(data)))
-	cmdPacket = append(cmdPacket, length...)
-	
-	if data != nil {
-		cmdPacket = append(cmdPacket, data...)
+func (s *Interface) GetStatus() (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil, ErrNotConnected
 	}
 
-	_, err := s.conn.Write(cmdPacket)
-	return err
+	response, err := s.roundTrip(s.ctx, CMD_STATUS, nil)
+	if err != nil {
+		return nil, s.check(err)
+	}
+
+	return parseStatus(response)
 }
 
-func (s *Interface) readResponse() ([]byte, error) {
-	// Read length first
-	lengthBuf := make([]byte, 4)
-	if _, err := s.conn.Read(lengthBuf); err != nil {
+// roundTrip sends a command and reads its response. Callers hold s.mu.
+func (s *Interface) roundTrip(ctx context.Context, cmd byte, data []byte) ([]byte, error) {
+	if err := s.conn.writeFrame(cmd, data); err != nil {
 		return nil, err
 	}
+	return s.conn.readResponse(ctx, cmd)
+}
 
-	length := binary.BigEndian.Uint32(lengthBuf)
-	response := make([]byte, length)
-
-	totalRead := 0
-	for totalRead < int(length) {
-		n, err := s.conn.Read(response[totalRead:])
-		if err != nil {
-			return nil, err
+// check drops the connection if err left it unusable, which wakes the
+// reconnect loop. Callers hold s.mu.
+func (s *Interface) check(err error) error {
+	if err != nil && s.conn != nil && s.conn.err() != nil {
+		s.closeConn()
+		s.state.set(StateError, err)
+		select {
+		case s.lost <- struct{}{}:
+		default:
 		}
-		totalRead += n
 	}
+	return err
+}
 
-	return response, nil
+// closeConn closes and forgets the current connection. Callers hold s.mu.
+func (s *Interface) closeConn() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
 }
 
+// Close stops reconnecting and disconnects from the scanner
 func (s *Interface) Close() error {
+	s.cancel()
+	<-s.done
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if !s.connected {
-		return nil
-	}
-
-	s.sendCommand(CMD_DISCONNECT, nil)
-	s.connected = false
-
 	if s.conn != nil {
-		return s.conn.Close()
+		s.conn.writeFrame(CMD_DISCONNECT, nil)
 	}
+	err := s.closeConn()
+	s.state.set(StateDisconnected, nil)
 
-	return nil
+	return err
 }
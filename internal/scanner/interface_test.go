@@ -0,0 +1,295 @@
+package scanner
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cyto-viewer/internal/config"
+)
+
+// fakeScanner speaks enough of the protocol to connect, poll status and
+// scan, and lets a test drop or stall the link
+type fakeScanner struct {
+	ln    net.Listener
+	stall atomic.Bool // leave scans unanswered
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startFakeScanner(t *testing.T, addr string) *fakeScanner {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeScanner{ln: ln}
+	t.Cleanup(func() {
+		ln.Close()
+		f.drop()
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// drop closes every open connection without a word, like a pulled cable
+func (f *fakeScanner) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeScanner) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reply := func(p []byte) error {
+		_, err := conn.Write(responseFrame(StatusOK, p))
+		return err
+	}
+	for {
+		var header [frameHeaderSize]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+
+		var err error
+		switch header[0] {
+		case CMD_CONNECT:
+			err = reply(payload(1, "fake-1.0", "FAKE-0001"))
+		case CMD_GET_LAYERS:
+			err = reply(payload(2, 0, 4096, 4096, 0, 512, 1, 4096, 4096, 500, 512))
+		case CMD_STATUS:
+			err = reply(payload(2150, byte(1), 0, 0))
+		case CMD_SCAN:
+			if f.stall.Load() {
+				continue
+			}
+			width := int(binary.BigEndian.Uint32(request[8:]))
+			height := int(binary.BigEndian.Uint32(request[12:]))
+			for off := 20; off+4 <= len(request) && err == nil; off += 4 {
+				layer := int(binary.BigEndian.Uint32(request[off:]))
+				err = reply(layerFrame(layer, width, height, 512, 1, 4, []byte("jpeg")))
+			}
+		case CMD_DISCONNECT:
+			return
+		default:
+			_, err = conn.Write(responseFrame(StatusUnknownCommand, nil))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func testScannerConfig(addr string) *config.ScannerConfig {
+	return &config.ScannerConfig{
+		ID:           "fake",
+		Protocol:     "tcp",
+		Address:      addr,
+		Timeout:      time.Second,
+		ScanTimeout:  5 * time.Second,
+		MaxFrameSize: 1 << 20,
+		MaxScanArea:  1 << 22,
+	}
+}
+
+// stateRecorder collects state changes as they happen
+type stateRecorder struct {
+	changes chan StateChange
+}
+
+func recordStates(s *Interface) *stateRecorder {
+	r := &stateRecorder{changes: make(chan StateChange, 64)}
+	s.OnStateChange(func(c StateChange) { r.changes <- c })
+	return r
+}
+
+// expect waits for the next changes and checks they follow want
+func (r *stateRecorder) expect(t *testing.T, want ...State) {
+	t.Helper()
+	for _, state := range want {
+		select {
+		case c := <-r.changes:
+			if c.State != state {
+				t.Fatalf("state %s (%s), want %s", c.State, c.Error, state)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no change to %s", state)
+		}
+	}
+}
+
+func waitForState(t *testing.T, s *Interface, state State) StateInfo {
+	t.Helper()
+	return waitFor(t, s, string(state), func(info StateInfo) bool { return info.State == state })
+}
+
+func waitFor(t *testing.T, s *Interface, what string, cond func(StateInfo) bool) StateInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if info := s.State(); cond(info) {
+			return info
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("scanner is %s, want %s", s.State().State, what)
+	return StateInfo{}
+}
+
+func newTestInterface(t *testing.T, addr string) *Interface {
+	t.Helper()
+	s, err := NewInterface(testScannerConfig(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestInterfaceReconnectsDroppedLink(t *testing.T) {
+	f := startFakeScanner(t, "127.0.0.1:0")
+	s := newTestInterface(t, f.ln.Addr().String())
+
+	info := waitForState(t, s, StateReady)
+	if len(info.History) != 2 || info.History[0].State != StateConnecting {
+		t.Errorf("connecting recorded as %+v", info.History)
+	}
+	states := recordStates(s)
+
+	req := &ScanRequest{Width: 1024, Height: 1024, Layers: []int{0, 1}}
+	result, err := s.StartScan(s.ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Layers) != 2 {
+		t.Errorf("scanned %d layers, want 2", len(result.Layers))
+	}
+	states.expect(t, StateScanning, StateReady)
+
+	// An idle link that drops is found by the next health check, and the
+	// interface reconnects without waiting out a backoff
+	f.drop()
+	s.healthCheck()
+	states.expect(t, StateError, StateConnecting, StateReady)
+	if info := s.State(); info.ReconnectAttempts != 0 || info.LastError == "" {
+		t.Errorf("after reconnecting: %d attempts, last error %q", info.ReconnectAttempts, info.LastError)
+	}
+	if _, err := s.GetStatus(); err != nil {
+		t.Errorf("status on the new connection: %v", err)
+	}
+
+	// A link dropping mid-scan fails the scan, then reconnects
+	f.stall.Store(true)
+	scanErr := make(chan error, 1)
+	go func() {
+		_, err := s.StartScan(s.ctx, req)
+		scanErr <- err
+	}()
+	states.expect(t, StateScanning)
+	f.drop()
+	if err := <-scanErr; !errors.Is(err, ErrDisconnected) {
+		t.Errorf("scan over a dropped link: %v, want ErrDisconnected", err)
+	}
+	states.expect(t, StateError, StateConnecting, StateReady)
+
+	s.Close()
+	states.expect(t, StateDisconnected)
+}
+
+func TestHealthCheckKeepsGoodLink(t *testing.T) {
+	f := startFakeScanner(t, "127.0.0.1:0")
+	s := newTestInterface(t, f.ln.Addr().String())
+	waitForState(t, s, StateReady)
+	states := recordStates(s)
+
+	s.healthCheck()
+	select {
+	case c := <-states.changes:
+		t.Errorf("healthy link changed state to %s (%s)", c.State, c.Error)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A scan holds the connection; the health check leaves it alone
+	s.mu.Lock()
+	s.healthCheck()
+	s.mu.Unlock()
+	if state := s.State().State; state != StateReady {
+		t.Errorf("state %s, want ready", state)
+	}
+}
+
+// TestInterfaceStartsWithoutScanner covers starting the server while the
+// scanner is off: the interface reports the failure, refuses commands and
+// connects once the scanner appears
+func TestInterfaceStartsWithoutScanner(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := newTestInterface(t, addr)
+	// The retry is scheduled just after the failure is recorded
+	info := waitFor(t, s, "retrying", func(info StateInfo) bool {
+		return info.State == StateError && info.NextAttempt != nil
+	})
+	if info.LastError == "" || info.ReconnectAttempts != 1 {
+		t.Errorf("failed connect: last error %q, %d attempts", info.LastError, info.ReconnectAttempts)
+	}
+
+	if _, err := s.GetStatus(); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("status: %v, want ErrNotConnected", err)
+	}
+	req := &ScanRequest{Width: 1024, Height: 1024, Layers: []int{0}}
+	if _, err := s.StartScan(s.ctx, req); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("scan: %v, want ErrNotConnected", err)
+	}
+	if err := s.SetFocusLayer(0); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("focus: %v, want ErrNotConnected", err)
+	}
+
+	startFakeScanner(t, addr)
+	info = waitForState(t, s, StateReady)
+	if info.ReconnectAttempts != 0 || info.NextAttempt != nil {
+		t.Errorf("after connecting: %d attempts, next attempt %v", info.ReconnectAttempts, info.NextAttempt)
+	}
+	var history []State
+	for _, c := range info.History {
+		history = append(history, c.State)
+	}
+	if len(history) < 4 || history[0] != StateConnecting || history[1] != StateError ||
+		history[len(history)-2] != StateConnecting {
+		t.Errorf("history %v, want connecting, error, ..., connecting, ready", history)
+	}
+	if len(s.GetLayerInfo()) != 2 {
+		t.Errorf("layer table not loaded: %v", s.GetLayerInfo())
+	}
+}
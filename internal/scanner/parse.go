@@ -0,0 +1,238 @@
+package scanner
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ErrMalformedResponse is returned when a complete frame arrived but its
+// payload doesn't have the layout its command requires. The stream is still
+// in sync, so the connection is kept.
+var ErrMalformedResponse = errors.New("malformed scanner response")
+
+const (
+	// Size of each entry of the CMD_GET_LAYERS table
+	layerEntrySize = 20
+
+	// Sanity bounds on values reported by the scanner
+	maxReportedLayers    = 4096
+	maxReportedDimension = 1 << 24
+	maxReportedString    = 256
+
+	// Tile sizes accepted from the scanner. Every tile is allocated and
+	// served whole, so larger ones would exhaust memory.
+	minReportedTileSize = 64
+	maxReportedTileSize = 4096
+)
+
+// payloadReader reads big-endian fields from a response payload, recording
+// the first read past its end instead of panicking
+type payloadReader struct {
+	cmd byte
+	buf []byte
+	off int
+	err error
+}
+
+func newPayloadReader(cmd byte, buf []byte) *payloadReader {
+	return &payloadReader{cmd: cmd, buf: buf}
+}
+
+func (r *payloadReader) need(n int, what string) bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.buf)-r.off < n {
+		r.err = r.malformed("%d-byte payload ends before %s at offset %d", len(r.buf), what, r.off)
+		return false
+	}
+	return true
+}
+
+func (r *payloadReader) uint32(what string) uint32 {
+	if !r.need(4, what) {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.buf[r.off:])
+	r.off += 4
+	return v
+}
+
+func (r *payloadReader) byte(what string) byte {
+	if !r.need(1, what) {
+		return 0
+	}
+	v := r.buf[r.off]
+	r.off++
+	return v
+}
+
+// string reads a uint32 length followed by that many bytes of UTF-8
+func (r *payloadReader) string(what string) string {
+	n := r.uint32(what + " length")
+	if r.err != nil {
+		return ""
+	}
+	if n > maxReportedString {
+		r.err = r.malformed("%s is %d bytes long", what, n)
+		return ""
+	}
+	if !r.need(int(n), what) {
+		return ""
+	}
+	v := string(r.buf[r.off : r.off+int(n)])
+	r.off += int(n)
+	if !utf8.ValidString(v) {
+		r.err = r.malformed("%s is not valid UTF-8", what)
+		return ""
+	}
+	return v
+}
+
+func (r *payloadReader) malformed(format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s: %w", commandName(r.cmd), fmt.Sprintf(format, args...), ErrMalformedResponse)
+}
+
+// parseDeviceInfo parses a CMD_CONNECT response: [protocol version]
+// [firmware][serial number], each string length-prefixed. Scanners older
+// than protocol version 1 answer with an empty payload.
+func parseDeviceInfo(payload []byte) (DeviceInfo, error) {
+	if len(payload) == 0 {
+		return DeviceInfo{}, nil
+	}
+
+	r := newPayloadReader(CMD_CONNECT, payload)
+	info := DeviceInfo{
+		ProtocolVersion: int(r.uint32("protocol version")),
+		Firmware:        r.string("firmware version"),
+		SerialNumber:    r.string("serial number"),
+	}
+	if r.err != nil {
+		return DeviceInfo{}, r.err
+	}
+	if r.off != len(payload) {
+		return DeviceInfo{}, r.malformed("%d trailing bytes", len(payload)-r.off)
+	}
+	return info, nil
+}
+
+// parseCalibration parses a CMD_CALIBRATE response: the name of the
+// calibration profile applied, as bare UTF-8, or nothing
+func parseCalibration(payload []byte) (string, error) {
+	if len(payload) > maxReportedString || !utf8.Valid(payload) {
+		return "", newPayloadReader(CMD_CALIBRATE, payload).malformed("invalid calibration profile name")
+	}
+	return string(payload), nil
+}
+
+// parseLayerTable parses a CMD_GET_LAYERS response:
+// [num_layers] then per layer [index][width][height][depth nm][tile size]
+func parseLayerTable(payload []byte) (map[int]*LayerInfo, error) {
+	r := newPayloadReader(CMD_GET_LAYERS, payload)
+
+	count := int(r.uint32("layer count"))
+	if r.err != nil {
+		return nil, r.err
+	}
+	if count > maxReportedLayers {
+		return nil, r.malformed("%d layers reported, at most %d supported", count, maxReportedLayers)
+	}
+	if want := 4 + count*layerEntrySize; len(payload) != want {
+		return nil, r.malformed("%d layers need %d bytes, got %d", count, want, len(payload))
+	}
+
+	layers := make(map[int]*LayerInfo, count)
+	for i := 0; i < count; i++ {
+		info := &LayerInfo{
+			LayerIndex: int(r.uint32("layer index")),
+			Width:      int(r.uint32("layer width")),
+			Height:     int(r.uint32("layer height")),
+			FocusDepth: float64(r.uint32("focus depth")) / 1000.0,
+			TileSize:   int(r.uint32("tile size")),
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		switch {
+		case info.LayerIndex >= maxReportedLayers:
+			return nil, r.malformed("layer index %d out of range", info.LayerIndex)
+		case layers[info.LayerIndex] != nil:
+			return nil, r.malformed("layer %d listed twice", info.LayerIndex)
+		case info.Width <= 0 || info.Height <= 0 || info.Width > maxReportedDimension || info.Height > maxReportedDimension:
+			return nil, r.malformed("layer %d has invalid size %dx%d", info.LayerIndex, info.Width, info.Height)
+		case info.TileSize < minReportedTileSize || info.TileSize > maxReportedTileSize:
+			return nil, r.malformed("layer %d has invalid tile size %d", info.LayerIndex, info.TileSize)
+		}
+		layers[info.LayerIndex] = info
+	}
+
+	return layers, nil
+}
+
+// parseStatus parses a CMD_STATUS response: [temperature in centidegrees]
+// [ready flag][error code][current layer]
+func parseStatus(payload []byte) (map[string]interface{}, error) {
+	r := newPayloadReader(CMD_STATUS, payload)
+
+	temperature := r.uint32("temperature")
+	ready := r.byte("ready flag")
+	errorCode := r.uint32("error code")
+	currentLayer := r.uint32("current layer")
+	if r.err != nil {
+		return nil, r.err
+	}
+	if ready > 1 {
+		return nil, r.malformed("ready flag is %d", ready)
+	}
+
+	return map[string]interface{}{
+		"connected":     true,
+		"temperature":   float64(int32(temperature)) / 100.0,
+		"ready":         ready == 1,
+		"error_code":    int(errorCode),
+		"current_layer": int(currentLayer),
+	}, nil
+}
+
+// parseLayerFrame parses a layer data frame: a 32-byte header (layer,
+// width, height, tiles x/y, tile size, compressed flag, data size) followed
+// by the image data
+func parseLayerFrame(cmd byte, frame []byte) (*LayerData, error) {
+	r := newPayloadReader(cmd, frame)
+
+	layer := &LayerData{
+		Layer:    int(r.uint32("layer index")),
+		Width:    int(r.uint32("width")),
+		Height:   int(r.uint32("height")),
+		TilesX:   int(r.uint32("tiles across")),
+		TilesY:   int(r.uint32("tiles down")),
+		TileSize: int(r.uint32("tile size")),
+	}
+	compressed := r.byte("compressed flag")
+	r.need(3, "header padding")
+	r.off += 3
+	dataSize := int(r.uint32("data size"))
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	switch {
+	case compressed > 1:
+		return nil, r.malformed("layer %d compressed flag is %d", layer.Layer, compressed)
+	case layer.Width <= 0 || layer.Height <= 0 || layer.Width > maxReportedDimension || layer.Height > maxReportedDimension:
+		return nil, r.malformed("layer %d has invalid size %dx%d", layer.Layer, layer.Width, layer.Height)
+	// A tile size of zero leaves it to the server
+	case layer.TileSize != 0 && (layer.TileSize < minReportedTileSize || layer.TileSize > maxReportedTileSize):
+		return nil, r.malformed("layer %d has invalid tile size %d", layer.Layer, layer.TileSize)
+	case dataSize != len(frame)-layerHeaderSize:
+		return nil, r.malformed("layer %d declares %d data bytes but frame carries %d",
+			layer.Layer, dataSize, len(frame)-layerHeaderSize)
+	}
+
+	layer.Compressed = compressed == 1
+	layer.RawData = frame[layerHeaderSize:]
+	return layer, nil
+}
@@ -0,0 +1,201 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+
+	"cyto-viewer/internal/config"
+)
+
+// payload builds a response payload from uint32s, bytes and
+// length-prefixed strings
+func payload(fields ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, f := range fields {
+		switch v := f.(type) {
+		case int:
+			binary.Write(&buf, binary.BigEndian, uint32(v))
+		case byte:
+			buf.WriteByte(v)
+		case string:
+			binary.Write(&buf, binary.BigEndian, uint32(len(v)))
+			buf.WriteString(v)
+		case []byte:
+			buf.Write(v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// layerFrame builds a layer data frame carrying data
+func layerFrame(layer, width, height, tileSize int, compressed byte, dataSize int, data []byte) []byte {
+	return payload(layer, width, height, (width+tileSize-1)/max(tileSize, 1), (height+tileSize-1)/max(tileSize, 1),
+		tileSize, compressed, []byte{0, 0, 0}, dataSize, data)
+}
+
+func wantMalformed(t *testing.T, name string, err error) {
+	t.Helper()
+	if !errors.Is(err, ErrMalformedResponse) {
+		t.Errorf("%s: got %v, want ErrMalformedResponse", name, err)
+	}
+}
+
+func TestParseDeviceInfo(t *testing.T) {
+	info, err := parseDeviceInfo(payload(1, "fw-2.1", "SN-42"))
+	if err != nil || info != (DeviceInfo{ProtocolVersion: 1, Firmware: "fw-2.1", SerialNumber: "SN-42"}) {
+		t.Errorf("got %+v, %v", info, err)
+	}
+	if info, err := parseDeviceInfo(nil); err != nil || info != (DeviceInfo{}) {
+		t.Errorf("version 0 scanner: got %+v, %v", info, err)
+	}
+
+	bad := map[string][]byte{
+		"truncated version":  {0, 0},
+		"missing serial":     payload(1, "fw-2.1"),
+		"string past end":    payload(1, 10, []byte("fw")),
+		"string too long":    payload(1, strings.Repeat("x", maxReportedString+1), "SN"),
+		"invalid UTF-8":      payload(1, string([]byte{0xff, 0xfe}), "SN"),
+		"trailing bytes":     payload(1, "fw", "SN", byte(0)),
+		"absurd string size": payload(1, 1<<31),
+	}
+	for name, p := range bad {
+		_, err := parseDeviceInfo(p)
+		wantMalformed(t, name, err)
+	}
+}
+
+func TestParseCalibration(t *testing.T) {
+	if profile, err := parseCalibration([]byte("factory")); err != nil || profile != "factory" {
+		t.Errorf("got %q, %v", profile, err)
+	}
+	if profile, err := parseCalibration(nil); err != nil || profile != "" {
+		t.Errorf("empty response: got %q, %v", profile, err)
+	}
+	_, err := parseCalibration([]byte(strings.Repeat("x", maxReportedString+1)))
+	wantMalformed(t, "too long", err)
+	_, err = parseCalibration([]byte{0xc3})
+	wantMalformed(t, "invalid UTF-8", err)
+}
+
+func TestParseLayerTable(t *testing.T) {
+	// index, width, height, depth in nm, tile size
+	layers, err := parseLayerTable(payload(2,
+		0, 1000, 800, 1500, 512,
+		1, 1000, 800, 2000, minReportedTileSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 || layers[0].FocusDepth != 1.5 || layers[1].TileSize != minReportedTileSize || layers[1].Width != 1000 {
+		t.Errorf("got %+v %+v", layers[0], layers[1])
+	}
+	if layers, err := parseLayerTable(payload(0)); err != nil || len(layers) != 0 {
+		t.Errorf("empty table: got %v, %v", layers, err)
+	}
+
+	bad := map[string][]byte{
+		"empty":              nil,
+		"too many layers":    payload(maxReportedLayers + 1),
+		"short table":        payload(2, 0, 1000, 800, 0, 512),
+		"long table":         payload(1, 0, 1000, 800, 0, 512, 0),
+		"listed twice":       payload(2, 3, 1000, 800, 0, 512, 3, 1000, 800, 0, 512),
+		"index out of range": payload(1, maxReportedLayers, 1000, 800, 0, 512),
+		"zero width":         payload(1, 0, 0, 800, 0, 512),
+		"too tall":           payload(1, 0, 1000, maxReportedDimension+1, 0, 512),
+		"tile size zero":     payload(1, 0, 1000, 800, 0, 0),
+		"tile too small":     payload(1, 0, 1000, 800, 0, minReportedTileSize-1),
+		"tile too large":     payload(1, 0, 1000, 800, 0, maxReportedTileSize+1),
+	}
+	for name, p := range bad {
+		_, err := parseLayerTable(p)
+		wantMalformed(t, name, err)
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	status, err := parseStatus(payload(-250, byte(1), 7, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status["temperature"] != -2.5 || status["ready"] != true || status["error_code"] != 7 || status["current_layer"] != 3 {
+		t.Errorf("got %v", status)
+	}
+
+	_, err = parseStatus(payload(2000, byte(1), 0))
+	wantMalformed(t, "truncated", err)
+	_, err = parseStatus(payload(2000, byte(2), 0, 0))
+	wantMalformed(t, "ready flag", err)
+}
+
+func TestParseLayerFrame(t *testing.T) {
+	data := []byte("jpeg data")
+	layer, err := parseLayerFrame(CMD_SCAN, layerFrame(4, 1000, 800, 512, 1, len(data), data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.Layer != 4 || layer.Width != 1000 || layer.Height != 800 || layer.TilesX != 2 || layer.TilesY != 2 ||
+		layer.TileSize != 512 || !layer.Compressed || !bytes.Equal(layer.RawData, data) {
+		t.Errorf("got %+v", layer)
+	}
+	if layer, err := parseLayerFrame(CMD_GET_IMAGE, layerFrame(0, 10, 10, 0, 0, 0, nil)); err != nil || layer.TileSize != 0 {
+		t.Errorf("tile size left to the server: got %+v, %v", layer, err)
+	}
+
+	bad := map[string][]byte{
+		"short header":       layerFrame(0, 10, 10, 512, 0, 0, nil)[:layerHeaderSize-1],
+		"compressed flag":    layerFrame(0, 10, 10, 512, 2, 0, nil),
+		"zero height":        layerFrame(0, 10, 0, 512, 0, 0, nil),
+		"too wide":           layerFrame(0, maxReportedDimension+1, 10, 512, 0, 0, nil),
+		"tile too small":     layerFrame(0, 10, 10, minReportedTileSize-1, 0, 0, nil),
+		"tile too large":     layerFrame(0, 10, 10, maxReportedTileSize+1, 0, 0, nil),
+		"data size too long": layerFrame(0, 10, 10, 512, 0, 10, data),
+		"data size short":    layerFrame(0, 10, 10, 512, 0, 2, data),
+	}
+	for name, frame := range bad {
+		_, err := parseLayerFrame(CMD_SCAN, frame)
+		wantMalformed(t, name, err)
+	}
+}
+
+func TestValidateScanAgainstCapabilities(t *testing.T) {
+	s := &Interface{
+		config: &config.ScannerConfig{MaxScanArea: 1 << 20},
+		layerData: map[int]*LayerInfo{
+			0: {LayerIndex: 0, Width: 2000, Height: 1000},
+			1: {LayerIndex: 1, Width: 2000, Height: 1000},
+		},
+	}
+
+	if err := s.ValidateScan(&ScanRequest{StartX: 1000, StartY: 500, Width: 1000, Height: 500, Layers: []int{1, 0}}); err != nil {
+		t.Errorf("valid scan rejected: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		req    ScanRequest
+		fields string
+	}{
+		{"beyond the stage", ScanRequest{StartX: 1500, StartY: 600, Width: 600, Height: 500, Layers: []int{0}}, "width height"},
+		{"over the area limit", ScanRequest{Width: 1024, Height: 1025, Layers: []int{0}}, "region height"},
+		{"negative origin", ScanRequest{StartX: -1, Width: 10, Height: 10, Layers: []int{0}}, "startX"},
+		{"no layers", ScanRequest{Width: 10, Height: 10}, "layers"},
+		{"unknown and repeated layers", ScanRequest{Width: 10, Height: 10, Layers: []int{1, 1, 5}}, "layers layers[1] layers[2]"},
+		{"negative layer", ScanRequest{Width: 10, Height: 10, Layers: []int{-1}}, "layers[0]"},
+	}
+	for _, tt := range tests {
+		var verr *ValidationError
+		if err := s.ValidateScan(&tt.req); !errors.As(err, &verr) {
+			t.Errorf("%s: got %v, want a validation error", tt.name, err)
+			continue
+		}
+		var fields []string
+		for _, v := range verr.Violations {
+			fields = append(fields, v.Field)
+		}
+		if got := strings.Join(fields, " "); got != tt.fields {
+			t.Errorf("%s: violations of %q, want %q", tt.name, got, tt.fields)
+		}
+	}
+}
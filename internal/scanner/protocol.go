@@ -0,0 +1,297 @@
+package scanner
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Wire framing shared by all transports. Every frame starts with a 5-byte
+// header: one type byte and a big-endian uint32 payload length.
+//
+//	request:  [CMD][LENGTH][PAYLOAD]
+//	response: [STATUS][LENGTH][PAYLOAD]
+//
+// Each command is answered by one response frame, except CMD_SCAN, which
+// gets one frame per requested layer, and CMD_DISCONNECT, which gets none.
+// A non-OK status ends the exchange and carries a UTF-8 error message as
+// its payload.
+const frameHeaderSize = 5
+
+// ProtocolVersion is the protocol revision this package speaks. Version 1
+// added the device identity to the CMD_CONNECT response and the calibration
+// profile to the CMD_CALIBRATE response; older scanners leave both empty.
+const ProtocolVersion = 1
+
+// Limit for command and control response payloads; layer data frames are
+// bounded by ScannerConfig.MaxFrameSize instead
+const maxControlFrameSize = 1 << 20
+
+// Status is the status byte of a response frame
+type Status byte
+
+const (
+	StatusOK              Status = 0x00
+	StatusBusy            Status = 0x01
+	StatusUnknownCommand  Status = 0x02
+	StatusInvalidArgument Status = 0x03
+	StatusHardwareFault   Status = 0x04
+	StatusNotCalibrated   Status = 0x05
+	StatusAborted         Status = 0x06
+)
+
+var statusNames = map[Status]string{
+	StatusOK:              "ok",
+	StatusBusy:            "busy",
+	StatusUnknownCommand:  "unknown command",
+	StatusInvalidArgument: "invalid argument",
+	StatusHardwareFault:   "hardware fault",
+	StatusNotCalibrated:   "not calibrated",
+	StatusAborted:         "aborted",
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("status 0x%02x", byte(s))
+}
+
+var commandNames = map[byte]string{
+	CMD_CONNECT:    "CONNECT",
+	CMD_DISCONNECT: "DISCONNECT",
+	CMD_SCAN:       "SCAN",
+	CMD_GET_LAYERS: "GET_LAYERS",
+	CMD_CALIBRATE:  "CALIBRATE",
+	CMD_STATUS:     "STATUS",
+	CMD_SET_FOCUS:  "SET_FOCUS",
+	CMD_GET_IMAGE:  "GET_IMAGE",
+}
+
+func commandName(cmd byte) string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", cmd)
+}
+
+// ScannerError is a non-OK status reported by the scanner. The connection
+// stays usable after one.
+type ScannerError struct {
+	Command byte
+	Status  Status
+	Message string
+}
+
+func (e *ScannerError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("scanner %s: %s", commandName(e.Command), e.Status)
+	}
+	return fmt.Sprintf("scanner %s: %s: %s", commandName(e.Command), e.Status, e.Message)
+}
+
+// Is matches scanner errors by status, so errors.Is(err, ErrScannerBusy) works
+// whatever the command and message
+func (e *ScannerError) Is(target error) bool {
+	t, ok := target.(*ScannerError)
+	return ok && t.Status == e.Status
+}
+
+var (
+	ErrScannerBusy     = &ScannerError{Status: StatusBusy}
+	ErrUnknownCommand  = &ScannerError{Status: StatusUnknownCommand}
+	ErrInvalidArgument = &ScannerError{Status: StatusInvalidArgument}
+	ErrHardwareFault   = &ScannerError{Status: StatusHardwareFault}
+	ErrNotCalibrated   = &ScannerError{Status: StatusNotCalibrated}
+	ErrScanAborted     = &ScannerError{Status: StatusAborted}
+)
+
+var (
+	// ErrTimeout is returned when the scanner doesn't answer within the deadline
+	ErrTimeout = errors.New("scanner timed out")
+
+	// ErrFrameTooLarge is returned for frames above the configured size limit
+	ErrFrameTooLarge = errors.New("scanner frame too large")
+
+	// ErrConnectionBroken is returned once a framing or I/O error has left the
+	// stream out of sync; the connection must be re-established
+	ErrConnectionBroken = errors.New("scanner connection broken")
+
+	// ErrDisconnected is returned when the scanner closed or reset the link.
+	// It says nothing about the command, so work it interrupted can be
+	// retried once the scanner is back.
+	ErrDisconnected = errors.New("scanner disconnected")
+)
+
+// deadlineConn is implemented by transports that support I/O deadlines
+type deadlineConn interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// frameConn reads and writes protocol frames over a transport. Reads use
+// io.ReadFull and a per-operation deadline; any error that may have left a
+// partial frame on the wire marks the connection broken.
+type frameConn struct {
+	rw       io.ReadWriteCloser
+	timeout  time.Duration
+	maxFrame int
+
+	mu     sync.Mutex
+	broken error
+}
+
+func newFrameConn(rw io.ReadWriteCloser, timeout time.Duration, maxFrame int) *frameConn {
+	return &frameConn{
+		rw:       rw,
+		timeout:  timeout,
+		maxFrame: maxFrame,
+	}
+}
+
+func (c *frameConn) writeFrame(cmd byte, payload []byte) error {
+	if err := c.err(); err != nil {
+		return err
+	}
+	if len(payload) > maxControlFrameSize {
+		return fmt.Errorf("%s payload of %d bytes: %w", commandName(cmd), len(payload), ErrFrameTooLarge)
+	}
+
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = cmd
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+
+	if dc, ok := c.rw.(deadlineConn); ok && c.timeout > 0 {
+		dc.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	if _, err := c.rw.Write(frame); err != nil {
+		return c.fail(fmt.Errorf("failed to send %s: %w", commandName(cmd), wrapIOError(err)))
+	}
+	return nil
+}
+
+// readResponse reads a control response to cmd
+func (c *frameConn) readResponse(ctx context.Context, cmd byte) ([]byte, error) {
+	return c.readFrame(ctx, cmd, maxControlFrameSize, c.timeout)
+}
+
+// readLayerFrame reads one layer data frame answering cmd (a scan or image
+// capture). wait bounds the time until the frame starts arriving, which
+// covers the acquisition itself.
+func (c *frameConn) readLayerFrame(ctx context.Context, cmd byte, wait time.Duration) ([]byte, error) {
+	return c.readFrame(ctx, cmd, c.maxFrame, wait)
+}
+
+// readFrame reads one response frame. The header must arrive within wait;
+// after that each read must make progress within the connection timeout.
+// ctx cancellation interrupts a blocked read, which breaks the connection.
+func (c *frameConn) readFrame(ctx context.Context, cmd byte, limit int, wait time.Duration) ([]byte, error) {
+	if err := c.err(); err != nil {
+		return nil, err
+	}
+
+	dc, hasDeadline := c.rw.(deadlineConn)
+	if hasDeadline {
+		stop := context.AfterFunc(ctx, func() {
+			dc.SetReadDeadline(time.Now())
+		})
+		defer stop()
+	}
+	setDeadline := func(d time.Duration) {
+		if hasDeadline && d > 0 {
+			dc.SetReadDeadline(time.Now().Add(d))
+		}
+	}
+
+	readErr := func(what string, err error) error {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return c.fail(fmt.Errorf("failed to read %s %s: %w", commandName(cmd), what, wrapIOError(err)))
+	}
+
+	var header [frameHeaderSize]byte
+	setDeadline(wait)
+	if _, err := io.ReadFull(c.rw, header[:]); err != nil {
+		return nil, readErr("response header", err)
+	}
+
+	status := Status(header[0])
+	length := binary.BigEndian.Uint32(header[1:])
+	if status != StatusOK {
+		limit = maxControlFrameSize
+	}
+	if uint64(length) > uint64(limit) {
+		return nil, c.fail(fmt.Errorf("%s response of %d bytes (limit %d): %w", commandName(cmd), length, limit, ErrFrameTooLarge))
+	}
+
+	payload := make([]byte, length)
+	reader := &idleReader{r: c.rw, refresh: func() { setDeadline(c.timeout) }}
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, readErr("response payload", err)
+	}
+
+	if status != StatusOK {
+		return nil, &ScannerError{Command: cmd, Status: status, Message: string(payload)}
+	}
+	return payload, nil
+}
+
+// idleReader refreshes the read deadline before every read, turning it into
+// an inactivity timeout for long payloads
+type idleReader struct {
+	r       io.Reader
+	refresh func()
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.refresh()
+	return r.r.Read(p)
+}
+
+// fail marks the connection broken and returns err
+func (c *frameConn) fail(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.broken == nil {
+		c.broken = err
+	}
+	return err
+}
+
+func (c *frameConn) err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.broken != nil {
+		return fmt.Errorf("%w: %v", ErrConnectionBroken, c.broken)
+	}
+	return nil
+}
+
+func (c *frameConn) Close() error {
+	c.fail(errors.New("closed"))
+	return c.rw.Close()
+}
+
+// wrapIOError marks timeouts and a lost link so callers can tell them from
+// other I/O errors
+func wrapIOError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return fmt.Errorf("%w: %w", ErrDisconnected, err)
+	}
+	return err
+}
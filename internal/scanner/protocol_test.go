@@ -0,0 +1,243 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeConn returns a frame connection and the scanner's end of the pipe
+func pipeConn(t *testing.T, timeout time.Duration, maxFrame int) (*frameConn, net.Conn) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return newFrameConn(client, timeout, maxFrame), server
+}
+
+func responseFrame(status Status, payload []byte) []byte {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = byte(status)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+	return frame
+}
+
+// split cuts data into writes at the given offsets
+func split(data []byte, at ...int) [][]byte {
+	var writes [][]byte
+	prev := 0
+	for _, i := range at {
+		writes = append(writes, data[prev:i])
+		prev = i
+	}
+	return append(writes, data[prev:])
+}
+
+// send writes each chunk separately, pausing between them so the reader
+// sees short reads
+func send(conn net.Conn, writes [][]byte, pause time.Duration) {
+	go func() {
+		for i, w := range writes {
+			if i > 0 {
+				time.Sleep(pause)
+			}
+			if _, err := conn.Write(w); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestReadFrame(t *testing.T) {
+	payload := bytes.Repeat([]byte("layer"), 20)
+	ok := responseFrame(StatusOK, payload)
+
+	tests := []struct {
+		name       string
+		writes     [][]byte
+		closeAfter bool // the scanner hangs up after the writes
+		want       []byte
+		wantErr    error
+		wantBroken bool
+	}{
+		{name: "whole frame", writes: [][]byte{ok}, want: payload},
+		{name: "header split", writes: split(ok, 1, 3), want: payload},
+		{name: "payload split", writes: split(ok, frameHeaderSize, 20, 21, 60), want: payload},
+		{name: "byte by byte", writes: split(ok, 1, 2, 3, 4, 5, 6, 7, 8), want: payload},
+		{name: "empty payload", writes: [][]byte{responseFrame(StatusOK, nil)}, want: []byte{}},
+		{name: "above limit", writes: [][]byte{responseFrame(StatusOK, make([]byte, 200))},
+			wantErr: ErrFrameTooLarge, wantBroken: true},
+		{name: "scanner error", writes: [][]byte{responseFrame(StatusBusy, []byte("scan in progress"))},
+			wantErr: ErrScannerBusy},
+		{name: "truncated header", writes: [][]byte{ok[:3]}, closeAfter: true,
+			wantErr: ErrDisconnected, wantBroken: true},
+		{name: "hung up", closeAfter: true, wantErr: ErrDisconnected, wantBroken: true},
+		{name: "truncated payload", writes: [][]byte{ok[:40]}, closeAfter: true,
+			wantErr: io.ErrUnexpectedEOF, wantBroken: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := pipeConn(t, time.Second, 128)
+			writes, closeAfter := tt.writes, tt.closeAfter
+			go func() {
+				for _, w := range writes {
+					if _, err := server.Write(w); err != nil {
+						return
+					}
+				}
+				if closeAfter {
+					server.Close()
+				}
+			}()
+
+			got, err := c.readLayerFrame(context.Background(), CMD_SCAN, time.Second)
+			if tt.wantErr == nil {
+				if err != nil || !bytes.Equal(got, tt.want) {
+					t.Fatalf("got %d bytes, %v, want %d bytes", len(got), err, len(tt.want))
+				}
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if broken := errors.Is(c.err(), ErrConnectionBroken); broken != tt.wantBroken {
+				t.Errorf("connection broken %v, want %v", broken, tt.wantBroken)
+			}
+		})
+	}
+}
+
+func TestReadFrameScannerError(t *testing.T) {
+	c, server := pipeConn(t, time.Second, 1<<20)
+	send(server, [][]byte{responseFrame(StatusHardwareFault, []byte("stage jammed"))}, 0)
+
+	_, err := c.readResponse(context.Background(), CMD_CALIBRATE)
+	var scanErr *ScannerError
+	if !errors.As(err, &scanErr) {
+		t.Fatalf("got %v, want a *ScannerError", err)
+	}
+	if scanErr.Command != CMD_CALIBRATE || scanErr.Status != StatusHardwareFault || scanErr.Message != "stage jammed" {
+		t.Errorf("got %+v", scanErr)
+	}
+	if !errors.Is(err, ErrHardwareFault) || errors.Is(err, ErrScannerBusy) {
+		t.Errorf("%v doesn't match by status", err)
+	}
+	if want := "scanner CALIBRATE: hardware fault: stage jammed"; err.Error() != want {
+		t.Errorf("message %q, want %q", err.Error(), want)
+	}
+
+	// The stream is still in sync, so the connection stays usable
+	send(server, [][]byte{responseFrame(StatusOK, []byte("ok"))}, 0)
+	if payload, err := c.readResponse(context.Background(), CMD_STATUS); err != nil || string(payload) != "ok" {
+		t.Errorf("next response: %q, %v", payload, err)
+	}
+
+	// Error messages are held to the control limit even when layers may be larger
+	c, server = pipeConn(t, time.Second, 64<<20)
+	header := responseFrame(StatusBusy, nil)
+	binary.BigEndian.PutUint32(header[1:], maxControlFrameSize+1)
+	send(server, [][]byte{header}, 0)
+	if _, err := c.readLayerFrame(context.Background(), CMD_SCAN, time.Second); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("oversized error message: %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestReadFrameDeadlines(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	ok := responseFrame(StatusOK, bytes.Repeat([]byte{1}, 64))
+
+	t.Run("no response", func(t *testing.T) {
+		c, _ := pipeConn(t, timeout, 1<<20)
+		start := time.Now()
+		_, err := c.readResponse(context.Background(), CMD_STATUS)
+		if !errors.Is(err, ErrTimeout) || !errors.Is(c.err(), ErrConnectionBroken) {
+			t.Fatalf("got %v, want a timeout breaking the connection", err)
+		}
+		if elapsed := time.Since(start); elapsed > 10*timeout {
+			t.Errorf("timed out after %v, want about %v", elapsed, timeout)
+		}
+	})
+
+	t.Run("layer wait covers acquisition", func(t *testing.T) {
+		c, server := pipeConn(t, timeout, 1<<20)
+		send(server, split(ok, 1), 3*timeout)
+		if _, err := c.readLayerFrame(context.Background(), CMD_SCAN, time.Second); err != nil {
+			t.Fatalf("frame starting within the wait: %v", err)
+		}
+
+		c, server = pipeConn(t, timeout, 1<<20)
+		time.AfterFunc(3*timeout, func() { server.Write(ok) })
+		if _, err := c.readLayerFrame(context.Background(), CMD_SCAN, 2*timeout); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("frame after the wait: got %v, want ErrTimeout", err)
+		}
+	})
+
+	t.Run("payload stalls", func(t *testing.T) {
+		c, server := pipeConn(t, timeout, 1<<20)
+		send(server, split(ok, 20), 3*timeout)
+		if _, err := c.readResponse(context.Background(), CMD_STATUS); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("got %v, want ErrTimeout", err)
+		}
+	})
+
+	t.Run("slow payload keeps making progress", func(t *testing.T) {
+		c, server := pipeConn(t, timeout, 1<<20)
+		send(server, split(ok, 10, 20, 30, 40, 50, 60), timeout/2)
+		if _, err := c.readResponse(context.Background(), CMD_STATUS); err != nil {
+			t.Fatalf("got %v, want the deadline to reset as data arrives", err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		c, _ := pipeConn(t, time.Minute, 1<<20)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(timeout, cancel)
+		_, err := c.readLayerFrame(ctx, CMD_SCAN, time.Minute)
+		if !errors.Is(err, context.Canceled) || !errors.Is(c.err(), ErrConnectionBroken) {
+			t.Fatalf("got %v, want cancellation breaking the connection", err)
+		}
+	})
+}
+
+func TestWriteFrame(t *testing.T) {
+	c, server := pipeConn(t, 50*time.Millisecond, 1<<20)
+
+	received := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, frameHeaderSize+3)
+		io.ReadFull(server, buf)
+		received <- buf
+	}()
+	if err := c.writeFrame(CMD_SET_FOCUS, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; !bytes.Equal(got, []byte{CMD_SET_FOCUS, 0, 0, 0, 3, 1, 2, 3}) {
+		t.Errorf("sent % x", got)
+	}
+
+	// Refused before anything is written, so the connection stays usable
+	if err := c.writeFrame(CMD_SCAN, make([]byte, maxControlFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("oversized payload: %v, want ErrFrameTooLarge", err)
+	}
+	if err := c.err(); err != nil {
+		t.Fatalf("connection broken by a refused write: %v", err)
+	}
+
+	// Nobody reads the other end of the pipe
+	if err := c.writeFrame(CMD_STATUS, nil); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("blocked write: %v, want ErrTimeout", err)
+	}
+	if err := c.writeFrame(CMD_STATUS, nil); !errors.Is(err, ErrConnectionBroken) {
+		t.Errorf("write after a timeout: %v, want ErrConnectionBroken", err)
+	}
+	if _, err := c.readResponse(context.Background(), CMD_STATUS); !errors.Is(err, ErrConnectionBroken) {
+		t.Errorf("read after a timeout: %v, want ErrConnectionBroken", err)
+	}
+}
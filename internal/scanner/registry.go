@@ -0,0 +1,74 @@
+package scanner
+
+import (
+	"fmt"
+
+	"cyto-viewer/internal/config"
+)
+
+// Registry holds the configured scanners by ID, in configuration order.
+// Each scanner keeps its own connection, state and calibration.
+type Registry struct {
+	scanners map[string]*Interface
+	order    []*Interface
+}
+
+// NewRegistry starts an interface for every configured scanner
+func NewRegistry(cfgs []config.ScannerConfig) (*Registry, error) {
+	r := &Registry{scanners: make(map[string]*Interface)}
+
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		if _, exists := r.scanners[cfg.ID]; exists {
+			r.Close()
+			return nil, fmt.Errorf("duplicate scanner ID: %s", cfg.ID)
+		}
+
+		iface, err := NewInterface(cfg)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("scanner %s: %w", cfg.ID, err)
+		}
+		r.scanners[cfg.ID] = iface
+		r.order = append(r.order, iface)
+	}
+
+	if len(r.order) == 0 {
+		return nil, fmt.Errorf("no scanners configured")
+	}
+	return r, nil
+}
+
+// Get returns the scanner with the given ID
+func (r *Registry) Get(id string) (*Interface, bool) {
+	s, ok := r.scanners[id]
+	return s, ok
+}
+
+// Default returns the first configured scanner, used by the unscoped
+// /api/scanner routes
+func (r *Registry) Default() *Interface {
+	return r.order[0]
+}
+
+// List returns every scanner in configuration order
+func (r *Registry) List() []*Interface {
+	return append([]*Interface(nil), r.order...)
+}
+
+// OnStateChange registers fn for state transitions of every scanner
+func (r *Registry) OnStateChange(fn func(s *Interface, c StateChange)) {
+	for _, s := range r.order {
+		s := s
+		s.OnStateChange(func(c StateChange) {
+			fn(s, c)
+		})
+	}
+}
+
+func (r *Registry) Close() error {
+	for _, s := range r.order {
+		s.Close()
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package scanner
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"cyto-viewer/internal/config"
+)
+
+func TestNewRegistryRejectsConfig(t *testing.T) {
+	cfg := func(id, protocol string) config.ScannerConfig {
+		return config.ScannerConfig{ID: id, Protocol: protocol, Address: "127.0.0.1:1"}
+	}
+
+	tests := []struct {
+		name    string
+		cfgs    []config.ScannerConfig
+		wantErr string
+	}{
+		{"none", nil, "no scanners configured"},
+		{"duplicate ID", []config.ScannerConfig{cfg("a", "tcp"), cfg("b", "tcp"), cfg("a", "tcp")}, "duplicate scanner ID: a"},
+		{"unsupported protocol", []config.ScannerConfig{cfg("a", "tcp"), cfg("b", "usb")}, "scanner b: unsupported protocol: usb"},
+	}
+	for _, tt := range tests {
+		r, err := NewRegistry(tt.cfgs)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.wantErr)
+		}
+		if r != nil {
+			t.Errorf("%s: got a registry with an error", tt.name)
+			r.Close()
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	f := startFakeScanner(t, "127.0.0.1:0")
+	cfgs := []config.ScannerConfig{*testScannerConfig(f.ln.Addr().String()), *testScannerConfig("127.0.0.1:1")}
+	cfgs[0].ID, cfgs[0].Name = "a", "Bench A"
+	cfgs[1].ID = "b"
+
+	r, err := NewRegistry(cfgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	a, ok := r.Get("a")
+	if !ok || a.ID() != "a" || a.Name() != "Bench A" {
+		t.Fatalf("Get(a) = %v, %v", a, ok)
+	}
+	b, ok := r.Get("b")
+	if !ok || b.ID() != "b" {
+		t.Fatalf("Get(b) = %v, %v", b, ok)
+	}
+	if _, ok := r.Get("c"); ok {
+		t.Error("Get found an unconfigured scanner")
+	}
+	if r.Default() != a {
+		t.Errorf("default is %s, want the first configured", r.Default().ID())
+	}
+	list := r.List()
+	if len(list) != 2 || list[0] != a || list[1] != b {
+		t.Errorf("List = %v, want a, b in configuration order", list)
+	}
+	list[0] = b
+	if r.List()[0] != a {
+		t.Error("List exposes the registry's order")
+	}
+
+	// Each scanner keeps its own connection: b failing leaves a ready
+	waitForState(t, a, StateReady)
+	waitForState(t, b, StateError)
+
+	// Listeners learn which scanner changed
+	var mu sync.Mutex
+	changes := make(map[*Interface][]State)
+	r.OnStateChange(func(s *Interface, c StateChange) {
+		mu.Lock()
+		changes[s] = append(changes[s], c.State)
+		mu.Unlock()
+	})
+	f.drop()
+	a.healthCheck()
+	waitFor(t, a, "reconnected", func(StateInfo) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(changes[a]) == 3
+	})
+
+	mu.Lock()
+	if got := changes[a]; got[0] != StateError || got[1] != StateConnecting || got[2] != StateReady {
+		t.Errorf("a changed %v, want error, connecting, ready", got)
+	}
+	for _, state := range changes[b] {
+		if state != StateConnecting && state != StateError {
+			t.Errorf("b, which can't be reached, changed to %s", state)
+		}
+	}
+	mu.Unlock()
+
+	r.Close()
+	for _, s := range []*Interface{a, b} {
+		if state := s.State().State; state != StateDisconnected {
+			t.Errorf("%s is %s after Close", s.ID(), state)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Package scannertest runs the scanner simulator for tests of packages
+// that talk to scanners
+package scannertest
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	simulatorDir   string
+	simulatorBuild sync.Once
+	simulatorErr   error
+)
+
+// StartSimulator builds cmd/scanner-sim once per test binary and starts it
+// on a free local port with the given flags. It returns the address it
+// listens on; the process is killed when the test ends. Tests are skipped
+// if the simulator can't be built.
+func StartSimulator(t testing.TB, args ...string) string {
+	t.Helper()
+
+	simulatorBuild.Do(func() {
+		if simulatorDir, simulatorErr = os.MkdirTemp("", "scanner-sim"); simulatorErr != nil {
+			return
+		}
+		out, err := exec.Command("go", "build", "-o", filepath.Join(simulatorDir, "scanner-sim"),
+			"cyto-viewer/cmd/scanner-sim").CombinedOutput()
+		if err != nil {
+			simulatorErr = &exec.Error{Name: "go build: " + string(out), Err: err}
+		}
+	})
+	if simulatorErr != nil {
+		t.Skipf("scanner simulator unavailable: %v", simulatorErr)
+	}
+
+	// Reserve a port, then hand it to the simulator
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command(filepath.Join(simulatorDir, "scanner-sim"), append([]string{"-addr", addr}, args...)...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("simulator not listening on %s: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Cleanup removes the simulator binary. Call it from TestMain once the
+// tests have run.
+func Cleanup() {
+	if simulatorDir != "" {
+		os.RemoveAll(simulatorDir)
+	}
+}
@@ -0,0 +1,107 @@
+//go:build linux
+
+package scanner
+
+import (
+	"fmt"
+	"os"
+
+	"cyto-viewer/internal/config"
+
+	"golang.org/x/sys/unix"
+)
+
+var baudRates = map[int]uint32{
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+	2000000: unix.B2000000,
+	3000000: unix.B3000000,
+	4000000: unix.B4000000,
+}
+
+var dataBits = map[int]uint32{
+	5: unix.CS5,
+	6: unix.CS6,
+	7: unix.CS7,
+	8: unix.CS8,
+}
+
+// openSerial opens a serial device in raw mode with the given line settings.
+// The descriptor is non-blocking so the returned file supports deadlines.
+func openSerial(path string, cfg *config.SerialConfig) (*os.File, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	baud, ok := baudRates[cfg.BaudRate]
+	if !ok {
+		return nil, fmt.Errorf("unsupported serial baud rate: %d", cfg.BaudRate)
+	}
+
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	if err := configureSerial(fd, baud, cfg); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to configure %s: %w", path, err)
+	}
+
+	// Discard anything left over from a previous connection
+	if err := unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIOFLUSH); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to flush %s: %w", path, err)
+	}
+
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+func configureSerial(fd int, baud uint32, cfg *config.SerialConfig) error {
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+
+	// Raw mode, as cfmakeraw(3)
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP |
+		unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF | unix.INPCK
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+	t.Cflag |= unix.CREAD | unix.CLOCAL | dataBits[cfg.DataBits] | baud
+	t.Ispeed = baud
+	t.Ospeed = baud
+
+	switch cfg.Parity {
+	case "even":
+		t.Cflag |= unix.PARENB
+		t.Iflag |= unix.INPCK
+	case "odd":
+		t.Cflag |= unix.PARENB | unix.PARODD
+		t.Iflag |= unix.INPCK
+	}
+
+	if cfg.StopBits == 2 {
+		t.Cflag |= unix.CSTOPB
+	}
+
+	switch cfg.FlowControl {
+	case "rtscts":
+		t.Cflag |= unix.CRTSCTS
+	case "xonxoff":
+		t.Iflag |= unix.IXON | unix.IXOFF
+	}
+
+	// Return from reads as soon as any byte is available
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
@@ -0,0 +1,127 @@
+//go:build linux
+
+package scanner
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"cyto-viewer/internal/config"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPTY returns the master side of a new pseudo-terminal and the path of
+// its slave device
+func openPTY(t *testing.T) (*os.File, string) {
+	t.Helper()
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("no pseudo-terminal support: %v", err)
+	}
+	t.Cleanup(func() { master.Close() })
+
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatalf("unlock pty: %v", err)
+	}
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		t.Fatalf("get pty number: %v", err)
+	}
+
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestSerialFraming(t *testing.T) {
+	master, slave := openPTY(t)
+
+	port, err := openSerial(slave, &config.SerialConfig{
+		BaudRate:    115200,
+		DataBits:    8,
+		Parity:      "even",
+		StopBits:    1,
+		FlowControl: "none",
+	})
+	if err != nil {
+		t.Fatalf("openSerial: %v", err)
+	}
+	conn := newFrameConn(port, time.Second, 1<<20)
+	defer conn.Close()
+
+	// Answer one STATUS command from the scanner side, split across writes
+	// to exercise partial reads
+	go func() {
+		header := make([]byte, frameHeaderSize)
+		if _, err := io.ReadFull(master, header); err != nil || header[0] != CMD_STATUS {
+			return
+		}
+		response := []byte{byte(StatusOK), 0, 0, 0, 3, 'a', 'b', 'c'}
+		master.Write(response[:2])
+		time.Sleep(20 * time.Millisecond)
+		master.Write(response[2:])
+	}()
+
+	if err := conn.writeFrame(CMD_STATUS, nil); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	payload, err := conn.readResponse(context.Background(), CMD_STATUS)
+	if err != nil {
+		t.Fatalf("readResponse: %v", err)
+	}
+	if string(payload) != "abc" {
+		t.Fatalf("payload = %q, want %q", payload, "abc")
+	}
+
+	// A scanner error status decodes into a typed error and keeps the link usable
+	go func() {
+		header := make([]byte, frameHeaderSize)
+		if _, err := io.ReadFull(master, header); err != nil {
+			return
+		}
+		body := binary.BigEndian.Uint32(header[1:])
+		io.CopyN(io.Discard, master, int64(body))
+		master.Write([]byte{byte(StatusBusy), 0, 0, 0, 0})
+	}()
+
+	conn.writeFrame(CMD_SET_FOCUS, []byte{0, 0, 0, 5})
+	_, err = conn.readResponse(context.Background(), CMD_SET_FOCUS)
+	if !errors.Is(err, ErrScannerBusy) {
+		t.Fatalf("err = %v, want ErrScannerBusy", err)
+	}
+	if conn.err() != nil {
+		t.Fatalf("connection broken after status error: %v", conn.err())
+	}
+
+	// Silence past the deadline times out and breaks the connection
+	conn.timeout = 50 * time.Millisecond
+	_, err = conn.readResponse(context.Background(), CMD_STATUS)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("err = %v, want ErrTimeout", err)
+	}
+	if !errors.Is(conn.err(), ErrConnectionBroken) {
+		t.Fatalf("connection not marked broken after timeout")
+	}
+}
+
+func TestSerialRejectsUnsupportedBaudRate(t *testing.T) {
+	_, slave := openPTY(t)
+
+	_, err := openSerial(slave, &config.SerialConfig{
+		BaudRate:    12345,
+		DataBits:    8,
+		Parity:      "none",
+		StopBits:    1,
+		FlowControl: "none",
+	})
+	if err == nil {
+		t.Fatal("expected an error for an unsupported baud rate")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"cyto-viewer/internal/config"
+)
+
+func openSerial(path string, cfg *config.SerialConfig) (*os.File, error) {
+	return nil, fmt.Errorf("serial scanner transport is not supported on %s", runtime.GOOS)
+}
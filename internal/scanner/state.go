@@ -0,0 +1,172 @@
+package scanner
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// State is the connection state of a scanner
+type State string
+
+const (
+	StateDisconnected State = "disconnected"
+	StateConnecting   State = "connecting"
+	StateReady        State = "ready"
+	StateScanning     State = "scanning"
+	StateError        State = "error"
+)
+
+// ErrNotConnected is returned for commands issued while the scanner is not
+// ready; the interface keeps reconnecting in the background
+var ErrNotConnected = errors.New("scanner not connected")
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+
+	// How often an idle connection is probed with CMD_STATUS, so a dropped
+	// link is noticed before the next scan
+	healthCheckInterval = 15 * time.Second
+
+	stateHistorySize = 20
+)
+
+// StateChange records one transition of the state machine
+type StateChange struct {
+	State State     `json:"state"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// StateInfo describes the current connection state and recent transitions
+type StateInfo struct {
+	State              State         `json:"state"`
+	Since              time.Time     `json:"since"`
+	LastError          string        `json:"last_error,omitempty"`
+	ReconnectAttempts  int           `json:"reconnect_attempts"`
+	NextAttempt        *time.Time    `json:"next_attempt,omitempty"`
+	Calibrated         *time.Time    `json:"calibrated,omitempty"` // last successful CMD_CALIBRATE
+	CalibrationProfile string        `json:"calibration_profile,omitempty"`
+	History            []StateChange `json:"history"`
+}
+
+// stateMachine tracks the connection state separately from the I/O lock, so
+// status can be read while a scan holds the connection
+type stateMachine struct {
+	mu          sync.RWMutex
+	state       State
+	since       time.Time
+	lastError   string
+	attempts    int
+	nextAttempt time.Time
+	calibrated  time.Time
+	profile     string // calibration profile reported by the scanner
+	history     []StateChange
+	listeners   []func(StateChange)
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{
+		state: StateDisconnected,
+		since: time.Now(),
+	}
+}
+
+func (m *stateMachine) set(state State, err error) {
+	change := StateChange{State: state, Time: time.Now()}
+	if err != nil {
+		change.Error = err.Error()
+	}
+
+	m.mu.Lock()
+	if m.state == state && err == nil {
+		m.mu.Unlock()
+		return
+	}
+	m.state = state
+	m.since = change.Time
+	if err != nil {
+		m.lastError = change.Error
+	}
+	if state == StateReady {
+		m.attempts = 0
+		m.nextAttempt = time.Time{}
+	}
+	m.history = append(m.history, change)
+	if len(m.history) > stateHistorySize {
+		m.history = m.history[len(m.history)-stateHistorySize:]
+	}
+	listeners := m.listeners
+	m.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(change)
+	}
+}
+
+func (m *stateMachine) get() State {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state
+}
+
+func (m *stateMachine) info() StateInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	info := StateInfo{
+		State:             m.state,
+		Since:             m.since,
+		LastError:         m.lastError,
+		ReconnectAttempts: m.attempts,
+		History:           append([]StateChange(nil), m.history...),
+	}
+	if !m.nextAttempt.IsZero() {
+		next := m.nextAttempt
+		info.NextAttempt = &next
+	}
+	if !m.calibrated.IsZero() {
+		calibrated := m.calibrated
+		info.Calibrated = &calibrated
+		info.CalibrationProfile = m.profile
+	}
+	return info
+}
+
+// setCalibrated records when the scanner was last calibrated and with
+// which profile; the zero time marks it uncalibrated
+func (m *stateMachine) setCalibrated(t time.Time, profile string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calibrated = t
+	m.profile = profile
+}
+
+// scheduleRetry records a failed attempt and returns the backoff delay
+// before the next one: exponential from minReconnectDelay, capped at
+// maxReconnectDelay, with up to 20% jitter
+func (m *stateMachine) scheduleRetry() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.attempts++
+	delay := maxReconnectDelay
+	if m.attempts < 7 {
+		delay = minReconnectDelay << (m.attempts - 1)
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+	delay += time.Duration(rand.Int63n(int64(delay) / 5))
+
+	m.nextAttempt = time.Now().Add(delay)
+	return delay
+}
+
+func (m *stateMachine) onChange(fn func(StateChange)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, fn)
+}
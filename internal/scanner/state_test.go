@@ -0,0 +1,126 @@
+package scanner
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScheduleRetryBackoff(t *testing.T) {
+	m := newStateMachine()
+
+	bases := []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second,
+		time.Minute, time.Minute, time.Minute,
+	}
+	for i, base := range bases {
+		before := time.Now()
+		delay := m.scheduleRetry()
+		if delay < base || delay >= base+base/5 {
+			t.Errorf("attempt %d: delay %v, want %v plus under 20%% jitter", i+1, delay, base)
+		}
+
+		info := m.info()
+		if info.ReconnectAttempts != i+1 {
+			t.Errorf("attempt %d: %d attempts recorded", i+1, info.ReconnectAttempts)
+		}
+		if info.NextAttempt == nil || info.NextAttempt.Before(before.Add(delay)) || info.NextAttempt.After(time.Now().Add(delay)) {
+			t.Errorf("attempt %d: next attempt %v, want %v from now", i+1, info.NextAttempt, delay)
+		}
+	}
+
+	// Connecting resets the backoff
+	m.set(StateReady, nil)
+	if info := m.info(); info.ReconnectAttempts != 0 || info.NextAttempt != nil {
+		t.Errorf("after connecting: %d attempts, next attempt %v", info.ReconnectAttempts, info.NextAttempt)
+	}
+	if delay := m.scheduleRetry(); delay >= minReconnectDelay+minReconnectDelay/5 {
+		t.Errorf("first retry after reconnecting waits %v", delay)
+	}
+}
+
+func TestScheduleRetryJitter(t *testing.T) {
+	// Scanners that drop together must not all retry in lockstep
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		delays[newStateMachine().scheduleRetry()] = true
+	}
+	if len(delays) < 2 {
+		t.Errorf("20 first retries all wait %v", delays)
+	}
+}
+
+func TestStateTransitions(t *testing.T) {
+	m := newStateMachine()
+	if info := m.info(); info.State != StateDisconnected || len(info.History) != 0 {
+		t.Fatalf("new state machine: %+v", info)
+	}
+
+	var seen []StateChange
+	m.onChange(func(c StateChange) { seen = append(seen, c) })
+
+	dropped := errors.New("link dropped")
+	steps := []struct {
+		state    State
+		err      error
+		recorded bool
+	}{
+		{StateConnecting, nil, true},
+		{StateConnecting, nil, false}, // no change
+		{StateReady, nil, true},
+		{StateScanning, nil, true},
+		{StateError, dropped, true},
+		{StateError, dropped, true}, // a new error is recorded even in the same state
+		{StateConnecting, nil, true},
+		{StateReady, nil, true},
+		{StateDisconnected, nil, true},
+	}
+	var want []StateChange
+	for _, step := range steps {
+		m.set(step.state, step.err)
+		if step.recorded {
+			c := StateChange{State: step.state}
+			if step.err != nil {
+				c.Error = step.err.Error()
+			}
+			want = append(want, c)
+		}
+	}
+
+	info := m.info()
+	if len(seen) != len(want) || len(info.History) != len(want) {
+		t.Fatalf("listener saw %d changes, history has %d, want %d", len(seen), len(info.History), len(want))
+	}
+	for i := range want {
+		if seen[i].State != want[i].State || seen[i].Error != want[i].Error {
+			t.Errorf("change %d: listener saw %+v, want %+v", i, seen[i], want[i])
+		}
+		if info.History[i].State != want[i].State || info.History[i].Error != want[i].Error {
+			t.Errorf("change %d: history has %+v, want %+v", i, info.History[i], want[i])
+		}
+	}
+	if info.State != StateDisconnected || !info.Since.Equal(info.History[len(want)-1].Time) {
+		t.Errorf("state %s since %v", info.State, info.Since)
+	}
+	// The last error outlives recovery, for the status page
+	if info.LastError != dropped.Error() {
+		t.Errorf("last error %q", info.LastError)
+	}
+}
+
+func TestStateHistoryBounded(t *testing.T) {
+	m := newStateMachine()
+	for i := 0; i < 3*stateHistorySize; i++ {
+		m.set(StateError, errors.New("refused"))
+		m.set(StateConnecting, nil)
+	}
+	m.set(StateReady, nil)
+
+	history := m.info().History
+	if len(history) != stateHistorySize {
+		t.Fatalf("history holds %d changes, want %d", len(history), stateHistorySize)
+	}
+	if last := history[len(history)-1]; last.State != StateReady {
+		t.Errorf("oldest changes kept instead of the latest: ends with %s", last.State)
+	}
+}
@@ -0,0 +1,153 @@
+package scanner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Violation is one reason a request was rejected
+type Violation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every problem found in a scan or capture request
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Field + ": " + v.Message
+	}
+	return "invalid request: " + strings.Join(msgs, "; ")
+}
+
+type violations []Violation
+
+func (v *violations) add(field, format string, args ...interface{}) {
+	*v = append(*v, Violation{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v violations) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return &ValidationError{Violations: v}
+}
+
+// capabilities is what the scanner reported about itself, taken from the
+// layer table. known is false until the first connection.
+type capabilities struct {
+	known       bool
+	stageWidth  int
+	stageHeight int
+	layers      map[int]bool
+}
+
+func (s *Interface) capabilities() capabilities {
+	s.layersMu.RLock()
+	defer s.layersMu.RUnlock()
+
+	c := capabilities{
+		known:  len(s.layerData) > 0,
+		layers: make(map[int]bool, len(s.layerData)),
+	}
+	for _, info := range s.layerData {
+		c.layers[info.LayerIndex] = true
+		if info.Width > c.stageWidth {
+			c.stageWidth = info.Width
+		}
+		if info.Height > c.stageHeight {
+			c.stageHeight = info.Height
+		}
+	}
+	return c
+}
+
+// ValidateScan checks a scan request against the configured size limit
+// and, once the scanner has reported them, its stage size and focus
+// layers. It returns a *ValidationError listing every violation.
+func (s *Interface) ValidateScan(req *ScanRequest) error {
+	var v violations
+	caps := s.capabilities()
+
+	s.validateRegion(&v, caps, "startX", "startY", req.StartX, req.StartY, req.Width, req.Height)
+
+	if len(req.Layers) == 0 {
+		v.add("layers", "at least one layer is required")
+	}
+	if caps.known && len(req.Layers) > len(caps.layers) {
+		v.add("layers", "%d layers requested, the scanner has %d", len(req.Layers), len(caps.layers))
+	}
+	seen := make(map[int]bool, len(req.Layers))
+	for i, layer := range req.Layers {
+		field := fmt.Sprintf("layers[%d]", i)
+		switch {
+		case layer < 0:
+			v.add(field, "layer %d is negative", layer)
+		case seen[layer]:
+			v.add(field, "layer %d is requested more than once", layer)
+		case caps.known && !caps.layers[layer]:
+			v.add(field, "layer %d doesn't exist on this scanner", layer)
+		}
+		seen[layer] = true
+	}
+
+	return v.err()
+}
+
+// ValidateCapture checks a capture request like ValidateScan
+func (s *Interface) ValidateCapture(req *CaptureRequest) error {
+	var v violations
+	caps := s.capabilities()
+
+	s.validateRegion(&v, caps, "x", "y", req.X, req.Y, req.Width, req.Height)
+
+	if req.Depth == nil {
+		switch {
+		case req.Layer < 0:
+			v.add("layer", "layer %d is negative", req.Layer)
+		case caps.known && !caps.layers[req.Layer]:
+			v.add("layer", "layer %d doesn't exist on this scanner", req.Layer)
+		}
+	} else if !caps.known {
+		v.add("depth", "the scanner hasn't reported its focus layers yet")
+	}
+	if req.Objective < 0 {
+		v.add("objective", "objective %d is negative", req.Objective)
+	}
+
+	return v.err()
+}
+
+func (s *Interface) validateRegion(v *violations, caps capabilities, xField, yField string, x, y, width, height int) {
+	if x < 0 {
+		v.add(xField, "must not be negative")
+	}
+	if y < 0 {
+		v.add(yField, "must not be negative")
+	}
+	if width <= 0 {
+		v.add("width", "must be positive")
+	}
+	if height <= 0 {
+		v.add("height", "must be positive")
+	}
+	if width <= 0 || height <= 0 {
+		return
+	}
+
+	if area := int64(width) * int64(height); area > s.config.MaxScanArea {
+		v.add("region", "region of %dx%d pixels exceeds the limit of %d pixels", width, height, s.config.MaxScanArea)
+	}
+	if caps.known {
+		if x >= 0 && int64(x)+int64(width) > int64(caps.stageWidth) {
+			v.add("width", "region ends at x=%d, beyond the stage width of %d", int64(x)+int64(width), caps.stageWidth)
+		}
+		if y >= 0 && int64(y)+int64(height) > int64(caps.stageHeight) {
+			v.add("height", "region ends at y=%d, beyond the stage height of %d", int64(y)+int64(height), caps.stageHeight)
+		}
+	}
+}
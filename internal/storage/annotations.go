@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"cyto-viewer/internal/geometry"
+)
+
+var (
+	ErrAnnotationNotFound = errors.New("annotation not found")
+
+	// ErrVersionConflict is returned when an annotation changed since the
+	// version the caller based its edit on
+	ErrVersionConflict = errors.New("annotation was modified concurrently")
+)
+
+// Annotation is a shape drawn on a slide, in level 0 slide pixels
+type Annotation struct {
+	ID        string            `json:"id"`
+	SlideID   string            `json:"slideId"`
+	Geometry  geometry.Geometry `json:"geometry"`
+	Bounds    geometry.Rect     `json:"bounds"`
+	Label     string            `json:"label,omitempty"`
+	Color     string            `json:"color,omitempty"`
+	Layer     *int              `json:"layer"` // focus layer; null for all layers
+	Author    string            `json:"author,omitempty"`
+	UpdatedBy string            `json:"updatedBy,omitempty"`
+	Created   time.Time         `json:"created"`
+	Updated   time.Time         `json:"updated"`
+	Version   int64             `json:"version"` // incremented by every change
+}
+
+// AnnotationFilter selects annotations. Zero fields match everything.
+type AnnotationFilter struct {
+	Bounds *geometry.Rect // bounding boxes overlapping this region
+	Layer  *int           // on this focus layer, or on all layers
+	Label  string
+}
+
+func (f *AnnotationFilter) match(a *Annotation) bool {
+	if f.Bounds != nil && !a.Geometry.Intersects(*f.Bounds) {
+		return false
+	}
+	if f.Layer != nil && a.Layer != nil && *a.Layer != *f.Layer {
+		return false
+	}
+	return f.Label == "" || a.Label == f.Label
+}
+
+// AnnotationStore keeps each slide's annotations in
+// basePath/annotations/<slide>.json. A slide's file is loaded on first use
+// and rewritten on every change.
+type AnnotationStore struct {
+	path string
+	mu   sync.Mutex
+
+	slides map[string]map[string]*Annotation // loaded slides by ID
+}
+
+func OpenAnnotationStore(basePath string) (*AnnotationStore, error) {
+	s := &AnnotationStore{
+		path:   filepath.Join(basePath, "annotations"),
+		slides: make(map[string]map[string]*Annotation),
+	}
+	if err := os.MkdirAll(s.path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create annotation store: %w", err)
+	}
+	return s, nil
+}
+
+// List returns a slide's annotations matching filter, oldest first
+func (s *AnnotationStore) List(slideID string, filter AnnotationFilter) ([]Annotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, err := s.loadLocked(slideID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Annotation, 0)
+	for _, a := range set {
+		if filter.match(a) {
+			result = append(result, a.clone())
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Created.Equal(result[j].Created) {
+			return result[i].Created.Before(result[j].Created)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+func (s *AnnotationStore) Get(slideID, id string) (Annotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, err := s.loadLocked(slideID)
+	if err != nil {
+		return Annotation{}, err
+	}
+	a, ok := set[id]
+	if !ok {
+		return Annotation{}, ErrAnnotationNotFound
+	}
+	return a.clone(), nil
+}
+
+// Create stores new annotations on a slide, assigning their IDs, versions
+// and timestamps. The geometry must already be valid. Either all are
+// stored or none.
+func (s *AnnotationStore) Create(slideID string, annotations ...Annotation) ([]Annotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, err := s.loadLocked(slideID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	created := make([]Annotation, 0, len(annotations))
+	for _, a := range annotations {
+		id, err := newAnnotationID()
+		if err != nil {
+			return nil, err
+		}
+		a.ID = id
+		a.SlideID = slideID
+		a.Bounds = a.Geometry.Bounds()
+		a.UpdatedBy = a.Author
+		a.Created, a.Updated = now, now
+		a.Version = 1
+		created = append(created, a)
+	}
+
+	for i := range created {
+		a := created[i].clone()
+		set[a.ID] = &a
+	}
+	if err := s.saveLocked(slideID, set); err != nil {
+		for _, a := range created {
+			delete(set, a.ID)
+		}
+		return nil, err
+	}
+	return created, nil
+}
+
+// Update applies fn to an annotation if it is still at version, and stores
+// it as the next version. Fields other than the geometry, label, color and
+// layer are kept.
+func (s *AnnotationStore) Update(slideID, id string, version int64, user string, fn func(*Annotation)) (Annotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, err := s.loadLocked(slideID)
+	if err != nil {
+		return Annotation{}, err
+	}
+	current, ok := set[id]
+	if !ok {
+		return Annotation{}, ErrAnnotationNotFound
+	}
+	if current.Version != version {
+		return current.clone(), ErrVersionConflict
+	}
+
+	updated := current.clone()
+	fn(&updated)
+	updated.ID, updated.SlideID = current.ID, current.SlideID
+	updated.Author, updated.Created = current.Author, current.Created
+	updated.Bounds = updated.Geometry.Bounds()
+	updated.UpdatedBy = user
+	updated.Updated = time.Now()
+	updated.Version = current.Version + 1
+
+	set[id] = &updated
+	if err := s.saveLocked(slideID, set); err != nil {
+		set[id] = current
+		return Annotation{}, err
+	}
+	return updated.clone(), nil
+}
+
+// Delete removes an annotation if it is still at version
+func (s *AnnotationStore) Delete(slideID, id string, version int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set, err := s.loadLocked(slideID)
+	if err != nil {
+		return err
+	}
+	current, ok := set[id]
+	if !ok {
+		return ErrAnnotationNotFound
+	}
+	if current.Version != version {
+		return ErrVersionConflict
+	}
+
+	delete(set, id)
+	if err := s.saveLocked(slideID, set); err != nil {
+		set[id] = current
+		return err
+	}
+	return nil
+}
+
+// DeleteSlide removes all of a slide's annotations
+func (s *AnnotationStore) DeleteSlide(slideID string) error {
+	if !ValidSlideID(slideID) {
+		return fmt.Errorf("invalid slide ID: %q", slideID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.slides, slideID)
+	err := os.Remove(s.slidePath(slideID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *AnnotationStore) slidePath(slideID string) string {
+	return filepath.Join(s.path, slideID+".json")
+}
+
+// loadLocked returns a slide's annotations, reading them on first use
+func (s *AnnotationStore) loadLocked(slideID string) (map[string]*Annotation, error) {
+	if set, ok := s.slides[slideID]; ok {
+		return set, nil
+	}
+	if !ValidSlideID(slideID) {
+		return nil, fmt.Errorf("invalid slide ID: %q", slideID)
+	}
+
+	set := make(map[string]*Annotation)
+	data, err := os.ReadFile(s.slidePath(slideID))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read annotations: %w", err)
+	default:
+		var list []*Annotation
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("failed to parse annotations of slide %s: %w", slideID, err)
+		}
+		for _, a := range list {
+			set[a.ID] = a
+		}
+	}
+
+	s.slides[slideID] = set
+	return set, nil
+}
+
+func (s *AnnotationStore) saveLocked(slideID string, set map[string]*Annotation) error {
+	list := make([]*Annotation, 0, len(set))
+	for _, a := range set {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.slidePath(slideID), data)
+}
+
+func (a *Annotation) clone() Annotation {
+	c := *a
+	c.Geometry.Points = append([]geometry.Point(nil), a.Geometry.Points...)
+	if a.Layer != nil {
+		layer := *a.Layer
+		c.Layer = &layer
+	}
+	return c
+}
+
+func newAnnotationID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "ann_" + hex.EncodeToString(b), nil
+}
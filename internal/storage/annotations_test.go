@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"cyto-viewer/internal/geometry"
+)
+
+func openTestAnnotations(t *testing.T) (*AnnotationStore, string) {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := OpenAnnotationStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func point(x, y float64) geometry.Geometry {
+	return geometry.Geometry{Type: geometry.TypePoint, Points: []geometry.Point{{x, y}}}
+}
+
+func rectangle(x0, y0, x1, y1 float64) geometry.Geometry {
+	return geometry.Geometry{Type: geometry.TypeRectangle, Points: []geometry.Point{{x0, y0}, {x1, y1}}}
+}
+
+func intPtr(v int) *int { return &v }
+
+// breakSaves makes every later save of slideID fail: its file is replaced
+// by a directory, which a rename can't overwrite. The slide must already be
+// loaded.
+func breakSaves(t *testing.T, dir, slideID string) {
+	t.Helper()
+	path := filepath.Join(dir, "annotations", slideID+".json")
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Join(path, "blocked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnnotationCRUD(t *testing.T) {
+	s, dir := openTestAnnotations(t)
+
+	created, err := s.Create("slide-1", Annotation{Geometry: rectangle(10, 20, 30, 40), Label: "HSIL", Author: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := created[0]
+	if !strings.HasPrefix(a.ID, "ann_") || a.SlideID != "slide-1" || a.Version != 1 || a.UpdatedBy != "alice" {
+		t.Fatalf("created %+v", a)
+	}
+	if a.Bounds != (geometry.Rect{MinX: 10, MinY: 20, MaxX: 30, MaxY: 40}) {
+		t.Errorf("bounds %+v, want the rectangle's corners", a.Bounds)
+	}
+
+	updated, err := s.Update("slide-1", a.ID, 1, "bob", func(u *Annotation) {
+		u.Geometry = point(5, 5)
+		u.Label = "LSIL"
+		u.Author = "mallory" // kept from the original
+		u.Version = 99       // assigned by the store
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Version != 2 || updated.Label != "LSIL" || updated.Author != "alice" || updated.UpdatedBy != "bob" {
+		t.Errorf("updated %+v", updated)
+	}
+	if updated.Bounds != (geometry.Rect{MinX: 5, MinY: 5, MaxX: 5, MaxY: 5}) {
+		t.Errorf("bounds %+v not recomputed from the new geometry", updated.Bounds)
+	}
+	if !updated.Created.Equal(a.Created) {
+		t.Error("update changed the creation time")
+	}
+
+	// Reopening reads back what was saved
+	s2, err := OpenAnnotationStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s2.Get("slide-1", a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 2 || got.Label != "LSIL" {
+		t.Errorf("reopened store has %+v", got)
+	}
+
+	if err := s.Delete("slide-1", a.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("slide-1", a.ID); !errors.Is(err, ErrAnnotationNotFound) {
+		t.Errorf("get after delete: %v, want ErrAnnotationNotFound", err)
+	}
+}
+
+func TestAnnotationVersionConflict(t *testing.T) {
+	s, _ := openTestAnnotations(t)
+	created, err := s.Create("slide-1", Annotation{Geometry: point(1, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := created[0].ID
+	if _, err := s.Update("slide-1", id, 1, "alice", func(a *Annotation) { a.Label = "first" }); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		op      func() error
+		wantErr error
+	}{
+		{"stale update", func() error {
+			current, err := s.Update("slide-1", id, 1, "bob", func(a *Annotation) { a.Label = "second" })
+			if current.Version != 2 || current.Label != "first" {
+				t.Errorf("conflict returned %+v, want the current version", current)
+			}
+			return err
+		}, ErrVersionConflict},
+		{"stale delete", func() error { return s.Delete("slide-1", id, 1) }, ErrVersionConflict},
+		{"update missing", func() error {
+			_, err := s.Update("slide-1", "ann_missing", 1, "bob", func(*Annotation) {})
+			return err
+		}, ErrAnnotationNotFound},
+		{"delete missing", func() error { return s.Delete("slide-1", "ann_missing", 1) }, ErrAnnotationNotFound},
+	}
+	for _, tt := range tests {
+		if err := tt.op(); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	got, err := s.Get("slide-1", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 2 || got.Label != "first" {
+		t.Errorf("rejected changes were applied: %+v", got)
+	}
+}
+
+func TestAnnotationList(t *testing.T) {
+	s, _ := openTestAnnotations(t)
+	_, err := s.Create("slide-1",
+		Annotation{Geometry: rectangle(0, 0, 100, 100), Label: "big"},
+		Annotation{Geometry: point(500, 500), Label: "far", Layer: intPtr(2)},
+		Annotation{Geometry: point(50, 50), Label: "near", Layer: intPtr(3)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create("slide-2", Annotation{Geometry: point(50, 50), Label: "other slide"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter AnnotationFilter
+		want   string
+	}{
+		{"all", AnnotationFilter{}, "big far near"},
+		{"bbox", AnnotationFilter{Bounds: &geometry.Rect{MinX: 40, MinY: 40, MaxX: 60, MaxY: 60}}, "big near"},
+		{"bbox touching an edge", AnnotationFilter{Bounds: &geometry.Rect{MinX: 100, MinY: 100, MaxX: 200, MaxY: 200}}, "big"},
+		{"bbox empty", AnnotationFilter{Bounds: &geometry.Rect{MinX: 200, MinY: 200, MaxX: 300, MaxY: 300}}, ""},
+		{"layer includes all-layer annotations", AnnotationFilter{Layer: intPtr(3)}, "big near"},
+		{"layer without annotations", AnnotationFilter{Layer: intPtr(7)}, "big"},
+		{"label", AnnotationFilter{Label: "far"}, "far"},
+		{"combined", AnnotationFilter{Layer: intPtr(2), Bounds: &geometry.Rect{MinX: 0, MinY: 0, MaxX: 1000, MaxY: 1000}}, "big far"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := s.List("slide-1", tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var labels []string
+			for _, a := range list {
+				labels = append(labels, a.Label)
+			}
+			sort.Strings(labels)
+			if got := strings.Join(labels, " "); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnnotationFailedSave(t *testing.T) {
+	s, dir := openTestAnnotations(t)
+	created, err := s.Create("slide-1", Annotation{Geometry: point(1, 1), Label: "kept"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := created[0].ID
+	breakSaves(t, dir, "slide-1")
+
+	// Create is all or nothing: none of the batch is kept
+	if _, err := s.Create("slide-1", Annotation{Geometry: point(2, 2)}, Annotation{Geometry: point(3, 3)}); err == nil {
+		t.Error("create succeeded without saving")
+	}
+	if _, err := s.Update("slide-1", id, 1, "bob", func(a *Annotation) { a.Label = "changed" }); err == nil {
+		t.Error("update succeeded without saving")
+	}
+	if err := s.Delete("slide-1", id, 1); err == nil {
+		t.Error("delete succeeded without saving")
+	}
+
+	list, err := s.List("slide-1", AnnotationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Label != "kept" || list[0].Version != 1 {
+		t.Errorf("failed saves changed the store: %+v", list)
+	}
+}
+
+func TestAnnotationInvalidSlide(t *testing.T) {
+	s, _ := openTestAnnotations(t)
+	if _, err := s.Create("../escape", Annotation{Geometry: point(1, 1)}); err == nil {
+		t.Error("created annotations for an invalid slide ID")
+	}
+	if err := s.DeleteSlide("../escape"); err == nil {
+		t.Error("deleted annotations of an invalid slide ID")
+	}
+}
+
+func TestAnnotationDeleteSlide(t *testing.T) {
+	s, dir := openTestAnnotations(t)
+	if _, err := s.Create("slide-1", Annotation{Geometry: point(1, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteSlide("slide-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteSlide("slide-1"); err != nil {
+		t.Errorf("deleting a slide without annotations: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "annotations", "slide-1.json")); !os.IsNotExist(err) {
+		t.Errorf("annotation file still exists: %v", err)
+	}
+	list, err := s.List("slide-1", AnnotationFilter{})
+	if err != nil || len(list) != 0 {
+		t.Errorf("got %d annotations, %v after deleting the slide", len(list), err)
+	}
+}
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCaseNotFound = errors.New("case not found")
+
+	// ErrAccessionExists is returned when another case has the accession
+	// number
+	ErrAccessionExists = errors.New("accession number already in use")
+)
+
+// SlideInCaseError is returned when a slide added to a case already
+// belongs to another one
+type SlideInCaseError struct {
+	SlideID string
+	CaseID  string
+}
+
+func (e *SlideInCaseError) Error() string {
+	return fmt.Sprintf("slide %s already belongs to case %s", e.SlideID, e.CaseID)
+}
+
+// Case groups the slides prepared from one specimen, such as several
+// smears and a cell block. A slide belongs to at most one case, and only
+// the case's users may see it.
+type Case struct {
+	ID              string    `json:"id"`
+	AccessionNumber string    `json:"accessionNumber"`
+	SpecimenType    string    `json:"specimenType"`
+	CollectionDate  string    `json:"collectionDate,omitempty"` // YYYY-MM-DD
+	Slides          []string  `json:"slides"`                   // slide IDs in display order
+	Owner           string    `json:"owner,omitempty"`
+	Readers         []string  `json:"readers"` // users who may view the case and its slides
+	Editors         []string  `json:"editors"` // users who may also change the case
+	Created         time.Time `json:"created"`
+	Updated         time.Time `json:"updated"`
+}
+
+// CanRead reports whether user may view the case and its slides
+func (c *Case) CanRead(user string) bool {
+	return c.CanEdit(user) || containsString(c.Readers, user)
+}
+
+// CanEdit reports whether user may change the case
+func (c *Case) CanEdit(user string) bool {
+	return user != "" && (user == c.Owner || containsString(c.Editors, user))
+}
+
+// CaseCatalog is the persistent index of cases, kept in cases.json
+type CaseCatalog struct {
+	path string
+	mu   sync.RWMutex
+
+	cases   map[string]*Case
+	bySlide map[string]string // case ID by slide ID
+}
+
+func OpenCaseCatalog(basePath string) (*CaseCatalog, error) {
+	c := &CaseCatalog{
+		path:    filepath.Join(basePath, "cases.json"),
+		cases:   make(map[string]*Case),
+		bySlide: make(map[string]string),
+	}
+
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read case catalog: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &c.cases); err != nil {
+		return nil, fmt.Errorf("failed to parse case catalog: %w", err)
+	}
+	for _, cs := range c.cases {
+		for _, slideID := range cs.Slides {
+			c.bySlide[slideID] = cs.ID
+		}
+	}
+
+	return c, nil
+}
+
+// Get returns a copy of a case
+func (c *CaseCatalog) Get(id string) (Case, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	cs, ok := c.cases[id]
+	if !ok {
+		return Case{}, false
+	}
+	return cs.clone(), true
+}
+
+// ForSlide returns the case a slide belongs to, if any
+func (c *CaseCatalog) ForSlide(slideID string) (Case, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	id, ok := c.bySlide[slideID]
+	if !ok {
+		return Case{}, false
+	}
+	return c.cases[id].clone(), true
+}
+
+// List returns the cases whose accession number starts with accession,
+// ignoring case, newest first. An empty accession lists every case.
+func (c *CaseCatalog) List(accession string) []Case {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	prefix := strings.ToLower(accession)
+	cases := make([]Case, 0)
+	for _, cs := range c.cases {
+		if strings.HasPrefix(strings.ToLower(cs.AccessionNumber), prefix) {
+			cases = append(cases, cs.clone())
+		}
+	}
+	sort.Slice(cases, func(i, j int) bool {
+		return cases[i].Created.After(cases[j].Created)
+	})
+	return cases
+}
+
+// Create stores a new case, assigning its ID and timestamps
+func (c *CaseCatalog) Create(cs Case) (Case, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, err := newCaseID()
+	if err != nil {
+		return Case{}, err
+	}
+	cs.ID = id
+	cs.Created = time.Now()
+	cs.Updated = cs.Created
+	if err := c.checkLocked(&cs); err != nil {
+		return Case{}, err
+	}
+
+	stored := cs.clone()
+	c.cases[id] = &stored
+	if err := c.saveLocked(); err != nil {
+		delete(c.cases, id)
+		return Case{}, err
+	}
+	c.indexLocked(nil, &stored)
+	return cs, nil
+}
+
+// Update applies fn to a case and saves it. The ID, owner and creation
+// time are kept.
+func (c *CaseCatalog) Update(id string, fn func(*Case)) (Case, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current, ok := c.cases[id]
+	if !ok {
+		return Case{}, ErrCaseNotFound
+	}
+
+	updated := current.clone()
+	fn(&updated)
+	updated.ID, updated.Owner, updated.Created = current.ID, current.Owner, current.Created
+	updated.Updated = time.Now()
+	if err := c.checkLocked(&updated); err != nil {
+		return Case{}, err
+	}
+
+	c.cases[id] = &updated
+	if err := c.saveLocked(); err != nil {
+		c.cases[id] = current
+		return Case{}, err
+	}
+	c.indexLocked(current, &updated)
+	return updated.clone(), nil
+}
+
+// Delete removes a case. Its slides are kept and become unassigned.
+func (c *CaseCatalog) Delete(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current, ok := c.cases[id]
+	if !ok {
+		return ErrCaseNotFound
+	}
+	delete(c.cases, id)
+	if err := c.saveLocked(); err != nil {
+		c.cases[id] = current
+		return err
+	}
+	c.indexLocked(current, nil)
+	return nil
+}
+
+// RemoveSlide takes a deleted slide out of its case, if it has one
+func (c *CaseCatalog) RemoveSlide(slideID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, ok := c.bySlide[slideID]
+	if !ok {
+		return nil
+	}
+	current := c.cases[id]
+	updated := current.clone()
+	updated.Slides = updated.Slides[:0]
+	for _, s := range current.Slides {
+		if s != slideID {
+			updated.Slides = append(updated.Slides, s)
+		}
+	}
+	updated.Updated = time.Now()
+
+	c.cases[id] = &updated
+	if err := c.saveLocked(); err != nil {
+		c.cases[id] = current
+		return err
+	}
+	c.indexLocked(current, &updated)
+	return nil
+}
+
+// checkLocked rejects a case whose accession number or slides another case
+// already has
+func (c *CaseCatalog) checkLocked(cs *Case) error {
+	for _, other := range c.cases {
+		if other.ID != cs.ID && strings.EqualFold(other.AccessionNumber, cs.AccessionNumber) {
+			return ErrAccessionExists
+		}
+	}
+	for _, slideID := range cs.Slides {
+		if owner, ok := c.bySlide[slideID]; ok && owner != cs.ID {
+			return &SlideInCaseError{SlideID: slideID, CaseID: owner}
+		}
+	}
+	return nil
+}
+
+// indexLocked moves the slide index from a case's old slides to its new
+// ones; either may be nil
+func (c *CaseCatalog) indexLocked(old, updated *Case) {
+	if old != nil {
+		for _, slideID := range old.Slides {
+			delete(c.bySlide, slideID)
+		}
+	}
+	if updated != nil {
+		for _, slideID := range updated.Slides {
+			c.bySlide[slideID] = updated.ID
+		}
+	}
+}
+
+func (c *CaseCatalog) saveLocked() error {
+	data, err := json.Marshal(c.cases)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, data)
+}
+
+func (cs *Case) clone() Case {
+	c := *cs
+	c.Slides = append([]string{}, cs.Slides...)
+	c.Readers = append([]string{}, cs.Readers...)
+	c.Editors = append([]string{}, cs.Editors...)
+	return c
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func newCaseID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "case_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestCases(t *testing.T) (*CaseCatalog, string) {
+	t.Helper()
+	dir := t.TempDir()
+	c, err := OpenCaseCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, dir
+}
+
+func TestCaseCreateAndReopen(t *testing.T) {
+	c, dir := openTestCases(t)
+	created, err := c.Create(Case{ID: "case_mine", AccessionNumber: "C26-100", SpecimenType: "FNA",
+		Slides: []string{"slide-2", "slide-1"}, Owner: "alice", Readers: []string{"rita"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.ID, "case_") || created.ID == "case_mine" || created.Created.IsZero() {
+		t.Fatalf("created %+v, want an assigned ID and time", created)
+	}
+
+	c2, err := OpenCaseCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := c2.ForSlide("slide-1")
+	if !ok || got.ID != created.ID || strings.Join(got.Slides, ",") != "slide-2,slide-1" {
+		t.Errorf("reopened catalog has %+v, %v for slide-1", got, ok)
+	}
+	if _, ok := c2.ForSlide("slide-3"); ok {
+		t.Error("unassigned slide has a case")
+	}
+
+	// Changing a returned copy doesn't change the catalog
+	got.Slides[0] = "slide-9"
+	if again, _ := c2.Get(created.ID); again.Slides[0] != "slide-2" {
+		t.Error("case changed through a returned copy")
+	}
+}
+
+func TestCaseAccessionUnique(t *testing.T) {
+	c, _ := openTestCases(t)
+	first, err := c.Create(Case{AccessionNumber: "C26-100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.Create(Case{AccessionNumber: "C26-101"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Create(Case{AccessionNumber: "c26-100"}); !errors.Is(err, ErrAccessionExists) {
+		t.Errorf("create with a taken accession number, ignoring case: %v, want ErrAccessionExists", err)
+	}
+	if _, err := c.Update(second.ID, func(cs *Case) { cs.AccessionNumber = "C26-100" }); !errors.Is(err, ErrAccessionExists) {
+		t.Errorf("update to a taken accession number: %v, want ErrAccessionExists", err)
+	}
+	// A case keeps its own accession number
+	if _, err := c.Update(first.ID, func(cs *Case) { cs.SpecimenType = "Urine" }); err != nil {
+		t.Errorf("update keeping the accession number: %v", err)
+	}
+	if got, _ := c.Get(second.ID); got.AccessionNumber != "C26-101" {
+		t.Errorf("rejected update was applied: %+v", got)
+	}
+}
+
+func TestCaseSlideInOneCase(t *testing.T) {
+	c, _ := openTestCases(t)
+	first, err := c.Create(Case{AccessionNumber: "C26-1", Slides: []string{"slide-1", "slide-2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := c.Create(Case{AccessionNumber: "C26-2", Slides: []string{"slide-3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var inCase *SlideInCaseError
+	if _, err := c.Create(Case{AccessionNumber: "C26-3", Slides: []string{"slide-4", "slide-2"}}); !errors.As(err, &inCase) ||
+		inCase.SlideID != "slide-2" || inCase.CaseID != first.ID {
+		t.Errorf("create with another case's slide: %v", err)
+	}
+	if _, err := c.Update(second.ID, func(cs *Case) { cs.Slides = append(cs.Slides, "slide-1") }); !errors.As(err, &inCase) {
+		t.Errorf("update with another case's slide: %v", err)
+	}
+	if _, ok := c.ForSlide("slide-4"); ok {
+		t.Error("rejected create indexed its slides")
+	}
+
+	// Moving a slide between cases takes two updates
+	if _, err := c.Update(first.ID, func(cs *Case) { cs.Slides = []string{"slide-2"} }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Update(second.ID, func(cs *Case) { cs.Slides = append(cs.Slides, "slide-1") }); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.ForSlide("slide-1"); got.ID != second.ID {
+		t.Errorf("slide-1 is in %q, want %q", got.ID, second.ID)
+	}
+
+	if err := c.Delete(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.ForSlide("slide-2"); ok {
+		t.Error("slide of a deleted case still has a case")
+	}
+	if err := c.Delete(first.ID); !errors.Is(err, ErrCaseNotFound) {
+		t.Errorf("delete twice: %v, want ErrCaseNotFound", err)
+	}
+}
+
+func TestCaseUpdateKeepsIdentity(t *testing.T) {
+	c, _ := openTestCases(t)
+	created, err := c.Create(Case{AccessionNumber: "C26-1", Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := c.Update(created.ID, func(cs *Case) {
+		cs.ID, cs.Owner, cs.Created = "case_other", "mallory", time.Time{}
+		cs.Editors = []string{"ed"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ID != created.ID || updated.Owner != "alice" || !updated.Created.Equal(created.Created) ||
+		len(updated.Editors) != 1 {
+		t.Errorf("updated %+v", updated)
+	}
+	if _, err := c.Update("case_missing", func(*Case) {}); !errors.Is(err, ErrCaseNotFound) {
+		t.Errorf("update missing: %v, want ErrCaseNotFound", err)
+	}
+}
+
+func TestCaseListByAccession(t *testing.T) {
+	c, _ := openTestCases(t)
+	for _, accession := range []string{"C26-100", "C26-101", "c26-2", "NG26-1"} {
+		if _, err := c.Create(Case{AccessionNumber: accession}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond) // distinct creation times
+	}
+
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", "NG26-1 c26-2 C26-101 C26-100"},
+		{"C26-10", "C26-101 C26-100"},
+		{"c26", "c26-2 C26-101 C26-100"},
+		{"ng", "NG26-1"},
+		{"26", ""},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, cs := range c.List(tt.prefix) {
+			got = append(got, cs.AccessionNumber)
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("List(%q) = %v, want %s newest first", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestCaseRemoveSlide(t *testing.T) {
+	c, dir := openTestCases(t)
+	created, err := c.Create(Case{AccessionNumber: "C26-1", Slides: []string{"slide-1", "slide-2", "slide-3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.RemoveSlide("slide-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RemoveSlide("slide-9"); err != nil {
+		t.Errorf("removing a slide in no case: %v", err)
+	}
+
+	c2, err := OpenCaseCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := c2.Get(created.ID)
+	if strings.Join(got.Slides, ",") != "slide-1,slide-3" {
+		t.Errorf("slides %v after removing slide-2, want the rest in order", got.Slides)
+	}
+	if _, ok := c2.ForSlide("slide-2"); ok {
+		t.Error("removed slide still has a case")
+	}
+
+	// The slide can join another case afterwards
+	if _, err := c.Create(Case{AccessionNumber: "C26-2", Slides: []string{"slide-2"}}); err != nil {
+		t.Errorf("adding a removed slide to another case: %v", err)
+	}
+}
+
+func TestCasePermissions(t *testing.T) {
+	cs := Case{Owner: "alice", Readers: []string{"rita"}, Editors: []string{"ed"}}
+	tests := []struct {
+		user             string
+		canRead, canEdit bool
+	}{
+		{"alice", true, true},
+		{"ed", true, true},
+		{"rita", true, false},
+		{"mallory", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		if got := cs.CanRead(tt.user); got != tt.canRead {
+			t.Errorf("CanRead(%q) = %v, want %v", tt.user, got, tt.canRead)
+		}
+		if got := cs.CanEdit(tt.user); got != tt.canEdit {
+			t.Errorf("CanEdit(%q) = %v, want %v", tt.user, got, tt.canEdit)
+		}
+	}
+
+	// A case without an owner isn't editable by the anonymous user
+	if (&Case{}).CanEdit("") {
+		t.Error("anonymous user may edit an unowned case")
+	}
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"cyto-viewer/internal/geometry"
+)
+
+var ErrMeasurementNotFound = errors.New("measurement not found")
+
+// Measurement is a recorded measurement of a shape on a slide. Records are
+// never changed once made, so a report can always be traced back to the
+// shape, calibration and user behind it.
+type Measurement struct {
+	ID           string               `json:"id"`
+	SlideID      string               `json:"slideId"`
+	AnnotationID string               `json:"annotationId,omitempty"` // annotation measured, if any
+	Geometry     geometry.Geometry    `json:"geometry"`
+	Label        string               `json:"label,omitempty"`
+	Layer        *int                 `json:"layer"` // focus layer measured on; null if not known
+	Result       geometry.Measurement `json:"measurement"`
+	User         string               `json:"user,omitempty"`
+	Created      time.Time            `json:"created"`
+}
+
+// MeasurementFilter selects measurements. Zero fields match everything.
+type MeasurementFilter struct {
+	Label        string
+	Layer        *int
+	AnnotationID string
+}
+
+func (f *MeasurementFilter) match(m *Measurement) bool {
+	if f.Layer != nil && (m.Layer == nil || *m.Layer != *f.Layer) {
+		return false
+	}
+	if f.AnnotationID != "" && m.AnnotationID != f.AnnotationID {
+		return false
+	}
+	return f.Label == "" || m.Label == f.Label
+}
+
+// MeasurementStore keeps each slide's measurements in
+// basePath/measurements/<slide>.json, beside its annotations. A slide's
+// file is loaded on first use and rewritten when a measurement is added.
+type MeasurementStore struct {
+	path string
+	mu   sync.Mutex
+
+	slides map[string][]*Measurement // loaded slides by ID, oldest first
+}
+
+func OpenMeasurementStore(basePath string) (*MeasurementStore, error) {
+	s := &MeasurementStore{
+		path:   filepath.Join(basePath, "measurements"),
+		slides: make(map[string][]*Measurement),
+	}
+	if err := os.MkdirAll(s.path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create measurement store: %w", err)
+	}
+	return s, nil
+}
+
+// List returns a slide's measurements matching filter, oldest first
+func (s *MeasurementStore) List(slideID string, filter MeasurementFilter) ([]Measurement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, err := s.loadLocked(slideID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Measurement, 0)
+	for _, m := range list {
+		if filter.match(m) {
+			result = append(result, m.clone())
+		}
+	}
+	return result, nil
+}
+
+func (s *MeasurementStore) Get(slideID, id string) (Measurement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, err := s.loadLocked(slideID)
+	if err != nil {
+		return Measurement{}, err
+	}
+	for _, m := range list {
+		if m.ID == id {
+			return m.clone(), nil
+		}
+	}
+	return Measurement{}, ErrMeasurementNotFound
+}
+
+// Add records a measurement on a slide, assigning its ID and timestamp.
+// The result must already be computed from the geometry.
+func (s *MeasurementStore) Add(slideID string, m Measurement) (Measurement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list, err := s.loadLocked(slideID)
+	if err != nil {
+		return Measurement{}, err
+	}
+
+	id, err := newMeasurementID()
+	if err != nil {
+		return Measurement{}, err
+	}
+	m.ID = id
+	m.SlideID = slideID
+	m.Created = time.Now()
+
+	stored := m.clone()
+	updated := append(list[:len(list):len(list)], &stored)
+	if err := s.saveLocked(slideID, updated); err != nil {
+		return Measurement{}, err
+	}
+	s.slides[slideID] = updated
+	return m, nil
+}
+
+// DeleteSlide removes all of a slide's measurements
+func (s *MeasurementStore) DeleteSlide(slideID string) error {
+	if !ValidSlideID(slideID) {
+		return fmt.Errorf("invalid slide ID: %q", slideID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.slides, slideID)
+	err := os.Remove(s.slidePath(slideID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *MeasurementStore) slidePath(slideID string) string {
+	return filepath.Join(s.path, slideID+".json")
+}
+
+// loadLocked returns a slide's measurements, reading them on first use
+func (s *MeasurementStore) loadLocked(slideID string) ([]*Measurement, error) {
+	if list, ok := s.slides[slideID]; ok {
+		return list, nil
+	}
+	if !ValidSlideID(slideID) {
+		return nil, fmt.Errorf("invalid slide ID: %q", slideID)
+	}
+
+	var list []*Measurement
+	data, err := os.ReadFile(s.slidePath(slideID))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read measurements: %w", err)
+	default:
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("failed to parse measurements of slide %s: %w", slideID, err)
+		}
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	}
+
+	s.slides[slideID] = list
+	return list, nil
+}
+
+func (s *MeasurementStore) saveLocked(slideID string, list []*Measurement) error {
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.slidePath(slideID), data)
+}
+
+func (m *Measurement) clone() Measurement {
+	c := *m
+	c.Geometry.Points = append([]geometry.Point(nil), m.Geometry.Points...)
+	if m.Layer != nil {
+		layer := *m.Layer
+		c.Layer = &layer
+	}
+	return c
+}
+
+func newMeasurementID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "msr_" + hex.EncodeToString(b), nil
+}
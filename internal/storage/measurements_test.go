@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cyto-viewer/internal/geometry"
+)
+
+func TestMeasurementAddAndGet(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenMeasurementStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shape := rectangle(0, 0, 10, 20)
+	added, err := s.Add("slide-1", Measurement{Geometry: shape, Label: "nucleus", Layer: intPtr(2),
+		Result: shape.Measure(0.5), User: "alice", ID: "msr_mine", SlideID: "slide-9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(added.ID, "msr_") || added.ID == "msr_mine" || added.SlideID != "slide-1" || added.Created.IsZero() {
+		t.Fatalf("added %+v, want an assigned ID, slide and time", added)
+	}
+
+	// Records survive a restart unchanged
+	s2, err := OpenMeasurementStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s2.Get("slide-1", added.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Label != "nucleus" || got.User != "alice" || *got.Layer != 2 || !got.Created.Equal(added.Created) {
+		t.Errorf("reopened store has %+v", got)
+	}
+	if got.Result.Area != 200 || got.Result.AreaMicrons == nil || *got.Result.AreaMicrons != 50 {
+		t.Errorf("result %+v, want 200 px² and 50 µm²", got.Result)
+	}
+
+	if _, err := s.Get("slide-1", "msr_missing"); !errors.Is(err, ErrMeasurementNotFound) {
+		t.Errorf("get missing: %v, want ErrMeasurementNotFound", err)
+	}
+	if _, err := s.Get("slide-2", added.ID); !errors.Is(err, ErrMeasurementNotFound) {
+		t.Errorf("get from another slide: %v, want ErrMeasurementNotFound", err)
+	}
+}
+
+func TestMeasurementCopies(t *testing.T) {
+	s, err := OpenMeasurementStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := s.Add("slide-1", Measurement{Geometry: point(1, 1), Layer: intPtr(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing what the store returned doesn't change the record
+	list, _ := s.List("slide-1", MeasurementFilter{})
+	list[0].Geometry.Points[0] = geometry.Point{9, 9}
+	*list[0].Layer = 9
+	got, _ := s.Get("slide-1", added.ID)
+	if got.Geometry.Points[0] != (geometry.Point{1, 1}) || *got.Layer != 1 {
+		t.Errorf("record changed through a returned copy: %+v", got)
+	}
+}
+
+func TestMeasurementList(t *testing.T) {
+	s, err := OpenMeasurementStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []Measurement{
+		{Geometry: point(1, 1), Label: "a", Layer: intPtr(0)},
+		{Geometry: point(2, 2), Label: "b", Layer: intPtr(1), AnnotationID: "ann_1"},
+		{Geometry: point(3, 3), Label: "a"},
+		{Geometry: point(4, 4), Label: "b", Layer: intPtr(1)},
+	} {
+		if _, err := s.Add("slide-1", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter MeasurementFilter
+		want   []float64 // x of each point, in order
+	}{
+		{"all, oldest first", MeasurementFilter{}, []float64{1, 2, 3, 4}},
+		{"label", MeasurementFilter{Label: "a"}, []float64{1, 3}},
+		{"layer skips unknown layers", MeasurementFilter{Layer: intPtr(0)}, []float64{1}},
+		{"annotation", MeasurementFilter{AnnotationID: "ann_1"}, []float64{2}},
+		{"combined", MeasurementFilter{Label: "b", Layer: intPtr(1)}, []float64{2, 4}},
+		{"no match", MeasurementFilter{Label: "c"}, []float64{}},
+	}
+	for _, tt := range tests {
+		list, err := s.List("slide-1", tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []float64
+		for _, m := range list {
+			got = append(got, m.Geometry.Points[0][0])
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMeasurementFailedSave(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenMeasurementStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add("slide-1", Measurement{Geometry: point(1, 1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "measurements", "slide-1.json")
+	os.Remove(path)
+	if err := os.MkdirAll(filepath.Join(path, "blocked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add("slide-1", Measurement{Geometry: point(2, 2)}); err == nil {
+		t.Error("add succeeded without saving")
+	}
+	if list, _ := s.List("slide-1", MeasurementFilter{}); len(list) != 1 {
+		t.Errorf("got %d measurements after a failed save, want 1", len(list))
+	}
+}
+
+func TestMeasurementDeleteSlide(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenMeasurementStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add("slide-1", Measurement{Geometry: point(1, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteSlide("slide-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteSlide("slide-1"); err != nil {
+		t.Errorf("deleting a slide without measurements: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "measurements", "slide-1.json")); !os.IsNotExist(err) {
+		t.Errorf("measurement file still exists: %v", err)
+	}
+	if list, err := s.List("slide-1", MeasurementFilter{}); err != nil || len(list) != 0 {
+		t.Errorf("got %d measurements, %v after deleting the slide", len(list), err)
+	}
+
+	if _, err := s.Add("../escape", Measurement{Geometry: point(1, 1)}); err == nil {
+		t.Error("recorded a measurement for an invalid slide ID")
+	}
+	if err := s.DeleteSlide("../escape"); err == nil {
+		t.Error("deleted measurements of an invalid slide ID")
+	}
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Revisions tracks version counters for slides, processing profiles and
+// each profile's rendering of a slide. Tile URLs and ETags embed the
+// combined tag, so bumping a counter makes browsers fetch fresh tiles
+// despite the long-lived immutable Cache-Control.
+type Revisions struct {
+	path string
+	mu   sync.RWMutex
+
+	Slides        map[string]uint64 `json:"slides"`
+	Profiles      map[string]uint64 `json:"profiles"`
+	SlideProfiles map[string]uint64 `json:"slideProfiles"` // keyed by slideProfileKey
+}
+
+func OpenRevisions(basePath string) (*Revisions, error) {
+	r := &Revisions{
+		path:          filepath.Join(basePath, "revisions.json"),
+		Slides:        make(map[string]uint64),
+		Profiles:      make(map[string]uint64),
+		SlideProfiles: make(map[string]uint64),
+	}
+
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revisions: %w", err)
+	}
+
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed to parse revisions: %w", err)
+	}
+	if r.Slides == nil {
+		r.Slides = make(map[string]uint64)
+	}
+	if r.Profiles == nil {
+		r.Profiles = make(map[string]uint64)
+	}
+	if r.SlideProfiles == nil {
+		r.SlideProfiles = make(map[string]uint64)
+	}
+
+	return r, nil
+}
+
+// Tag returns the revision tag for tiles of a slide rendered with a profile
+func (r *Revisions) Tag(slideID, profile string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return fmt.Sprintf("%d.%d.%d", r.Slides[slideID], r.Profiles[profile],
+		r.SlideProfiles[slideProfileKey(slideID, profile)])
+}
+
+func (r *Revisions) BumpSlide(slideID string) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Slides[slideID]++
+	return r.Slides[slideID], r.saveLocked()
+}
+
+func (r *Revisions) BumpProfile(profile string) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Profiles[profile]++
+	return r.Profiles[profile], r.saveLocked()
+}
+
+// BumpSlideProfile invalidates one profile's tiles of a slide, leaving the
+// slide's other profiles and the profile's other slides cached
+func (r *Revisions) BumpSlideProfile(slideID, profile string) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := slideProfileKey(slideID, profile)
+	r.SlideProfiles[key]++
+	return r.SlideProfiles[key], r.saveLocked()
+}
+
+// validSlideID rules out slashes in slide IDs, so keys can't collide
+func slideProfileKey(slideID, profile string) string {
+	return slideID + "/" + profile
+}
+
+func (r *Revisions) saveLocked() error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
@@ -0,0 +1,36 @@
+package storage
+
+import "testing"
+
+func TestRevisionsBumpSlideProfile(t *testing.T) {
+	dir := t.TempDir()
+	r, err := OpenRevisions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := func(r *Revisions) [4]string {
+		return [4]string{r.Tag("slide-1", "he"), r.Tag("slide-1", ""), r.Tag("slide-2", "he"), r.Tag("slide-2", "")}
+	}
+	before := tags(r)
+	if _, err := r.BumpSlideProfile("slide-1", "he"); err != nil {
+		t.Fatal(err)
+	}
+	after := tags(r)
+	if after[0] == before[0] {
+		t.Error("bumped slide and profile kept its tag")
+	}
+	for i := 1; i < len(after); i++ {
+		if after[i] != before[i] {
+			t.Errorf("tag %d changed from %s to %s, want only slide-1 with he bumped", i, before[i], after[i])
+		}
+	}
+
+	reopened, err := OpenRevisions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tags(reopened); got != tags(r) {
+		t.Errorf("reopened tags %v, want %v", got, tags(r))
+	}
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SlideStatus tracks whether a slide's tiles are complete
+type SlideStatus string
+
+const (
+	SlideScanning SlideStatus = "scanning"
+	SlideComplete SlideStatus = "complete"
+	SlideFailed   SlideStatus = "failed"
+)
+
+// Slide is the catalog record of a stored slide
+type Slide struct {
+	ID       string      `json:"id"`
+	Name     string      `json:"name"`
+	Created  time.Time   `json:"created"`
+	Width    int         `json:"width"`
+	Height   int         `json:"height"`
+	TileSize int         `json:"tileSize"`
+	OriginX  int         `json:"originX"` // scanner coordinates of pixel 0,0
+	OriginY  int         `json:"originY"`
+	Scanner  string      `json:"scanner,omitempty"` // scanner holding the glass slide
+	Layers   []int       `json:"layers"`            // focus layers with stored tiles
+	Status   SlideStatus `json:"status"`
+	JobID    string      `json:"jobId,omitempty"` // scan job that produced the slide
+	Overlays []Overlay   `json:"overlays,omitempty"`
+
+	// Physical size of a level 0 pixel; zero for slides scanned before it
+	// was recorded
+	MicronsPerPixel float64 `json:"micronsPerPixel,omitempty"`
+
+	Acquisition *Acquisition `json:"acquisition,omitempty"` // provenance of the latest scan
+}
+
+// Acquisition records which instrument produced a slide and how, as
+// required for accreditation. It is captured when the scan starts.
+type Acquisition struct {
+	Scanner            string          `json:"scanner"`
+	ScannerName        string          `json:"scannerName,omitempty"`
+	SerialNumber       string          `json:"serialNumber,omitempty"`
+	Firmware           string          `json:"firmware,omitempty"`
+	ProtocolVersion    int             `json:"protocolVersion"`
+	CalibrationProfile string          `json:"calibrationProfile,omitempty"`
+	Calibrated         *time.Time      `json:"calibrated,omitempty"` // last calibration before the scan
+	Objective          string          `json:"objective,omitempty"`
+	Magnification      int             `json:"magnification"`
+	MicronsPerPixel    float64         `json:"micronsPerPixel"`
+	FocusDepths        map[int]float64 `json:"focusDepths"`           // micrometres, by layer
+	Temperature        *float64        `json:"temperature,omitempty"` // degrees Celsius at scan start
+	Operator           string          `json:"operator,omitempty"`
+	JobID              string          `json:"jobId,omitempty"`
+	Started            time.Time       `json:"started"`
+}
+
+// Overlay is a region re-captured after the scan, typically at another
+// focus or objective. Its tiles are stored apart from the slide's layers,
+// in the overlay's own pixel grid.
+type Overlay struct {
+	ID              string    `json:"id"`
+	X               int       `json:"x"` // region on the slide, in slide pixels
+	Y               int       `json:"y"`
+	Width           int       `json:"width"`
+	Height          int       `json:"height"`
+	Layer           int       `json:"layer"`
+	FocusDepth      float64   `json:"focusDepth,omitempty"` // micrometres, when known
+	Objective       int       `json:"objective,omitempty"`
+	ImageWidth      int       `json:"imageWidth"` // captured image size
+	ImageHeight     int       `json:"imageHeight"`
+	TileSize        int       `json:"tileSize"`
+	MicronsPerPixel float64   `json:"micronsPerPixel,omitempty"` // of the captured image
+	Owner           string    `json:"owner,omitempty"`
+	Created         time.Time `json:"created"`
+}
+
+// SlideCatalog is the persistent index of slides, kept in slides.json
+type SlideCatalog struct {
+	path string
+	mu   sync.RWMutex
+
+	slides map[string]*Slide
+}
+
+func OpenSlideCatalog(basePath string) (*SlideCatalog, error) {
+	c := &SlideCatalog{
+		path:   filepath.Join(basePath, "slides.json"),
+		slides: make(map[string]*Slide),
+	}
+
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read slide catalog: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &c.slides); err != nil {
+		return nil, fmt.Errorf("failed to parse slide catalog: %w", err)
+	}
+
+	return c, nil
+}
+
+// Get returns a copy of a slide record
+func (c *SlideCatalog) Get(id string) (Slide, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	s, ok := c.slides[id]
+	if !ok {
+		return Slide{}, false
+	}
+	return s.clone(), true
+}
+
+// List returns all slides, newest first
+func (c *SlideCatalog) List() []Slide {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	slides := make([]Slide, 0, len(c.slides))
+	for _, s := range c.slides {
+		slides = append(slides, s.clone())
+	}
+	sort.Slice(slides, func(i, j int) bool {
+		return slides[i].Created.After(slides[j].Created)
+	})
+	return slides
+}
+
+func (c *SlideCatalog) Put(slide Slide) error {
+	if !ValidSlideID(slide.ID) {
+		return fmt.Errorf("invalid slide ID: %q", slide.ID)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := slide.clone()
+	c.slides[slide.ID] = &s
+	return c.saveLocked()
+}
+
+// Update applies fn to a stored slide and saves the catalog
+func (c *SlideCatalog) Update(id string, fn func(*Slide)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.slides[id]
+	if !ok {
+		return fmt.Errorf("slide %q not found", id)
+	}
+	fn(s)
+	return c.saveLocked()
+}
+
+func (c *SlideCatalog) Delete(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.slides[id]; !ok {
+		return nil
+	}
+	delete(c.slides, id)
+	return c.saveLocked()
+}
+
+// Level describes one resolution of a slide's tile pyramid. Level z is
+// downsampled 2^z from the scan.
+type Level struct {
+	Level           int      `json:"level"`
+	Downsample      float64  `json:"downsample"`
+	Width           int      `json:"width"`
+	Height          int      `json:"height"`
+	MicronsPerPixel *float64 `json:"micronsPerPixel"` // null when the slide is uncalibrated
+}
+
+// StoredLevels are the pyramid levels ingest writes tiles for
+var StoredLevels = []int{0}
+
+// Levels describes the slide's stored pyramid levels
+func (s *Slide) Levels() []Level {
+	levels := make([]Level, 0, len(StoredLevels))
+	for _, z := range StoredLevels {
+		downsample := math.Ldexp(1, z)
+		level := Level{
+			Level:      z,
+			Downsample: downsample,
+			Width:      int(math.Ceil(float64(s.Width) / downsample)),
+			Height:     int(math.Ceil(float64(s.Height) / downsample)),
+		}
+		if s.MicronsPerPixel > 0 {
+			mpp := s.MicronsPerPixel * downsample
+			level.MicronsPerPixel = &mpp
+		}
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// Overlay returns the slide's overlay with the given ID
+func (s *Slide) Overlay(id string) (Overlay, bool) {
+	for _, o := range s.Overlays {
+		if o.ID == id {
+			return o, true
+		}
+	}
+	return Overlay{}, false
+}
+
+func (s *Slide) clone() Slide {
+	c := *s
+	c.Layers = append([]int(nil), s.Layers...)
+	c.Overlays = append([]Overlay(nil), s.Overlays...)
+	if s.Acquisition != nil {
+		a := s.Acquisition.clone()
+		c.Acquisition = &a
+	}
+	return c
+}
+
+func (a *Acquisition) clone() Acquisition {
+	c := *a
+	c.FocusDepths = make(map[int]float64, len(a.FocusDepths))
+	for layer, depth := range a.FocusDepths {
+		c.FocusDepths[layer] = depth
+	}
+	return c
+}
+
+func (c *SlideCatalog) saveLocked() error {
+	data, err := json.Marshal(c.slides)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, data)
+}
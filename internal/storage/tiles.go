@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// ErrTileNotFound is returned when a slide has no stored tile at a position
+var ErrTileNotFound = errors.New("tile not found")
+
+var validSlideID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Corrections records the processing already baked into a stored tile
+type Corrections struct {
+	ColorCorrected bool   `json:"colorCorrected"`
+	Profile        string `json:"profile,omitempty"`
+}
+
+// StoredTile is a tile as kept on disk: the original compressed bytes from
+// the scanner plus what is needed to decide whether they can be served as is
+type StoredTile struct {
+	Data        []byte      `json:"-"`
+	Format      string      `json:"format"` // "jpeg", "webp", "png" or "raw"
+	Width       int         `json:"width"`
+	Height      int         `json:"height"`
+	Corrections Corrections `json:"corrections"`
+}
+
+// TileStore keeps pre-encoded tiles under basePath/tiles as
+// <slide>/<layer>/<z>/<x>_<y>.<format> with a JSON metadata sidecar.
+// Overlay tiles live under <slide>/overlays/<overlay>/<z>/.
+type TileStore struct {
+	basePath string
+}
+
+func NewTileStore(basePath string) *TileStore {
+	return &TileStore{basePath: filepath.Join(basePath, "tiles")}
+}
+
+// ValidSlideID reports whether id is safe to use as a storage path component
+func ValidSlideID(id string) bool {
+	return validSlideID.MatchString(id)
+}
+
+func (s *TileStore) tilePath(slideID string, layer, x, y, z int) (string, error) {
+	if !ValidSlideID(slideID) {
+		return "", fmt.Errorf("invalid slide ID: %q", slideID)
+	}
+	if layer < 0 || x < 0 || y < 0 || z < 0 {
+		return "", fmt.Errorf("invalid tile position: layer=%d x=%d y=%d z=%d", layer, x, y, z)
+	}
+	return filepath.Join(s.basePath, slideID, fmt.Sprint(layer), fmt.Sprint(z), fmt.Sprintf("%d_%d", x, y)), nil
+}
+
+func (s *TileStore) overlayPath(slideID, overlayID string, x, y, z int) (string, error) {
+	if !ValidSlideID(slideID) || !ValidSlideID(overlayID) {
+		return "", fmt.Errorf("invalid overlay: %q/%q", slideID, overlayID)
+	}
+	if x < 0 || y < 0 || z < 0 {
+		return "", fmt.Errorf("invalid tile position: x=%d y=%d z=%d", x, y, z)
+	}
+	return filepath.Join(s.basePath, slideID, "overlays", overlayID, fmt.Sprint(z), fmt.Sprintf("%d_%d", x, y)), nil
+}
+
+func (s *TileStore) Get(slideID string, layer, x, y, z int) (*StoredTile, error) {
+	base, err := s.tilePath(slideID, layer, x, y, z)
+	if err != nil {
+		return nil, err
+	}
+	return s.read(base)
+}
+
+// GetOverlay reads a tile of an overlay captured on a slide
+func (s *TileStore) GetOverlay(slideID, overlayID string, x, y, z int) (*StoredTile, error) {
+	base, err := s.overlayPath(slideID, overlayID, x, y, z)
+	if err != nil {
+		return nil, err
+	}
+	return s.read(base)
+}
+
+func (s *TileStore) read(base string) (*StoredTile, error) {
+	meta, err := os.ReadFile(base + ".json")
+	if os.IsNotExist(err) {
+		return nil, ErrTileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tile := &StoredTile{}
+	if err := json.Unmarshal(meta, tile); err != nil {
+		return nil, fmt.Errorf("corrupt tile metadata: %w", err)
+	}
+
+	tile.Data, err = os.ReadFile(base + "." + tile.Format)
+	if os.IsNotExist(err) {
+		return nil, ErrTileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return tile, nil
+}
+
+// Put stores a tile. The data file is written before its metadata so a
+// reader never sees metadata pointing at a missing or partial file.
+func (s *TileStore) Put(slideID string, layer, x, y, z int, tile *StoredTile) error {
+	base, err := s.tilePath(slideID, layer, x, y, z)
+	if err != nil {
+		return err
+	}
+	return s.write(base, tile)
+}
+
+func (s *TileStore) PutOverlay(slideID, overlayID string, x, y, z int, tile *StoredTile) error {
+	base, err := s.overlayPath(slideID, overlayID, x, y, z)
+	if err != nil {
+		return err
+	}
+	return s.write(base, tile)
+}
+
+func (s *TileStore) write(base string, tile *StoredTile) error {
+	if !validSlideID.MatchString(tile.Format) {
+		return fmt.Errorf("invalid tile format: %q", tile.Format)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(base+"."+tile.Format, tile.Data); err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(tile)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(base+".json", meta)
+}
+
+// DeleteSlide removes every stored tile of a slide
+func (s *TileStore) DeleteSlide(slideID string) error {
+	if !ValidSlideID(slideID) {
+		return fmt.Errorf("invalid slide ID: %q", slideID)
+	}
+	return os.RemoveAll(filepath.Join(s.basePath, slideID))
+}
+
+// DeleteOverlay removes every stored tile of one overlay
+func (s *TileStore) DeleteOverlay(slideID, overlayID string) error {
+	if !ValidSlideID(slideID) || !ValidSlideID(overlayID) {
+		return fmt.Errorf("invalid overlay: %q/%q", slideID, overlayID)
+	}
+	return os.RemoveAll(filepath.Join(s.basePath, slideID, "overlays", overlayID))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
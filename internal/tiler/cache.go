@@ -1,21 +1,61 @@
 package tiler
 
 import (
-	"container/list"
+	"hash/maphash"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// TileCache is the in-memory L1 tile cache. It is split into independently
+// locked shards so concurrent hits on different tiles don't serialize, and
+// cached tiles are shared with callers without copying.
+//
+// Each shard holds an equal share of the size limit and evicts on its own,
+// so the cache can start evicting before it is full overall. Keys are
+// hashed, so however they cluster by slide or region, shards fill evenly
+// once each holds many tiles: a full cache uses over 90% of its limit (see
+// TestTileCacheEffectiveCapacity). A tile larger than one shard's share is
+// never cached; small caches use fewer shards so each still holds at least
+// minShardSize.
 type TileCache struct {
-	maxSize   int64
+	maxSize int64
+	shards  []*cacheShard
+	seed    maphash.Seed
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+
+	// Bumped by every Invalidate, so renders that started before it can
+	// be kept out of the cache
+	generation atomic.Uint64
+
+	prefetchSlots chan struct{}
+
+	// Optional persistent L2 tier; evicted entries spill to it in the background
+	l2        *DiskCache
+	spill     chan *cacheEntry
+	spillMu   sync.RWMutex
+	spillDone chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// cacheShard holds a slice of the key space with its own lock and policy
+type cacheShard struct {
+	maxSize     int64
 	currentSize int64
-	items     map[string]*list.Element
-	lru       *list.List
-	mu        sync.RWMutex
-	hits      uint64
-	misses    uint64
+	items       map[string]*cacheEntry
+	policy      EvictionPolicy
+	mu          sync.RWMutex
 }
 
+const (
+	defaultPrefetchConcurrency = 2
+	defaultCacheShards         = 64
+	minShardSize               = 8 << 20
+	spillQueueSize             = 256
+)
+
 type cacheEntry struct {
 	key       string
 	value     *TileResponse
@@ -24,123 +64,430 @@ type cacheEntry struct {
 }
 
 func NewTileCache(maxSizeBytes int64) *TileCache {
-	return &TileCache{
+	c, _ := NewTileCacheWithPolicy(maxSizeBytes, "lru")
+	return c
+}
+
+// NewTileCacheWithPolicy creates a sharded cache; each shard gets its own
+// instance of the named eviction policy.
+func NewTileCacheWithPolicy(maxSizeBytes int64, policy string) (*TileCache, error) {
+	return newShardedTileCache(maxSizeBytes, policy, defaultCacheShards)
+}
+
+func newShardedTileCache(maxSizeBytes int64, policy string, shards int) (*TileCache, error) {
+	for shards > 1 && maxSizeBytes/int64(shards) < minShardSize {
+		shards /= 2
+	}
+
+	c := &TileCache{
 		maxSize: maxSizeBytes,
-		items:   make(map[string]*list.Element),
-		lru:     list.New(),
+		shards:  make([]*cacheShard, shards),
+		seed:    maphash.MakeSeed(),
+
+		prefetchSlots: make(chan struct{}, defaultPrefetchConcurrency),
 	}
+
+	shardSize := maxSizeBytes / int64(shards)
+	for i := range c.shards {
+		p, err := NewEvictionPolicy(policy, shardSize)
+		if err != nil {
+			return nil, err
+		}
+		c.shards[i] = &cacheShard{
+			maxSize: shardSize,
+			items:   make(map[string]*cacheEntry),
+			policy:  p,
+		}
+	}
+
+	return c, nil
+}
+
+func (c *TileCache) shardFor(key string) *cacheShard {
+	return c.shards[maphash.String(c.seed, key)%uint64(len(c.shards))]
 }
 
+// SetDiskTier attaches a persistent L2 tier. Lookups that miss memory fall
+// through to it, and entries evicted from memory spill to it.
+func (c *TileCache) SetDiskTier(l2 *DiskCache) {
+	c.l2 = l2
+	c.spill = make(chan *cacheEntry, spillQueueSize)
+	c.spillDone = make(chan struct{})
+	go c.spillWorker(c.spill)
+}
+
+// Get returns a cached tile. The response is shared with the cache and must
+// be treated as read-only.
 func (c *TileCache) Get(key string) (*TileResponse, bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	if resp, ok := c.getMemory(key); ok {
+		return resp, true
+	}
+
+	if c.l2 == nil {
+		return nil, false
+	}
+	return c.getDisk(key, c.Generation())
+}
 
-	elem, ok := c.items[key]
+// getDisk reads a tile from the disk tier and promotes it back into memory,
+// unless the cache was invalidated since gen: the file read may predate the
+// invalidation, and promoting it would bring the stale tile back.
+func (c *TileCache) getDisk(key string, gen uint64) (*TileResponse, bool) {
+	resp, ok := c.l2.Get(key)
 	if !ok {
-		c.misses++
 		return nil, false
 	}
+	c.setIfCurrent(key, resp, PriorityNormal, gen)
 
-	c.hits++
-	c.lru.MoveToFront(elem)
-	entry := elem.Value.(*cacheEntry)
-	
-	// Return a copy to prevent modification
-	return &TileResponse{
-		Data:        append([]byte(nil), entry.value.Data...),
-		Width:       entry.value.Width,
-		Height:      entry.value.Height,
-		ContentType: entry.value.ContentType,
-		CacheKey:    entry.value.CacheKey,
-	}, true
+	return resp, true
+}
+
+func (c *TileCache) getMemory(key string) (*TileResponse, bool) {
+	shard := c.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	shard.policy.Record(key)
+
+	entry, ok := shard.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	shard.policy.Hit(key)
+
+	return entry.value, true
 }
 
 func (c *TileCache) Set(key string, value *TileResponse) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.SetWithPriority(key, value, PriorityNormal)
+}
+
+// SetWithPriority caches a tile. The eviction policy may refuse to admit it
+// if it is less valuable than the tiles it would displace. The cache keeps
+// value as is, so callers must not modify it afterwards.
+func (c *TileCache) SetWithPriority(key string, value *TileResponse, priority WritePriority) {
+	shard := c.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	c.setLocked(shard, key, value, priority)
+}
+
+// Generation returns the invalidation count. A tile rendered from what was
+// stored at one generation is stale once the generation has moved on.
+func (c *TileCache) Generation() uint64 {
+	return c.generation.Load()
+}
+
+// setIfCurrent caches a tile rendered at generation gen, unless the cache
+// was invalidated since: the render may have read a tile that has been
+// replaced, and caching it would undo the invalidation.
+func (c *TileCache) setIfCurrent(key string, value *TileResponse, priority WritePriority, gen uint64) {
+	shard := c.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
+	// Invalidate bumps the generation before it clears any shard, so a
+	// tile set here under the old generation is cleared along with the rest
+	if c.generation.Load() != gen {
+		return
+	}
+	c.setLocked(shard, key, value, priority)
+}
+
+// setLocked caches a tile in shard. Callers must hold shard.mu.
+func (c *TileCache) setLocked(shard *cacheShard, key string, value *TileResponse, priority WritePriority) {
 	size := int64(len(value.Data))
 
 	// Check if key exists, update it
-	if elem, ok := c.items[key]; ok {
-		entry := elem.Value.(*cacheEntry)
-		c.currentSize -= entry.size
-		c.currentSize += size
+	if entry, ok := shard.items[key]; ok {
+		shard.currentSize -= entry.size
+		shard.currentSize += size
 		entry.value = value
 		entry.size = size
 		entry.timestamp = time.Now()
-		c.lru.MoveToFront(elem)
+		shard.policy.Remove(key)
+		shard.policy.Add(key, size, priority)
+		return
+	}
+
+	if size > shard.maxSize {
 		return
 	}
 
-	// Evict until we have space
-	for c.currentSize+size > c.maxSize && c.lru.Len() > 0 {
-		c.evictOldest()
+	// Pick the victims that make room first and only evict them if the
+	// policy admits the new tile over every one of them, so a rejected
+	// tile leaves the cache as it was
+	var victims []string
+	freed := int64(0)
+	admitted := true
+	shard.policy.Victims(func(victim string) bool {
+		if shard.currentSize-freed+size <= shard.maxSize {
+			return false
+		}
+		if !shard.policy.Admit(key, victim, priority) {
+			admitted = false
+			return false
+		}
+		victims = append(victims, victim)
+		if entry, ok := shard.items[victim]; ok {
+			freed += entry.size
+		}
+		return true
+	})
+	if !admitted {
+		return
+	}
+	for _, victim := range victims {
+		c.evict(shard, victim)
 	}
 
 	// Add new entry
-	entry := &cacheEntry{
+	shard.items[key] = &cacheEntry{
 		key:       key,
 		value:     value,
 		size:      size,
 		timestamp: time.Now(),
 	}
-	elem := c.lru.PushFront(entry)
-	c.items[key] = elem
-	c.currentSize += size
+	shard.currentSize += size
+	shard.policy.Add(key, size, priority)
 }
 
-func (c *TileCache) evictOldest() {
-	elem := c.lru.Back()
-	if elem == nil {
+// evict removes key from shard and queues it for the disk tier.
+// Callers must hold shard.mu.
+func (c *TileCache) evict(shard *cacheShard, key string) {
+	entry, ok := shard.items[key]
+	shard.policy.Remove(key)
+	if !ok {
 		return
 	}
 
-	entry := elem.Value.(*cacheEntry)
-	c.lru.Remove(elem)
-	delete(c.items, entry.key)
-	c.currentSize -= entry.size
+	delete(shard.items, key)
+	shard.currentSize -= entry.size
+
+	c.spillMu.RLock()
+	if c.spill != nil {
+		select {
+		case c.spill <- entry:
+		default:
+			// Spill queue is full; drop rather than block the request path
+		}
+	}
+	c.spillMu.RUnlock()
+}
+
+// spillWorker writes evicted entries to the disk tier until spill is
+// closed. It takes the channel rather than reading c.spill, which Close
+// clears, possibly before the worker has started.
+func (c *TileCache) spillWorker(spill <-chan *cacheEntry) {
+	defer close(c.spillDone)
+
+	for entry := range spill {
+		if c.l2.Contains(entry.key) {
+			continue
+		}
+		c.l2.Set(entry.key, entry.value)
+	}
+}
+
+// Close flushes pending spills and persists the L2 index. Later calls
+// return the result of the first.
+func (c *TileCache) Close() error {
+	if c.l2 == nil {
+		return nil
+	}
+
+	c.closeOnce.Do(func() {
+		c.spillMu.Lock()
+		spill := c.spill
+		c.spill = nil
+		c.spillMu.Unlock()
+
+		close(spill)
+		<-c.spillDone
+		c.closeErr = c.l2.Close()
+	})
+	return c.closeErr
 }
 
 func (c *TileCache) Clear() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for key := range shard.items {
+			shard.policy.Remove(key)
+		}
+		shard.items = make(map[string]*cacheEntry)
+		shard.currentSize = 0
+		shard.mu.Unlock()
+	}
+}
 
-	c.items = make(map[string]*list.Element)
-	c.lru = list.New()
-	c.currentSize = 0
+// InvalidationFilter selects cached tiles by slide, focus layer and processing
+// profile. Unset fields match any tile; an empty filter matches everything.
+type InvalidationFilter struct {
+	SlideID string
+	Layer   *int
+	Profile *string
+}
+
+func (f InvalidationFilter) matches(slideID string, layer int, profile string) bool {
+	if f.SlideID != "" && f.SlideID != slideID {
+		return false
+	}
+	if f.Layer != nil && *f.Layer != layer {
+		return false
+	}
+	if f.Profile != nil && *f.Profile != profile {
+		return false
+	}
+	return true
+}
+
+// Invalidate drops matching tiles from memory, the pending spill queue and
+// the disk tier. Returns the number of tiles removed.
+func (c *TileCache) Invalidate(f InvalidationFilter) int {
+	c.generation.Add(1)
+
+	removed := 0
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for key, entry := range shard.items {
+			if !f.matches(entry.value.slideID, entry.value.layer, entry.value.profile) {
+				continue
+			}
+			shard.policy.Remove(key)
+			delete(shard.items, key)
+			shard.currentSize -= entry.size
+			removed++
+		}
+		shard.mu.Unlock()
+	}
+
+	// Keep stale tiles queued for spilling from reaching the disk tier
+	c.spillMu.RLock()
+	if c.spill != nil {
+		pending := len(c.spill)
+		for i := 0; i < pending; i++ {
+			select {
+			case entry := <-c.spill:
+				if !f.matches(entry.value.slideID, entry.value.layer, entry.value.profile) {
+					select {
+					case c.spill <- entry:
+					default:
+					}
+				}
+			default:
+			}
+		}
+	}
+	c.spillMu.RUnlock()
+
+	if c.l2 != nil {
+		removed += c.l2.Invalidate(f)
+	}
+	return removed
 }
 
 func (c *TileCache) Stats() (hits, misses uint64, size int64, count int) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	for _, shard := range c.shards {
+		shard.mu.RLock()
+		size += shard.currentSize
+		count += len(shard.items)
+		shard.mu.RUnlock()
+	}
 
-	return c.hits, c.misses, c.currentSize, c.lru.Len()
+	return c.hits.Load(), c.misses.Load(), size, count
+}
+
+// TierStats reports cache counters for a single tier
+type TierStats struct {
+	Hits    uint64
+	Misses  uint64
+	Size    int64
+	MaxSize int64
+	Tiles   int
+}
+
+func (t TierStats) HitRate() float64 {
+	total := t.Hits + t.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(t.Hits) / float64(total)
+}
+
+// TierStats returns per-tier counters. The disk tier is nil when not configured.
+func (c *TileCache) TierStats() (memory TierStats, disk *TierStats) {
+	hits, misses, size, count := c.Stats()
+	memory = TierStats{Hits: hits, Misses: misses, Size: size, MaxSize: c.maxSize, Tiles: count}
+
+	if c.l2 != nil {
+		hits, misses, size, count := c.l2.Stats()
+		disk = &TierStats{Hits: hits, Misses: misses, Size: size, MaxSize: c.l2.maxSize, Tiles: count}
+	}
+	return memory, disk
 }
 
 func (c *TileCache) HitRate() float64 {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	hits, misses := c.hits.Load(), c.misses.Load()
 
-	total := c.hits + c.misses
+	total := hits + misses
 	if total == 0 {
 		return 0
 	}
-	return float64(c.hits) / float64(total)
+	return float64(hits) / float64(total)
+}
+
+// Contains reports whether a tile is cached without touching eviction order or
+// hit/miss counters, so speculative lookups don't skew the stats.
+func (c *TileCache) Contains(key string) bool {
+	shard := c.shardFor(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	_, ok := shard.items[key]
+	return ok
 }
 
-// Prefetch tiles that are likely to be requested soon
-func (c *TileCache) Prefetch(keys []string, fetcher func(string) (*TileResponse, error)) {
-	for _, key := range keys {
-		if _, ok := c.Get(key); ok {
+// SetPrefetchConcurrency sets the global budget of concurrent prefetch fetches.
+func (c *TileCache) SetPrefetchConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	c.prefetchSlots = make(chan struct{}, n)
+}
+
+// Prefetch tiles that are likely to be requested soon. Fetches run at low
+// priority: when the prefetch budget is exhausted, the remaining tiles are
+// dropped rather than queued, so foreground requests never wait on them.
+// Returns the number of fetches started.
+func (c *TileCache) Prefetch(reqs []*TileRequest, fetcher func(*TileRequest) (*TileResponse, error)) int {
+	started := 0
+	for _, req := range reqs {
+		key := req.cacheKey()
+		if c.Contains(key) || (c.l2 != nil && c.l2.Contains(key)) {
 			continue // Already cached
 		}
 
-		go func(k string) {
-			resp, err := fetcher(k)
+		select {
+		case c.prefetchSlots <- struct{}{}:
+		default:
+			return started // Budget exhausted
+		}
+
+		started++
+		go func(r *TileRequest, k string) {
+			defer func() { <-c.prefetchSlots }()
+
+			gen := c.Generation()
+			resp, err := fetcher(r)
 			if err == nil {
-				c.Set(k, resp)
+				c.setIfCurrent(k, resp, PriorityLow, gen)
 			}
-		}(key)
+		}(req, key)
 	}
+	return started
 }
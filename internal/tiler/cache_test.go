@@ -0,0 +1,154 @@
+package tiler
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+const benchCacheTiles = 16384
+
+func newBenchCache(b *testing.B, shards int) (*TileCache, []string) {
+	// Large enough that every shard count is kept
+	cache, err := newShardedTileCache(benchCacheTiles*64<<10, "lru", shards)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	payload := make([]byte, 1024)
+	keys := make([]string, benchCacheTiles)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("slide-001:%d:%d:%d:6:", i%40, i%128, i/128)
+		cache.Set(keys[i], &TileResponse{Data: payload})
+	}
+	return cache, keys
+}
+
+// BenchmarkTileCacheGetParallel measures concurrent hit throughput. Run with
+// -cpu 1,2,4,8,16 to see how it scales with cores; the single-shard variant
+// behaves like the old global-mutex cache for comparison.
+func BenchmarkTileCacheGetParallel(b *testing.B) {
+	for _, shards := range []int{1, defaultCacheShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache, keys := newBenchCache(b, shards)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					if _, ok := cache.Get(keys[rng.Intn(len(keys))]); !ok {
+						b.Error("unexpected cache miss")
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkTileCacheMixedParallel mixes 90% hits with 10% writes replacing
+// cached tiles, so the cache stays full without evicting
+func BenchmarkTileCacheMixedParallel(b *testing.B) {
+	for _, shards := range []int{1, defaultCacheShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			cache, keys := newBenchCache(b, shards)
+			payload := make([]byte, 1024)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					key := keys[rng.Intn(len(keys))]
+					if rng.Intn(10) == 0 {
+						cache.Set(key, &TileResponse{Data: payload})
+					} else {
+						cache.Get(key)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestSetIfCurrentDropsStaleRenders(t *testing.T) {
+	c := NewTileCache(1 << 20)
+	tile := &TileResponse{Data: []byte("tile"), slideID: "slide-1"}
+
+	gen := c.Generation()
+	c.setIfCurrent("fresh", tile, PriorityNormal, gen)
+	if !c.Contains("fresh") {
+		t.Fatal("tile rendered at the current generation wasn't cached")
+	}
+
+	// A render that started before an invalidation finishes after it
+	c.Invalidate(InvalidationFilter{SlideID: "slide-2"})
+	c.setIfCurrent("stale", tile, PriorityNormal, gen)
+	if c.Contains("stale") {
+		t.Error("tile rendered before an invalidation was cached")
+	}
+}
+
+func TestPrefetchDropsStaleRenders(t *testing.T) {
+	c := NewTileCache(1 << 20)
+	rendering := make(chan struct{})
+	finish := make(chan struct{})
+	fetcher := func(*TileRequest) (*TileResponse, error) {
+		close(rendering)
+		<-finish
+		return &TileResponse{Data: []byte("tile"), slideID: "slide-1"}, nil
+	}
+
+	req := &TileRequest{SlideID: "slide-1"}
+	if c.Prefetch([]*TileRequest{req}, fetcher) != 1 {
+		t.Fatal("prefetch not started")
+	}
+	<-rendering
+	c.Invalidate(InvalidationFilter{SlideID: "slide-1"})
+	close(finish)
+
+	// The fetch is done once its slot is free again
+	for i := 0; i < cap(c.prefetchSlots); i++ {
+		c.prefetchSlots <- struct{}{}
+	}
+	if c.Contains(req.cacheKey()) {
+		t.Error("prefetched tile rendered before an invalidation was cached")
+	}
+}
+
+// TestTileCacheEffectiveCapacity fills the cache with tiles clustered the
+// way viewers request them, a few slides and regions, and checks that
+// per-shard limits leave little of the overall limit unused
+func TestTileCacheEffectiveCapacity(t *testing.T) {
+	const tileSize = 16 << 10
+	cache, err := newShardedTileCache(256<<20, "lru", defaultCacheShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, tileSize)
+	for i := 0; i < 2*int(cache.maxSize/tileSize); i++ {
+		key := fmt.Sprintf("slide-%d:0:%d:%d:0::jpeg:85", i%3, 100+i%64, i/64)
+		cache.Set(key, &TileResponse{Data: payload})
+	}
+
+	_, _, size, _ := cache.Stats()
+	if used := float64(size) / float64(cache.maxSize); used < 0.9 {
+		t.Errorf("full cache holds %.0f%% of its limit, want at least 90%%", used*100)
+	}
+}
+
+func TestSmallCacheUsesFewerShards(t *testing.T) {
+	cache, err := newShardedTileCache(32<<20, "lru", defaultCacheShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.shards) != 4 {
+		t.Errorf("got %d shards, want 4 of %d bytes", len(cache.shards), minShardSize)
+	}
+
+	// A tile too large for a 64th of the cache still fits in a shard
+	cache.Set("large", &TileResponse{Data: make([]byte, 4<<20)})
+	if !cache.Contains("large") {
+		t.Error("4 MB tile not cached in a 32 MB cache")
+	}
+}
@@ -0,0 +1,352 @@
+package tiler
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	diskIndexFile     = "index.json"
+	diskIndexInterval = time.Minute
+)
+
+// DiskCache is the persistent L2 tier behind TileCache. Tiles are stored one
+// per file under dir, and the LRU index is saved to disk so a restart or
+// deploy starts warm. Files written after the last index save only hold
+// tile data, so they can't be indexed again; they are deleted at startup.
+type DiskCache struct {
+	dir         string
+	maxSize     int64
+	currentSize int64
+	items       map[string]*list.Element
+	lru         *list.List
+	mu          sync.Mutex
+	hits        uint64
+	misses      uint64
+	dirty       bool
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type diskEntry struct {
+	Key         string    `json:"key"`
+	File        string    `json:"file"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	ContentType string    `json:"contentType"`
+	LastAccess  time.Time `json:"lastAccess"`
+	SlideID     string    `json:"slideId"`
+	Layer       int       `json:"layer"`
+	Profile     string    `json:"profile"`
+}
+
+func NewDiskCache(dir string, maxSizeBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create disk cache directory: %w", err)
+	}
+
+	c := &DiskCache{
+		dir:     dir,
+		maxSize: maxSizeBytes,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if err := c.loadIndex(); err != nil {
+		return nil, fmt.Errorf("failed to load disk cache index: %w", err)
+	}
+	if err := c.removeOrphans(); err != nil {
+		return nil, fmt.Errorf("failed to reconcile disk cache: %w", err)
+	}
+
+	go c.indexWorker()
+
+	return c, nil
+}
+
+func (c *DiskCache) Get(key string) (*TileResponse, bool) {
+	c.mu.Lock()
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	entry := *elem.Value.(*diskEntry)
+	elem.Value.(*diskEntry).LastAccess = time.Now()
+	c.dirty = true
+	c.mu.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(c.dir, entry.File))
+	if err != nil || int64(len(data)) != entry.Size {
+		// File vanished or is truncated; treat as a miss
+		c.Delete(key)
+		c.mu.Lock()
+		c.misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	c.mu.Lock()
+	c.hits++
+	c.mu.Unlock()
+
+	return &TileResponse{
+		Data:        data,
+		Width:       entry.Width,
+		Height:      entry.Height,
+		ContentType: entry.ContentType,
+		CacheKey:    key,
+		slideID:     entry.SlideID,
+		layer:       entry.Layer,
+		profile:     entry.Profile,
+	}, true
+}
+
+func (c *DiskCache) Contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.items[key]
+	return ok
+}
+
+func (c *DiskCache) Set(key string, value *TileResponse) error {
+	size := int64(len(value.Data))
+	if size > c.maxSize {
+		return fmt.Errorf("tile too large for disk cache: %d bytes", size)
+	}
+
+	file := diskFileName(key)
+	path := filepath.Join(c.dir, file)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename so readers never see partial tiles
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(value.Data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem, false)
+	}
+
+	for c.currentSize+size > c.maxSize && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back(), true)
+	}
+
+	entry := &diskEntry{
+		Key:         key,
+		File:        file,
+		Size:        size,
+		Width:       value.Width,
+		Height:      value.Height,
+		ContentType: value.ContentType,
+		LastAccess:  time.Now(),
+		SlideID:     value.slideID,
+		Layer:       value.layer,
+		Profile:     value.profile,
+	}
+	c.items[key] = c.lru.PushFront(entry)
+	c.currentSize += size
+	c.dirty = true
+
+	return nil
+}
+
+func (c *DiskCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem, true)
+	}
+}
+
+// Invalidate removes every entry matching the filter
+func (c *DiskCache) Invalidate(f InvalidationFilter) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for _, elem := range c.items {
+		entry := elem.Value.(*diskEntry)
+		if f.matches(entry.SlideID, entry.Layer, entry.Profile) {
+			c.removeElement(elem, true)
+			removed++
+		}
+	}
+	return removed
+}
+
+// removeElement drops an entry from the index, optionally deleting its file.
+// Callers must hold c.mu.
+func (c *DiskCache) removeElement(elem *list.Element, removeFile bool) {
+	entry := elem.Value.(*diskEntry)
+	c.lru.Remove(elem)
+	delete(c.items, entry.Key)
+	c.currentSize -= entry.Size
+	c.dirty = true
+
+	if removeFile {
+		os.Remove(filepath.Join(c.dir, entry.File))
+	}
+}
+
+func (c *DiskCache) Stats() (hits, misses uint64, size int64, count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits, c.misses, c.currentSize, c.lru.Len()
+}
+
+// Close stops the index worker and persists the index
+func (c *DiskCache) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		<-c.done
+	})
+	return c.saveIndex()
+}
+
+func (c *DiskCache) indexWorker() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(diskIndexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.saveIndex()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *DiskCache) loadIndex() error {
+	data, err := os.ReadFile(filepath.Join(c.dir, diskIndexFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []*diskEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		// A corrupt index only costs us a cold start
+		return nil
+	}
+
+	// Entries are stored most recently used first
+	for _, entry := range entries {
+		info, err := os.Stat(filepath.Join(c.dir, entry.File))
+		if err != nil || info.Size() != entry.Size {
+			continue
+		}
+		if _, dup := c.items[entry.Key]; dup {
+			continue
+		}
+		c.items[entry.Key] = c.lru.PushBack(entry)
+		c.currentSize += entry.Size
+	}
+
+	// The size limit may have shrunk since the index was written
+	for c.currentSize > c.maxSize && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back(), true)
+	}
+
+	return nil
+}
+
+// removeOrphans deletes files under dir that the index doesn't list: tiles
+// spilled after the last index save before a crash, files of entries the
+// index dropped, and temp files of interrupted writes
+func (c *DiskCache) removeOrphans() error {
+	indexed := make(map[string]bool, len(c.items))
+	for _, elem := range c.items {
+		indexed[elem.Value.(*diskEntry).File] = true
+	}
+
+	return filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == diskIndexFile || indexed[rel] {
+			return nil
+		}
+		return os.Remove(path)
+	})
+}
+
+func (c *DiskCache) saveIndex() error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	entries := make([]diskEntry, 0, c.lru.Len())
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, *elem.Value.(*diskEntry))
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(c.dir, diskIndexFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// diskFileName maps a cache key to a file path, fanned out over 256 directories
+func diskFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(name[:2], name)
+}
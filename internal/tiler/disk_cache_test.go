@@ -0,0 +1,109 @@
+package tiler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestDiskCacheRemovesOrphans simulates a crash after spills that the index
+// never recorded: on reopen, their files are deleted and indexed tiles kept
+func TestDiskCacheRemovesOrphans(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewDiskCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("kept", &TileResponse{Data: []byte("indexed tile")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.saveIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("orphan", &TileResponse{Data: []byte("spilled after the last save")}); err != nil {
+		t.Fatal(err)
+	}
+	// Crash: the worker stops without saving the index again
+	close(c.stop)
+	<-c.done
+
+	stray := filepath.Join(dir, "ab", ".tmp-123")
+	if err := os.MkdirAll(filepath.Dir(stray), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stray, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewDiskCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if resp, ok := c.Get("kept"); !ok || string(resp.Data) != "indexed tile" {
+		t.Error("indexed tile lost on reopen")
+	}
+	if _, err := os.Stat(filepath.Join(dir, diskFileName("orphan"))); !os.IsNotExist(err) {
+		t.Errorf("orphaned tile file still on disk: %v", err)
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Errorf("temp file still on disk: %v", err)
+	}
+	if _, _, size, count := c.Stats(); size != int64(len("indexed tile")) || count != 1 {
+		t.Errorf("got %d tiles of %d bytes, want only the indexed tile", count, size)
+	}
+}
+
+func TestTileCacheCloseTwice(t *testing.T) {
+	l2, err := NewDiskCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewTileCache(1 << 20)
+	c.SetDiskTier(l2)
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if err := l2.Close(); err != nil {
+		t.Fatalf("closing the disk tier again: %v", err)
+	}
+}
+
+func TestDiskHitPromotion(t *testing.T) {
+	l2, err := NewDiskCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewTileCache(1 << 20)
+	c.SetDiskTier(l2)
+	defer c.Close()
+
+	tile := &TileResponse{Data: []byte("tile"), slideID: "slide-1"}
+	for _, key := range []string{"fresh", "stale"} {
+		if err := l2.Set(key, tile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := c.Get("fresh"); !ok {
+		t.Fatal("disk hit missed")
+	}
+	if !c.Contains("fresh") {
+		t.Error("disk hit wasn't promoted into memory")
+	}
+
+	// A disk read that started before an invalidation finishes after it
+	gen := c.Generation()
+	c.Invalidate(InvalidationFilter{SlideID: "slide-2"})
+	if _, ok := c.getDisk("stale", gen); !ok {
+		t.Fatal("disk hit missed")
+	}
+	if c.Contains("stale") {
+		t.Error("tile read before an invalidation was promoted")
+	}
+}
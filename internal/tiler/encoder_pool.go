@@ -0,0 +1,116 @@
+package tiler
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/kolesa-team/go-webp/encoder"
+)
+
+// Buffers that grew beyond this are dropped instead of pooled, so one huge
+// tile doesn't pin memory forever
+const maxPooledBufferSize = 4 * 1024 * 1024
+
+// encoderPool bounds concurrent tile encoding to the host's CPU count and
+// recycles output buffers between encodes
+type encoderPool struct {
+	slots   chan struct{}
+	buffers sync.Pool
+	metrics *EncodeMetrics
+}
+
+func newEncoderPool(workers int) *encoderPool {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	return &encoderPool{
+		slots: make(chan struct{}, workers),
+		buffers: sync.Pool{
+			New: func() interface{} {
+				return new(bytes.Buffer)
+			},
+		},
+		metrics: NewEncodeMetrics(),
+	}
+}
+
+type encodeFunc func(buf *bytes.Buffer, img *image.RGBA, quality int) (string, error)
+
+// encode runs enc on a worker slot, waiting for one to free up unless ctx
+// is cancelled first. The returned bytes are an exact-size copy of the
+// pooled buffer.
+func (p *encoderPool) encode(ctx context.Context, format string, img *image.RGBA, quality int, enc encodeFunc) ([]byte, string, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	buf := p.buffers.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	start := time.Now()
+	contentType, err := enc(buf, img, quality)
+	p.metrics.observe(format, time.Since(start))
+
+	var data []byte
+	if err == nil {
+		data = append([]byte(nil), buf.Bytes()...)
+	}
+
+	if buf.Cap() <= maxPooledBufferSize {
+		p.buffers.Put(buf)
+	}
+
+	return data, contentType, err
+}
+
+// webpOptionPools keeps reusable libwebp option sets per lossy quality or
+// lossless level. Options are mutated during encoding, so each encode
+// borrows its own copy.
+var webpOptionPools sync.Map // webpOptionKey -> *sync.Pool
+
+type webpOptionKey struct {
+	lossless bool
+	level    int
+}
+
+func getWebPOptions(lossless bool, level int) (*encoder.Options, func(), error) {
+	key := webpOptionKey{lossless, level}
+	v, ok := webpOptionPools.Load(key)
+	if !ok {
+		v, _ = webpOptionPools.LoadOrStore(key, &sync.Pool{})
+	}
+	pool := v.(*sync.Pool)
+
+	if opts, ok := pool.Get().(*encoder.Options); ok {
+		return opts, func() { pool.Put(opts) }, nil
+	}
+
+	var opts *encoder.Options
+	var err error
+	if lossless {
+		opts, err = encoder.NewLosslessEncoderOptions(encoder.PresetDefault, level)
+	} else {
+		opts, err = encoder.NewLossyEncoderOptions(encoder.PresetDefault, float32(level))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Tiles are encoded in parallel by the encoder pool, so libwebp's own
+	// threading would only oversubscribe the CPUs
+	opts.ThreadLevel = false
+	if lossless {
+		// Keep RGB values under fully transparent pixels so the output is exact
+		opts.Exact = 1
+	}
+
+	return opts, func() { pool.Put(opts) }, nil
+}
@@ -2,51 +2,135 @@ package tiler
 
 import (
 	"bytes"
+	"errors"
 	"image"
 	"image/jpeg"
+	"image/png"
+	"sync"
 
-	"github.com/chai2010/webp"
-	"github.com/kolesa-team/go-webp/encoder"
-	"github.com/kolesa-team/go-webp/webp as libwebp"
+	libwebp "github.com/kolesa-team/go-webp/webp"
 )
 
+// ErrUnsupportedFormat is returned when a tile format can't be encoded by this build
+var ErrUnsupportedFormat = errors.New("tile format not supported by this build")
+
+// FormatSupported reports whether this build can encode the given tile format
+func FormatSupported(format string) bool {
+	switch format {
+	case "jpeg", "webp", "png", "webp-lossless":
+		return true
+	case "avif":
+		return avifSupported
+	case "jxl":
+		return jxlSupported
+	default:
+		return false
+	}
+}
+
+// FormatLossless reports whether a tile format preserves pixels exactly.
+// For lossless formats the request quality (1-100) selects encoder effort
+// rather than fidelity: higher is smaller output but slower encoding.
+func FormatLossless(format string) bool {
+	switch format {
+	case "png", "webp-lossless", "jxl":
+		return true
+	default:
+		return false
+	}
+}
+
+// effortLevel maps a 1-100 quality value onto an encoder effort range
+func effortLevel(quality, min, max int) int {
+	level := min + quality*(max-min)/100
+	if level < min {
+		return min
+	}
+	if level > max {
+		return max
+	}
+	return level
+}
+
 // encodeJPEG uses hardware-accelerated JPEG encoding when available
-func encodeJPEG(img *image.RGBA, quality int) ([]byte, string, error) {
-	var buf bytes.Buffer
-	
+func encodeJPEG(buf *bytes.Buffer, img *image.RGBA, quality int) (string, error) {
 	opts := &jpeg.Options{
 		Quality: quality,
 	}
-	
-	if err := jpeg.Encode(&buf, img, opts); err != nil {
-		return nil, "", err
+
+	if err := jpeg.Encode(buf, img, opts); err != nil {
+		return "", err
 	}
-	
-	return buf.Bytes(), "image/jpeg", nil
+
+	return "image/jpeg", nil
 }
 
 // encodeWebP provides optimized WebP encoding
-func encodeWebP(img *image.RGBA, quality int) ([]byte, string, error) {
-	config, err := encoder.NewLossyEncoderOptions(encoder.PresetDefault, float32(quality))
+func encodeWebP(buf *bytes.Buffer, img *image.RGBA, quality int) (string, error) {
+	config, release, err := getWebPOptions(false, quality)
 	if err != nil {
-		return nil, "", err
+		return "", err
+	}
+	defer release()
+
+	if err := libwebp.Encode(buf, img, config); err != nil {
+		return "", err
+	}
+
+	return "image/webp", nil
+}
+
+// encodePNG provides lossless PNG encoding. quality selects zlib effort:
+// 1-33 fastest, 34-66 default, 67-100 best compression.
+func encodePNG(buf *bytes.Buffer, img *image.RGBA, quality int) (string, error) {
+	enc := &png.Encoder{
+		CompressionLevel: png.DefaultCompression,
+		BufferPool:       pngBuffers,
+	}
+	switch {
+	case quality <= 33:
+		enc.CompressionLevel = png.BestSpeed
+	case quality > 66:
+		enc.CompressionLevel = png.BestCompression
 	}
 
-	// Use multi-threaded encoding for better performance
-	config.SetThreadLevel(8)
-	
-	var buf bytes.Buffer
-	if err := libwebp.Encode(&buf, img, config); err != nil {
-		return nil, "", err
+	if err := enc.Encode(buf, img); err != nil {
+		return "", err
 	}
-	
-	return buf.Bytes(), "image/webp", nil
+
+	return "image/png", nil
 }
 
-// encodeAVIF provides next-gen AVIF encoding (best compression)
-func encodeAVIF(img *image.RGBA, quality int) ([]byte, string, error) {
-	// AVIF encoding requires libavif
-	// For now, fallback to WebP which has similar compression
-	// In production, integrate with libavif for true AVIF support
-	return encodeWebP(img, quality)
+// pngBufferPool lets PNG encoders reuse their internal scanline buffers
+type pngBufferPool struct {
+	pool sync.Pool
+}
+
+var pngBuffers = &pngBufferPool{}
+
+func (p *pngBufferPool) Get() *png.EncoderBuffer {
+	if b, ok := p.pool.Get().(*png.EncoderBuffer); ok {
+		return b
+	}
+	return nil
+}
+
+func (p *pngBufferPool) Put(b *png.EncoderBuffer) {
+	p.pool.Put(b)
+}
+
+// encodeWebPLossless provides lossless WebP encoding. quality selects the
+// libwebp lossless level 0 (fastest) to 9 (smallest).
+func encodeWebPLossless(buf *bytes.Buffer, img *image.RGBA, quality int) (string, error) {
+	config, release, err := getWebPOptions(true, effortLevel(quality, 0, 9))
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	if err := libwebp.Encode(buf, img, config); err != nil {
+		return "", err
+	}
+
+	return "image/webp", nil
 }
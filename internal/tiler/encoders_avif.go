@@ -0,0 +1,41 @@
+//go:build avif
+
+package tiler
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/Kagami/go-avif"
+)
+
+const avifSupported = true
+
+// encodeAVIF provides next-gen AVIF encoding (best compression) via libaom.
+// speed ranges from 0 (slowest, smallest) to 8 (fastest).
+func encodeAVIF(buf *bytes.Buffer, img *image.RGBA, quality, speed int) (string, error) {
+	// libaom quantizer: 0 is lossless, 63 is worst
+	q := avif.MaxQuality - quality*avif.MaxQuality/100
+	if q < avif.MinQuality {
+		q = avif.MinQuality
+	}
+
+	if speed < avif.MinSpeed {
+		speed = avif.MinSpeed
+	} else if speed > avif.MaxSpeed {
+		speed = avif.MaxSpeed
+	}
+
+	// One thread per tile; the encoder pool parallelizes across tiles
+	opts := &avif.Options{
+		Threads: 1,
+		Speed:   speed,
+		Quality: q,
+	}
+
+	if err := avif.Encode(buf, img, opts); err != nil {
+		return "", err
+	}
+
+	return "image/avif", nil
+}
@@ -0,0 +1,95 @@
+//go:build jxl
+
+package tiler
+
+/*
+#cgo LDFLAGS: -ljxl
+#include <stdlib.h>
+#include <jxl/encode.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"unsafe"
+)
+
+const jxlSupported = true
+
+const jxlOutputChunk = 64 * 1024
+
+// encodeJXL provides lossless JPEG-XL encoding via libjxl. quality selects
+// the encoder effort 1 (fastest) to 9 (smallest).
+func encodeJXL(buf *bytes.Buffer, img *image.RGBA, quality int) (string, error) {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+
+	// libjxl expects tightly packed rows
+	pix := img.Pix
+	if img.Stride != width*4 {
+		pix = make([]byte, width*height*4)
+		for y := 0; y < height; y++ {
+			copy(pix[y*width*4:(y+1)*width*4], img.Pix[y*img.Stride:])
+		}
+	}
+
+	enc := C.JxlEncoderCreate(nil)
+	if enc == nil {
+		return "", fmt.Errorf("failed to create JPEG-XL encoder")
+	}
+	defer C.JxlEncoderDestroy(enc)
+
+	var info C.JxlBasicInfo
+	C.JxlEncoderInitBasicInfo(&info)
+	info.xsize = C.uint32_t(width)
+	info.ysize = C.uint32_t(height)
+	info.bits_per_sample = 8
+	info.num_color_channels = 3
+	info.num_extra_channels = 1
+	info.alpha_bits = 8
+	info.uses_original_profile = C.JXL_TRUE // required for lossless
+	if C.JxlEncoderSetBasicInfo(enc, &info) != C.JXL_ENC_SUCCESS {
+		return "", fmt.Errorf("failed to set JPEG-XL basic info")
+	}
+
+	var color C.JxlColorEncoding
+	C.JxlColorEncodingSetToSRGB(&color, C.JXL_FALSE)
+	if C.JxlEncoderSetColorEncoding(enc, &color) != C.JXL_ENC_SUCCESS {
+		return "", fmt.Errorf("failed to set JPEG-XL color encoding")
+	}
+
+	settings := C.JxlEncoderFrameSettingsCreate(enc, nil)
+	C.JxlEncoderSetFrameLossless(settings, C.JXL_TRUE)
+	C.JxlEncoderFrameSettingsSetOption(settings, C.JXL_ENC_FRAME_SETTING_EFFORT, C.int64_t(effortLevel(quality, 1, 9)))
+
+	format := C.JxlPixelFormat{
+		num_channels: 4,
+		data_type:    C.JXL_TYPE_UINT8,
+		endianness:   C.JXL_NATIVE_ENDIAN,
+	}
+	if C.JxlEncoderAddImageFrame(settings, &format, unsafe.Pointer(&pix[0]), C.size_t(len(pix))) != C.JXL_ENC_SUCCESS {
+		return "", fmt.Errorf("failed to add JPEG-XL frame")
+	}
+	C.JxlEncoderCloseInput(enc)
+
+	// Output goes through a C buffer; cgo forbids passing C a pointer into Go memory that it then stores
+	chunk := (*C.uint8_t)(C.malloc(jxlOutputChunk))
+	defer C.free(unsafe.Pointer(chunk))
+
+	for {
+		next := chunk
+		avail := C.size_t(jxlOutputChunk)
+		status := C.JxlEncoderProcessOutput(enc, &next, &avail)
+		buf.Write(C.GoBytes(unsafe.Pointer(chunk), C.int(jxlOutputChunk-avail)))
+
+		if status == C.JXL_ENC_SUCCESS {
+			break
+		}
+		if status != C.JXL_ENC_NEED_MORE_OUTPUT {
+			return "", fmt.Errorf("JPEG-XL encoding failed")
+		}
+	}
+
+	return "image/jxl", nil
+}
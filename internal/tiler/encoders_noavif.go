@@ -0,0 +1,16 @@
+//go:build !avif
+
+package tiler
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+)
+
+// Build with -tags avif (requires libaom) to enable AVIF encoding
+const avifSupported = false
+
+func encodeAVIF(buf *bytes.Buffer, img *image.RGBA, quality, speed int) (string, error) {
+	return "", fmt.Errorf("avif: %w", ErrUnsupportedFormat)
+}
@@ -0,0 +1,16 @@
+//go:build !jxl
+
+package tiler
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+)
+
+// Build with -tags jxl (requires libjxl) to enable JPEG-XL encoding
+const jxlSupported = false
+
+func encodeJXL(buf *bytes.Buffer, img *image.RGBA, quality int) (string, error) {
+	return "", fmt.Errorf("jxl: %w", ErrUnsupportedFormat)
+}
@@ -0,0 +1,230 @@
+package tiler
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/kolesa-team/go-webp/decoder"
+	"github.com/kolesa-team/go-webp/encoder"
+	libwebp "github.com/kolesa-team/go-webp/webp"
+)
+
+// benchTile builds a 512x512 tile resembling stained cytology: a pale
+// background with darker blobs and sensor noise
+func benchTile() *image.RGBA {
+	const size = 512
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	rng := rand.New(rand.NewSource(1))
+
+	type cell struct{ x, y, r int }
+	cells := make([]cell, 40)
+	for i := range cells {
+		cells[i] = cell{rng.Intn(size), rng.Intn(size), 8 + rng.Intn(24)}
+	}
+
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			r, g, b := 235, 225, 235
+			for _, c := range cells {
+				dx, dy := x-c.x, y-c.y
+				if dx*dx+dy*dy < c.r*c.r {
+					r, g, b = 150, 90, 170
+					break
+				}
+			}
+			n := rng.Intn(9) - 4
+			i := img.PixOffset(x, y)
+			img.Pix[i+0] = uint8(r + n)
+			img.Pix[i+1] = uint8(g + n)
+			img.Pix[i+2] = uint8(b + n)
+			img.Pix[i+3] = 255
+		}
+	}
+	return img
+}
+
+// encodeWebPUnpooled is the original encoder: fresh options and buffer per
+// tile, with libwebp threading on regardless of load
+func encodeWebPUnpooled(img *image.RGBA, quality int) ([]byte, error) {
+	config, err := encoder.NewLossyEncoderOptions(encoder.PresetDefault, float32(quality))
+	if err != nil {
+		return nil, err
+	}
+	config.ThreadLevel = true
+
+	var buf bytes.Buffer
+	if err := libwebp.Encode(&buf, img, config); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeUnpooled(enc encodeFunc) func(*image.RGBA, int) ([]byte, error) {
+	return func(img *image.RGBA, quality int) ([]byte, error) {
+		var buf bytes.Buffer
+		if _, err := enc(&buf, img, quality); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// BenchmarkEncode compares the original per-call encoders ("unpooled") with
+// the bounded encoder pool under parallel batch load. Run with -benchmem to
+// compare allocations.
+func BenchmarkEncode(b *testing.B) {
+	img := benchTile()
+
+	formats := []struct {
+		name     string
+		pooled   encodeFunc
+		unpooled func(*image.RGBA, int) ([]byte, error)
+	}{
+		{"webp", encodeWebP, encodeWebPUnpooled},
+		{"jpeg", encodeJPEG, encodeUnpooled(encodeJPEG)},
+		{"png", encodePNG, encodeUnpooled(encodePNG)},
+	}
+
+	for _, f := range formats {
+		b.Run(f.name+"/unpooled", func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := f.unpooled(img, 85); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+
+		b.Run(f.name+"/pooled", func(b *testing.B) {
+			pool := newEncoderPool(0)
+			ctx := context.Background()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, _, err := pool.encode(ctx, f.name, img, 85, f.pooled); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestLosslessEncodersRoundTrip(t *testing.T) {
+	src := benchTile()
+
+	formats := []struct {
+		name        string
+		encode      encodeFunc
+		contentType string
+		decode      func(io.Reader) (image.Image, error)
+	}{
+		{"png", encodePNG, "image/png", png.Decode},
+		{"webp-lossless", encodeWebPLossless, "image/webp", func(r io.Reader) (image.Image, error) {
+			return libwebp.Decode(r, &decoder.Options{})
+		}},
+	}
+	pool := newEncoderPool(1)
+	for _, f := range formats {
+		for _, quality := range []int{1, 50, 100} {
+			data, contentType, err := pool.encode(context.Background(), f.name, src, quality, f.encode)
+			if err != nil {
+				t.Fatalf("%s at %d: %v", f.name, quality, err)
+			}
+			if contentType != f.contentType {
+				t.Errorf("%s: Content-Type %s, want %s", f.name, contentType, f.contentType)
+			}
+			img, err := f.decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%s at %d: decode: %v", f.name, quality, err)
+			}
+			if x, y, ok := samePixels(src, img); !ok {
+				t.Errorf("%s at %d: pixel %d,%d is %v, want %v", f.name, quality, x, y, img.At(x, y), src.At(x, y))
+			}
+		}
+	}
+}
+
+// samePixels compares images pixel by pixel in one color model, as decoders
+// return whichever image type suits the file. It returns the first
+// differing pixel.
+func samePixels(want *image.RGBA, got image.Image) (x, y int, ok bool) {
+	if got.Bounds() != want.Bounds() {
+		return 0, 0, false
+	}
+	for y := 0; y < want.Rect.Dy(); y++ {
+		for x := 0; x < want.Rect.Dx(); x++ {
+			if color.NRGBAModel.Convert(got.At(x, y)) != color.NRGBAModel.Convert(want.At(x, y)) {
+				return x, y, false
+			}
+		}
+	}
+	return 0, 0, true
+}
+
+func TestEffortLevel(t *testing.T) {
+	tests := []struct{ quality, min, max, want int }{
+		{1, 0, 9, 0},
+		{50, 0, 9, 4},
+		{99, 0, 9, 8},
+		{100, 0, 9, 9},
+		{1, 1, 9, 1},
+		{100, 1, 9, 9},
+		{0, 1, 9, 1},
+		{150, 1, 9, 9},
+		{-20, 0, 9, 0},
+	}
+	for _, tt := range tests {
+		if got := effortLevel(tt.quality, tt.min, tt.max); got != tt.want {
+			t.Errorf("effortLevel(%d, %d, %d) = %d, want %d", tt.quality, tt.min, tt.max, got, tt.want)
+		}
+	}
+
+	// Higher PNG quality selects more zlib effort, so smaller output
+	sizes := make(map[int]int)
+	for _, quality := range []int{1, 50, 100} {
+		var buf bytes.Buffer
+		if _, err := encodePNG(&buf, benchTile(), quality); err != nil {
+			t.Fatal(err)
+		}
+		sizes[quality] = buf.Len()
+	}
+	if sizes[1] < sizes[50] || sizes[50] < sizes[100] || sizes[1] == sizes[100] {
+		t.Errorf("PNG sizes by quality %v, want them to shrink with effort", sizes)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		format    string
+		supported bool
+		lossless  bool
+	}{
+		{"jpeg", true, false},
+		{"webp", true, false},
+		{"avif", avifSupported, false},
+		{"png", true, true},
+		{"webp-lossless", true, true},
+		{"jxl", jxlSupported, true},
+		// Aliases are resolved by the API before they reach the tiler
+		{"jpg", false, false},
+		{"gif", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		if got := FormatSupported(tt.format); got != tt.supported {
+			t.Errorf("FormatSupported(%q) = %v, want %v", tt.format, got, tt.supported)
+		}
+		if got := FormatLossless(tt.format); got != tt.lossless {
+			t.Errorf("FormatLossless(%q) = %v, want %v", tt.format, got, tt.lossless)
+		}
+	}
+}
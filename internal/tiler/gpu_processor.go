@@ -1,13 +1,16 @@
 package tiler
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"image"
+	"image/draw"
 	"sync"
 	"unsafe"
 
 	"cyto-viewer/internal/config"
+	"cyto-viewer/internal/storage"
 )
 
 /*
@@ -29,6 +32,9 @@ type GPUTileProcessor struct {
 	stream       C.cudaStream_t
 	bufferPool   sync.Pool
 	tileCache    *TileCache
+	prefetcher   *Prefetcher
+	encoders     *encoderPool
+	tiles        *storage.TileStore
 	colorCorrect bool
 	mu           sync.RWMutex
 }
@@ -38,11 +44,13 @@ type TileRequest struct {
 	Layer    int
 	X        int
 	Y        int
-	Z        int // Focus layer
+	Z        int // Pyramid level; Layer is the focus layer
 	Width    int
 	Height   int
-	Format   string // "jpeg", "webp", "avif"
+	Format   string // "jpeg", "webp", "avif" or lossless "png", "webp-lossless", "jxl"
 	Quality  int
+	Profile  string // Processing profile; empty for the scanner default
+	Overlay  string // Captured overlay to read instead of the slide's layers
 }
 
 type TileResponse struct {
@@ -51,6 +59,11 @@ type TileResponse struct {
 	Height      int
 	ContentType string
 	CacheKey    string
+
+	// Tile identity, used for targeted cache invalidation
+	slideID string
+	layer   int
+	profile string
 }
 
 func NewGPUTileProcessor(cfg *config.GPUConfig) (*GPUTileProcessor, error) {
@@ -75,13 +88,31 @@ func NewGPUTileProcessor(cfg *config.GPUConfig) (*GPUTileProcessor, error) {
 		return nil, fmt.Errorf("failed to create CUDA stream: %v", err)
 	}
 
+	tileCache, err := NewTileCacheWithPolicy(cfg.CacheSize, cfg.CachePolicy)
+	if err != nil {
+		C.cudaStreamDestroy(stream)
+		return nil, err
+	}
+
 	processor := &GPUTileProcessor{
 		config:       cfg,
 		deviceID:     cfg.DeviceID,
 		stream:       stream,
 		colorCorrect: cfg.ColorCorrection,
-		tileCache:    NewTileCache(cfg.CacheSize),
+		tileCache:    tileCache,
+		encoders:     newEncoderPool(cfg.EncodeWorkers),
+	}
+	processor.tileCache.SetPrefetchConcurrency(cfg.PrefetchWorkers)
+
+	if cfg.DiskCachePath != "" {
+		l2, err := NewDiskCache(cfg.DiskCachePath, cfg.DiskCacheSize)
+		if err != nil {
+			C.cudaStreamDestroy(stream)
+			return nil, err
+		}
+		processor.tileCache.SetDiskTier(l2)
 	}
+	processor.prefetcher = NewPrefetcher(processor)
 
 	// Initialize buffer pool for zero-copy operations
 	processor.bufferPool = sync.Pool{
@@ -93,20 +124,85 @@ func NewGPUTileProcessor(cfg *config.GPUConfig) (*GPUTileProcessor, error) {
 	return processor, nil
 }
 
+// cacheKey identifies a processed tile in the cache. Format and quality are
+// part of the key since they change the encoded bytes.
+func (r *TileRequest) cacheKey() string {
+	key := fmt.Sprintf("%s:%d:%d:%d:%d:%s:%s:%d", r.SlideID, r.Layer, r.X, r.Y, r.Z, r.Profile, r.Format, r.Quality)
+	if r.Overlay != "" {
+		key += ":" + r.Overlay
+	}
+	return key
+}
+
 func (p *GPUTileProcessor) ProcessTile(ctx context.Context, req *TileRequest) (*TileResponse, error) {
+	// Fail fast rather than render a tile we can't encode
+	if !FormatSupported(req.Format) {
+		return nil, fmt.Errorf("%q: %w", req.Format, ErrUnsupportedFormat)
+	}
+
 	// Check cache first
-	cacheKey := fmt.Sprintf("%s:%d:%d:%d:%d", req.SlideID, req.Layer, req.X, req.Y, req.Z)
-	
+	cacheKey := req.cacheKey()
+
 	if cached, ok := p.tileCache.Get(cacheKey); ok {
 		return cached, nil
 	}
 
-	// Load raw tile data from storage
-	rawData, err := p.loadRawTile(req)
+	gen := p.tileCache.Generation()
+	response, err := p.renderTile(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cache the result, unless the slide was invalidated while rendering
+	p.tileCache.setIfCurrent(cacheKey, response, PriorityNormal, gen)
+
+	return response, nil
+}
+
+// Prefetch records a tile request on slide for the given viewing session and
+// warms the cache in the background with the tiles of the slide the session
+// is likely to need next.
+func (p *GPUTileProcessor) Prefetch(session string, req *TileRequest, slide *storage.Slide) {
+	p.prefetcher.Observe(session, req, slide)
+}
+
+// SetTileStore sets the storage backend tiles are loaded from
+func (p *GPUTileProcessor) SetTileStore(store *storage.TileStore) {
+	p.tiles = store
+}
+
+// renderTile runs the full load, GPU process and encode pipeline, bypassing the cache
+func (p *GPUTileProcessor) renderTile(ctx context.Context, req *TileRequest) (*TileResponse, error) {
+	// Load the stored tile in its original compressed form
+	stored, err := p.loadRawTile(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load raw tile: %w", err)
 	}
 
+	// Serve the stored bytes as is when they already are what was asked for
+	if p.canPassthrough(stored, req) {
+		return &TileResponse{
+			Data:        stored.Data,
+			Width:       stored.Width,
+			Height:      stored.Height,
+			ContentType: contentTypes[stored.Format],
+			CacheKey:    req.cacheKey(),
+			slideID:     req.SlideID,
+			layer:       req.Layer,
+			profile:     req.Profile,
+		}, nil
+	}
+
+	// The kernel works on RGBA pixels, so compressed tiles are decoded first
+	pixels, err := decodeStoredTile(stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode stored tile: %w", err)
+	}
+	if b := pixels.Bounds(); b.Dx() != req.Width || b.Dy() != req.Height {
+		return nil, fmt.Errorf("stored tile is %dx%d, request is for %dx%d", b.Dx(), b.Dy(), req.Width, req.Height)
+	}
+	rawData := pixels.Pix
+
 	// Allocate GPU memory
 	var dInput, dOutput unsafe.Pointer
 	tileSize := req.Width * req.Height * 4 // RGBA
@@ -152,7 +248,7 @@ func (p *GPUTileProcessor) ProcessTile(ctx context.Context, req *TileRequest) (*
 	}
 
 	// Encode to requested format (JPEG, WebP, or AVIF)
-	encoded, contentType, err := p.encodeTile(output, req)
+	encoded, contentType, err := p.encodeTile(ctx, output, req)
 	if err != nil {
 		p.bufferPool.Put(output)
 		return nil, fmt.Errorf("failed to encode tile: %w", err)
@@ -163,26 +259,88 @@ func (p *GPUTileProcessor) ProcessTile(ctx context.Context, req *TileRequest) (*
 		Width:       req.Width,
 		Height:      req.Height,
 		ContentType: contentType,
-		CacheKey:    cacheKey,
+		CacheKey:    req.cacheKey(),
+		slideID:     req.SlideID,
+		layer:       req.Layer,
+		profile:     req.Profile,
 	}
 
-	// Cache the result
-	p.tileCache.Set(cacheKey, response)
-
 	// Return buffer to pool
 	p.bufferPool.Put(output)
 
 	return response, nil
 }
 
-func (p *GPUTileProcessor) loadRawTile(req *TileRequest) ([]byte, error) {
-	// This would interface with your actual storage backend
-	// For now, placeholder for the raw tile loading logic
-	// In production, this would read from your compressed tile storage
-	return nil, fmt.Errorf("not implemented: loadRawTile")
+func (p *GPUTileProcessor) loadRawTile(req *TileRequest) (*storage.StoredTile, error) {
+	if p.tiles == nil {
+		return nil, fmt.Errorf("no tile store configured")
+	}
+	if req.Overlay != "" {
+		return p.tiles.GetOverlay(req.SlideID, req.Overlay, req.X, req.Y, req.Z)
+	}
+	return p.tiles.Get(req.SlideID, req.Layer, req.X, req.Y, req.Z)
+}
+
+// decodeStoredTile returns a stored tile's pixels as tightly packed RGBA,
+// the layout the GPU kernel reads
+func decodeStoredTile(stored *storage.StoredTile) (*image.RGBA, error) {
+	if len(stored.Data) == 0 {
+		return nil, fmt.Errorf("empty tile data")
+	}
+
+	if stored.Format == "raw" {
+		if stored.Width <= 0 || stored.Height <= 0 || len(stored.Data) != stored.Width*stored.Height*4 {
+			return nil, fmt.Errorf("raw tile has %d bytes, expected %dx%d RGBA", len(stored.Data), stored.Width, stored.Height)
+		}
+		return &image.RGBA{
+			Pix:    stored.Data,
+			Stride: stored.Width * 4,
+			Rect:   image.Rect(0, 0, stored.Width, stored.Height),
+		}, nil
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(stored.Data))
+	if err != nil {
+		return nil, err
+	}
+	if format != stored.Format {
+		return nil, fmt.Errorf("tile recorded as %s holds %s data", stored.Format, format)
+	}
+	b := img.Bounds()
+	if b.Dx() != stored.Width || b.Dy() != stored.Height {
+		return nil, fmt.Errorf("tile recorded as %dx%d decodes to %dx%d", stored.Width, stored.Height, b.Dx(), b.Dy())
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba, nil
+}
+
+// contentTypes maps stored tile formats that can be served without re-encoding
+var contentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+	"png":  "image/png",
+}
+
+// canPassthrough reports whether a stored tile can be served without decoding
+// and re-encoding: it must already be in the requested format and size, and
+// carry every correction the request implies. The requested quality is not
+// enforced; the stored bytes are the best the scanner produced.
+func (p *GPUTileProcessor) canPassthrough(stored *storage.StoredTile, req *TileRequest) bool {
+	if _, ok := contentTypes[stored.Format]; !ok || stored.Format != req.Format {
+		return false
+	}
+	if stored.Width != req.Width || stored.Height != req.Height {
+		return false
+	}
+	if p.colorCorrect && !stored.Corrections.ColorCorrected {
+		return false
+	}
+	return stored.Corrections.Profile == req.Profile
 }
 
-func (p *GPUTileProcessor) encodeTile(data []byte, req *TileRequest) ([]byte, string, error) {
+func (p *GPUTileProcessor) encodeTile(ctx context.Context, data []byte, req *TileRequest) ([]byte, string, error) {
 	// Create image from raw RGBA data
 	img := &image.RGBA{
 		Pix:    data,
@@ -191,14 +349,32 @@ func (p *GPUTileProcessor) encodeTile(data []byte, req *TileRequest) ([]byte, st
 	}
 
 	// Use optimized encoders based on format
+	var enc encodeFunc
 	switch req.Format {
 	case "webp":
-		return encodeWebP(img, req.Quality)
+		enc = encodeWebP
 	case "avif":
-		return encodeAVIF(img, req.Quality)
+		enc = func(buf *bytes.Buffer, img *image.RGBA, quality int) (string, error) {
+			return encodeAVIF(buf, img, quality, p.config.AVIFSpeed)
+		}
+	case "jpeg":
+		enc = encodeJPEG
+	case "png":
+		enc = encodePNG
+	case "webp-lossless":
+		enc = encodeWebPLossless
+	case "jxl":
+		enc = encodeJXL
 	default:
-		return encodeJPEG(img, req.Quality)
+		return nil, "", fmt.Errorf("%q: %w", req.Format, ErrUnsupportedFormat)
 	}
+
+	return p.encoders.encode(ctx, req.Format, img, req.Quality, enc)
+}
+
+// EncodeMetrics returns per-format encode latency histograms
+func (p *GPUTileProcessor) EncodeMetrics() map[string]HistogramSnapshot {
+	return p.encoders.metrics.Snapshot()
 }
 
 func (p *GPUTileProcessor) getColorCorrectionMatrix() []float32 {
@@ -262,9 +438,19 @@ func (p *GPUTileProcessor) ProcessBatch(ctx context.Context, requests []*TileReq
 	return responses, nil
 }
 
+// Invalidate drops cached tiles matching the filter from every tier
+func (p *GPUTileProcessor) Invalidate(f InvalidationFilter) int {
+	return p.tileCache.Invalidate(f)
+}
+
+// CacheStats returns hit/miss and size counters for each cache tier
+func (p *GPUTileProcessor) CacheStats() (memory TierStats, disk *TierStats) {
+	return p.tileCache.TierStats()
+}
+
 func (p *GPUTileProcessor) Close() error {
 	if p.stream != nil {
 		C.cudaStreamDestroy(p.stream)
 	}
-	return nil
+	return p.tileCache.Close()
 }
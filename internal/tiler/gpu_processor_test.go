@@ -0,0 +1,140 @@
+package tiler
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"sync"
+	"testing"
+
+	"cyto-viewer/internal/config"
+	"cyto-viewer/internal/storage"
+)
+
+// newTestProcessor builds a processor on the default CUDA stream reading
+// from a fresh tile store
+func newTestProcessor(t *testing.T, colorCorrect bool) (*GPUTileProcessor, *storage.TileStore) {
+	t.Helper()
+
+	tiles := storage.NewTileStore(t.TempDir())
+	cache, err := NewTileCacheWithPolicy(64<<20, "lru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &GPUTileProcessor{
+		config:       &config.GPUConfig{},
+		colorCorrect: colorCorrect,
+		tileCache:    cache,
+		encoders:     newEncoderPool(1),
+		tiles:        tiles,
+		bufferPool: sync.Pool{
+			New: func() interface{} { return make([]byte, 4096*4096*4) },
+		},
+	}
+	return p, tiles
+}
+
+func storeJPEG(t *testing.T, tiles *storage.TileStore, img *image.RGBA) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	b := img.Bounds()
+	err := tiles.Put("slide-1", 0, 0, 0, 0, &storage.StoredTile{
+		Data:   buf.Bytes(),
+		Format: "jpeg",
+		Width:  b.Dx(),
+		Height: b.Dy(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeStoredTile(t *testing.T) {
+	src := benchTile()
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, src); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tile    storage.StoredTile
+		wantErr bool
+	}{
+		{"png", storage.StoredTile{Data: pngData.Bytes(), Format: "png", Width: 512, Height: 512}, false},
+		{"raw", storage.StoredTile{Data: src.Pix, Format: "raw", Width: 512, Height: 512}, false},
+		{"raw short", storage.StoredTile{Data: src.Pix[:100], Format: "raw", Width: 512, Height: 512}, true},
+		{"wrong size", storage.StoredTile{Data: pngData.Bytes(), Format: "png", Width: 256, Height: 256}, true},
+		{"wrong format", storage.StoredTile{Data: pngData.Bytes(), Format: "jpeg", Width: 512, Height: 512}, true},
+		{"garbage", storage.StoredTile{Data: []byte("not an image"), Format: "jpeg", Width: 512, Height: 512}, true},
+		{"empty", storage.StoredTile{Format: "png", Width: 512, Height: 512}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := decodeStoredTile(&tt.tile)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Stride != 512*4 || len(img.Pix) != 512*512*4 {
+				t.Fatalf("got stride %d and %d bytes, want packed 512x512 RGBA", img.Stride, len(img.Pix))
+			}
+			if !bytes.Equal(img.Pix, src.Pix) {
+				t.Error("decoded pixels differ from the source")
+			}
+		})
+	}
+}
+
+// TestRenderTileStoredJPEG renders a tile that can't be passed through:
+// color correction is on and the stored JPEG isn't corrected, so it has to
+// be decoded, processed and re-encoded
+func TestRenderTileStoredJPEG(t *testing.T) {
+	p, tiles := newTestProcessor(t, true)
+	storeJPEG(t, tiles, benchTile())
+
+	req := &TileRequest{SlideID: "slide-1", Width: 512, Height: 512, Format: "png", Quality: 50}
+	stored, err := p.loadRawTile(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.canPassthrough(stored, req) {
+		t.Fatal("an uncorrected JPEG must not be passed through as PNG")
+	}
+
+	resp, err := p.renderTile(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentType != "image/png" {
+		t.Errorf("content type %q, want image/png", resp.ContentType)
+	}
+	img, err := png.Decode(bytes.NewReader(resp.Data))
+	if err != nil {
+		t.Fatalf("response isn't a PNG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 512 || b.Dy() != 512 {
+		t.Errorf("rendered %dx%d, want 512x512", b.Dx(), b.Dy())
+	}
+}
+
+func TestRenderTileSizeMismatch(t *testing.T) {
+	p, tiles := newTestProcessor(t, true)
+	storeJPEG(t, tiles, benchTile())
+
+	req := &TileRequest{SlideID: "slide-1", Width: 256, Height: 256, Format: "png", Quality: 50}
+	if _, err := p.renderTile(context.Background(), req); err == nil {
+		t.Fatal("expected an error for a request that doesn't match the stored tile size")
+	}
+}
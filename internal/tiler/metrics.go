@@ -0,0 +1,112 @@
+package tiler
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// encodeBuckets are the upper bounds of the encode latency histogram buckets
+var encodeBuckets = []time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+}
+
+// LatencyHistogram counts observations into fixed latency buckets.
+// The last count is the overflow bucket for anything slower than the bounds.
+type LatencyHistogram struct {
+	counts []atomic.Uint64
+	total  atomic.Uint64
+	sumNs  atomic.Int64
+}
+
+func newLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{
+		counts: make([]atomic.Uint64, len(encodeBuckets)+1),
+	}
+}
+
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(encodeBuckets) && d > encodeBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.total.Add(1)
+	h.sumNs.Add(int64(d))
+}
+
+// HistogramSnapshot is a point-in-time copy of a LatencyHistogram
+type HistogramSnapshot struct {
+	Count   uint64            `json:"count"`
+	MeanMs  float64           `json:"meanMs"`
+	Buckets map[string]uint64 `json:"buckets"` // upper bound ("le") -> count
+}
+
+func (h *LatencyHistogram) Snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{
+		Count:   h.total.Load(),
+		Buckets: make(map[string]uint64, len(h.counts)),
+	}
+	if snap.Count > 0 {
+		snap.MeanMs = float64(h.sumNs.Load()) / float64(snap.Count) / float64(time.Millisecond)
+	}
+
+	for i := range h.counts {
+		le := "+Inf"
+		if i < len(encodeBuckets) {
+			le = encodeBuckets[i].String()
+		}
+		snap.Buckets[le] = h.counts[i].Load()
+	}
+	return snap
+}
+
+// EncodeMetrics tracks encode latency per output format
+type EncodeMetrics struct {
+	mu         sync.RWMutex
+	histograms map[string]*LatencyHistogram
+}
+
+func NewEncodeMetrics() *EncodeMetrics {
+	return &EncodeMetrics{
+		histograms: make(map[string]*LatencyHistogram),
+	}
+}
+
+func (m *EncodeMetrics) observe(format string, d time.Duration) {
+	m.mu.RLock()
+	h, ok := m.histograms[format]
+	m.mu.RUnlock()
+
+	if !ok {
+		m.mu.Lock()
+		if h, ok = m.histograms[format]; !ok {
+			h = newLatencyHistogram()
+			m.histograms[format] = h
+		}
+		m.mu.Unlock()
+	}
+
+	h.Observe(d)
+}
+
+// Snapshot returns the histogram of every format encoded so far
+func (m *EncodeMetrics) Snapshot() map[string]HistogramSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make(map[string]HistogramSnapshot, len(m.histograms))
+	for format, h := range m.histograms {
+		out[format] = h.Snapshot()
+	}
+	return out
+}
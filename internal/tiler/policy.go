@@ -0,0 +1,304 @@
+package tiler
+
+import (
+	"container/list"
+	"fmt"
+	"hash/maphash"
+)
+
+// WritePriority marks how valuable a cache write is. Background work such as
+// prefetch and region exports writes at low priority so a single sweep over a
+// slide can't push the interactive working set out of the cache.
+type WritePriority int
+
+const (
+	PriorityNormal WritePriority = iota
+	PriorityLow
+)
+
+// EvictionPolicy decides which tiles TileCache keeps. Implementations are not
+// safe for concurrent use; TileCache calls them under its own lock.
+type EvictionPolicy interface {
+	// Record notes a lookup of key, whether or not it was cached
+	Record(key string)
+	// Hit promotes a cached key after a successful lookup
+	Hit(key string)
+	// Admit reports whether candidate, written at priority, may displace
+	// victim
+	Admit(candidate, victim string, priority WritePriority) bool
+	// Add starts tracking a newly cached key
+	Add(key string, size int64, priority WritePriority)
+	// Victims calls fn with cached keys in the order they should be
+	// evicted, until fn returns false or every key has been visited.
+	// The keys stay cached; fn must not change the policy.
+	Victims(fn func(key string) bool)
+	// Remove stops tracking key
+	Remove(key string)
+}
+
+// NewEvictionPolicy builds a policy by name: "lru", "slru" or "tinylfu"
+func NewEvictionPolicy(name string, maxSizeBytes int64) (EvictionPolicy, error) {
+	switch name {
+	case "", "lru":
+		return newLRUPolicy(), nil
+	case "slru":
+		return newSLRUPolicy(maxSizeBytes), nil
+	case "tinylfu":
+		return newTinyLFUPolicy(maxSizeBytes), nil
+	default:
+		return nil, fmt.Errorf("unknown cache eviction policy: %s", name)
+	}
+}
+
+// lruPolicy evicts the least recently used tile. Low priority writes enter at
+// the cold end so they are the first to go.
+type lruPolicy struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		order: list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+func (p *lruPolicy) Record(key string) {}
+
+func (p *lruPolicy) Hit(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.order.MoveToFront(elem)
+	}
+}
+
+func (p *lruPolicy) Admit(candidate, victim string, priority WritePriority) bool { return true }
+
+func (p *lruPolicy) Add(key string, size int64, priority WritePriority) {
+	if priority == PriorityLow {
+		p.elems[key] = p.order.PushBack(key)
+	} else {
+		p.elems[key] = p.order.PushFront(key)
+	}
+}
+
+func (p *lruPolicy) Victims(fn func(key string) bool) {
+	for elem := p.order.Back(); elem != nil; elem = elem.Prev() {
+		if !fn(elem.Value.(string)) {
+			return
+		}
+	}
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.order.Remove(elem)
+		delete(p.elems, key)
+	}
+}
+
+// slruPolicy is a segmented LRU. New tiles land in a probation segment and
+// are promoted to the protected segment on their second access, so one-hit
+// scans only churn probation.
+type slruPolicy struct {
+	probation     *list.List
+	protected     *list.List
+	elems         map[string]*list.Element
+	protectedSize int64
+	protectedMax  int64
+}
+
+type slruItem struct {
+	key       string
+	size      int64
+	protected bool
+}
+
+const slruProtectedShare = 0.8
+
+func newSLRUPolicy(maxSizeBytes int64) *slruPolicy {
+	return &slruPolicy{
+		probation:    list.New(),
+		protected:    list.New(),
+		elems:        make(map[string]*list.Element),
+		protectedMax: int64(float64(maxSizeBytes) * slruProtectedShare),
+	}
+}
+
+func (p *slruPolicy) Record(key string) {}
+
+func (p *slruPolicy) Hit(key string) {
+	elem, ok := p.elems[key]
+	if !ok {
+		return
+	}
+
+	item := elem.Value.(*slruItem)
+	if item.protected {
+		p.protected.MoveToFront(elem)
+		return
+	}
+
+	// Promote to protected, demoting its coldest tiles back to probation
+	p.probation.Remove(elem)
+	item.protected = true
+	p.elems[key] = p.protected.PushFront(item)
+	p.protectedSize += item.size
+
+	for p.protectedSize > p.protectedMax && p.protected.Len() > 1 {
+		back := p.protected.Back()
+		demoted := back.Value.(*slruItem)
+		p.protected.Remove(back)
+		p.protectedSize -= demoted.size
+		demoted.protected = false
+		p.elems[demoted.key] = p.probation.PushFront(demoted)
+	}
+}
+
+func (p *slruPolicy) Admit(candidate, victim string, priority WritePriority) bool { return true }
+
+func (p *slruPolicy) Add(key string, size int64, priority WritePriority) {
+	item := &slruItem{key: key, size: size}
+	if priority == PriorityLow {
+		p.elems[key] = p.probation.PushBack(item)
+	} else {
+		p.elems[key] = p.probation.PushFront(item)
+	}
+}
+
+func (p *slruPolicy) Victims(fn func(key string) bool) {
+	for _, segment := range []*list.List{p.probation, p.protected} {
+		for elem := segment.Back(); elem != nil; elem = elem.Prev() {
+			if !fn(elem.Value.(*slruItem).key) {
+				return
+			}
+		}
+	}
+}
+
+func (p *slruPolicy) Remove(key string) {
+	elem, ok := p.elems[key]
+	if !ok {
+		return
+	}
+
+	item := elem.Value.(*slruItem)
+	if item.protected {
+		p.protected.Remove(elem)
+		p.protectedSize -= item.size
+	} else {
+		p.probation.Remove(elem)
+	}
+	delete(p.elems, key)
+}
+
+// tinyLFUPolicy layers a frequency-based admission filter over SLRU: a new
+// tile only displaces the eviction victim if it has been requested more often
+// recently. Frequencies are estimated with an aging count-min sketch.
+//
+// Prefetched tiles are written before anyone has asked for them, so they
+// would never win on frequency. They are credited with the access the
+// prefetcher predicts, which lets them displace tiles nobody has requested
+// again, but not the working set.
+type tinyLFUPolicy struct {
+	*slruPolicy
+	sketch *countMinSketch
+}
+
+const (
+	// Assumed average tile size, used to size the frequency sketch
+	tinyLFUAvgTileSize = 64 * 1024
+
+	// Accesses credited to a low priority (prefetched) tile on admission
+	tinyLFUPrefetchCredit = 1
+)
+
+func newTinyLFUPolicy(maxSizeBytes int64) *tinyLFUPolicy {
+	return &tinyLFUPolicy{
+		slruPolicy: newSLRUPolicy(maxSizeBytes),
+		sketch:     newCountMinSketch(int(maxSizeBytes / tinyLFUAvgTileSize)),
+	}
+}
+
+func (p *tinyLFUPolicy) Record(key string) {
+	p.sketch.increment(key)
+}
+
+func (p *tinyLFUPolicy) Admit(candidate, victim string, priority WritePriority) bool {
+	freq := int(p.sketch.estimate(candidate))
+	if priority == PriorityLow {
+		freq += tinyLFUPrefetchCredit
+	}
+	return freq > int(p.sketch.estimate(victim))
+}
+
+// countMinSketch estimates access frequency with 4-bit saturating counters.
+// All counters are halved every sampleSize increments so old popularity fades.
+type countMinSketch struct {
+	rows       [4][]uint8
+	mask       uint64
+	seed       maphash.Seed
+	additions  int
+	sampleSize int
+}
+
+const sketchMaxCount = 15
+
+func newCountMinSketch(expectedItems int) *countMinSketch {
+	width := 1024
+	for width < expectedItems {
+		width <<= 1
+	}
+
+	s := &countMinSketch{
+		mask:       uint64(width - 1),
+		seed:       maphash.MakeSeed(),
+		sampleSize: width * 10,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) indexes(key string) [4]uint64 {
+	h := maphash.String(s.seed, key)
+	lo, hi := h, h>>32|h<<32
+	var idx [4]uint64
+	for i := range idx {
+		idx[i] = (lo + uint64(i)*hi) & s.mask
+	}
+	return idx
+}
+
+func (s *countMinSketch) increment(key string) {
+	for i, idx := range s.indexes(key) {
+		if s.rows[i][idx] < sketchMaxCount {
+			s.rows[i][idx]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	min := uint8(sketchMaxCount)
+	for i, idx := range s.indexes(key) {
+		if v := s.rows[i][idx]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
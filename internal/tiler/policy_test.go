@@ -0,0 +1,223 @@
+package tiler
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// traceAccess is one tile lookup in a recorded or synthetic access trace
+type traceAccess struct {
+	key  string
+	size int
+	low  bool // written at low priority on miss (prefetch, export)
+}
+
+const (
+	traceTileSize  = 64 * 1024
+	traceCacheSize = 2048 * traceTileSize
+)
+
+// loadTrace reads a recorded trace: one access per line as
+// "<cache key> [size] [low]". Blank lines and # comments are skipped.
+func loadTrace(path string) ([]traceAccess, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var trace []traceAccess
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		access := traceAccess{key: fields[0], size: traceTileSize}
+		if len(fields) > 1 {
+			if size, err := strconv.Atoi(fields[1]); err == nil {
+				access.size = size
+			}
+		}
+		if len(fields) > 2 && fields[2] == "low" {
+			access.low = true
+		}
+		trace = append(trace, access)
+	}
+	return trace, scanner.Err()
+}
+
+// readingTrace models pathologists panning around a few regions of interest
+// across focus layers, with a Zipf-skewed preference for the hottest regions.
+func readingTrace(rng *rand.Rand, n int) []traceAccess {
+	zipf := rand.NewZipf(rng, 1.2, 4, 63)
+	trace := make([]traceAccess, 0, n)
+	for len(trace) < n {
+		region := int(zipf.Uint64())
+		cx, cy := (region%8)*40, (region/8)*40
+		layer := 5 + rng.Intn(5)
+		for i := 0; i < 20 && len(trace) < n; i++ {
+			x, y := cx+rng.Intn(12), cy+rng.Intn(8)
+			trace = append(trace, traceAccess{
+				key:  fmt.Sprintf("slide-%d:%d:%d:%d:6:", region%3, layer, x, y),
+				size: traceTileSize,
+			})
+		}
+	}
+	return trace
+}
+
+// sweepTrace interleaves a one-pass scan over an entire slide, as produced by
+// a region export or a crawler, with the reading workload.
+func sweepTrace(rng *rand.Rand, n int, low bool) []traceAccess {
+	reading := readingTrace(rng, n)
+	trace := make([]traceAccess, 0, n*2)
+	for i, access := range reading {
+		trace = append(trace, access)
+		trace = append(trace, traceAccess{
+			key:  fmt.Sprintf("export:40:%d:%d:6:", i%400, i/400),
+			size: traceTileSize,
+			low:  low,
+		})
+	}
+	return trace
+}
+
+func benchmarkTraces() map[string][]traceAccess {
+	rng := rand.New(rand.NewSource(1))
+	traces := map[string][]traceAccess{
+		"reading":        readingTrace(rng, 200000),
+		"crawler":        sweepTrace(rng, 100000, false),
+		"export-lowprio": sweepTrace(rng, 100000, true),
+	}
+
+	// Replay a trace recorded from production access logs when provided
+	if path := os.Getenv("TILE_TRACE"); path != "" {
+		if trace, err := loadTrace(path); err == nil {
+			traces["recorded"] = trace
+		}
+	}
+	return traces
+}
+
+func BenchmarkPolicyHitRate(b *testing.B) {
+	traces := benchmarkTraces()
+	payload := make([]byte, traceTileSize)
+
+	for _, policyName := range []string{"lru", "slru", "tinylfu"} {
+		for traceName, trace := range traces {
+			b.Run(policyName+"/"+traceName, func(b *testing.B) {
+				var hits, total int
+				for i := 0; i < b.N; i++ {
+					// A single shard measures the policy itself, not shard imbalance
+					cache, err := newShardedTileCache(traceCacheSize, policyName, 1)
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					for _, access := range trace {
+						total++
+						if _, ok := cache.Get(access.key); ok {
+							hits++
+							continue
+						}
+
+						data := payload
+						if access.size != traceTileSize {
+							data = make([]byte, access.size)
+						}
+						priority := PriorityNormal
+						if access.low {
+							priority = PriorityLow
+						}
+						cache.SetWithPriority(access.key, &TileResponse{Data: data}, priority)
+					}
+				}
+				b.ReportMetric(100*float64(hits)/float64(total), "hit%")
+			})
+		}
+	}
+}
+
+func newTinyLFUTestCache(t *testing.T, size int64) *TileCache {
+	t.Helper()
+	cache, err := newShardedTileCache(size, "tinylfu", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+// TestTinyLFURejectionKeepsVictims writes a tile that needs two victims
+// evicted, of which only the first is colder than it. The rejected tile
+// must leave both in place.
+func TestTinyLFURejectionKeepsVictims(t *testing.T) {
+	cache := newTinyLFUTestCache(t, 200)
+	cache.Set("cold", &TileResponse{Data: make([]byte, 100)})
+	cache.Set("hot", &TileResponse{Data: make([]byte, 100)})
+	for i := 0; i < 3; i++ {
+		cache.Get("hot")
+	}
+
+	cache.Get("big") // one miss, so it beats "cold" but not "hot"
+	cache.Set("big", &TileResponse{Data: make([]byte, 200)})
+
+	if cache.Contains("big") {
+		t.Fatal("tile admitted over a more frequently used one")
+	}
+	for _, key := range []string{"cold", "hot"} {
+		if !cache.Contains(key) {
+			t.Errorf("%s evicted for a tile that wasn't admitted", key)
+		}
+	}
+}
+
+func TestTinyLFUPrefetchCredit(t *testing.T) {
+	cache := newTinyLFUTestCache(t, 200)
+	cache.Set("a", &TileResponse{Data: make([]byte, 100)})
+	cache.Set("b", &TileResponse{Data: make([]byte, 100)})
+
+	// Never requested, so no more valuable than the tiles it would displace
+	cache.Set("normal", &TileResponse{Data: make([]byte, 100)})
+	if cache.Contains("normal") {
+		t.Error("unrequested tile admitted at normal priority")
+	}
+
+	// A prefetched tile is credited with the request the prefetcher expects
+	cache.SetWithPriority("prefetched", &TileResponse{Data: make([]byte, 100)}, PriorityLow)
+	if !cache.Contains("prefetched") {
+		t.Fatal("prefetched tile not admitted over unrequested tiles")
+	}
+
+	// but doesn't displace tiles in use
+	for _, key := range []string{"a", "b", "prefetched"} {
+		cache.Get(key)
+		cache.Get(key)
+	}
+	cache.SetWithPriority("prefetched-2", &TileResponse{Data: make([]byte, 100)}, PriorityLow)
+	if cache.Contains("prefetched-2") {
+		t.Error("prefetched tile admitted over requested tiles")
+	}
+}
+
+func TestNewEvictionPolicyNames(t *testing.T) {
+	for _, name := range []string{"", "lru", "slru", "tinylfu"} {
+		if _, err := NewEvictionPolicy(name, traceCacheSize); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+
+	// 2Q isn't implemented; asking for it must not quietly get SLRU
+	for _, name := range []string{"2q", "LRU", "arc"} {
+		if _, err := NewEvictionPolicy(name, traceCacheSize); err == nil {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
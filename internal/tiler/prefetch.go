@@ -0,0 +1,161 @@
+package tiler
+
+import (
+	"context"
+	"image"
+	"sync"
+	"time"
+
+	"cyto-viewer/internal/storage"
+)
+
+const (
+	prefetchTimeout    = 10 * time.Second
+	sessionIdleTimeout = 10 * time.Minute
+	maxTrackedSessions = 1024
+)
+
+// Prefetcher tracks recent tile requests per viewing session and warms the
+// cache with the tiles a session is likely to request next.
+type Prefetcher struct {
+	processor *GPUTileProcessor
+	sessions  map[string]*viewState
+	mu        sync.Mutex
+}
+
+// viewState is the last tile a session requested
+type viewState struct {
+	last     TileRequest
+	lastSeen time.Time
+}
+
+func NewPrefetcher(p *GPUTileProcessor) *Prefetcher {
+	return &Prefetcher{
+		processor: p,
+		sessions:  make(map[string]*viewState),
+	}
+}
+
+// Observe records a foreground tile request on slide and schedules
+// prefetching of its likely successors.
+func (pf *Prefetcher) Observe(session string, req *TileRequest, slide *storage.Slide) {
+	pf.mu.Lock()
+	prev, ok := pf.sessions[session]
+	if !ok {
+		if len(pf.sessions) >= maxTrackedSessions {
+			pf.pruneLocked()
+		}
+		prev = &viewState{}
+		pf.sessions[session] = prev
+	}
+	var last *TileRequest
+	if ok && prev.last.SlideID == req.SlideID {
+		l := prev.last
+		last = &l
+	}
+	prev.last = *req
+	prev.lastSeen = time.Now()
+	pf.mu.Unlock()
+
+	candidates := predictTiles(last, req, newPrefetchScope(slide, req.Width))
+	if len(candidates) == 0 {
+		return
+	}
+
+	pf.processor.tileCache.Prefetch(candidates, func(r *TileRequest) (*TileResponse, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+		defer cancel()
+		return pf.processor.renderTile(ctx, r)
+	})
+}
+
+// pruneLocked drops sessions that have gone idle. Callers must hold pf.mu.
+func (pf *Prefetcher) pruneLocked() {
+	cutoff := time.Now().Add(-sessionIdleTimeout)
+	for id, state := range pf.sessions {
+		if state.lastSeen.Before(cutoff) {
+			delete(pf.sessions, id)
+		}
+	}
+}
+
+// prefetchScope is where on a slide tiles exist to be prefetched
+type prefetchScope struct {
+	layers map[int]bool
+	levels map[int]image.Point // tiles across and down at each stored level
+}
+
+// newPrefetchScope covers the slide's focus layers with stored tiles at its
+// stored pyramid levels. tileSize applies if the slide doesn't record one.
+func newPrefetchScope(slide *storage.Slide, tileSize int) prefetchScope {
+	if slide.TileSize > 0 {
+		tileSize = slide.TileSize
+	}
+	scope := prefetchScope{
+		layers: make(map[int]bool, len(slide.Layers)),
+		levels: make(map[int]image.Point),
+	}
+	for _, layer := range slide.Layers {
+		scope.layers[layer] = true
+	}
+	if tileSize > 0 {
+		for _, level := range slide.Levels() {
+			scope.levels[level.Level] = image.Pt(
+				(level.Width+tileSize-1)/tileSize, (level.Height+tileSize-1)/tileSize)
+		}
+	}
+	return scope
+}
+
+func (s prefetchScope) contains(layer, x, y, z int) bool {
+	grid, ok := s.levels[z]
+	return ok && s.layers[layer] && x >= 0 && y >= 0 && x < grid.X && y < grid.Y
+}
+
+// predictTiles returns the tiles in scope most likely to follow req, in
+// priority order: neighbors in the pan direction, then adjacent focus
+// layers. Ingest stores a single pyramid level (storage.StoredLevels), so
+// there is no other zoom level to fetch.
+func predictTiles(last, req *TileRequest, scope prefetchScope) []*TileRequest {
+	var out []*TileRequest
+	add := func(layer, x, y, z int) {
+		if !scope.contains(layer, x, y, z) {
+			return
+		}
+		t := *req
+		t.Layer, t.X, t.Y, t.Z = layer, x, y, z
+		out = append(out, &t)
+	}
+
+	// Neighbors in the pan direction
+	if last != nil && last.Z == req.Z && last.Layer == req.Layer {
+		dx, dy := sign(req.X-last.X), sign(req.Y-last.Y)
+		if dx != 0 || dy != 0 {
+			add(req.Layer, req.X+dx, req.Y+dy, req.Z)
+			if dx != 0 {
+				add(req.Layer, req.X+dx, req.Y-1, req.Z)
+				add(req.Layer, req.X+dx, req.Y+1, req.Z)
+			}
+			if dy != 0 {
+				add(req.Layer, req.X-1, req.Y+dy, req.Z)
+				add(req.Layer, req.X+1, req.Y+dy, req.Z)
+			}
+		}
+	}
+
+	// Adjacent focus layers
+	add(req.Layer-1, req.X, req.Y, req.Z)
+	add(req.Layer+1, req.X, req.Y, req.Z)
+
+	return out
+}
+
+func sign(v int) int {
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+package tiler
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"cyto-viewer/internal/storage"
+)
+
+func TestPredictTiles(t *testing.T) {
+	// 4x2 tiles on focus layers 0, 1 and 3, stored at level 0 only
+	slide := &storage.Slide{ID: "slide-1", Width: 2048, Height: 1000, TileSize: 512, Layers: []int{0, 1, 3}}
+	scope := newPrefetchScope(slide, 512)
+
+	tests := []struct {
+		name      string
+		last, req *TileRequest
+		want      string
+	}{
+		{"first request", nil, &TileRequest{Layer: 1, X: 1, Y: 0},
+			"0/1,0"},
+		{"pan right", &TileRequest{Layer: 0, X: 0, Y: 0}, &TileRequest{Layer: 0, X: 1, Y: 0},
+			"0/2,0 0/2,1 1/1,0"},
+		{"pan down at the edge", &TileRequest{Layer: 3, X: 3, Y: 0}, &TileRequest{Layer: 3, X: 3, Y: 1},
+			""},
+		{"pan past the right edge", &TileRequest{Layer: 0, X: 2, Y: 1}, &TileRequest{Layer: 0, X: 3, Y: 1},
+			"1/3,1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, r := range predictTiles(tt.last, tt.req, scope) {
+				if r.Z != 0 {
+					t.Errorf("predicted level %d, which isn't stored", r.Z)
+				}
+				got = append(got, fmt.Sprintf("%d/%d,%d", r.Layer, r.X, r.Y))
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("predicted %q, want %q", strings.Join(got, " "), tt.want)
+			}
+		})
+	}
+}
@@ -95,6 +95,48 @@ func (m *Manager) ValidateToken(tokenString string) bool {
 	return token.Valid
 }
 
+// Username returns the user owning a valid session token
+func (m *Manager) Username(tokenString string) (string, bool) {
+	if !m.ValidateToken(tokenString) {
+		return "", false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.activeSessions[tokenString]
+	if !ok {
+		return "", false
+	}
+	return session.Username, true
+}
+
+// IsAdmin reports whether a user may access administrative endpoints
+func (m *Manager) IsAdmin(username string) bool {
+	if m.config.PasswordHash == "" {
+		// Development mode - everyone is an admin
+		return true
+	}
+
+	for _, admin := range m.config.AdminUsers {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// LosslessOnly reports whether a user is an analysis client that must only
+// receive lossless tiles, e.g. measurement or ML pipelines
+func (m *Manager) LosslessOnly(username string) bool {
+	for _, user := range m.config.LosslessUsers {
+		if user == username {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Manager) RevokeToken(tokenString string) {
 	m.mu.Lock()
 	delete(m.activeSessions, tokenString)